@@ -0,0 +1,125 @@
+package uint64mph
+
+import "unsafe"
+
+// valueAggregates are the smallest, largest and sum of the values of a table,
+// see ValueStats.
+type valueAggregates struct {
+	min, max, sum uint64
+}
+
+// The words of the value aggregates section: flags, then the minimum, maximum
+// and sum of the values.
+const (
+	aggregatesFlags = iota
+	aggregatesMin
+	aggregatesMax
+	aggregatesSum
+	aggregatesWords
+)
+
+// aggregatesValid is set in the flags of the value aggregates section while
+// they match the values. SetValue clears it when it modifies the values of a
+// mapped file in a way that makes them unknown.
+const aggregatesValid = 1
+
+// WithValueStats makes Build compute the smallest, largest and sum of the
+// values, and store them in the serialized table, so that ValueStats of large
+// mapped tables doesn't need to read all values. SetValue keeps them up to
+// date, also in the file of a table opened by OpenMmapFileRW, unless it
+// increases the smallest value or decreases the largest one, which drops them.
+// Tables derived from the table by MapValues and RebuildWith keep them.
+func WithValueStats() BuildOption {
+	return func(o *buildOptions) {
+		o.valueStats = true
+	}
+}
+
+// ValueStats returns the smallest and largest value in the table and the sum of
+// all values, modulo 2^64. The number of values is Len. ok is false for empty
+// and index-only tables, and for tables with pair values.
+//
+// ValueStats takes constant time for tables built with WithValueStats, and
+// tables loaded from their files. For other tables, and after SetValue
+// increased the smallest value or decreased the largest one, it reads all
+// values.
+func (c *CHD) ValueStats() (min, max, sum uint64, ok bool) {
+	if c == nil || c.IndexOnly() || c.pairValues != nil {
+		return 0, 0, 0, false
+	}
+	a := c.aggregates
+	if a == nil {
+		if a = c.computeAggregates(); a == nil {
+			return 0, 0, 0, false
+		}
+	}
+	return a.min, a.max, a.sum, true
+}
+
+// computeAggregates returns the aggregates of the values, or nil if there are
+// none.
+func (c *CHD) computeAggregates() *valueAggregates {
+	if c.IndexOnly() || c.pairValues != nil {
+		return nil
+	}
+	var a *valueAggregates
+	for i, n := 0, c.numValues(); i < n; i++ {
+		if !c.live(i) {
+			continue
+		}
+		v := c.value(i)
+		if a == nil {
+			a = &valueAggregates{min: v, max: v}
+		}
+		a.min, a.max, a.sum = min(a.min, v), max(a.max, v), a.sum+v
+	}
+	return a
+}
+
+// updateAggregates updates the aggregates for a value that changed from old to
+// v, or drops them if that makes the minimum or maximum unknown. If inPlace,
+// the values were changed in the buffer the table was loaded from, and the
+// aggregates section in it is updated too.
+func (c *CHD) updateAggregates(old, v uint64, inPlace bool) {
+	a := c.aggregates
+	if a == nil {
+		return
+	}
+	if (old == a.min && v > old) || (old == a.max && v < old) {
+		c.aggregates = nil
+	} else {
+		a.min, a.max, a.sum = min(a.min, v), max(a.max, v), a.sum-old+v
+	}
+	s := c.aggregatesSection
+	if !inPlace || s == nil || !c.aliases(unsafe.Pointer(&s[0])) {
+		return
+	}
+	if c.aggregates == nil {
+		s[aggregatesFlags] &^= aggregatesValid
+		return
+	}
+	s[aggregatesMin], s[aggregatesMax], s[aggregatesSum] = a.min, a.max, a.sum
+}
+
+// aggregates writes the value aggregates section.
+func (e *encoder) aggregates(a *valueAggregates) {
+	e.section(sectionValueAggregates, 8, aggregatesWords)
+	e.uint64(aggregatesValid)
+	e.uint64(a.min)
+	e.uint64(a.max)
+	e.uint64(a.sum)
+}
+
+// loadAggregates loads the value aggregates section, if the file has one and
+// it's valid.
+func (c *CHD) loadAggregates(h header, data func(tag uint32) []byte) {
+	if h.flags&FlagValueAggregates == 0 {
+		return
+	}
+	s := readUint64s(h, data, sectionValueAggregates)
+	if s[aggregatesFlags]&aggregatesValid == 0 {
+		return
+	}
+	c.aggregatesSection = s
+	c.aggregates = &valueAggregates{min: s[aggregatesMin], max: s[aggregatesMax], sum: s[aggregatesSum]}
+}
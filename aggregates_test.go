@@ -0,0 +1,239 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wantStats returns the smallest, largest and sum of the values of m.
+func wantStats(m map[uint64]uint64) (lo, hi, sum uint64) {
+	lo = math.MaxUint64
+	for _, v := range m {
+		lo, hi, sum = min(lo, v), max(hi, v), sum+v
+	}
+	return lo, hi, sum
+}
+
+// keyWithValue returns a key of m whose value is v, or if v is zero, one whose
+// value is neither the smallest nor the largest.
+func keyWithValue(m map[uint64]uint64, v uint64) uint64 {
+	lo, hi, _ := wantStats(m)
+	for k, got := range m {
+		if got == v || (v == 0 && got != lo && got != hi) {
+			return k
+		}
+	}
+	panic("no such value")
+}
+
+func assertValueStats(t *testing.T, m map[uint64]uint64, c *CHD) {
+	t.Helper()
+	lo, hi, sum, ok := c.ValueStats()
+	require.True(t, ok)
+	wlo, whi, wsum := wantStats(m)
+	assert.Equal(t, []uint64{wlo, whi, wsum}, []uint64{lo, hi, sum})
+}
+
+func TestWithValueStats(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[500+i] = i + 7
+	}
+	few := map[uint64]uint64{}
+	for k := range randomData(1000, 29) {
+		few[k] = k % 5 * 1000
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":        {randomData(1000, 29), nil},
+		"small":      {sampleData, nil},
+		"dense":      {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"packed":     {byteValues(), []BuildOption{WithPackedValues()}},
+		"dictionary": {few, []BuildOption{WithValueDictionary()}},
+		"pthash":     {randomData(1000, 30), []BuildOption{WithPTHash(7, 0.99)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithValueStats())...)
+			require.NoError(t, err)
+			require.NotNil(t, c.aggregates)
+			assertValueStats(t, tc.data, c)
+
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&FlagValueAggregates)
+
+			for name, load := range map[string]func() (*CHD, error){
+				"Mmap": func() (*CHD, error) { return Mmap(w.Bytes()) },
+				"Read": func() (*CHD, error) { return Read(bytes.NewReader(w.Bytes())) },
+			} {
+				g, err := load()
+				require.NoError(t, err, name)
+				require.NotNil(t, g.aggregates, name)
+				assertValueStats(t, tc.data, g)
+				assertValueStats(t, tc.data, g.Materialize())
+			}
+
+			// Without the option, the stats are computed on the fly and not
+			// written.
+			plain, err := FromMap(tc.data, tc.opts...)
+			require.NoError(t, err)
+			assert.Nil(t, plain.aggregates)
+			assertValueStats(t, tc.data, plain)
+			w.Reset()
+			require.NoError(t, plain.Write(w))
+			fi, err = Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.Zero(t, fi.Flags&FlagValueAggregates)
+		})
+	}
+}
+
+func TestValueStats_none(t *testing.T) {
+	_, _, _, ok := (*CHD)(nil).ValueStats()
+	assert.False(t, ok)
+
+	empty, err := FromMap(map[uint64]uint64{}, WithValueStats())
+	require.NoError(t, err)
+	_, _, _, ok = empty.ValueStats()
+	assert.False(t, ok)
+
+	pb := NewPairBuilder()
+	pb.Add2(1, 2, 3)
+	pairs, err := pb.Build(WithValueStats())
+	require.NoError(t, err)
+	_, _, _, ok = pairs.ValueStats()
+	assert.False(t, ok)
+
+	structure, _ := writeSplit(t, MustFromMap(sampleData, WithValueStats()))
+	idx, err := MmapSplit(structure, nil)
+	require.NoError(t, err)
+	_, _, _, ok = idx.ValueStats()
+	assert.False(t, ok)
+}
+
+func TestValueStats_setValue(t *testing.T) {
+	m := map[uint64]uint64{}
+	for k, v := range sampleData {
+		m[k] = v
+	}
+	c := MustFromMap(m, WithValueStats())
+	lo, hi, _ := wantStats(m)
+	loKey := keyWithValue(m, lo)
+
+	// Values within the range are tracked.
+	k := keyWithValue(m, 0)
+	require.NoError(t, c.SetValue(k, hi+1))
+	m[k] = hi + 1
+	require.NotNil(t, c.aggregates)
+	assertValueStats(t, m, c)
+
+	// Increasing the smallest value makes it unknown.
+	require.NoError(t, c.SetValue(loKey, hi+2))
+	m[loKey] = hi + 2
+	assert.Nil(t, c.aggregates)
+	assertValueStats(t, m, c)
+
+	assert.ErrorIs(t, c.SetValue(12345, 1), ErrKeyNotFound)
+}
+
+func TestValueStats_derived(t *testing.T) {
+	m := randomData(1000, 31)
+	c := MustFromMap(m, WithValueStats())
+
+	n := c.MapValues(func(key, old uint64) uint64 { return old / 2 })
+	require.NotNil(t, n.aggregates)
+	for k, v := range m {
+		m[k] = v / 2
+	}
+	assertValueStats(t, m, n)
+
+	added := map[uint64]uint64{firstKey(m): 1}
+	r, err := RebuildWith(n, added, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r.aggregates)
+	m[firstKey(added)] = 1
+	assertValueStats(t, m, r)
+
+	added = map[uint64]uint64{1: 2, 3: 4}
+	r, err = RebuildWith(r, added, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r.aggregates)
+	m[1], m[3] = 2, 4
+	assertValueStats(t, m, r)
+}
+
+func TestValueStats_mmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	m := map[uint64]uint64{}
+	for k, v := range sampleData {
+		m[k] = v
+	}
+	path := writeTempTable(t, MustFromMap(m, WithValueStats()))
+	lo, hi, _ := wantStats(m)
+
+	rw, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	k := keyWithValue(m, 0)
+	require.NoError(t, rw.SetValue(k, hi+1))
+	m[k] = hi + 1
+	require.NoError(t, rw.Close())
+
+	// The file holds the new stats.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	require.NotNil(t, g.aggregates)
+	assertValueStats(t, m, g)
+
+	// Unknown stats are marked as such in the file.
+	rw, err = OpenMmapFileRW(path)
+	require.NoError(t, err)
+	k = keyWithValue(m, lo)
+	require.NoError(t, rw.SetValue(k, hi+2))
+	m[k] = hi + 2
+	require.NoError(t, rw.Close())
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	fi, err := Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagValueAggregates)
+	g, err = Mmap(b)
+	require.NoError(t, err)
+	assert.Nil(t, g.aggregates)
+	assertValueStats(t, m, g)
+}
+
+func TestValueStats_split(t *testing.T) {
+	m := randomData(500, 32)
+	structure, values := writeSplit(t, MustFromMap(m, hashed, WithValueStats()))
+	fi, err := Stat(bytes.NewReader(structure))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagValueAggregates)
+
+	g, err := MmapSplit(structure, values)
+	require.NoError(t, err)
+	require.NotNil(t, g.aggregates)
+	assertValueStats(t, m, g)
+}
+
+func TestValueStats_badSection(t *testing.T) {
+	w := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData, WithValueStats()).Write(w))
+	h, err := mmapHeader(w.Bytes())
+	require.NoError(t, err)
+	h.flags &^= FlagValueAggregates
+	assert.ErrorContains(t, h.check(), "value aggregates flag doesn't match")
+}
@@ -0,0 +1,73 @@
+package uint64mph
+
+import (
+	"context"
+	"sync"
+)
+
+// A BuildHandle tracks a build started by BuildAsync.
+type BuildHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	placed int
+	total  int
+
+	// Set before done is closed.
+	c   *CHD
+	err error
+}
+
+// BuildAsync starts BuildContext in a new goroutine and returns right away. The
+// builder must not be changed until the build is done.
+func (b *CHDBuilder) BuildAsync(ctx context.Context, opts ...BuildOption) *BuildHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &BuildHandle{cancel: cancel, done: make(chan struct{})}
+	opts = append(opts[:len(opts):len(opts)], func(o *buildOptions) {
+		prev := o.progress
+		o.progress = func(done, total int) {
+			if prev != nil {
+				prev(done, total)
+			}
+			h.mu.Lock()
+			h.placed, h.total = done, total
+			h.mu.Unlock()
+		}
+	})
+	go func() {
+		defer close(h.done)
+		defer cancel()
+		h.c, h.err = b.BuildContext(ctx, opts...)
+	}()
+	return h
+}
+
+// Done returns a channel that is closed once the build has finished, failed or
+// was canceled.
+func (h *BuildHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Result waits for the build to finish and returns its result. It can be called
+// any number of times, and returns the same result every time.
+func (h *BuildHandle) Result() (*CHD, error) {
+	<-h.done
+	return h.c, h.err
+}
+
+// Progress returns the number of buckets placed so far and the total number of
+// buckets, as passed to WithProgress. Both are zero until placing starts, and
+// stay zero for small and dense tables.
+func (h *BuildHandle) Progress() (done, total int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.placed, h.total
+}
+
+// Cancel stops the build, which then fails with context.Canceled unless it
+// finishes first. It doesn't wait for the build to stop: use Done or Result
+// for that. Canceling more than once is harmless.
+func (h *BuildHandle) Cancel() {
+	h.cancel()
+}
@@ -0,0 +1,56 @@
+package uint64mph
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildAsync(t *testing.T) {
+	b := Builder()
+	for k, v := range sampleData {
+		b.Add(k, v)
+	}
+	var calls int
+	h := b.BuildAsync(context.Background(), hashed, WithProgress(func(done, total int) { calls++ }))
+	<-h.Done()
+	c, err := h.Result()
+	require.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	c2, err2 := h.Result()
+	assert.Same(t, c, c2)
+	assert.NoError(t, err2)
+	// Options passed to BuildAsync still get progress reports.
+	assert.Greater(t, calls, 0)
+	done, total := h.Progress()
+	assert.Greater(t, total, 0)
+	assert.Equal(t, total, done)
+	h.Cancel()
+	_, err = h.Result()
+	assert.NoError(t, err)
+}
+
+func TestBuildAsync_cancel(t *testing.T) {
+	b := Builder()
+	r := rand.New(rand.NewSource(1))
+	for i := uint64(0); i < 200000; i++ {
+		b.Add(r.Uint64(), i)
+	}
+	h := b.BuildAsync(context.Background())
+	h.Cancel()
+	h.Cancel()
+	<-h.Done()
+	_, err := h.Result()
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h = b.BuildAsync(ctx, WithSeed(1))
+	cancel()
+	_, err = h.Result()
+	assert.ErrorIs(t, err, context.Canceled)
+}
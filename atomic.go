@@ -0,0 +1,66 @@
+package uint64mph
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// AtomicCHD holds a table that can be replaced while other goroutines are
+// reading from it. Readers always see either the old or the new table, never a
+// mix. The zero value holds no table and behaves as an empty table.
+//
+// Replacing a table doesn't wait for readers of the old one, so a replaced
+// table must only be closed after a grace period in which all lookups that
+// started before the replacement have finished.
+type AtomicCHD struct {
+	p atomic.Pointer[CHD]
+}
+
+// NewAtomicCHD returns an AtomicCHD holding c.
+func NewAtomicCHD(c *CHD) *AtomicCHD {
+	a := &AtomicCHD{}
+	a.p.Store(c)
+	return a
+}
+
+// Load returns the current table, or nil if none was stored.
+func (a *AtomicCHD) Load() *CHD {
+	return a.p.Load()
+}
+
+// Store replaces the current table with c.
+func (a *AtomicCHD) Store(c *CHD) {
+	a.p.Store(c)
+}
+
+// Swap replaces the current table with c and returns the previous one.
+func (a *AtomicCHD) Swap(c *CHD) (old *CHD) {
+	return a.p.Swap(c)
+}
+
+// Get an entry from the current table. See CHD.Get.
+func (a *AtomicCHD) Get(key uint64) uint64 {
+	c := a.p.Load()
+	if c == nil {
+		return math.MaxUint64
+	}
+	return c.Get(key)
+}
+
+// GetOK gets an entry from the current table. See CHD.GetOK.
+func (a *AtomicCHD) GetOK(key uint64) (uint64, bool) {
+	c := a.p.Load()
+	if c == nil {
+		return 0, false
+	}
+	return c.GetOK(key)
+}
+
+// Len returns the number of entries in the current table.
+func (a *AtomicCHD) Len() int {
+	c := a.p.Load()
+	if c == nil {
+		return 0
+	}
+	return c.Len()
+}
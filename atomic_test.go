@@ -0,0 +1,65 @@
+package uint64mph
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicCHD_zero(t *testing.T) {
+	var a AtomicCHD
+	assert.Nil(t, a.Load())
+	assert.Equal(t, 0, a.Len())
+	assert.Equal(t, uint64(math.MaxUint64), a.Get(1))
+	_, ok := a.GetOK(1)
+	assert.False(t, ok)
+
+	c := MustFromMap(sampleData)
+	assert.Nil(t, a.Swap(c))
+	assert.Same(t, c, a.Load())
+	assert.Equal(t, len(sampleData), a.Len())
+}
+
+// TestAtomicCHD_concurrent is most useful with the race detector enabled.
+func TestAtomicCHD_concurrent(t *testing.T) {
+	even := map[uint64]uint64{}
+	odd := map[uint64]uint64{}
+	for i, w := range words[:1000] {
+		even[w] = uint64(2 * i)
+		odd[w] = uint64(2*i + 1)
+	}
+	tables := []*CHD{MustFromMap(even), MustFromMap(odd)}
+	a := NewAtomicCHD(tables[0])
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i = (i + 1) % 1000 {
+				// Every lookup in one table must see consistent values.
+				c := a.Load()
+				v1, ok1 := c.GetOK(words[i])
+				v2, ok2 := c.GetOK(words[(i+1)%1000])
+				if !ok1 || !ok2 || v1%2 != v2%2 {
+					t.Errorf("inconsistent lookups: %d, %d", v1, v2)
+					return
+				}
+				if v, ok := a.GetOK(words[i]); !ok || v/2 != uint64(i) {
+					t.Errorf("GetOK(words[%d]) = %d, %v", i, v, ok)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		old := a.Swap(tables[(i+1)%2])
+		assert.Same(t, tables[i%2], old)
+	}
+	stop.Store(true)
+	wg.Wait()
+}
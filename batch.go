@@ -0,0 +1,77 @@
+package uint64mph
+
+import (
+	"math"
+	"sort"
+)
+
+// A probe is a position a lookup needs to read, and the index of the key in the
+// batch it is for.
+type probe struct {
+	pos uint64
+	i   int
+}
+
+type probesByPos []probe
+
+func (p probesByPos) Len() int           { return len(p) }
+func (p probesByPos) Less(i, j int) bool { return p[i].pos < p[j].pos }
+func (p probesByPos) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// GetBatchSorted is like GetBatch, but reads the table in ascending memory
+// order rather than in the order of keys: it first hashes all keys, then reads
+// the indices and finally the keys and values of all slots, sorting the
+// positions in between. For large batches on tables that aren't in memory, this
+// turns random reads into mostly sequential ones; for tables in memory, the
+// sorting makes it about twice as slow as GetBatch. The results are still stored
+// in the order of keys. Batches of sorted keys, like those coming from a merge
+// join, aren't any different: the hash scatters them regardless.
+func (c *CHD) GetBatchSorted(keys, dst []uint64) int {
+	_ = dst[:len(keys)]
+	if c == nil || len(c.r) == 0 {
+		// Small and dense tables are looked up without hashing, so sorting
+		// doesn't help. PTHash tables have no indices to sort by.
+		return c.GetBatch(keys, dst)
+	}
+	if c.IndexOnly() {
+		panic(ErrNoValues)
+	}
+	if len(c.keys) == 0 {
+		return c.GetBatch(keys, dst)
+	}
+	keys = c.maskKeys(keys)
+	r0 := c.r[0]
+	probes := make([]probe, 0, len(keys))
+	for i, k := range keys {
+		dst[i] = math.MaxUint64
+		if c.filter != nil && !c.filter.contains(k) {
+			continue
+		}
+		probes = append(probes, probe{bucketFor(c.hash(k)^r0, uint64(len(c.indices)), c.mixBuckets), i})
+	}
+	sort.Sort(probesByPos(probes))
+
+	// Turn the bucket positions into slots, dropping keys in empty buckets.
+	slots := probes[:0]
+	for _, p := range probes {
+		ri := c.indices[p.pos]
+		if ri >= uint16(len(c.r)) {
+			continue
+		}
+		h := c.hash(keys[p.i]) ^ r0
+		slots = append(slots, probe{(h ^ c.r[ri]) % uint64(len(c.keys)), p.i})
+	}
+	sort.Sort(probesByPos(slots))
+
+	found := 0
+	for _, p := range slots {
+		if c.keys[p.pos] != keys[p.i] {
+			continue
+		}
+		if v, ok := c.valueOK(int(p.pos)); ok {
+			dst[p.i] = v
+			found++
+		}
+	}
+	return found
+}
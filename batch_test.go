@@ -0,0 +1,44 @@
+package uint64mph
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBatchSorted(t *testing.T) {
+	b := Builder()
+	for i, w := range words[:10000] {
+		b.Add(w, uint64(i))
+	}
+	for _, opts := range [][]BuildOption{nil, {WithFilter()}} {
+		c, err := b.Build(append(opts, WithSeed(1))...)
+		require.NoError(t, err)
+
+		// Both present and missing keys, sorted.
+		keys := append([]uint64(nil), words[5000:15000]...)
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		want := make([]uint64, len(keys))
+		got := make([]uint64, len(keys))
+		wantFound := c.GetBatch(keys, want)
+		assert.Equal(t, 5000, wantFound)
+		assert.Equal(t, wantFound, c.GetBatchSorted(keys, got))
+		assert.Equal(t, want, got)
+
+		// Unsorted keys with duplicates work too.
+		keys = []uint64{words[3], 5, words[3], words[1]}
+		got = make([]uint64, len(keys))
+		assert.Equal(t, 3, c.GetBatchSorted(keys, got))
+		assert.Equal(t, []uint64{3, math.MaxUint64, 3, 1}, got)
+		assert.Panics(t, func() { c.GetBatchSorted(keys, got[:1]) })
+	}
+
+	empty, err := Builder().Build()
+	require.NoError(t, err)
+	dst := []uint64{1}
+	assert.Zero(t, empty.GetBatchSorted([]uint64{1}, dst))
+	assert.Equal(t, uint64(math.MaxUint64), dst[0])
+}
@@ -0,0 +1,367 @@
+package uint64mph
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// Benchmarks comparing CHD lookups against a builtin map for realistic access
+// patterns. All datasets are generated from fixed seeds, so results are
+// comparable across machines. Tables of 1e7 entries and more take minutes to
+// build and are only benchmarked with -uint64mph.large, except by
+// BenchmarkLoad.
+
+var benchLarge = flag.Bool("uint64mph.large", false, "also benchmark tables with 1e7 and 1e8 entries")
+
+func benchSizes() []int {
+	sizes := []int{1e4, 1e5, 1e6}
+	if *benchLarge {
+		sizes = append(sizes, 1e7, 1e8)
+	}
+	return sizes
+}
+
+// Number of lookups prepared per benchmark. Lookups cycle through these.
+const benchQueries = 1 << 20
+
+type benchDataset struct {
+	keys    []uint64
+	misses  []uint64
+	table   *CHD
+	builtin map[uint64]uint64
+	// table with a filter, see WithFilter.
+	filtered *CHD
+}
+
+var (
+	benchDatasetsMtx sync.Mutex
+	benchDatasets    = map[int]*benchDataset{}
+)
+
+// getBenchDataset returns the dataset with n entries, building it on first use.
+func getBenchDataset(b *testing.B, n int) *benchDataset {
+	benchDatasetsMtx.Lock()
+	defer benchDatasetsMtx.Unlock()
+	if d, ok := benchDatasets[n]; ok {
+		return d
+	}
+	rng := rand.New(rand.NewSource(int64(n)))
+	d := &benchDataset{builtin: make(map[uint64]uint64, n)}
+	builder := Builder()
+	for len(d.keys) < n {
+		k := rng.Uint64()
+		if _, dup := d.builtin[k]; dup {
+			continue
+		}
+		d.builtin[k] = k
+		d.keys = append(d.keys, k)
+		builder.Add(k, k)
+	}
+	for len(d.misses) < benchQueries {
+		k := rng.Uint64()
+		if _, hit := d.builtin[k]; !hit {
+			d.misses = append(d.misses, k)
+		}
+	}
+	t, err := builder.Build(WithSeed(int64(n)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	d.table = t
+	// Add a filter to a copy rather than building the table again.
+	filtered := *t
+	if filtered.filter, err = newXorFilter(t.keys, rng); err != nil {
+		b.Fatal(err)
+	}
+	d.filtered = &filtered
+	benchDatasets[n] = d
+	return d
+}
+
+// uniformQueries picks keys uniformly at random.
+func uniformQueries(keys []uint64, seed int64) []uint64 {
+	rng := rand.New(rand.NewSource(seed))
+	q := make([]uint64, benchQueries)
+	for i := range q {
+		q[i] = keys[rng.Intn(len(keys))]
+	}
+	return q
+}
+
+// zipfQueries picks keys following a Zipfian distribution, so a few hot keys
+// make up most queries.
+func zipfQueries(keys []uint64, seed int64) []uint64 {
+	rng := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(rng, 1.1, 1, uint64(len(keys)-1))
+	q := make([]uint64, benchQueries)
+	for i := range q {
+		q[i] = keys[z.Uint64()]
+	}
+	return q
+}
+
+func reportBytesPerKey(b *testing.B, d *benchDataset) {
+	b.ReportMetric(float64(d.table.Stats().TotalBytes())/float64(len(d.keys)), "B/key")
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, n := range benchSizes() {
+		for _, pattern := range []string{"uniform", "zipf", "miss"} {
+			b.Run(fmt.Sprintf("n=%d/%s", n, pattern), func(b *testing.B) {
+				d := getBenchDataset(b, n)
+				var q []uint64
+				switch pattern {
+				case "uniform":
+					q = uniformQueries(d.keys, 1)
+				case "zipf":
+					q = zipfQueries(d.keys, 1)
+				case "miss":
+					q = d.misses
+				}
+				b.Run("chd", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						d.table.GetOK(q[i%len(q)])
+					}
+					reportBytesPerKey(b, d)
+				})
+				b.Run("typed", func(b *testing.B) {
+					c := NewCHDT[userID, balance](d.table)
+					for i := 0; i < b.N; i++ {
+						c.Get(userID(q[i%len(q)]))
+					}
+				})
+				b.Run("chd+filter", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						d.filtered.GetOK(q[i%len(q)])
+					}
+				})
+				b.Run("raw", func(b *testing.B) {
+					w := &bytes.Buffer{}
+					if err := d.table.Write(w); err != nil {
+						b.Fatal(err)
+					}
+					raw, err := OpenRaw(w.Bytes())
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						raw.GetOK(q[i%len(q)])
+					}
+				})
+				b.Run("map", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						_ = d.builtin[q[i%len(q)]]
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkLookupColdBatch evicts the CPU caches before every batch of lookups.
+func BenchmarkLookupColdBatch(b *testing.B) {
+	const batch = 1024
+	scratch := make([]uint64, 64<<20/8)
+	evict := func() {
+		for i := range scratch {
+			scratch[i]++
+		}
+	}
+	for _, n := range benchSizes() {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			d := getBenchDataset(b, n)
+			q := uniformQueries(d.keys, 2)
+			dst := make([]uint64, batch)
+			b.Run("chd", func(b *testing.B) {
+				d.table.Prefault()
+				b.ResetTimer()
+				for i := 0; i < b.N; i += batch {
+					b.StopTimer()
+					evict()
+					off := i % (len(q) - batch)
+					b.StartTimer()
+					d.table.GetBatch(q[off:off+batch], dst)
+				}
+				reportBytesPerKey(b, d)
+			})
+			b.Run("chd sorted", func(b *testing.B) {
+				d.table.Prefault()
+				b.ResetTimer()
+				for i := 0; i < b.N; i += batch {
+					b.StopTimer()
+					evict()
+					off := i % (len(q) - batch)
+					b.StartTimer()
+					d.table.GetBatchSorted(q[off:off+batch], dst)
+				}
+			})
+			b.Run("map", func(b *testing.B) {
+				for i := 0; i < b.N; i += batch {
+					b.StopTimer()
+					evict()
+					off := i % (len(q) - batch)
+					b.StartTimer()
+					for j, k := range q[off : off+batch] {
+						dst[j] = d.builtin[k]
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkBackends compares the construction algorithms on the same keys:
+// build time, the bits per key of the structure finding a key's slot (not
+// counting the keys and values), and lookup time.
+func BenchmarkBackends(b *testing.B) {
+	backends := []struct {
+		name string
+		opts []BuildOption
+	}{
+		{"chd", nil},
+		{"pthash", []BuildOption{WithPTHash(7, 0.99)}},
+		{"pthash-fast", []BuildOption{WithPTHash(10, 0.94)}},
+	}
+	for _, n := range benchSizes() {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			d := getBenchDataset(b, n)
+			q := uniformQueries(d.keys, 3)
+			for _, backend := range backends {
+				var c *CHD
+				b.Run(backend.name+"/build", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						var err error
+						if c, err = FromMap(d.builtin, append(backend.opts, WithSeed(int64(i)))...); err != nil {
+							b.Fatal(err)
+						}
+					}
+					s := c.Stats()
+					b.ReportMetric(float64(8*(s.HashFunctionBytes+s.IndicesBytes))/float64(n), "bits/key")
+				})
+				if c == nil {
+					continue
+				}
+				b.Run(backend.name+"/lookup", func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						c.GetOK(q[i%len(q)])
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkHas compares membership tests with Has, which doesn't load the
+// value, to Get.
+func BenchmarkHas(b *testing.B) {
+	c := MustFromMap(func() map[uint64]uint64 {
+		m := make(map[uint64]uint64, len(words)/2)
+		for _, w := range words[:len(words)/2] {
+			m[w] = w
+		}
+		return m
+	}(), WithSeed(1))
+	// Half of the queries are hits.
+	q := uniformQueries(words, 4)
+	b.Run("has", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.Has(q[i%len(q)])
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.Get(q[i%len(q)])
+		}
+	})
+}
+
+// BenchmarkLoad compares loading a serialized table with MmapAliased, which
+// aliases the buffer on little endian platforms, to ReadBytes, which copies it.
+// Aliasing matters most for large tables, so it always includes a table of 1e7
+// entries, built without the rest of a benchDataset.
+func BenchmarkLoad(b *testing.B) {
+	sizes := benchSizes()
+	if !*benchLarge {
+		sizes = append(sizes, 1e7)
+	}
+	for _, n := range sizes {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			var c *CHD
+			if n <= 1e6 || *benchLarge {
+				c = getBenchDataset(b, n).table
+			} else {
+				builder := Builder()
+				for i := uint64(0); i < uint64(n); i++ {
+					// Odd multipliers don't map two keys to one.
+					builder.Add(i*0x9e3779b97f4a7c15, i)
+				}
+				var err error
+				if c, err = builder.Build(WithSeed(int64(n))); err != nil {
+					b.Fatal(err)
+				}
+			}
+			w := &bytes.Buffer{}
+			if err := c.Write(w); err != nil {
+				b.Fatal(err)
+			}
+			for _, tc := range []struct {
+				name string
+				load func([]byte, ...LoadOption) (*CHD, error)
+			}{
+				{"mmap", MmapAliased},
+				{"readbytes", ReadBytes},
+			} {
+				load := tc.load
+				b.Run(tc.name, func(b *testing.B) {
+					b.ReportAllocs()
+					b.SetBytes(int64(w.Len()))
+					for i := 0; i < b.N; i++ {
+						if _, err := load(w.Bytes()); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkMergeBuilders compares MergeBuilders to adding the entries of the
+// sources one by one.
+func BenchmarkMergeBuilders(b *testing.B) {
+	for _, n := range benchSizes() {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			d := getBenchDataset(b, n)
+			srcs := make([]*CHDBuilder, 4)
+			for i := range srcs {
+				srcs[i] = Builder()
+			}
+			for i, k := range d.keys {
+				srcs[i%len(srcs)].Add(k, k)
+			}
+			b.Run("merge", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := MergeBuilders(Builder(), srcs...); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("add", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					dst := Builder()
+					for _, src := range srcs {
+						src.Entries()(func(k, v uint64) bool {
+							dst.Add(k, v)
+							return true
+						})
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package uint64mph
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+// WithBestOfSeeds builds the table with k different seeds and keeps the
+// smallest, as measured by Spec, or the one with the fewest hash functions
+// among equally small ones. Two builds of the same keys can differ by a few
+// hash functions by luck of the seed, which for small tables and packed
+// values is a noticeable share of the file. BuildStats reports the chosen seed,
+// with which WithSeed builds the same table again.
+//
+// The seeds are derived from the seed set by Seed or WithSeed, if any, so the
+// result is reproducible. The builds run in parallel, limited by
+// WithCPUFraction, unless WithTrace or WithProgress is used. Small and dense
+// tables don't depend on the seed and are only built once.
+func WithBestOfSeeds(k int) BuildOption {
+	return func(o *buildOptions) {
+		o.bestOfSeeds = k
+	}
+}
+
+// buildBestOfSeeds builds b with o.bestOfSeeds seeds, see WithBestOfSeeds.
+// opts are the options o was made from.
+func (b *CHDBuilder) buildBestOfSeeds(ctx context.Context, o buildOptions, opts []BuildOption, start time.Time) (*CHD, error) {
+	seed := o.seed
+	if !o.seeded {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	seeds := make([]int64, o.bestOfSeeds)
+	for i := range seeds {
+		seeds[i] = rng.Int63()
+	}
+	stats := make([]BuildStats, len(seeds))
+	build := func(ctx context.Context, i int) (*CHD, error) {
+		return b.BuildContext(ctx, append(opts[:len(opts):len(opts)], WithSeed(seeds[i]), WithBestOfSeeds(1), WithStats(&stats[i]))...)
+	}
+
+	first, err := build(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("seed %d: %w", seeds[0], err)
+	}
+	best := 0
+	if !first.small && first.dense == nil {
+		workers := max(1, int(o.cpuFraction*float64(runtime.GOMAXPROCS(0))))
+		if o.trace != nil || o.progress != nil {
+			workers = 1
+		}
+		var tables []*CHD
+		tables, err = buildAll(ctx, len(seeds)-1, workers, func(ctx context.Context, i int) (*CHD, error) {
+			return build(ctx, i+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		tables = append([]*CHD{first}, tables...)
+		size := first.Spec().Size
+		for i, c := range tables[1:] {
+			if s := c.Spec().Size; s < size || (s == size && len(c.r) < len(tables[best].r)) {
+				best, size = i+1, s
+			}
+		}
+		first = tables[best]
+	}
+	if o.stats != nil {
+		*o.stats = stats[best]
+		o.stats.Duration = time.Since(start)
+		o.stats.Seed = seeds[best]
+	}
+	return first, nil
+}
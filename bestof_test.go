@@ -0,0 +1,60 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithBestOfSeeds(t *testing.T) {
+	b := Builder()
+	b.AddMap(randomData(2000, 28))
+	write := func(c *CHD) []byte {
+		w := &bytes.Buffer{}
+		require.NoError(t, c.Write(w))
+		return w.Bytes()
+	}
+
+	var stats BuildStats
+	c, err := b.Build(WithSeed(1), WithBestOfSeeds(5), WithPackedValues(), WithStats(&stats))
+	require.NoError(t, err)
+	assert.NotZero(t, stats.Seed)
+	assert.Equal(t, len(c.r), stats.HashFunctions)
+
+	// The chosen seed builds the same table, which is the smallest of the five.
+	again, err := b.Build(WithSeed(stats.Seed), WithPackedValues())
+	require.NoError(t, err)
+	assert.Equal(t, write(c), write(again))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5; i++ {
+		other, err := b.Build(WithSeed(rng.Int63()), WithPackedValues())
+		require.NoError(t, err)
+		assert.LessOrEqual(t, c.Spec().Size, other.Spec().Size)
+	}
+
+	// The same seed gives the same result, also with a single worker.
+	again, err = b.Build(WithSeed(1), WithBestOfSeeds(5), WithPackedValues(), WithCPUFraction(0.01))
+	require.NoError(t, err)
+	assert.Equal(t, write(c), write(again))
+
+	// Traces see every build.
+	outer := 0
+	_, err = b.Build(WithSeed(1), WithBestOfSeeds(3), WithTrace(func(e TraceEvent) {
+		if _, ok := e.(OuterHashChosen); ok {
+			outer++
+		}
+	}))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, outer, 3)
+
+	// Small tables are built once.
+	_, err = FromMap(sampleData, WithBestOfSeeds(3), WithStats(&stats))
+	require.NoError(t, err)
+	assert.Zero(t, stats.HashFunctions)
+
+	_, err = b.Build(WithBestOfSeeds(0))
+	assert.ErrorContains(t, err, "invalid number of seeds 0")
+}
@@ -0,0 +1,38 @@
+package uint64mph
+
+import "bytes"
+
+// SerializedSize returns the number of bytes Write without options writes for
+// the table, see Spec.
+func (c *CHD) SerializedSize() int {
+	return int(c.Spec().Size)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, returning the table as
+// written by Write without options. The result is allocated once, at its
+// final size.
+func (c *CHD) MarshalBinary() ([]byte, error) {
+	if err := c.checkWritable(true); err != nil {
+		return nil, err
+	}
+	w := bytes.NewBuffer(make([]byte, 0, c.SerializedSize()))
+	if err := c.write(w, writeOptions{}); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, loading the table in
+// b, as written by Write or MarshalBinary, into c like ReadBytes does: c doesn't
+// reference b afterwards. Use Mmap to load a table without copying it.
+func (c *CHD) UnmarshalBinary(b []byte) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	loaded, err := ReadBytes(b)
+	if err != nil {
+		return err
+	}
+	*c = *loaded
+	return nil
+}
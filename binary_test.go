@@ -0,0 +1,72 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*CHD)(nil)
+	_ encoding.BinaryUnmarshaler = (*CHD)(nil)
+)
+
+func TestMarshalBinary(t *testing.T) {
+	b := Builder()
+	for i, w := range words {
+		b.Add(w, uint64(i))
+	}
+	all, err := b.Build(WithSeed(110))
+	require.NoError(t, err)
+	for name, c := range map[string]*CHD{
+		"words":  all,
+		"small":  MustFromMap(sampleData),
+		"empty":  MustFromMap(nil),
+		"packed": MustFromMap(byteValues(), WithSeed(111), WithPackedValues(), WithFilter(), WithSortedIndex()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, w.Len(), c.SerializedSize())
+			data, err := c.MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, w.Bytes(), data)
+			assert.Equal(t, len(data), cap(data))
+
+			var got CHD
+			require.NoError(t, got.UnmarshalBinary(data))
+			assertSameTable(t, c, &got)
+			// The table doesn't reference data.
+			clear(data)
+			for it := c.Iterate(); it != nil; it = it.Next() {
+				k, v := it.Get()
+				if !assert.Equal(t, v, got.Get(k)) {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalBinary_errors(t *testing.T) {
+	_, err := (*CHD)(nil).MarshalBinary()
+	assert.ErrorIs(t, err, ErrNilTable)
+	assert.ErrorIs(t, (*CHD)(nil).UnmarshalBinary(nil), ErrNilTable)
+	var c CHD
+	assert.ErrorIs(t, c.UnmarshalBinary([]byte("not a table")), ErrNotCHD)
+
+	closed := MustFromMap(sampleData)
+	require.NoError(t, closed.Close())
+	_, err = closed.MarshalBinary()
+	assert.ErrorIs(t, err, ErrClosed)
+
+	w := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData).Write(w))
+	idx, err := MmapWithOptions(w.Bytes(), SkipValues())
+	require.NoError(t, err)
+	_, err = idx.MarshalBinary()
+	assert.ErrorIs(t, err, ErrNoValues)
+}
@@ -7,26 +7,34 @@
 //
 // To create and serialize a hash table:
 //
-//	b := mph.Builder()
+//	h, _ := uint64mph.FromMap(data)
+//	w, _ := os.Create("data.idx")
+//	_ = h.Write(w)
+//
+// Or, when the entries aren't in a map already:
+//
+//	b := uint64mph.Builder()
 //	for k, v := range data {
 //		b.Add(k, v)
 //	}
 //	h, _ := b.Build()
-//	w, _ := os.Create("data.idx")
-//	b, _ := h.Write(w)
 //
 // To read from the hash table:
 //
 //	r, _ := os.Open("data.idx")
-//	h, _ := h.Read(r)
+//	h, _ := uint64mph.Read(r)
 //
-//	v := h.Get([]byte("some key"))
-//	if v == nil {
+//	v := h.Get(1337)
+//	if v == math.MaxUint64 {
 //	    // Key not found
 //	}
 //
-// MMAP is also indirectly supported, by deserializing from a byte
-// slice and slicing the keys and values.
+// MMAP is also supported: OpenMmapFile maps a file and creates a table over
+// it, and Mmap creates a table over a byte slice the caller mapped. A table
+// created by Mmap borrows the slice: keep it mapped and unmodified for as long
+// as the table is used. Tables from OpenMmapFile or MmapWithCloser own their
+// mapping instead and release it on Close. OpenMmapFileRW maps a file
+// writable, so that SetValue updates it in place.
 //
 // See https://github.com/Jille/uint64mph for source.
 // See https://github.com/alecthomas/mph for the original source.
@@ -34,12 +42,19 @@ package uint64mph
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/bits"
 )
 
 // CHD hash table lookup.
+//
+// A nil *CHD is an empty table: lookups don't find any key, Len returns 0 and
+// Iterate returns nil. Methods that write or modify the table return
+// ErrNilTable instead.
 type CHD struct {
 	// Random hash function table.
 	r []uint64
@@ -49,9 +64,109 @@ type CHD struct {
 	// Final table of values.
 	keys   []uint64
 	values []uint64
+	// The values of tables built with WithPackedValues, valueWidth bytes
+	// each, instead of values. valueWidth is 0 for unpacked tables.
+	packed     []byte
+	valueWidth int
+	// The distinct values, which packed holds codes into, see
+	// WithDictionaryThreshold. May be nil.
+	dict []uint64
+	// Both values of every slot of a table with pair values, instead of
+	// values, see PairBuilder.
+	pairValues []uint64
+
+	// The buffers passed to Mmap or MmapSplit, if the sections alias them.
+	backing [][]byte
+	// Releases the backing buffer, see Close.
+	closer io.Closer
+	closed bool
+	// Whether the values are mapped read-only, see SetValue.
+	readOnly bool
+	// See SetMetadata.
+	metadata []byte
+	// See Info.
+	info Info
+	// Rejects most missing keys before touching the other arrays, see
+	// WithFilter. May be nil.
+	filter *xorFilter
+	// Whether the table has so few keys that lookups scan them rather than
+	// hashing them. Small tables have no hash functions or buckets, and their
+	// keys are sorted.
+	small bool
+	// Replaces r, indices and keys for tables whose keys cover most of a
+	// range, see WithDenseThreshold. May be nil.
+	dense *denseKeys
+	// Replaces r and indices for tables built with WithPTHash. May be nil.
+	pthash *pthashTable
+	// Whether all values in r fit in 32 bits and are written as such, see
+	// WithHashFunctions32.
+	r32 bool
+	// Whether buckets are picked with mixBucketHash, as in format version 3
+	// and later. Tables loaded from older files pick them with a modulo.
+	mixBuckets bool
+	// Hashes the keys instead of Hash, see WithHasher. May be nil. Set with
+	// setHasher.
+	hasher Hasher
+	// Whether hasher is Identity, see AssumeUniformKeys.
+	uniformKeys bool
+	// Masks the keys, see MaskKeys. May be nil.
+	keyMask *keyMask
+	// See AttachColumn, sorted by name.
+	columns []column
+	// See ValueStats. May be nil, also for tables with values.
+	aggregates *valueAggregates
+	// The value aggregates section of the file the table was loaded from,
+	// which SetValue updates along with values that alias the file.
+	aggregatesSection []uint64
+	// The slots of the keys sorted by key, see WithSortedIndex. May be nil.
+	sorted []uint32
+	// See AddGeneration, oldest first. nextGeneration is the number of the
+	// next one.
+	generations    []generation
+	nextGeneration int
+	// The digest stored in the file the table was loaded from, see WithDigest,
+	// and the section holding it, which SetValue zeroes along with values that
+	// alias the file. May be nil.
+	digest        *[32]byte
+	digestSection []byte
+	// The section holding the checksum of the file the table was loaded from,
+	// which SetValue zeroes like the digest. See WithChecksum. May be nil.
+	checksumSection []byte
+	// A bit for every slot whose key was deleted, see Delete. May be nil.
+	deleted      []uint64
+	deletedCount int
 }
 
-func hasher(data uint64) uint64 {
+// ErrClosed is returned when using a table after Close.
+var ErrClosed = errors.New("uint64mph: use of closed CHD")
+
+var (
+	// ErrKeyNotFound is returned by SetValue for keys that aren't in the table.
+	ErrKeyNotFound = errors.New("uint64mph: key not found")
+	// ErrReadOnly is returned by SetValue for tables mapped read-only.
+	ErrReadOnly = errors.New("uint64mph: table is read-only")
+	// ErrNilTable is returned by methods that write or modify a table when
+	// called on a nil *CHD.
+	ErrNilTable = errors.New("uint64mph: nil CHD")
+	// ErrNilWriter is returned by the methods that write a table when passed a
+	// nil writer.
+	ErrNilWriter = errors.New("uint64mph: nil writer")
+	// ErrNilReader is returned by Read and ReadAt when passed a nil reader.
+	ErrNilReader = errors.New("uint64mph: nil reader")
+	// ErrNilBuilder is returned by MergeBuilders when passed a nil builder.
+	ErrNilBuilder = errors.New("uint64mph: nil builder")
+)
+
+// Hash returns the 64-bit hash every table applies to its keys: FNV-1a over
+// the 8 little endian bytes of the key. Tables mix it with their own r[0]
+// before picking a bucket, so equal hashes get the same bucket only within a
+// table, but routing on Hash (like ShardedBuilder does) guarantees that keys
+// with equal hashes always end up together.
+//
+// The result of Hash is stable and will never change. Should tables start
+// hashing keys differently, the new function will be exported under a
+// versioned name like HashV2.
+func Hash(data uint64) uint64 {
 	var buf [8]byte
 	binary.LittleEndian.PutUint64(buf[:], data)
 	var hash uint64 = 14695981039346656037
@@ -62,95 +177,599 @@ func hasher(data uint64) uint64 {
 	return hash
 }
 
-// Read a serialized CHD.
+// mixBucketHash mixes the high bits of a hash into its low bits before picking
+// a bucket. Without it, keys differing only in the high bits of their bytes
+// (like sequential IDs shifted left) end up in few buckets when the number of
+// buckets is a power of two.
+func mixBucketHash(h uint64) uint64 {
+	h ^= h >> 32
+	h *= 0xd6e8feb86659fd93
+	h ^= h >> 32
+	return h
+}
+
+// bucketFor returns the bucket of h, the hash of a key mixed with r[0].
+func bucketFor(h, buckets uint64, mix bool) uint64 {
+	if mix {
+		hi, _ := bits.Mul64(mixBucketHash(h), buckets)
+		return hi
+	}
+	return h % buckets
+}
+
+// Read a serialized CHD. Tables written by WriteCompressed are decompressed.
+// The lengths declared by the input are checked against its size before
+// allocating anything, but Read reads as much as r provides: use ReadWithLimit
+// for untrusted input.
 func Read(r io.Reader) (*CHD, error) {
+	return readLimit(r, -1)
+}
+
+// ReadWithOptions is like Read, but configured by opts.
+func ReadWithOptions(r io.Reader, opts ...LoadOption) (*CHD, error) {
+	return readLimit(r, -1, opts...)
+}
+
+// ErrTooLarge is returned by ReadWithLimit for tables larger than the limit.
+var ErrTooLarge = errors.New("uint64mph: table exceeds the size limit")
+
+// ReadWithLimit is like Read, but fails with ErrTooLarge instead of reading or
+// decompressing more than maxBytes bytes.
+func ReadWithLimit(r io.Reader, maxBytes int64) (*CHD, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid limit %d: must not be negative", maxBytes)
+	}
+	return readLimit(r, maxBytes)
+}
+
+// readLimit implements ReadWithLimit, without a limit if maxBytes is negative.
+func readLimit(r io.Reader, maxBytes int64, opts ...LoadOption) (*CHD, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+	if maxBytes >= 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	return Mmap(b)
+	if maxBytes >= 0 && int64(len(b)) > maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxBytes)
+	}
+	if isCompressed(b) {
+		b, err = decompress(b, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loadOwned(b, opts)
 }
 
-// Mmap creates a new CHD aliasing the CHD structure over an existing byte region (typically mmapped).
-func Mmap(b []byte) (*CHD, error) {
-	c := &CHD{}
+// loadOwned creates a table over b, which nothing else references.
+func loadOwned(b []byte, opts []LoadOption) (*CHD, error) {
+	c, err := MmapWithOptions(b, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.IndexOnly() && zeroCopy {
+		// Don't keep the skipped values alive.
+		c = c.Materialize()
+	}
+	// We own b, so for all intents and purposes it's heap allocated.
+	c.backing = nil
+	return c, nil
+}
 
-	bi := &sliceReader{b: b}
+// MmapWithCloser is like Mmap, but closer is closed when the table is closed.
+// This ties the lifetime of the mapping to the table: the caller must not
+// unmap b itself and must call Close on the table instead.
+func MmapWithCloser(b []byte, closer io.Closer) (*CHD, error) {
+	c, err := Mmap(b)
+	if err != nil {
+		return nil, err
+	}
+	c.closer = closer
+	return c, nil
+}
 
-	// Read vector of hash functions.
-	rl := bi.ReadInt()
-	c.r = bi.ReadUint64Array(rl)
+// Close releases the table's resources, like unmapping the file opened by
+// OpenMmapFile. After Close, lookups panic with ErrClosed and Write returns it.
+// Close must not be called while other goroutines are using the table.
+// Closing an already closed table is a no-op.
+func (c *CHD) Close() error {
+	if c == nil || c.closed {
+		return nil
+	}
+	c.closed = true
+	c.r, c.indices, c.keys, c.values, c.packed, c.dict, c.backing, c.metadata, c.filter, c.dense, c.pthash, c.columns = nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil
+	c.aggregates, c.aggregatesSection, c.sorted, c.generations = nil, nil, nil, nil
+	c.digest, c.digestSection, c.checksumSection, c.deleted, c.pairValues = nil, nil, nil, nil, nil
+	if c.closer == nil {
+		return nil
+	}
+	closer := c.closer
+	c.closer = nil
+	return closer.Close()
+}
 
-	// Read hash function indices.
-	il := bi.ReadInt()
-	c.indices = bi.ReadUint16Array(il)
+// checkWritable returns why c can't be written to a writer, if any.
+func (c *CHD) checkWritable(haveWriter bool) error {
+	switch {
+	case c == nil:
+		return ErrNilTable
+	case !haveWriter:
+		return ErrNilWriter
+	case c.closed:
+		return ErrClosed
+	}
+	return nil
+}
 
-	el := bi.ReadInt()
+func (c *CHD) checkClosed() {
+	if c.closed {
+		panic(ErrClosed)
+	}
+}
 
-	c.keys = bi.ReadUint64Array(el)
-	c.values = bi.ReadUint64Array(el)
+// Mmap creates a new CHD over an existing byte region (typically mmapped). It
+// is MmapAliased without options: b is borrowed for the lifetime of the table.
+// Use ReadBytes for buffers that are reused.
+func Mmap(b []byte) (*CHD, error) {
+	return MmapAliased(b)
+}
 
-	return c, nil
+// MmapAliased creates a new CHD over an existing byte region, typically an
+// mmapped file, without copying it where possible: the hash functions, bucket
+// indices, keys and values of the table are views of b, so loading a table
+// takes about as long whatever its size. The table borrows b for its lifetime:
+// b must not be modified, reused or unmapped until the table is no longer used,
+// or closed if it was opened with MmapWithCloser. Materialize returns a copy
+// that no longer needs b.
+//
+// Platforms that aren't known to be little endian, and builds with the
+// uint64mph_safereader tag, copy b instead, as do some older files. Don't rely
+// on either: code that is only correct when the table copies b is only correct
+// on some platforms. MemoryFootprint reports how much of the table aliases b.
+func MmapAliased(b []byte, opts ...LoadOption) (*CHD, error) {
+	return MmapWithOptions(b, opts...)
+}
+
+// ReadBytes creates a new CHD from the serialized table in b, like Read. The
+// table never references b, so b may be modified or reused as soon as
+// ReadBytes returns. Unlike Mmap, ReadBytes copies the table on every
+// platform.
+func ReadBytes(b []byte, opts ...LoadOption) (*CHD, error) {
+	if isCompressed(b) {
+		d, err := decompress(b, -1)
+		if err != nil {
+			return nil, err
+		}
+		return loadOwned(d, opts)
+	}
+	c, err := MmapWithOptions(b, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Materialize(), nil
 }
 
-// Get an entry from the hash table.
+// Get an entry from the hash table. Returns math.MaxUint64 if the key is not
+// present, so a stored math.MaxUint64 looks like a missing key. Tables whose
+// values use the full range should use Lookup, which does the same single probe
+// and reports presence separately.
 func (c *CHD) Get(key uint64) uint64 {
+	v, ok := c.GetOK(key)
+	if !ok {
+		return math.MaxUint64
+	}
+	return v
+}
+
+// Lookup gets an entry from the hash table and reports whether it was present,
+// so that a missing key can be told apart from any stored value. It probes the
+// table once, like Get. It is the same as GetOK.
+func (c *CHD) Lookup(key uint64) (uint64, bool) {
+	return c.GetOK(key)
+}
+
+// GetOK gets an entry from the hash table and reports whether it was present.
+// Building with the uint64mph_unsafe tag removes the bounds checks from it.
+func (c *CHD) GetOK(key uint64) (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	if c.keyMask != nil {
+		key = c.keyMask.mask(key)
+	}
+	if c.deleted != nil {
+		ti, ok := c.slot(key)
+		if !ok || c.isDeleted(ti) {
+			return 0, false
+		}
+		return c.valueOK(ti)
+	}
+	if uncheckedGet {
+		return c.getOKUnchecked(key)
+	}
+	if len(c.r) == 0 {
+		c.checkClosed()
+		if c.dense != nil {
+			if ti, ok := c.dense.slot(key); ok {
+				return c.valueOK(ti)
+			}
+		} else if c.pthash != nil {
+			if ti, ok := c.pthashSlot(key); ok {
+				return c.valueOK(ti)
+			}
+		} else if c.small {
+			if ti, ok := c.smallSlot(key); ok {
+				return c.valueOK(ti)
+			}
+		}
+		return 0, false
+	}
+	if c.filter != nil && !c.filter.contains(key) {
+		return 0, false
+	}
 	r0 := c.r[0]
-	h := hasher(key) ^ r0
-	i := h % uint64(len(c.indices))
+	h := c.hash(key) ^ r0
+	i := bucketFor(h, uint64(len(c.indices)), c.mixBuckets)
 	ri := c.indices[i]
-	// This can occur if there were unassigned slots in the hash table.
-	if ri >= uint16(len(c.r)) {
-		return math.MaxUint64
+	// This can occur if there were unassigned slots in the hash table, and
+	// tables without keys have nowhere for a key to be.
+	if ri >= uint16(len(c.r)) || len(c.keys) == 0 {
+		return 0, false
 	}
 	r := c.r[ri]
 	ti := (h ^ r) % uint64(len(c.keys))
 	// fmt.Printf("r[0]=%d, h=%d, i=%d, ri=%d, r=%d, ti=%d\n", c.r[0], h, i, ri, r, ti)
 	k := c.keys[ti]
 	if k != key {
-		return math.MaxUint64
+		return 0, false
 	}
-	v := c.values[ti]
-	return v
+	if ti >= uint64(len(c.values)) {
+		return c.packedValue(int(ti))
+	}
+	return c.values[ti], true
+}
+
+// Slot returns the index of key in the keys and values arrays, and whether the
+// key is present. This is mainly useful for reimplementing lookups elsewhere.
+// Keys hidden by Delete aren't present.
+func (c *CHD) Slot(key uint64) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	ti, ok := c.slot(c.maskKey(key))
+	if !ok || c.isDeleted(ti) {
+		return 0, false
+	}
+	return ti, true
+}
+
+// slot implements Slot for a key as stored in the table.
+func (c *CHD) slot(key uint64) (int, bool) {
+	if c.small {
+		c.checkClosed()
+		return c.smallSlot(key)
+	}
+	ti, ok := c.candidateSlot(key, len(c.keys))
+	if !ok || (c.dense == nil && c.keys[ti] != key) {
+		return 0, false
+	}
+	return ti, true
+}
+
+// candidateSlot returns the slot key is in if it's in the table, which has
+// slots slots, without looking at the keys. Unless the table is dense, the
+// caller must check that the key in the slot is key. Small tables have no such
+// slot.
+func (c *CHD) candidateSlot(key uint64, slots int) (int, bool) {
+	if len(c.r) == 0 {
+		c.checkClosed()
+		if c.dense != nil {
+			return c.dense.slot(key)
+		}
+		if c.pthash != nil {
+			if c.filter != nil && !c.filter.contains(key) {
+				return 0, false
+			}
+			return int(c.pthash.slot(c.hash(key))), true
+		}
+		return 0, false
+	}
+	if c.filter != nil && !c.filter.contains(key) {
+		return 0, false
+	}
+	h := c.hash(key) ^ c.r[0]
+	ri := c.indices[bucketFor(h, uint64(len(c.indices)), c.mixBuckets)]
+	if ri >= uint16(len(c.r)) || slots == 0 {
+		return 0, false
+	}
+	return int((h ^ c.r[ri]) % uint64(slots)), true
+}
+
+// smallSlot finds key in a small table by scanning its keys.
+func (c *CHD) smallSlot(key uint64) (int, bool) {
+	slot := -1
+	for i, k := range c.keys {
+		if k == key {
+			slot = i
+		}
+	}
+	return slot, slot >= 0
+}
+
+// Contains reports whether key is in the table. It finds the slot like GetOK,
+// but doesn't load the value. Unlike Get, it works for index-only tables.
+func (c *CHD) Contains(key uint64) bool {
+	_, ok := c.Slot(key)
+	return ok
+}
+
+// Has reports whether key is in the table, comparing it against the keys only:
+// it never reads the values, so membership tests don't touch their pages, and
+// it works for index-only tables. It is the same as Contains.
+func (c *CHD) Has(key uint64) bool {
+	return c.Contains(key)
+}
+
+// SetValue replaces the value of key. The set of keys is fixed: SetValue
+// returns ErrKeyNotFound for keys that aren't in the table. For tables created
+// by Mmap the value is written to the buffer. Tables opened by OpenMmapFile are
+// read-only, use OpenMmapFileRW to modify the file instead. For tables with
+// packed values, SetValue returns ErrValueTooLarge for values that don't fit.
+//
+// SetValue must not be called concurrently with other methods of the table.
+func (c *CHD) SetValue(key, value uint64) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.IndexOnly() {
+		return ErrNoValues
+	}
+	ti, ok := c.Slot(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	return c.setSlot(ti, value)
+}
+
+// Sync writes the values changed by SetValue back to the file of a table opened
+// by OpenMmapFileRW, and returns once they're stored. It does nothing for other
+// tables.
+func (c *CHD) Sync() error {
+	if c == nil {
+		return nil
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if s, ok := c.closer.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
+// GetBatch looks up every key in keys like Get, storing the values in dst,
+// which must be at least as long as keys. Missing keys get math.MaxUint64. It
+// returns the number of keys that were found.
+func (c *CHD) GetBatch(keys, dst []uint64) int {
+	_ = dst[:len(keys)]
+	found := 0
+	for i, k := range keys {
+		v, ok := c.GetOK(k)
+		if !ok {
+			v = math.MaxUint64
+		} else {
+			found++
+		}
+		dst[i] = v
+	}
+	return found
+}
+
+// Prefault reads every memory page of the table once. For mmapped tables this
+// pulls the whole table into the page cache, so that later lookups don't incur
+// page faults.
+func (c *CHD) Prefault() {
+	if c == nil {
+		return
+	}
+	var sum uint64
+	for i := 0; i < len(c.r); i += pageSize / 8 {
+		sum += c.r[i]
+	}
+	for i := 0; i < len(c.indices); i += pageSize / 2 {
+		sum += uint64(c.indices[i])
+	}
+	for _, s := range [][]uint64{c.keys, c.values, c.dict, c.pairValues} {
+		for i := 0; i < len(s); i += pageSize / 8 {
+			sum += s[i]
+		}
+	}
+	if c.dense != nil {
+		for i := 0; i < len(c.dense.present); i += pageSize / 8 {
+			sum += c.dense.present[i]
+		}
+	}
+	if c.pthash != nil {
+		for i := 0; i < len(c.pthash.pilots); i += pageSize / 8 {
+			sum += c.pthash.pilots[i]
+		}
+		for i := 0; i < len(c.pthash.free); i += pageSize / 4 {
+			sum += uint64(c.pthash.free[i])
+		}
+	}
+	for i := 0; i < len(c.packed); i += pageSize {
+		sum += uint64(c.packed[i])
+	}
+	prefaultSink = sum
+}
+
+// The smallest page size of supported platforms. Prefault touches one word per
+// pageSize bytes.
+const pageSize = 4096
+
+// prefaultSink prevents the compiler from optimizing away Prefault's reads.
+var prefaultSink uint64
+
+// MapValues returns a copy of the table with every value replaced by fn(key, value).
+// The hash functions, indices and keys are shared with c, so the result has the
+// exact same structure and no hash functions need to be solved again. If the
+// values of c are packed or in a dictionary, so are those of the result, as
+// far as they allow.
+func (c *CHD) MapValues(fn func(key, old uint64) uint64) *CHD {
+	if c == nil {
+		return nil
+	}
+	if c.IndexOnly() {
+		panic(ErrNoValues)
+	}
+	values := make([]uint64, c.numValues())
+	for i := range values {
+		if k, ok := c.slotKey(i); ok {
+			values[i] = fn(c.unmaskKey(k), c.value(i))
+		}
+	}
+	n := &CHD{
+		r:              c.r,
+		indices:        c.indices,
+		keys:           c.keys,
+		values:         values,
+		backing:        c.backing,
+		metadata:       c.metadata,
+		filter:         c.filter,
+		mixBuckets:     c.mixBuckets,
+		hasher:         c.hasher,
+		uniformKeys:    c.uniformKeys,
+		r32:            c.r32,
+		small:          c.small,
+		dense:          c.dense,
+		pthash:         c.pthash,
+		keyMask:        c.keyMask,
+		columns:        c.columns,
+		sorted:         c.sorted,
+		generations:    c.generations,
+		nextGeneration: c.nextGeneration,
+		deleted:        c.copyDeletions(),
+		deletedCount:   c.deletedCount,
+	}
+	if c.aggregates != nil {
+		n.aggregates = n.computeAggregates()
+	}
+	if c.dict != nil {
+		// More than maxDictionary distinct values are left plain.
+		if ok, _ := n.encodeDictionary(0, true); ok {
+			return n
+		}
+	}
+	if c.valueWidth != 0 {
+		n.packValues()
+	}
+	return n
+}
+
+// Verify checks that every entry in the table can be found with Get. A table
+// that fails verification is corrupt.
+func (c *CHD) Verify() error {
+	if c == nil {
+		return nil
+	}
+	if c.dict != nil {
+		if err := c.checkDictionary(); err != nil {
+			return err
+		}
+	}
+	if c.sorted != nil {
+		if err := c.verifySorted(); err != nil {
+			return err
+		}
+	}
+	if err := c.verifyDigest(); err != nil {
+		return err
+	}
+	if err := c.verifyDeletions(); err != nil {
+		return err
+	}
+	if c.dense != nil {
+		// Dense tables have no keys to misplace.
+		return nil
+	}
+	for i, k := range c.keys {
+		ti, ok := c.slot(k)
+		if !ok {
+			return fmt.Errorf("key %d in slot %d can't be found", c.unmaskKey(k), i)
+		}
+		if ti != i {
+			return fmt.Errorf("key %d in slot %d resolves to slot %d", c.unmaskKey(k), i, ti)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys in the table, including those hidden by
+// Delete.
 func (c *CHD) Len() int {
+	if c == nil {
+		return 0
+	}
+	if c.dense != nil {
+		return c.dense.n
+	}
 	return len(c.keys)
 }
 
-// Iterate over entries in the hash table.
+// Iterate over entries in the hash table. Keys hidden by Delete are skipped.
 func (c *CHD) Iterate() *Iterator {
-	if len(c.keys) == 0 {
+	// The first slot of a dense table holds its smallest key, so it is never a
+	// hole, but it may have been deleted.
+	if c == nil || c.numSlots() == 0 {
 		return nil
 	}
+	if c.isDeleted(0) {
+		return c.IterateFrom(1)
+	}
 	return &Iterator{c: c}
 }
 
-// Serialize the CHD. The serialized form is conducive to mmapped access. See
-// the Mmap function for details.
-func (c *CHD) Write(w io.Writer) error {
-	write := func(nd ...interface{}) error {
-		for _, d := range nd {
-			if err := binary.Write(w, binary.LittleEndian, d); err != nil {
-				return err
-			}
-		}
+// IterateFrom resumes iterating over the entries where Iterator.Token left off,
+// returning nil if no entries remain. IterateFrom(0) is Iterate.
+//
+// Entries are iterated in the order of their slots, and a token is a slot
+// number, so tokens stay valid for tables loaded from the same file, or written
+// from the same table, across processes. Tables built again, for example by
+// RebuildWith or ApplyPatch, put the keys in other slots, which invalidates
+// the tokens: resuming with them skips or repeats entries.
+func (c *CHD) IterateFrom(token uint64) *Iterator {
+	if c == nil || token >= uint64(c.numSlots()) {
 		return nil
 	}
-
-	data := []interface{}{
-		uint32(len(c.r)), c.r,
-		uint32(len(c.indices)), c.indices,
-		uint32(len(c.keys)),
-		c.keys,
-		c.values,
+	it := &Iterator{i: int(token), c: c}
+	if c.live(it.i) {
+		return it
 	}
+	return it.Next()
+}
 
-	if err := write(data...); err != nil {
+// Serialize the CHD. The serialized form is conducive to mmapped access. See
+// the Mmap function for details.
+func (c *CHD) Write(w io.Writer, opts ...WriteOption) error {
+	if err := c.checkWritable(w != nil); err != nil {
 		return err
 	}
-
-	return nil
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.write(w, o)
 }
 
 type Iterator struct {
@@ -158,14 +777,32 @@ type Iterator struct {
 	c *CHD
 }
 
+// Get returns the current entry. It panics with ErrNoValues for index-only
+// tables, use Key for those.
 func (c *Iterator) Get() (key, value uint64) {
-	return c.c.keys[c.i], c.c.values[c.i]
+	if c.c.IndexOnly() {
+		panic(ErrNoValues)
+	}
+	return c.Key(), c.c.value(c.i)
+}
+
+// Key returns the key of the current entry.
+func (c *Iterator) Key() uint64 {
+	k, _ := c.c.slotKey(c.i)
+	return c.c.unmaskKey(k)
+}
+
+// Token returns the token to pass to IterateFrom to resume iterating after the
+// current entry.
+func (c *Iterator) Token() uint64 {
+	return uint64(c.i) + 1
 }
 
 func (c *Iterator) Next() *Iterator {
-	c.i++
-	if c.i >= len(c.c.keys) {
-		return nil
+	for c.i++; c.i < c.c.numSlots(); c.i++ {
+		if c.c.live(c.i) {
+			return c
+		}
 	}
-	return c
+	return nil
 }
@@ -1,8 +1,14 @@
 package uint64mph
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
 	"math/rand"
+	"runtime"
 	"sort"
 	"strconv"
 	"time"
@@ -13,6 +19,12 @@ type chdHasher struct {
 	size    uint64
 	buckets uint64
 	rand    *rand.Rand
+	// Applied to generated random values.
+	mask uint64
+	// Hashes the keys instead of Hash, see WithHasher. May be nil.
+	keyHasher Hasher
+	// Whether keyHasher is Identity.
+	uniformKeys bool
 }
 
 type bucket struct {
@@ -21,9 +33,17 @@ type bucket struct {
 	values []uint64
 }
 
-func (b *bucket) String() string {
+// The most keys bucket.String lists, so that errors mentioning a bucket stay
+// readable.
+const maxBucketStringKeys = 16
+
+func (b bucket) String() string {
 	a := "bucket{"
-	for _, k := range b.keys {
+	for i, k := range b.keys {
+		if i == maxBucketStringKeys {
+			a += "... " + strconv.Itoa(len(b.keys)-i) + " more, "
+			break
+		}
 		a += strconv.FormatUint(k, 10) + ", "
 	}
 	return a + "}"
@@ -32,151 +52,793 @@ func (b *bucket) String() string {
 // Intermediate data structure storing buckets + outer hash index.
 type bucketVector []bucket
 
-func (b bucketVector) Len() int           { return len(b) }
-func (b bucketVector) Less(i, j int) bool { return len(b[i].keys) > len(b[j].keys) }
-func (b bucketVector) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bucketVector) Len() int      { return len(b) }
+func (b bucketVector) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// Less orders buckets by decreasing size. Ties are broken by the hash index to
+// make the order (and thus the built table) independent of the sort algorithm.
+func (b bucketVector) Less(i, j int) bool {
+	if len(b[i].keys) != len(b[j].keys) {
+		return len(b[i].keys) > len(b[j].keys)
+	}
+	return b[i].index < b[j].index
+}
+
+const (
+	// Every this many attempts to place a bucket are logged as a warning.
+	retryLogMilestone = 1000000
+	// Build checks whether its context is done every this many buckets and
+	// attempts to place a bucket.
+	ctxCheckInterval = 1024
+	// Build starts over with another outer hash at most this many times when
+	// the keys of a bucket can't be told apart by any hash function, or no hash
+	// function moves them to free slots. Small tables, for which that happens
+	// to most outer hashes when their size is a power of two, start over until
+	// they grouped reseedKeys keys.
+	maxReseeds = 32
+	reseedKeys = 1 << 16
+	// Before starting over, Build tries at most this many hash functions per
+	// key of the table to place a bucket.
+	reseedAttemptsPerKey = 64
+	// Build checks whether a bucket fits the free slots at all after this many
+	// attempts to place it per key of the table, and at least
+	// noFreeSlotsAttempts, see noFreeSlots. A bucket whose key has f free slots
+	// to go to takes about n/f attempts, so only buckets that can't be placed
+	// get there, and the check, which reads every slot, stays cheap.
+	noFreeSlotsAttemptsPerKey = 4
+	noFreeSlotsAttempts       = 4096
+)
 
 // Build a new CDH MPH.
 type CHDBuilder struct {
-	keys   []uint64
-	values []uint64
-	seed   int64
-	seeded bool
+	entries entryChunks
+	seed    int64
+	seeded  bool
+
+	// See Validator.
+	validator func(key, value uint64) error
+	// The first maxViolations errors returned by validator, and the total
+	// number of them.
+	violations     []error
+	violationCount int
+	// See MemoryBudget.
+	memoryBudget int64
+	// The keys of the first indexed entries, built by Contains.
+	index   map[uint64]struct{}
+	indexed int
 }
 
+// The number of validation errors kept for Build's error.
+const maxViolations = 10
+
 // Create a new CHD hash table builder.
 func Builder() *CHDBuilder {
 	return &CHDBuilder{}
 }
 
+// FromMap builds a CHD hash table containing all entries of m.
+func FromMap(m map[uint64]uint64, opts ...BuildOption) (*CHD, error) {
+	b := Builder()
+	b.AddMap(m)
+	return b.Build(opts...)
+}
+
+// MustFromMap is like FromMap but panics if the table can't be built. It is
+// intended for tests and package level variables.
+func MustFromMap(m map[uint64]uint64, opts ...BuildOption) *CHD {
+	c, err := FromMap(m, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
 // Seed the RNG. This can be used to reproducible building.
 func (b *CHDBuilder) Seed(seed int64) {
 	b.seed = seed
 	b.seeded = true
 }
 
+// Validator makes the builder check every entry with validate as it is added.
+// Entries for which validate returns an error aren't added: AddChecked returns
+// the error, and the other Add methods make Build fail with the errors
+// collected so far.
+func (b *CHDBuilder) Validator(validate func(key, value uint64) error) {
+	b.validator = validate
+}
+
 // Add a key and value to the hash table.
 func (b *CHDBuilder) Add(key, value uint64) {
-	b.keys = append(b.keys, key)
-	b.values = append(b.values, value)
+	if b.validator != nil {
+		if err := b.validate(key, value); err != nil {
+			b.violationCount++
+			if len(b.violations) < maxViolations {
+				b.violations = append(b.violations, err)
+			}
+			return
+		}
+	}
+	b.entries.add(key, value)
+}
+
+// AddChecked is like Add, but returns the error of the Validator instead of
+// making Build fail.
+func (b *CHDBuilder) AddChecked(key, value uint64) error {
+	if b.validator != nil {
+		if err := b.validate(key, value); err != nil {
+			return err
+		}
+	}
+	b.entries.add(key, value)
+	return nil
+}
+
+func (b *CHDBuilder) validate(key, value uint64) error {
+	if err := b.validator(key, value); err != nil {
+		return fmt.Errorf("invalid entry %d: %w", key, err)
+	}
+	return nil
+}
+
+// AddMap adds all entries of m.
+func (b *CHDBuilder) AddMap(m map[uint64]uint64) {
+	for k, v := range m {
+		b.Add(k, v)
+	}
+}
+
+// AddSlices adds the entries keys[i], values[i]. It panics if the slices have
+// different lengths.
+func (b *CHDBuilder) AddSlices(keys, values []uint64) {
+	if len(keys) != len(values) {
+		panic(fmt.Sprintf("uint64mph: AddSlices with %d keys and %d values", len(keys), len(values)))
+	}
+	if b.validator == nil {
+		b.entries.addSlices(keys, values)
+		return
+	}
+	for i, k := range keys {
+		b.Add(k, values[i])
+	}
+}
+
+// MergeBuilders adds the entries of srcs to dst, in order, leaving srcs
+// unchanged. The entries are copied in bulk, which is much faster than adding
+// them one by one, unless dst has a Validator, which checks every entry. Keys
+// added to more than one builder are duplicates like any other, so Build fails
+// with ErrDuplicateKey or resolves them with OnDuplicate. Entries a Validator of
+// a source rejected make Build of dst fail too.
+func MergeBuilders(dst *CHDBuilder, srcs ...*CHDBuilder) error {
+	if dst == nil {
+		return ErrNilBuilder
+	}
+	n := 0
+	for _, src := range srcs {
+		if src == nil {
+			return ErrNilBuilder
+		}
+		n += src.entries.len()
+	}
+	dst.entries.reserve(n)
+	for _, src := range srcs {
+		// Copy the chunk headers first, so merging dst into itself only
+		// copies the entries it had before.
+		keys, values := append([][]uint64(nil), src.entries.keys...), append([][]uint64(nil), src.entries.values...)
+		for c := range keys {
+			dst.AddSlices(keys[c], values[c])
+		}
+		for _, err := range src.violations {
+			if len(dst.violations) < maxViolations {
+				dst.violations = append(dst.violations, err)
+			}
+		}
+		dst.violationCount += src.violationCount
+	}
+	return nil
+}
+
+// Contains reports whether key has been added. The first call indexes all keys
+// added so far, which takes O(n) time and about as much memory again as the
+// entries themselves; later calls only index the keys added since, so a
+// sequence of Add and Contains calls takes O(1) time per call on average.
+func (b *CHDBuilder) Contains(key uint64) bool {
+	if b.index == nil {
+		b.index = make(map[uint64]struct{}, b.entries.len())
+	}
+	for ; b.indexed < b.entries.len(); b.indexed++ {
+		b.index[b.entries.key(b.indexed)] = struct{}{}
+	}
+	_, ok := b.index[key]
+	return ok
+}
+
+// Entries returns an iterator over the entries added so far, in the order they
+// were added, including duplicate keys. It has the signature of an
+// iter.Seq2[uint64, uint64], so it can be ranged over. Iterating takes O(n)
+// time but no extra memory. Entries must not be added while iterating.
+func (b *CHDBuilder) Entries() func(yield func(key, value uint64) bool) {
+	return func(yield func(key, value uint64) bool) {
+		for c, keys := range b.entries.keys {
+			for i, k := range keys {
+				if !yield(k, b.entries.values[c][i]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+var (
+	// ErrDuplicateKey is returned by Build if a key was added more than once,
+	// unless OnDuplicate resolves it.
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrNoHashFunction is returned by Build if the keys of a bucket can't be
+	// placed in the free slots of the table, see WithMaxAttempts.
+	ErrNoHashFunction = errors.New("failed to find a collision-free hash function")
+)
+
+// unplaceable reports whether no hash function can place all keys of a bucket:
+// Table(r, k) only differs for two keys if their hashes do. For power of two
+// table sizes only the low bits of the hashes count, which for keys used as
+// their own hash can easily be equal. hashes is scratch space with room for the
+// hash of every key.
+func unplaceable(hasher *chdHasher, keys, hashes []uint64) bool {
+	mask := ^uint64(0)
+	if hasher.size&(hasher.size-1) == 0 {
+		mask = hasher.size - 1
+	}
+	hashes = hashes[:len(keys)]
+	for i, k := range keys {
+		hashes[i] = hasher.hash(k) & mask
+	}
+	_, ok := findDuplicate(hashes)
+	return ok
+}
+
+// canReseed reports whether a build of n keys that started over reseeds times
+// may start over again.
+func canReseed(reseeds int, n uint64) bool {
+	return reseeds < maxReseeds || uint64(reseeds)*n < reseedKeys
+}
+
+// noFreeSlots reports whether no hash function can move the keys of a bucket
+// to free slots. Table(r, k) only changes the low bits of the slot by xoring r
+// into them, up to the largest power of two dividing the table size, so the
+// keys can only be placed if for some such r every class of slots that agree
+// in those bits has enough free slots for the keys sent to it. For tables whose
+// size is a power of two that's also enough, otherwise it's a quick way to tell
+// that trying more hash functions is pointless. It reads every slot, so it's
+// only worth it for buckets that resist many attempts. hashes is scratch space
+// with room for the hash of every key.
+func noFreeSlots(hasher *chdHasher, seen slotSet, keys, hashes []uint64) bool {
+	classes := uint64(1) << bits.TrailingZeros64(hasher.size)
+	free := make([]int, classes)
+	for s := uint64(0); s < hasher.size; s++ {
+		if !seen.has(s) {
+			free[s&(classes-1)]++
+		}
+	}
+	hashes = hashes[:len(keys)]
+	for i, k := range keys {
+		hashes[i] = (hasher.hash(k) ^ hasher.r[0]) & (classes - 1)
+	}
+	for r := uint64(0); r < classes; r++ {
+		fits := true
+		for _, h := range hashes {
+			if free[h^r]--; free[h^r] < 0 {
+				fits = false
+			}
+		}
+		for _, h := range hashes {
+			free[h^r]++
+		}
+		if fits {
+			return false
+		}
+	}
+	return true
 }
 
 // Try to find a hash function that does not cause collisions with table, when
-// applied to the keys in the bucket.
-func tryHash(hasher *chdHasher, seen map[uint64]bool, keys []uint64, values []uint64, indices []uint16, bucket *bucket, ri uint16, r uint64) bool {
-	// Track duplicates within this bucket.
-	duplicate := make(map[uint64]bool)
+// applied to the keys in the bucket. hashes is scratch space with room for the
+// hash of every key in the bucket.
+func tryHash(hasher *chdHasher, seen slotSet, keys []uint64, values []uint64, indices []uint16, bucket *bucket, ri uint16, r uint64, hashes []uint64) bool {
 	// Make hashes for each entry in the bucket.
-	hashes := make([]uint64, len(bucket.keys))
 	for i, k := range bucket.keys {
 		h := hasher.Table(r, k)
 		hashes[i] = h
-		if seen[h] {
+		if seen.has(h) {
 			return false
 		}
-		if duplicate[h] {
-			return false
+		// Check for duplicates within this bucket.
+		for _, o := range hashes[:i] {
+			if o == h {
+				return false
+			}
 		}
-		duplicate[h] = true
 	}
 
 	// Update seen hashes
-	for _, h := range hashes {
-		seen[h] = true
+	for _, h := range hashes[:len(bucket.keys)] {
+		seen.add(h)
 	}
 
 	// Add the hash index.
 	indices[bucket.index] = ri
 
 	// Update the the hash table.
-	for i, h := range hashes {
+	for i, h := range hashes[:len(bucket.keys)] {
 		keys[h] = bucket.keys[i]
 		values[h] = bucket.values[i]
 	}
 	return true
 }
 
-func (b *CHDBuilder) Build() (*CHD, error) {
-	n := uint64(len(b.keys))
-	m := n / 2
+// Build the hash table. Options passed here take precedence over settings made
+// on the builder.
+//
+// The table depends on the entries that were added and the seed, but not on
+// the order the entries were added in: building the same entries with the same
+// seed (see Seed and WithSeed) writes an identical file. Only the order in
+// which OnDuplicate sees the values of a key follows the order of adding.
+func (b *CHDBuilder) Build(opts ...BuildOption) (*CHD, error) {
+	return b.BuildContext(context.Background(), opts...)
+}
+
+// BuildContext is like Build, but gives up with ctx's error once ctx is done.
+func (b *CHDBuilder) BuildContext(ctx context.Context, opts ...BuildOption) (*CHD, error) {
+	start := time.Now()
+	o := buildOptions{
+		seed:   b.seed,
+		seeded: b.seeded,
+		ratio:  defaultRatio,
+
+		denseThreshold:      defaultDenseThreshold,
+		dictionaryThreshold: defaultDictionaryThreshold,
+		maxAttempts:         defaultMaxAttempts,
+		cpuFraction:         1,
+		logInterval:         defaultLogInterval,
+		largeBucket:         defaultLargeBucket,
+		bestOfSeeds:         1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !(o.ratio > 0) {
+		return nil, fmt.Errorf("invalid ratio %v: must be positive", o.ratio)
+	}
+	if o.dictionaryThreshold < 0 {
+		return nil, fmt.Errorf("invalid dictionary threshold %d: must not be negative", o.dictionaryThreshold)
+	}
+	if !(o.denseThreshold > 0) {
+		return nil, fmt.Errorf("invalid dense threshold %v: must be positive", o.denseThreshold)
+	}
+	if o.pthash && !(o.pthashC > 0 && o.pthashAlpha > 0 && o.pthashAlpha <= 1) {
+		return nil, fmt.Errorf("invalid PTHash parameters c=%v alpha=%v: c must be positive and alpha in (0, 1]", o.pthashC, o.pthashAlpha)
+	}
+	if o.maxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid maximum of %d attempts: must be positive", o.maxAttempts)
+	}
+	if o.yieldInterval < 0 {
+		return nil, fmt.Errorf("invalid yield interval %d: must not be negative", o.yieldInterval)
+	}
+	if err := checkCPUFraction(o.cpuFraction); err != nil {
+		return nil, err
+	}
+	if o.bestOfSeeds <= 0 {
+		return nil, fmt.Errorf("invalid number of seeds %d: must be positive", o.bestOfSeeds)
+	}
+	if o.r32 && o.outerSeeded && o.outerSeed > math.MaxUint32 {
+		return nil, fmt.Errorf("outer seed %#x passed to WithOuterSeed doesn't fit in 32 bits, as needed by WithHashFunctions32", o.outerSeed)
+	}
+	if o.hasher != nil && (len(o.hasher.Name()) == 0 || len(o.hasher.Name()) > maxHasherName) {
+		return nil, fmt.Errorf("invalid hasher name %q: must be 1 to %d bytes", o.hasher.Name(), maxHasherName)
+	}
+
+	if b.violationCount > 0 {
+		err := errors.Join(b.violations...)
+		if more := b.violationCount - len(b.violations); more > 0 {
+			err = fmt.Errorf("%w\n(and %d more)", err, more)
+		}
+		return nil, fmt.Errorf("%d entries failed validation: %w", b.violationCount, err)
+	}
+	if o.bestOfSeeds > 1 {
+		return b.buildBestOfSeeds(ctx, o, opts, start)
+	}
+	added := &b.entries
+	if o.onDuplicate != nil {
+		var err error
+		if added, err = resolveDuplicates(added, o.onDuplicate); err != nil {
+			return nil, err
+		}
+	}
+	if o.keyMask != nil {
+		added = o.keyMask.maskEntries(added)
+	}
+
+	n := uint64(added.len())
+	if n > 0 && n <= maxSmallTable && !o.forceHashed {
+		return buildSmall(added, o, start)
+	}
+	if lo, span, ok := denseRange(added, o.denseThreshold); ok && !o.forceHashed {
+		return buildDense(added, lo, span, o, start)
+	}
+	if o.pthash && n > 0 {
+		return buildPTHash(ctx, added, o, start)
+	}
+	if o.logger != nil && o.hasher == Identity {
+		if bit, ones, sampled := checkUniformKeys(added); bit >= 0 {
+			o.logger.Warn("uint64mph: keys don't look uniformly distributed, but are used as their own hash", "bit", bit, "set_in", ones, "sampled", sampled)
+		}
+	}
+	m := uint64(float64(n) / o.ratio)
 	if m == 0 {
 		m = 1
 	}
 
+	strategy := o.strategy
+	if b.memoryBudget > 0 {
+		var err error
+		if strategy, err = chooseStrategy(b.memoryBudget, n, m, o.filter); err != nil {
+			return nil, err
+		}
+	}
+	var peak *peakTracker
+	if o.stats != nil {
+		peak = newPeakTracker()
+	}
+
 	keys := make([]uint64, n)
 	values := make([]uint64, n)
-	hasher := newCHDHasher(n, m, b.seed, b.seeded)
-	buckets := make(bucketVector, m)
-	indices := make([]uint16, m)
-	// An extra check to make sure we don't use an invalid index
-	for i := range indices {
-		indices[i] = ^uint16(0)
+	hasher := newCHDHasher(n, m, o.seed, o.seeded)
+	hasher.keyHasher, hasher.uniformKeys = o.hasher, o.hasher == Identity
+	if o.r32 {
+		hasher.mask = math.MaxUint32
+		hasher.r[0] &= hasher.mask
 	}
+	if o.outerSeeded {
+		hasher.r[0] = o.outerSeed
+	}
+	indices := make([]uint16, m)
 	// Have we seen a hash before?
-	seen := make(map[uint64]bool)
-	// Used to ensure there are no duplicate keys.
-	duplicates := make(map[uint64]bool)
-
-	for i := range b.keys {
-		key := b.keys[i]
-		value := b.values[i]
-		if duplicates[key] {
-			return nil, fmt.Errorf("duplicate key %d", key)
+	var seen slotSet
+	// The buckets, ordered by size (retaining the hash index).
+	var buckets bucketSource
+	var sorted []uint64
+	if strategy == StrategyExternal {
+		var release func() error
+		var err error
+		if sorted, release, err = mapScratch(2 * n); err != nil {
+			return nil, err
 		}
-		duplicates[key] = true
-		oh := hasher.HashIndexFromKey(key)
-
-		buckets[oh].index = oh
-		buckets[oh].keys = append(buckets[oh].keys, key)
-		buckets[oh].values = append(buckets[oh].values, value)
+		defer release()
+	} else if strategy == StrategySorted {
+		sorted = make([]uint64, 2*n)
 	}
-
-	// Order buckets by size (retaining the hash index)
 	collisions := 0
-	sort.Sort(buckets)
-nextBucket:
-	for i, bucket := range buckets {
-		if len(bucket.keys) == 0 {
-			continue
+	// Buckets and attempts since Build last yielded, see WithYieldInterval.
+	sinceYield := 0
+	lastLog := start
+	var hashes []uint64
+reseed:
+	for reseeds := 0; ; reseeds++ {
+		// An extra check to make sure we don't use an invalid index
+		for i := range indices {
+			indices[i] = ^uint16(0)
+		}
+		if o.trace != nil {
+			o.trace(OuterHashChosen{Seed: hasher.r[0]})
+		}
+		var err error
+		switch strategy {
+		case StrategyMaps:
+			seen = make(slotMap)
+			buckets, err = groupWithMaps(added, hasher, m)
+		case StrategySorted, StrategyExternal:
+			seen = newSlotBitset(n)
+			buckets, err = groupSorted(added, hasher, m, sorted[:n:n], sorted[n:])
+		default:
+			err = fmt.Errorf("unknown build strategy %v", strategy)
+		}
+		if err != nil {
+			return nil, err
 		}
+		peak.sample()
 
-		// Check existing hash functions.
-		for ri, r := range hasher.r {
-			if tryHash(hasher, seen, keys, values, indices, &bucket, uint16(ri), r) {
-				continue nextBucket
+		if o.outerSeeded && buckets.Len() > 0 && len(buckets.Bucket(0).keys) > maxOuterSeedBucket {
+			return nil, fmt.Errorf("outer seed %#x passed to WithOuterSeed puts %d keys in a single bucket: try another seed", o.outerSeed, len(buckets.Bucket(0).keys))
+		}
+		if o.trace != nil {
+			for i := 0; i < buckets.Len(); i++ {
+				bucket := buckets.Bucket(i)
+				o.trace(BucketAssigned{Bucket: i, Index: bucket.index, Keys: len(bucket.keys)})
 			}
 		}
+	nextBucket:
+		for i := 0; i < buckets.Len(); i++ {
+			bucket := buckets.Bucket(i)
+			if len(bucket.keys) == 0 {
+				continue
+			}
+			if len(hashes) < len(bucket.keys) {
+				hashes = make([]uint64, len(bucket.keys))
+			}
+			if sinceYield++; o.yieldInterval > 0 && sinceYield >= o.yieldInterval {
+				sinceYield = 0
+				runtime.Gosched()
+			}
+			if i%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				if o.progress != nil {
+					o.progress(i, buckets.Len())
+				}
+			}
+			if o.logger != nil {
+				if now := time.Now(); now.Sub(lastLog) >= o.logInterval {
+					lastLog = now
+					o.logger.Info("uint64mph: build progress", "buckets_placed", i, "buckets", buckets.Len(), "hash_functions", hasher.Len(), "elapsed", now.Sub(start))
+				}
+				if len(bucket.keys) > o.largeBucket {
+					o.logger.Warn("uint64mph: large bucket", "bucket", i, "keys", len(bucket.keys))
+				}
+			}
 
-		// Keep trying new functions until we get one that does not collide.
-		// The number of retries here is very high to allow a very high
-		// probability of not getting collisions.
-		for i := 0; i < 10000000; i++ {
-			if i > collisions {
-				collisions = i
+			// Check existing hash functions.
+			for ri, r := range hasher.r {
+				if tryHash(hasher, seen, keys, values, indices, &bucket, uint16(ri), r, hashes) {
+					if o.trace != nil {
+						o.trace(BucketPlaced{Bucket: i, Index: bucket.index, Keys: len(bucket.keys), HashFunction: ri})
+					}
+					continue nextBucket
+				}
 			}
-			ri, r := hasher.Generate()
-			if tryHash(hasher, seen, keys, values, indices, &bucket, ri, r) {
-				hasher.Add(r)
-				continue nextBucket
+
+			if unplaceable(hasher, bucket.keys, hashes) {
+				// The outer hash decides which keys share a bucket, so
+				// start over with another one.
+				if !o.outerSeeded && canReseed(reseeds, n) {
+					if o.logger != nil {
+						o.logger.Warn("uint64mph: bucket can't be placed, retrying with another outer hash", "bucket", i, "keys", len(bucket.keys))
+					}
+					hasher.r = append(hasher.r[:0], hasher.rand.Uint64()&hasher.mask)
+					continue reseed
+				}
+				err := fmt.Errorf("%w for bucket %d/%d with %d entries: no hash function tells the slots of some of its keys apart: %s",
+					ErrNoHashFunction, i, buckets.Len(), len(bucket.keys), bucket.String())
+				if hasher.uniformKeys {
+					err = fmt.Errorf("%w (keys used as their own hash must differ in their low bits for a table of %d keys)", err, n)
+				}
+				if o.outerSeeded {
+					err = fmt.Errorf("%w (the outer seed %#x was pinned by WithOuterSeed, try another seed)", err, o.outerSeed)
+				}
+				if o.trace != nil {
+					o.trace(BuildFailed{Bucket: i, Index: bucket.index, Keys: len(bucket.keys), Err: err})
+				}
+				return nil, err
+			}
+
+			// Keep trying new functions until we get one that does not collide.
+			// The number of retries here is very high to allow a very high
+			// probability of not getting collisions.
+			// Unless this is the last outer hash to try, a bucket that
+			// resists many more attempts than the table has slots is
+			// better off in another one.
+			attempts := o.maxAttempts
+			if !o.outerSeeded && canReseed(reseeds, n) {
+				attempts = int(min(uint64(attempts), reseedAttemptsPerKey*n))
+			}
+			checkFree := int(max(noFreeSlotsAttempts, noFreeSlotsAttemptsPerKey*n))
+			for attempt := 0; attempt < attempts; attempt++ {
+				if attempt == checkFree && noFreeSlots(hasher, seen, bucket.keys, hashes) {
+					attempts = attempt
+					break
+				}
+				if attempt > collisions {
+					collisions = attempt
+				}
+				if sinceYield++; o.yieldInterval > 0 && sinceYield >= o.yieldInterval {
+					sinceYield = 0
+					runtime.Gosched()
+				}
+				if attempt%ctxCheckInterval == ctxCheckInterval-1 {
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+				}
+				if o.logger != nil && attempt > 0 && attempt%retryLogMilestone == 0 {
+					o.logger.Warn("uint64mph: bucket needs many attempts", "keys", len(bucket.keys), "attempts", attempt)
+				}
+				ri, r := hasher.Generate()
+				if tryHash(hasher, seen, keys, values, indices, &bucket, ri, r, hashes) {
+					hasher.Add(r)
+					if o.trace != nil {
+						o.trace(HashFunctionAdded{HashFunction: int(ri), Seed: r})
+						o.trace(BucketPlaced{Bucket: i, Index: bucket.index, Keys: len(bucket.keys), HashFunction: int(ri), Attempts: attempt + 1})
+					}
+					continue nextBucket
+				}
 			}
-		}
 
-		// Failed to find a hash function with no collisions.
-		return nil, fmt.Errorf(
-			"failed to find a collision-free hash function after ~10000000 attempts, for bucket %d/%d with %d entries: %s",
-			i, len(buckets), len(bucket.keys), &bucket)
+			// Failed to find a hash function with no collisions. Another
+			// outer hash puts the keys in other buckets.
+			if !o.outerSeeded && canReseed(reseeds, n) {
+				if o.logger != nil {
+					o.logger.Warn("uint64mph: bucket can't be placed, retrying with another outer hash", "bucket", i, "keys", len(bucket.keys), "attempts", attempts)
+				}
+				hasher.r = append(hasher.r[:0], hasher.rand.Uint64()&hasher.mask)
+				continue reseed
+			}
+			if o.logger != nil {
+				o.logger.Error("uint64mph: build failed", "bucket", i, "keys", len(bucket.keys), "elapsed", time.Since(start))
+			}
+			err := fmt.Errorf(
+				"%w after ~%d attempts, for bucket %d/%d with %d entries: %s",
+				ErrNoHashFunction, attempts, i, buckets.Len(), len(bucket.keys), bucket.String())
+			if o.outerSeeded {
+				err = fmt.Errorf("%w (the outer seed %#x was pinned by WithOuterSeed, try another seed)", err, o.outerSeed)
+			}
+			if o.trace != nil {
+				o.trace(BuildFailed{Bucket: i, Index: bucket.index, Keys: len(bucket.keys), Attempts: attempts, Err: err})
+			}
+			return nil, err
+		}
+		if o.progress != nil {
+			o.progress(buckets.Len(), buckets.Len())
+		}
+		break
 	}
 
+	peak.sample()
+	hasher.r = compactHashFunctions(hasher.r, indices)
+
 	// println("max bucket collisions:", collisions)
 	// println("keys:", len(table))
 	// println("hash functions:", len(hasher.r))
 
-	return &CHD{
-		r:       hasher.r,
-		indices: indices,
-		keys:    keys,
-		values:  values,
-	}, nil
+	c := &CHD{
+		r:          hasher.r,
+		indices:    indices,
+		keys:       keys,
+		values:     values,
+		mixBuckets: true,
+		r32:        o.r32,
+		keyMask:    o.keyMask,
+	}
+	c.setHasher(o.hasher)
+	if err := c.shrinkValues(o); err != nil {
+		return nil, err
+	}
+	if o.filter {
+		f, err := newXorFilter(keys, hasher.rand)
+		if err != nil {
+			return nil, err
+		}
+		c.filter = f
+		peak.sample()
+	}
+	if o.logger != nil {
+		o.logger.Info("uint64mph: build finished", "entries", n, "buckets", m, "hash_functions", hasher.Len(), "max_attempts", collisions, "elapsed", time.Since(start))
+	}
+	if o.stats != nil {
+		*o.stats = BuildStats{
+			TableStats:  c.Stats(),
+			Duration:    time.Since(start),
+			MaxAttempts: collisions,
+			OuterSeed:   hasher.r[0],
+			Strategy:    strategy,
+			PeakBytes:   int64(peak.peak),
+		}
+	}
+	return c, nil
+}
+
+// buildSmall builds a small table, which stores the entries sorted by key.
+func buildSmall(entries *entryChunks, o buildOptions, start time.Time) (*CHD, error) {
+	c := &CHD{
+		keys:   append([]uint64(nil), entries.keys[0]...),
+		values: append([]uint64(nil), entries.values[0]...),
+		small:  true,
+		// Small tables are new in version 3.
+		mixBuckets: true,
+		keyMask:    o.keyMask,
+	}
+	sort.Sort(smallEntries{c})
+	for i := 1; i < len(c.keys); i++ {
+		if c.keys[i] == c.keys[i-1] {
+			return nil, fmt.Errorf("%w %d", ErrDuplicateKey, c.keys[i])
+		}
+	}
+	if err := c.shrinkValues(o); err != nil {
+		return nil, err
+	}
+	if o.logger != nil {
+		o.logger.Info("uint64mph: build finished", "entries", len(c.keys), "small", true, "elapsed", time.Since(start))
+	}
+	if o.stats != nil {
+		*o.stats = BuildStats{
+			TableStats: c.Stats(),
+			Duration:   time.Since(start),
+		}
+	}
+	return c, nil
+}
+
+// smallEntries sorts the entries of a small table by key.
+type smallEntries struct{ c *CHD }
+
+func (s smallEntries) Len() int           { return len(s.c.keys) }
+func (s smallEntries) Less(i, j int) bool { return s.c.keys[i] < s.c.keys[j] }
+func (s smallEntries) Swap(i, j int) {
+	s.c.keys[i], s.c.keys[j] = s.c.keys[j], s.c.keys[i]
+	s.c.values[i], s.c.values[j] = s.c.values[j], s.c.values[i]
+}
+
+// groupWithMaps groups the entries into m buckets, finding duplicate keys with a
+// map.
+func groupWithMaps(entries *entryChunks, hasher *chdHasher, m uint64) (bucketVector, error) {
+	buckets := make(bucketVector, m)
+	for i := range buckets {
+		buckets[i].index = uint64(i)
+	}
+	// Used to ensure there are no duplicate keys.
+	duplicates := make(map[uint64]bool)
+
+	for c, chunk := range entries.keys {
+		for i, key := range chunk {
+			value := entries.values[c][i]
+			if duplicates[key] {
+				return nil, fmt.Errorf("%w %d", ErrDuplicateKey, key)
+			}
+			duplicates[key] = true
+			oh := hasher.HashIndexFromKey(key)
+
+			buckets[oh].keys = append(buckets[oh].keys, key)
+			buckets[oh].values = append(buckets[oh].values, value)
+		}
+	}
+	sort.Sort(buckets)
+	return buckets, nil
+}
+
+// resolveDuplicates merges the values of keys that occur more than once with
+// resolve, returning the entries without duplicates.
+func resolveDuplicates(entries *entryChunks, resolve func(key, existing, incoming uint64) (uint64, error)) (*entryChunks, error) {
+	// Maps keys to their index in the result.
+	index := make(map[uint64]int, entries.len())
+	out := &entryChunks{}
+	for c, chunk := range entries.keys {
+		for i, k := range chunk {
+			j, ok := index[k]
+			if !ok {
+				index[k] = out.len()
+				out.add(k, entries.values[c][i])
+				continue
+			}
+			v, err := resolve(k, out.values[j/entryChunkSize][j%entryChunkSize], entries.values[c][i])
+			if err != nil {
+				return nil, fmt.Errorf("%w %d: %w", ErrDuplicateKey, k, err)
+			}
+			out.values[j/entryChunkSize][j%entryChunkSize] = v
+		}
+	}
+	return out, nil
+}
+
+// BuildTo builds the hash table and serializes it to w, like Build followed by
+// Write, but without keeping the table around afterwards. It returns the
+// statistics of the build, so WithStats isn't needed.
+func (b *CHDBuilder) BuildTo(w io.Writer, opts ...BuildOption) (BuildStats, error) {
+	var stats BuildStats
+	c, err := b.Build(append(opts[:len(opts):len(opts)], WithStats(&stats))...)
+	if err != nil {
+		return BuildStats{}, err
+	}
+	if err := c.Write(w); err != nil {
+		return BuildStats{}, err
+	}
+	return stats, nil
 }
 
 func newCHDHasher(size, buckets uint64, seed int64, seeded bool) *chdHasher {
@@ -184,23 +846,68 @@ func newCHDHasher(size, buckets uint64, seed int64, seeded bool) *chdHasher {
 		seed = time.Now().UnixNano()
 	}
 	rs := rand.NewSource(seed)
-	c := &chdHasher{size: size, buckets: buckets, rand: rand.New(rs)}
+	c := &chdHasher{size: size, buckets: buckets, rand: rand.New(rs), mask: math.MaxUint64}
 	c.Add(c.rand.Uint64())
 	return c
 }
 
+// compactHashFunctions merges the hash functions with equal random values and
+// drops those that no bucket uses, remapping indices to the result. r[0] stays
+// first, as it is mixed into every key's hash. Buckets without keys keep their
+// index, which is still beyond the end of the result. The result reuses the
+// memory of r.
+func compactHashFunctions(r []uint64, indices []uint16) []uint64 {
+	used := make([]bool, len(r))
+	for _, ri := range indices {
+		if int(ri) < len(r) {
+			used[ri] = true
+		}
+	}
+	out := r[:1]
+	remap := make([]uint16, len(r))
+	pos := map[uint64]uint16{r[0]: 0}
+	for ri, v := range r[1:] {
+		if !used[ri+1] {
+			continue
+		}
+		p, ok := pos[v]
+		if !ok {
+			p = uint16(len(out))
+			pos[v] = p
+			out = append(out, v)
+		}
+		remap[ri+1] = p
+	}
+	for i, ri := range indices {
+		if int(ri) < len(r) {
+			indices[i] = remap[ri]
+		}
+	}
+	return out
+}
+
 // Hash index from key.
 func (h *chdHasher) HashIndexFromKey(b uint64) uint64 {
-	return (hasher(b) ^ h.r[0]) % h.buckets
+	return bucketFor(h.hash(b)^h.r[0], h.buckets, true)
+}
+
+func (h *chdHasher) hash(key uint64) uint64 {
+	if h.keyHasher == nil {
+		return Hash(key)
+	}
+	if h.uniformKeys {
+		return key
+	}
+	return h.keyHasher.Hash(key)
 }
 
 // Table hash from random value and key. Generate() returns these random values.
 func (h *chdHasher) Table(r uint64, b uint64) uint64 {
-	return (hasher(b) ^ h.r[0] ^ r) % h.size
+	return (h.hash(b) ^ h.r[0] ^ r) % h.size
 }
 
 func (c *chdHasher) Generate() (uint16, uint64) {
-	return c.Len(), c.rand.Uint64()
+	return c.Len(), c.rand.Uint64() & c.mask
 }
 
 // Add a random value generated by Generate().
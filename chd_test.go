@@ -2,11 +2,18 @@ package uint64mph
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
+	"math/bits"
 	"math/rand"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -26,12 +33,18 @@ var (
 )
 
 func init() {
+	// Seeded so that failures are reproducible.
+	rng := rand.New(rand.NewSource(1))
 	words = make([]uint64, 102401)
 	for i := range words {
-		words[i] = rand.Uint64()
+		words[i] = rng.Uint64()
 	}
 }
 
+// hashed makes Build hash tables that would be small, for tests of the hashed
+// structure with sampleData.
+var hashed BuildOption = func(o *buildOptions) { o.forceHashed = true }
+
 func TestCHDBuilder(t *testing.T) {
 	b := Builder()
 	for k, v := range sampleData {
@@ -46,6 +59,447 @@ func TestCHDBuilder(t *testing.T) {
 	assert.Equal(t, uint64(math.MaxUint64), c.Get(5))
 }
 
+func TestGetOK_maxUint64(t *testing.T) {
+	m := randomData(1000, 31)
+	k := firstKey(m)
+	m[k] = math.MaxUint64
+	for name, opts := range map[string][]BuildOption{
+		"chd":    {WithSeed(31)},
+		"pthash": {WithSeed(31), WithPTHash(7, 0.99)},
+		"dict":   {WithSeed(31), WithValueDictionary()},
+		"filter": {WithSeed(31), WithFilter()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(m, opts...)
+			require.NoError(t, err)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			g, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			for _, c := range []*CHD{c, g} {
+				// Get can't tell these apart, GetOK and Lookup can.
+				assert.Equal(t, uint64(math.MaxUint64), c.Get(k))
+				assert.Equal(t, uint64(math.MaxUint64), c.Get(5))
+				v, ok := c.GetOK(k)
+				assert.True(t, ok)
+				assert.Equal(t, uint64(math.MaxUint64), v)
+				_, ok = c.GetOK(5)
+				assert.False(t, ok)
+				v, ok = c.Lookup(k)
+				assert.True(t, ok)
+				assert.Equal(t, uint64(math.MaxUint64), v)
+				_, ok = c.Lookup(5)
+				assert.False(t, ok)
+			}
+		})
+	}
+	c := MustFromMap(map[uint64]uint64{1: math.MaxUint64, 2: 3, 4: 0})
+	v, ok := c.GetOK(1)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(math.MaxUint64), v)
+	_, ok = c.GetOK(5)
+	assert.False(t, ok)
+	// A stored 0 isn't a miss either.
+	v, ok = c.Lookup(4)
+	assert.True(t, ok)
+	assert.Zero(t, v)
+	v, ok = c.Lookup(5)
+	assert.False(t, ok)
+	assert.Zero(t, v)
+	_, ok = (*CHD)(nil).Lookup(1)
+	assert.False(t, ok)
+}
+
+func TestContains(t *testing.T) {
+	m := map[uint64]uint64{}
+	for _, w := range words[:5000] {
+		m[w] = w
+	}
+	c := MustFromMap(m, WithSeed(32))
+	for _, w := range words[:5000] {
+		assert.True(t, c.Contains(w))
+		assert.True(t, c.Has(w))
+	}
+	// Most misses land in buckets without keys, or slots of other keys.
+	for _, w := range words[5000:10000] {
+		assert.False(t, c.Contains(w))
+		assert.False(t, c.Has(w))
+	}
+	assert.False(t, MustFromMap(nil).Contains(words[0]))
+	assert.False(t, (*CHD)(nil).Contains(words[0]))
+	assert.False(t, (*CHD)(nil).Has(words[0]))
+
+	// Has doesn't need the values.
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	idx, err := MmapWithOptions(w.Bytes(), SkipValues())
+	require.NoError(t, err)
+	assert.True(t, idx.Has(words[0]))
+	assert.False(t, idx.Has(words[5000]))
+}
+
+func TestCHDBuilderIntrospection(t *testing.T) {
+	b := Builder()
+	assert.False(t, b.Contains(1))
+	b.Add(1, 10)
+	b.Add(2, 20)
+	assert.True(t, b.Contains(1))
+	assert.False(t, b.Contains(3))
+	// Keys added after the first Contains are found too.
+	b.Add(3, 30)
+	b.Add(1, 11)
+	assert.True(t, b.Contains(3))
+
+	var keys, values []uint64
+	b.Entries()(func(k, v uint64) bool {
+		keys = append(keys, k)
+		values = append(values, v)
+		return true
+	})
+	assert.Equal(t, []uint64{1, 2, 3, 1}, keys)
+	assert.Equal(t, []uint64{10, 20, 30, 11}, values)
+	n := 0
+	b.Entries()(func(k, v uint64) bool {
+		n++
+		return n < 2
+	})
+	assert.Equal(t, 2, n)
+
+	// Entries spanning several chunks.
+	b = Builder()
+	many := make([]uint64, entryChunkSize+5)
+	for i := range many {
+		many[i] = uint64(i)
+	}
+	b.AddSlices(many, many)
+	i := 0
+	b.Entries()(func(k, v uint64) bool {
+		if k != uint64(i) || v != uint64(i) {
+			t.Fatalf("entry %d is %d: %d", i, k, v)
+		}
+		i++
+		return true
+	})
+	assert.Equal(t, len(many), i)
+	assert.True(t, b.Contains(entryChunkSize+4))
+	assert.False(t, b.Contains(entryChunkSize+5))
+}
+
+func TestWithMaxAttempts(t *testing.T) {
+	b := Builder()
+	for i := uint64(0); i < 1024; i++ {
+		b.Add(i<<20, i)
+	}
+	// Keys used as their own hash that only differ in their high bits can't
+	// be placed in a table of a power of two slots, which fails right away.
+	start := time.Now()
+	_, err := b.Build(AssumeUniformKeys())
+	assert.ErrorIs(t, err, ErrNoHashFunction)
+	assert.ErrorContains(t, err, "must differ in their low bits")
+	assert.Less(t, time.Since(start), time.Second)
+	c, err := b.Build()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), c.Get(5<<20))
+
+	// Pinning the outer seed keeps Build from starting over.
+	for i := 0; i < 20; i++ {
+		_, err = FromMap(sampleData, hashed, WithSeed(int64(i)), WithOuterSeed(uint64(i)), WithRatio(0.01), WithMaxAttempts(1))
+		if err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, ErrNoHashFunction)
+	assert.ErrorContains(t, err, "after ~1 attempts")
+	_, err = FromMap(sampleData, WithMaxAttempts(0))
+	assert.ErrorContains(t, err, "must be positive")
+
+	b.Add(3<<20, 1)
+	_, err = b.Build()
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+}
+
+func TestBuild_smallTables(t *testing.T) {
+	// Buckets of small tables, especially those of a power of two slots,
+	// often fit no hash function, which Build gets around by starting over.
+	rng := rand.New(rand.NewSource(47))
+	for n := 8; n <= 64; n++ {
+		for seed := int64(0); seed < 50; seed++ {
+			m := map[uint64]uint64{}
+			for len(m) < n {
+				m[rng.Uint64()] = rng.Uint64()
+			}
+			c, err := FromMap(m, WithSeed(seed))
+			require.NoError(t, err, "%d keys, seed %d", n, seed)
+			for k, v := range m {
+				assert.Equal(t, v, c.Get(k))
+			}
+		}
+	}
+}
+
+func TestCHDBuilderValidator(t *testing.T) {
+	errZero := errors.New("value must be non-zero")
+	newBuilder := func() *CHDBuilder {
+		b := Builder()
+		b.Validator(func(key, value uint64) error {
+			if value == 0 {
+				return errZero
+			}
+			return nil
+		})
+		return b
+	}
+
+	b := newBuilder()
+	assert.NoError(t, b.AddChecked(1, 1))
+	err := b.AddChecked(2, 0)
+	assert.ErrorIs(t, err, errZero)
+	assert.ErrorContains(t, err, "invalid entry 2")
+	b.AddSlices([]uint64{3, 4, 6}, []uint64{3, 4, 6})
+	b.AddMap(map[uint64]uint64{5: 5})
+	c, err := b.Build()
+	require.NoError(t, err)
+	assert.Equal(t, 5, c.Len())
+	assert.False(t, c.Contains(2))
+
+	b = newBuilder()
+	b.Add(1, 1)
+	b.AddSlices([]uint64{2, 3}, []uint64{0, 3})
+	b.AddMap(map[uint64]uint64{4: 0})
+	for k := uint64(100); k < 120; k++ {
+		b.Add(k, 0)
+	}
+	_, err = b.Build()
+	assert.ErrorIs(t, err, errZero)
+	assert.ErrorContains(t, err, "22 entries failed validation")
+	assert.ErrorContains(t, err, "invalid entry 2")
+	assert.ErrorContains(t, err, "invalid entry 4")
+	assert.ErrorContains(t, err, "(and 12 more)")
+	assert.NotContains(t, err.Error(), "invalid entry 119")
+
+	assert.Panics(t, func() { Builder().AddSlices([]uint64{1}, nil) })
+}
+
+func TestBuild_orderIndependent(t *testing.T) {
+	m := randomData(5000, 30)
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	for name, opts := range map[string][]BuildOption{
+		"maps":       nil,
+		"sorted":     {func(o *buildOptions) { o.strategy = StrategySorted }},
+		"32 bit":     {WithHashFunctions32()},
+		"packed":     {WithPackedValues()},
+		"dictionary": {WithPackedValues(), WithDictionaryThreshold(1 << 20)},
+		"filter":     {WithFilter()},
+		"pthash":     {WithPTHash(7, 0.99)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var want []byte
+			for seed := int64(0); seed < 4; seed++ {
+				rand.New(rand.NewSource(seed)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+				b := Builder()
+				for _, k := range keys {
+					b.Add(k, m[k]%1000)
+				}
+				c, err := b.Build(append(opts, WithSeed(3))...)
+				require.NoError(t, err)
+				w := &bytes.Buffer{}
+				require.NoError(t, c.Write(w))
+				if want == nil {
+					want = w.Bytes()
+				}
+				assert.True(t, bytes.Equal(want, w.Bytes()), "order %d", seed)
+			}
+		})
+	}
+}
+
+func TestMergeBuilders(t *testing.T) {
+	srcs := []*CHDBuilder{Builder(), Builder(), Builder()}
+	want := map[uint64]uint64{}
+	for i := uint64(0); i < 3000; i++ {
+		srcs[i%3].Add(i*7, i)
+		want[i*7] = i
+	}
+	dst := Builder()
+	dst.Add(1, 2)
+	want[1] = 2
+	require.NoError(t, MergeBuilders(dst, srcs...))
+	c, err := dst.Build()
+	require.NoError(t, err)
+	assert.Equal(t, len(want), c.Len())
+	for k, v := range want {
+		assert.Equal(t, v, c.Get(k))
+	}
+	// The sources are left alone.
+	for i, src := range srcs {
+		assert.Equal(t, 1000, src.entries.len(), "source %d", i)
+	}
+	assert.True(t, dst.Contains(21))
+
+	// Keys in several builders are duplicates.
+	require.NoError(t, MergeBuilders(dst, srcs[1]))
+	_, err = dst.Build()
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+	c, err = dst.Build(OnDuplicate(func(key, existing, incoming uint64) (uint64, error) {
+		return existing + incoming, nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), c.Get(7))
+
+	// Merging a builder into itself doubles it.
+	b := Builder()
+	b.AddSlices([]uint64{1, 2}, []uint64{3, 4})
+	require.NoError(t, MergeBuilders(b, b))
+	assert.Equal(t, 4, b.entries.len())
+
+	// Validators apply to dst, and rejected entries of sources carry over.
+	v := Builder()
+	v.Validator(func(key, value uint64) error {
+		if key == 7 {
+			return errors.New("no sevens")
+		}
+		return nil
+	})
+	require.NoError(t, MergeBuilders(v, srcs[1]))
+	_, err = v.Build()
+	assert.ErrorContains(t, err, "1 entries failed validation")
+	d := Builder()
+	require.NoError(t, MergeBuilders(d, v))
+	_, err = d.Build()
+	assert.ErrorContains(t, err, "invalid entry 7: no sevens")
+
+	assert.ErrorIs(t, MergeBuilders(nil), ErrNilBuilder)
+	assert.ErrorIs(t, MergeBuilders(Builder(), nil), ErrNilBuilder)
+}
+
+func TestHash(t *testing.T) {
+	// These values must never change, see the documentation of Hash.
+	for _, tc := range []struct{ key, hash uint64 }{
+		{0x0, 0xa8c7f832281a39c5},
+		{0x1, 0x89cd31291d2aefa4},
+		{0x2a, 0xff3add6b3789daef},
+		{0xdeadbeefcafebabe, 0xbdf6b67f799bf80b},
+		{0xffffffffffffffff, 0x8cf51a8bfca3883d},
+	} {
+		assert.Equal(t, tc.hash, Hash(tc.key), "Hash(%#x)", tc.key)
+	}
+}
+
+// chiSquaredPoisson returns the chi-squared statistic of the bucket sizes in
+// counts against a Poisson distribution with mean ratio, over the sizes 0 to 7
+// and a category for all larger sizes.
+func chiSquaredPoisson(counts []int, ratio float64) float64 {
+	const categories = 9
+	var observed [categories]float64
+	for _, c := range counts {
+		observed[min(c, categories-1)]++
+	}
+	var chi, cumulative float64
+	p := math.Exp(-ratio)
+	for k := 0; k < categories; k++ {
+		if k == categories-1 {
+			p = 1 - cumulative
+		}
+		expected := p * float64(len(counts))
+		chi += (observed[k] - expected) * (observed[k] - expected) / expected
+		cumulative += p
+		p *= ratio / float64(k+1)
+	}
+	return chi
+}
+
+func TestBucketDistribution(t *testing.T) {
+	generators := []struct {
+		name string
+		gen  func(i uint64) uint64
+	}{
+		{"sequential", func(i uint64) uint64 { return i }},
+		{"shifted16", func(i uint64) uint64 { return i << 16 }},
+		{"shifted32", func(i uint64) uint64 { return i << 32 }},
+		{"shifted40", func(i uint64) uint64 { return i << 40 }},
+		{"strided", func(i uint64) uint64 { return 1000*i + 7 }},
+		{"reversed", func(i uint64) uint64 { return bits.ReverseBytes64(i) }},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []uint64{100000, 1 << 16} {
+		for _, g := range generators {
+			h := newCHDHasher(n, n/2, rng.Int63(), true)
+			counts := make([]int, n/2)
+			for i := uint64(0); i < n; i++ {
+				counts[h.HashIndexFromKey(g.gen(i))]++
+			}
+			// The critical value for 8 degrees of freedom at p = 0.001.
+			assert.Less(t, chiSquaredPoisson(counts, 2), 26.12, "%s keys into %d buckets", g.name, n/2)
+		}
+	}
+}
+
+func TestCompactHashFunctions(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	r := c.HashFunctions()
+
+	// Duplicate every hash function, point all but the first bucket using it at
+	// the copy and add a hash function no bucket uses.
+	bloated := append(append([]uint64{}, r...), r[1:]...)
+	bloated = append(bloated, 12345)
+	indices := c.Indices()
+	seen := map[uint16]bool{}
+	for i, ri := range indices {
+		if ri > 0 && int(ri) < len(r) && seen[ri] {
+			indices[i] = ri + uint16(len(r)) - 1
+		}
+		seen[ri] = true
+	}
+	c.r, c.indices = compactHashFunctions(bloated, indices), indices
+	assert.Equal(t, r, c.r)
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	assert.NoError(t, c.Verify())
+	compacted := &bytes.Buffer{}
+	require.NoError(t, c.Write(compacted))
+	assert.Equal(t, w.Bytes(), compacted.Bytes())
+
+	// Hash functions equal to r[0] are merged into it.
+	assert.Equal(t, []uint64{7}, compactHashFunctions([]uint64{7, 7, 8}, []uint16{1, 1, ^uint16(0)}))
+}
+
+func TestCHDBuilderBuildTo(t *testing.T) {
+	b := Builder()
+	for i := uint64(0); i < 1000; i++ {
+		b.Add(i*31, i)
+	}
+	c, err := b.Build(WithSeed(5))
+	assert.NoError(t, err)
+	want := &bytes.Buffer{}
+	assert.NoError(t, c.Write(want))
+
+	w := &bytes.Buffer{}
+	stats, err := b.BuildTo(w, WithSeed(5))
+	assert.NoError(t, err)
+	assert.Equal(t, want.Bytes(), w.Bytes())
+	assert.Equal(t, 1000, stats.Entries)
+	assert.Equal(t, c.Stats(), stats.TableStats)
+
+	// Errors from the build and from w are returned.
+	b.Add(0, 1)
+	_, err = b.BuildTo(&bytes.Buffer{})
+	assert.ErrorContains(t, err, "duplicate key")
+	_, err = Builder().BuildTo(failingWriter{})
+	assert.Error(t, err)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
 func TestCHDSerialization(t *testing.T) {
 	cb := Builder()
 	for _, v := range words {
@@ -84,6 +538,47 @@ func TestCHDSerialization_empty(t *testing.T) {
 	assert.Equal(t, n.values, m.values)
 }
 
+func TestEmptyTable(t *testing.T) {
+	c, err := Builder().Build()
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+	mapped, err := Mmap(b)
+	require.NoError(t, err)
+	read, err := Read(bytes.NewReader(b))
+	require.NoError(t, err)
+	raw, err := OpenRaw(b)
+	require.NoError(t, err)
+
+	// A bucket assigned to a hash function, while there are no slots for it
+	// to pick from.
+	assigned := append([]byte(nil), b...)
+	h, err := mmapHeader(assigned)
+	require.NoError(t, err)
+	s, _ := h.section(sectionIndices)
+	assigned[s.offset], assigned[s.offset+1] = 0, 0
+	crafted, err := Mmap(assigned)
+	require.NoError(t, err)
+	require.Equal(t, uint16(0), crafted.indices[0])
+
+	for _, c := range []*CHD{c, mapped, read, crafted} {
+		assert.Equal(t, 0, c.Len())
+		assert.Nil(t, c.Iterate())
+		for _, k := range words[:100] {
+			assert.Equal(t, uint64(math.MaxUint64), c.Get(k))
+			_, ok := c.GetOK(k)
+			assert.False(t, ok)
+			assert.False(t, c.Contains(k))
+		}
+		dst := make([]uint64, 100)
+		assert.Zero(t, c.GetBatch(words[:100], dst))
+		assert.Zero(t, c.GetBatchSorted(words[:100], dst))
+		assert.Equal(t, uint64(math.MaxUint64), dst[0])
+	}
+	assert.False(t, raw.Contains(words[0]))
+}
+
 func TestCHDSerialization_one(t *testing.T) {
 	cb := Builder()
 	cb.Add(13, 37)
@@ -95,10 +590,77 @@ func TestCHDSerialization_one(t *testing.T) {
 
 	n, err := Mmap(w.Bytes())
 	assert.NoError(t, err)
-	assert.Equal(t, n.r, m.r)
-	assert.Equal(t, n.indices, m.indices)
+	assert.Empty(t, n.r)
+	assert.Empty(t, n.indices)
 	assert.Equal(t, n.keys, m.keys)
 	assert.Equal(t, n.values, m.values)
+	assert.Equal(t, uint64(37), n.Get(13))
+}
+
+func TestSmallTables(t *testing.T) {
+	for _, n := range []int{1, maxSmallTable - 1, maxSmallTable, maxSmallTable + 1} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := map[uint64]uint64{}
+			for i := 0; i < n; i++ {
+				m[uint64(i)*1000003+7] = uint64(i) * 10
+			}
+			c, err := FromMap(m)
+			require.NoError(t, err)
+			assert.Equal(t, n <= maxSmallTable, c.small)
+			if c.small {
+				assert.Empty(t, c.r)
+				assert.Empty(t, c.indices)
+				assert.True(t, sort.SliceIsSorted(c.keys, func(i, j int) bool { return c.keys[i] < c.keys[j] }))
+			}
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, c.small, fi.Flags&FlagSmall != 0)
+
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			s, v := writeSplit(t, c)
+			sl, err := MmapSplit(s, v)
+			require.NoError(t, err)
+			keys := make([]uint64, 0, n+1)
+			for _, g := range []*CHD{c, l, sl} {
+				assert.Equal(t, c.small, g.small)
+				for k, v := range m {
+					got, ok := g.GetOK(k)
+					assert.True(t, ok)
+					assert.Equal(t, v, got)
+					ti, ok := g.Slot(k)
+					assert.True(t, ok)
+					assert.Equal(t, k, g.keys[ti])
+					assert.True(t, g.Contains(k))
+					keys = append(keys, k)
+				}
+				assert.Equal(t, uint64(math.MaxUint64), g.Get(5))
+				assert.False(t, g.Contains(5))
+				assert.NoError(t, g.Verify())
+
+				dst := make([]uint64, len(keys)+1)
+				assert.Equal(t, len(keys), g.GetBatchSorted(append(keys, 5), dst))
+				for i, k := range keys {
+					assert.Equal(t, m[k], dst[i])
+				}
+				keys = keys[:0]
+			}
+		})
+	}
+
+	cb := Builder()
+	cb.Add(1, 2)
+	cb.Add(1, 3)
+	_, err := cb.Build()
+	assert.ErrorContains(t, err, "duplicate key 1")
+
+	// A small table is smaller than a hashed one with the same keys.
+	small, hashedTable := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData).Write(small))
+	require.NoError(t, MustFromMap(sampleData, hashed).Write(hashedTable))
+	assert.Less(t, small.Len(), hashedTable.Len())
 }
 
 func BenchmarkBuiltinMap(b *testing.B) {
@@ -126,3 +688,305 @@ func BenchmarkCHD(b *testing.B) {
 		h.Get(keys[i%len(keys)])
 	}
 }
+
+func TestCHDMapValues(t *testing.T) {
+	cb := Builder()
+	for k, v := range sampleData {
+		cb.Add(k, v)
+	}
+	m, err := cb.Build()
+	assert.NoError(t, err)
+	before := &bytes.Buffer{}
+	assert.NoError(t, m.Write(before))
+
+	n := m.MapValues(func(key, old uint64) uint64 {
+		return old ^ key
+	})
+	for k, v := range sampleData {
+		assert.Equal(t, v^k, n.Get(k))
+		assert.Equal(t, v, m.Get(k))
+	}
+
+	after := &bytes.Buffer{}
+	assert.NoError(t, n.Write(after))
+	// Everything but the values section must be unchanged.
+	valuesLen := 8 * len(m.values)
+	assert.Equal(t, before.Len(), after.Len())
+	assert.Equal(t, before.Bytes()[:before.Len()-valuesLen], after.Bytes()[:after.Len()-valuesLen])
+
+	o, err := Mmap(after.Bytes())
+	assert.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v^k, o.Get(k))
+	}
+}
+
+func TestIterateFrom(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[500+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(1000, 24), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash": {randomData(1000, 25), []BuildOption{WithPTHash(7, 0.99)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, tc.opts...)
+			require.NoError(t, err)
+			var keys, tokens []uint64
+			for it := c.Iterate(); it != nil; it = it.Next() {
+				keys = append(keys, it.Key())
+				tokens = append(tokens, it.Token())
+			}
+			require.Len(t, keys, len(tc.data))
+
+			// Resume in a table loaded from the file, as after a restart.
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			for _, i := range []int{0, 1, len(keys) / 2, len(keys) - 2} {
+				var rest []uint64
+				for it := l.IterateFrom(tokens[i]); it != nil; it = it.Next() {
+					rest = append(rest, it.Key())
+				}
+				assert.Equal(t, keys[i+1:], rest, "resuming after entry %d", i)
+			}
+			assert.Equal(t, keys[0], l.IterateFrom(0).Key())
+			// Resuming after the last entry, or with a token beyond the
+			// table, ends the iteration.
+			assert.Nil(t, l.IterateFrom(tokens[len(tokens)-1]))
+			assert.Nil(t, l.IterateFrom(1<<40))
+		})
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	c, err := FromMap(sampleData, WithSeed(1), WithRatio(1), hashed)
+	assert.NoError(t, err)
+	assert.Equal(t, len(sampleData), c.Len())
+	assert.Equal(t, len(sampleData), len(c.indices))
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+
+	d := MustFromMap(sampleData, WithSeed(1), WithRatio(1), hashed)
+	assert.Equal(t, c.r, d.r)
+	assert.Equal(t, c.keys, d.keys)
+
+	_, err = FromMap(sampleData, WithRatio(0))
+	assert.Error(t, err)
+	assert.Panics(t, func() { MustFromMap(sampleData, WithRatio(-1)) })
+}
+
+func TestCHDVerify(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	assert.NoError(t, c.Verify())
+	c.keys[0], c.keys[1] = c.keys[1], c.keys[0]
+	assert.Error(t, c.Verify())
+}
+
+func TestCHDGetBatch(t *testing.T) {
+	c := MustFromMap(sampleData)
+	keys := []uint64{5}
+	for k := range sampleData {
+		keys = append(keys, k)
+	}
+	dst := make([]uint64, len(keys))
+	assert.Equal(t, len(sampleData), c.GetBatch(keys, dst))
+	assert.Equal(t, uint64(math.MaxUint64), dst[0])
+	for i, k := range keys[1:] {
+		assert.Equal(t, sampleData[k], dst[i+1])
+	}
+	assert.Panics(t, func() { c.GetBatch(keys, dst[:1]) })
+	c.Prefault()
+}
+
+func TestCHDPrefault(t *testing.T) {
+	// Few distinct values are kept in a dictionary, without values.
+	rng := rand.New(rand.NewSource(48))
+	m := map[uint64]uint64{}
+	for len(m) < 1000 {
+		m[rng.Uint64()] = uint64(rng.Intn(5))
+	}
+	pb := NewPairBuilder()
+	for k, v := range m {
+		pb.Add2(k, v, v+1)
+	}
+	pairs, err := pb.Build(WithSeed(48))
+	require.NoError(t, err)
+	for name, c := range map[string]*CHD{
+		"dictionary": MustFromMap(m),
+		"pairs":      pairs,
+		"packed":     MustFromMap(m, WithSeed(48), WithPackedValues()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			mapped, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			read, err := Read(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			index, err := MmapWithOptions(w.Bytes(), SkipValues())
+			require.NoError(t, err)
+			for _, g := range []*CHD{c, mapped, read, c.Materialize(), index} {
+				g.Prefault()
+				k := firstKey(m)
+				assert.True(t, g.Contains(k))
+			}
+		})
+	}
+}
+
+func TestCHDSetValue(t *testing.T) {
+	c := MustFromMap(sampleData)
+	for k := range sampleData {
+		assert.NoError(t, c.SetValue(k, k^1))
+	}
+	for k := range sampleData {
+		assert.Equal(t, k^1, c.Get(k))
+	}
+	assert.ErrorIs(t, c.SetValue(5, 1), ErrKeyNotFound)
+
+	empty, err := Builder().Build()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, empty.SetValue(5, 1), ErrKeyNotFound)
+
+	assert.NoError(t, c.Close())
+	assert.ErrorIs(t, c.SetValue(5, 1), ErrClosed)
+}
+
+func TestReadWithLimit(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	assert.NoError(t, c.Write(w))
+	z := &bytes.Buffer{}
+	assert.NoError(t, c.WriteCompressed(z, -1))
+
+	limit := int64(w.Len())
+	if z.Len() > w.Len() {
+		limit = int64(z.Len())
+	}
+	for _, b := range [][]byte{w.Bytes(), z.Bytes()} {
+		g, err := ReadWithLimit(bytes.NewReader(b), limit)
+		if assert.NoError(t, err) {
+			assert.Equal(t, len(sampleData), g.Len())
+		}
+
+		_, err = ReadWithLimit(bytes.NewReader(b), int64(w.Len()-1))
+		assert.ErrorIs(t, err, ErrTooLarge)
+	}
+	_, err := ReadWithLimit(bytes.NewReader(w.Bytes()), -1)
+	assert.Error(t, err)
+}
+
+func TestRead_hostileLengths(t *testing.T) {
+	le := binary.LittleEndian
+	for name, b := range map[string][]byte{
+		"hash functions": le.AppendUint32(nil, math.MaxUint32),
+		"no buckets":     le.AppendUint32(le.AppendUint64(le.AppendUint32(nil, 1), 1), 0),
+		"indices":        le.AppendUint32(le.AppendUint64(le.AppendUint32(nil, 1), 1), math.MaxUint32),
+		"entries":        le.AppendUint32(le.AppendUint16(le.AppendUint32(le.AppendUint64(le.AppendUint32(nil, 1), 1), 1), 0), math.MaxUint32),
+		"v2 entries": func() []byte {
+			c := MustFromMap(sampleData)
+			w := &bytes.Buffer{}
+			assert.NoError(t, c.Write(w))
+			b := w.Bytes()
+			le.PutUint64(b[c.Spec().Keys.Offset-8:], math.MaxUint32)
+			return b
+		}(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(b))
+			assert.ErrorIs(t, err, ErrNotCHD)
+			_, err = Mmap(b)
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+}
+
+func TestNilCHD(t *testing.T) {
+	var c *CHD
+	assert.Equal(t, uint64(math.MaxUint64), c.Get(1))
+	_, ok := c.GetOK(1)
+	assert.False(t, ok)
+	_, ok = c.Slot(1)
+	assert.False(t, ok)
+	assert.False(t, c.Contains(1))
+	assert.Zero(t, c.Len())
+	assert.Nil(t, c.Iterate())
+	assert.Nil(t, c.IterateFrom(0))
+	dst := make([]uint64, 2)
+	assert.Zero(t, c.GetBatch([]uint64{1, 2}, dst))
+	assert.Zero(t, c.GetBatchSorted([]uint64{1, 2}, dst))
+	assert.Equal(t, []uint64{math.MaxUint64, math.MaxUint64}, dst)
+	assert.False(t, c.IndexOnly())
+	assert.False(t, c.HasFilter())
+	assert.False(t, c.Locked())
+	assert.Equal(t, 8, c.ValueWidth())
+	assert.Nil(t, c.Metadata())
+	assert.Nil(t, c.Dictionary())
+	assert.Nil(t, c.Hasher())
+	assert.Nil(t, c.HashFunctions())
+	assert.Nil(t, c.Indices())
+	assert.Nil(t, c.MapValues(func(k, v uint64) uint64 { return v }))
+	assert.Nil(t, c.Materialize())
+	assert.Zero(t, c.Stats())
+	assert.Zero(t, c.Info())
+	assert.Zero(t, c.Spec())
+	assert.Zero(t, c.MemoryFootprint())
+	assert.Equal(t, "CHD(nil)", fmt.Sprint(c))
+	assert.Equal(t, "(*uint64mph.CHD)(nil)", fmt.Sprintf("%#v", c))
+	c.Prefault()
+	assert.NoError(t, c.Verify())
+	assert.NoError(t, c.Sync())
+	assert.NoError(t, c.Unlock())
+	assert.NoError(t, c.Close())
+
+	w := &bytes.Buffer{}
+	assert.ErrorIs(t, c.Write(w), ErrNilTable)
+	assert.ErrorIs(t, c.WriteCompressed(w, 1), ErrNilTable)
+	assert.ErrorIs(t, c.WriteSplit(w, w), ErrNilTable)
+	_, err := c.WriteToAt(&offsetBuffer{})
+	assert.ErrorIs(t, err, ErrNilTable)
+	_, err = c.WritePairs(w)
+	assert.ErrorIs(t, err, ErrNilTable)
+	assert.ErrorIs(t, c.SetValue(1, 2), ErrNilTable)
+	assert.ErrorIs(t, c.SetMetadata([]byte("x")), ErrNilTable)
+	_, err = NewValueJournal(w, c)
+	assert.ErrorIs(t, err, ErrNilTable)
+	_, err = ApplyJournal(c, w)
+	assert.ErrorIs(t, err, ErrNilTable)
+	_, err = CompactJournal(c, w, w)
+	assert.ErrorIs(t, err, ErrNilTable)
+	assert.Zero(t, w.Len())
+}
+
+func TestNilArguments(t *testing.T) {
+	c := MustFromMap(sampleData)
+	assert.ErrorIs(t, c.Write(nil), ErrNilWriter)
+	assert.ErrorIs(t, c.WriteCompressed(nil, 1), ErrNilWriter)
+	assert.ErrorIs(t, c.WriteSplit(nil, nil), ErrNilWriter)
+	_, err := c.WriteToAt(nil)
+	assert.ErrorIs(t, err, ErrNilWriter)
+	_, err = c.WritePairs(nil)
+	assert.ErrorIs(t, err, ErrNilWriter)
+	_, err = NewValueJournal(nil, c)
+	assert.ErrorIs(t, err, ErrNilWriter)
+	_, err = ApplyJournal(c, nil)
+	assert.ErrorIs(t, err, ErrNilReader)
+
+	_, err = Read(nil)
+	assert.ErrorIs(t, err, ErrNilReader)
+	_, err = ReadWithLimit(nil, 100)
+	assert.ErrorIs(t, err, ErrNilReader)
+	_, err = ReadAt(nil)
+	assert.ErrorIs(t, err, ErrNilReader)
+	_, err = Mmap(nil)
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
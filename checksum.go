@@ -0,0 +1,82 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"unsafe"
+)
+
+// WithChecksum stores a CRC-32 (IEEE) of the file in it, so that Mmap and Read
+// reject files that were truncated and padded, partially written or otherwise
+// damaged, instead of returning a table that looks up garbage. Checking it
+// reads the whole file, which for a large mapped file means touching every
+// page, see SkipChecksum. ReadAt, which only reads the sections it needs, and
+// MmapSplit don't check it.
+//
+// Only Write, and WriteFile, support it. SetValue zeroes the checksum of a file
+// opened by OpenMmapFileRW, as it no longer matches. A zero checksum isn't
+// checked.
+func WithChecksum() WriteOption {
+	return func(o *writeOptions) {
+		o.checksum = true
+	}
+}
+
+// SkipChecksum loads a table without checking the checksum stored by
+// WithChecksum. The other checks of the file still apply.
+func SkipChecksum() LoadOption {
+	return func(o *loadOptions) {
+		o.skipChecksum = true
+	}
+}
+
+// checksum writes the checksum section, which must be the last one, holding
+// the checksum of everything written before it to h.
+func (e *encoder) checksum(h hash.Hash32) {
+	e.flush()
+	sum := h.Sum32()
+	e.section(sectionChecksum, 4, 1)
+	e.uint32(sum)
+	e.pad()
+}
+
+// verifyChecksum checks the checksum of the file b, if it has one and opts
+// don't skip it.
+func verifyChecksum(h header, b []byte, opts []LoadOption) error {
+	s, ok := h.section(sectionChecksum)
+	if !ok {
+		return nil
+	}
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	want := binary.LittleEndian.Uint32(b[s.offset:])
+	if o.skipChecksum || want == 0 {
+		return nil
+	}
+	if got := crc32.ChecksumIEEE(b[:s.offset-sectionHeaderSize]); got != want {
+		return fmt.Errorf("%w: stored checksum %08x doesn't match the file's %08x", ErrNotCHD, want, got)
+	}
+	return nil
+}
+
+// loadChecksum remembers the checksum section, if any, to zero it when a value
+// changes.
+func (c *CHD) loadChecksum(data func(tag uint32) []byte) {
+	c.checksumSection = data(sectionChecksum)
+}
+
+// dropChecksum zeroes the checksum in the buffer the table was loaded from, if
+// inPlace, as a value was changed in that buffer.
+func (c *CHD) dropChecksum(inPlace bool) {
+	if !inPlace {
+		return
+	}
+	if s := c.checksumSection; s != nil && c.aliases(unsafe.Pointer(&s[0])) {
+		clear(s)
+	}
+	c.checksumSection = nil
+}
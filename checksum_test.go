@@ -0,0 +1,93 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithChecksum(t *testing.T) {
+	m := randomData(500, 100)
+	c := MustFromMap(m, WithSeed(100), WithFilter())
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Zero(t, fi.Flags&FlagChecksum)
+	plain := w.Len()
+
+	w.Reset()
+	require.NoError(t, c.Write(w, WithChecksum(), WithDigest()))
+	b := w.Bytes()
+	fi, err = Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagChecksum)
+	assert.Equal(t, int64(len(b)), fi.Size)
+	assert.Equal(t, plain+48+24, len(b))
+
+	for _, load := range []func([]byte, ...LoadOption) (*CHD, error){
+		MmapWithOptions,
+		func(b []byte, opts ...LoadOption) (*CHD, error) { return ReadWithOptions(bytes.NewReader(b), opts...) },
+	} {
+		g, err := load(b)
+		require.NoError(t, err)
+		for k, v := range m {
+			assert.Equal(t, v, g.Get(k))
+		}
+		assert.NoError(t, g.Verify())
+	}
+
+	// A damaged value is caught by the checksum, but not by the other checks.
+	corrupt := append([]byte(nil), b...)
+	corrupt[c.Spec().Values.Offset+5]++
+	_, err = Mmap(corrupt)
+	assert.ErrorIs(t, err, ErrNotCHD)
+	assert.ErrorContains(t, err, "checksum")
+	_, err = Read(bytes.NewReader(corrupt))
+	assert.ErrorContains(t, err, "checksum")
+	for _, opts := range [][]LoadOption{{SkipChecksum()}, {SkipChecksum(), SkipValues()}} {
+		_, err = MmapWithOptions(corrupt, opts...)
+		assert.NoError(t, err)
+	}
+	_, err = ReadAt(bytes.NewReader(corrupt))
+	assert.NoError(t, err)
+
+	// The checksum must come last.
+	h, err := mmapHeader(b)
+	require.NoError(t, err)
+	n := len(h.sections)
+	h.sections[n-1], h.sections[n-2] = h.sections[n-2], h.sections[n-1]
+	assert.ErrorContains(t, h.check(), "not the last one")
+	h.flags &^= FlagChecksum
+	assert.ErrorContains(t, h.check(), "checksum flag doesn't match")
+}
+
+func TestWithChecksum_mmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	m := randomData(200, 101)
+	c := MustFromMap(m, WithSeed(101))
+	path := filepath.Join(t.TempDir(), "table.idx")
+	require.NoError(t, c.WriteFile(path, WithChecksum()))
+
+	rw, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	k := firstKey(m)
+	require.NoError(t, rw.SetValue(k, m[k]+1))
+	require.NoError(t, rw.Close())
+
+	// The stale checksum is zeroed in the file, so it loads.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	fi, err := Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagChecksum)
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	assert.Equal(t, m[k]+1, g.Get(k))
+}
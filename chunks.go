@@ -0,0 +1,489 @@
+package uint64mph
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// ChunkManifestName is the name of the manifest WriteChunks writes.
+const ChunkManifestName = "CHUNKS"
+
+// ErrBadChunk is returned, wrapped in a ChunkError, for chunks that are
+// missing, have the wrong size or don't match their hash.
+var ErrBadChunk = errors.New("uint64mph: bad chunk")
+
+// ChunkError names a chunk that needs to be fetched again.
+type ChunkError struct {
+	// Index is the number of the chunk, counting from 0.
+	Index int
+	Path  string
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d (%s): %v", e.Index, e.Path, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// BadChunks returns the indices of the chunks err names, as returned by
+// VerifyChunks, AssembleChunks and OpenChunked.
+func BadChunks(err error) []int {
+	var errs []error
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = j.Unwrap()
+	} else if err != nil {
+		errs = []error{err}
+	}
+	var bad []int
+	for _, err := range errs {
+		var ce *ChunkError
+		if errors.As(err, &ce) {
+			bad = append(bad, ce.Index)
+		}
+	}
+	return bad
+}
+
+// ChunkManifest describes a table split into chunks by WriteChunks.
+type ChunkManifest struct {
+	// FormatVersion is the format version of the table, see Info.Version.
+	FormatVersion int
+	// Size is the size of the table, the sum of the sizes of the chunks.
+	Size int64
+	// ChunkSize is the size of every chunk but the last, which can be
+	// smaller.
+	ChunkSize int64
+	Chunks    []Chunk
+}
+
+// Chunk is a part of a table split into chunks.
+type Chunk struct {
+	Path   string
+	Size   int64
+	SHA256 [sha256.Size]byte
+}
+
+// WriteChunks writes c as Write would to files of chunkSize bytes in dir,
+// which must exist, and a manifest listing them named ChunkManifestName.
+// Together they can be fetched one by one, and checked and put back together
+// by AssembleChunks or OpenChunked. The manifest is written last, so a
+// directory with a manifest is complete.
+func (c *CHD) WriteChunks(dir string, chunkSize int64, opts ...WriteOption) error {
+	if err := c.checkWritable(true); err != nil {
+		return err
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	w := &chunkWriter{dir: dir, chunkSize: chunkSize}
+	err := c.Write(w, opts...)
+	if w.err != nil {
+		err = w.err
+	}
+	if err == nil {
+		err = w.finish()
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	return w.m.write(dir, c.writeVersion(), chunkSize)
+}
+
+// chunkWriter writes to a series of chunk files, hashing them as it goes.
+type chunkWriter struct {
+	dir       string
+	chunkSize int64
+	f         *os.File
+	h         hash.Hash
+	n         int64
+	m         ChunkManifest
+	// The first error writing a chunk, which WriteChunks returns rather than
+	// what the encoder made of it.
+	err error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 && w.err == nil {
+		if w.f == nil {
+			w.f, w.err = os.CreateTemp(w.dir, fmt.Sprintf("chunk-%05d.tmp-*", len(w.m.Chunks)))
+			if w.err != nil {
+				break
+			}
+			w.h = sha256.New()
+			w.n = 0
+		}
+		b := p
+		if int64(len(b)) > w.chunkSize-w.n {
+			b = b[:w.chunkSize-w.n]
+		}
+		if _, w.err = w.f.Write(b); w.err != nil {
+			break
+		}
+		w.h.Write(b)
+		w.n += int64(len(b))
+		p = p[len(b):]
+		if w.n == w.chunkSize {
+			w.err = w.finish()
+		}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return written, nil
+}
+
+// finish completes the current chunk, if any.
+func (w *chunkWriter) finish() error {
+	if w.f == nil {
+		return nil
+	}
+	f := w.f
+	w.f = nil
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	name := fmt.Sprintf("chunk-%05d", len(w.m.Chunks))
+	if err := os.Rename(f.Name(), filepath.Join(w.dir, name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	ch := Chunk{Path: name, Size: w.n}
+	w.h.Sum(ch.SHA256[:0])
+	w.m.Chunks = append(w.m.Chunks, ch)
+	w.m.Size += w.n
+	return nil
+}
+
+// abort removes the chunk being written. Completed chunks are left, they're
+// replaced by the next attempt.
+func (w *chunkWriter) abort() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}
+}
+
+// write writes the manifest to dir, see ReadChunkManifest.
+func (m ChunkManifest) write(dir string, version int, chunkSize int64) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "format %d\nsize %d\nchunk-size %d\n", version, m.Size, chunkSize)
+	b.WriteString("# id path size sha256\n")
+	for i, ch := range m.Chunks {
+		fmt.Fprintf(&b, "%d %s %d %x\n", i, ch.Path, ch.Size, ch.SHA256)
+	}
+	f, err := os.CreateTemp(dir, ChunkManifestName+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, ChunkManifestName)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// ReadChunkManifest reads a manifest written by WriteChunks. It starts with the
+// format version of the table, its size and the size of the chunks, followed by
+// a line for every chunk holding its id, path, size and SHA-256 hash:
+//
+//	format 3
+//	size 10000
+//	chunk-size 4096
+//	# id path size sha256
+//	0 chunk-00000 4096 9f86d081884c7d65...
+//	1 chunk-00001 4096 60303ae22b998861...
+//	2 chunk-00002 1808 fd61a03af4f77d87...
+//
+// Blank lines and lines starting with # are ignored. Ids must be 0 up to the
+// number of chunks, in any order. Relative paths are relative to the directory
+// of the manifest.
+func ReadChunkManifest(path string) (ChunkManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ChunkManifest{}, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(path)
+	var m ChunkManifest
+	byID := map[int]Chunk{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		var err error
+		switch fields[0] {
+		case "format":
+			if len(fields) != 2 {
+				err = fmt.Errorf("want \"format version\", got %q", text)
+			} else if m.FormatVersion, err = strconv.Atoi(fields[1]); err != nil || m.FormatVersion < legacyFormatVersion || m.FormatVersion > formatVersion {
+				err = fmt.Errorf("%w: unsupported format version %q", ErrNotCHD, fields[1])
+			}
+		case "size", "chunk-size":
+			var n int64
+			if len(fields) != 2 {
+				err = fmt.Errorf("want \"%s bytes\", got %q", fields[0], text)
+			} else if n, err = strconv.ParseInt(fields[1], 10, 64); err != nil || n < 0 {
+				err = fmt.Errorf("invalid %s %q", fields[0], fields[1])
+			} else if fields[0] == "size" {
+				m.Size = n
+			} else {
+				m.ChunkSize = n
+			}
+		default:
+			var ch Chunk
+			var id int
+			ch, id, err = parseChunkLine(fields, text)
+			if err == nil {
+				if _, dup := byID[id]; dup {
+					err = fmt.Errorf("chunk %d is listed twice", id)
+				}
+			}
+			if !filepath.IsAbs(ch.Path) {
+				ch.Path = filepath.Join(dir, ch.Path)
+			}
+			byID[id] = ch
+		}
+		if err != nil {
+			return ChunkManifest{}, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return ChunkManifest{}, err
+	}
+	if m.FormatVersion == 0 || m.ChunkSize == 0 {
+		return ChunkManifest{}, fmt.Errorf("%s: format and chunk-size are required", path)
+	}
+	m.Chunks = make([]Chunk, len(byID))
+	for id, ch := range byID {
+		if id >= len(m.Chunks) {
+			return ChunkManifest{}, fmt.Errorf("%s: chunk %d is listed, but only %d chunks are", path, id, len(m.Chunks))
+		}
+		m.Chunks[id] = ch
+	}
+	var total int64
+	for i, ch := range m.Chunks {
+		if ch.Size > m.ChunkSize || (ch.Size != m.ChunkSize && i != len(m.Chunks)-1) {
+			return ChunkManifest{}, fmt.Errorf("%s: chunk %d is %d bytes, chunks are %d", path, i, ch.Size, m.ChunkSize)
+		}
+		total += ch.Size
+	}
+	if total != m.Size {
+		return ChunkManifest{}, fmt.Errorf("%s: chunks add up to %d bytes, the table is %d", path, total, m.Size)
+	}
+	return m, nil
+}
+
+// parseChunkLine parses the line of a chunk in a manifest, see
+// ReadChunkManifest.
+func parseChunkLine(fields []string, text string) (Chunk, int, error) {
+	if len(fields) != 4 {
+		return Chunk{}, 0, fmt.Errorf("want \"id path size sha256\", got %q", text)
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil || id < 0 {
+		return Chunk{}, 0, fmt.Errorf("invalid chunk id %q", fields[0])
+	}
+	ch := Chunk{Path: fields[1]}
+	if ch.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil || ch.Size <= 0 {
+		return Chunk{}, 0, fmt.Errorf("invalid size %q", fields[2])
+	}
+	if n, err := hex.Decode(ch.SHA256[:], []byte(fields[3])); err != nil || n != sha256.Size || len(fields[3]) != 2*sha256.Size {
+		return Chunk{}, 0, fmt.Errorf("invalid sha256 %q", fields[3])
+	}
+	return ch, id, nil
+}
+
+// copyChunks copies the chunks of m to w, checking their sizes and hashes. It
+// checks every chunk, also after finding a bad one, and returns a ChunkError
+// for each of them joined together. Nothing more is written to w after a bad
+// chunk.
+func (m ChunkManifest) copyChunks(w io.Writer) error {
+	var bad []error
+	var werr error
+	for i, ch := range m.Chunks {
+		dst := w
+		if len(bad) > 0 || werr != nil {
+			dst = io.Discard
+		}
+		err := ch.copyTo(dst, &werr)
+		if err != nil {
+			bad = append(bad, &ChunkError{Index: i, Path: ch.Path, Err: err})
+		}
+	}
+	if len(bad) > 0 {
+		return errors.Join(bad...)
+	}
+	return werr
+}
+
+// copyTo copies the chunk to w and checks it. Errors writing to w are stored
+// in *werr, so they aren't blamed on the chunk.
+func (ch Chunk) copyTo(w io.Writer, werr *error) error {
+	f, err := os.Open(ch.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: missing", ErrBadChunk)
+		}
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(h, &errWriter{w, werr}), io.LimitReader(f, ch.Size+1))
+	if *werr != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n != ch.Size {
+		return fmt.Errorf("%w: %d bytes, want %d", ErrBadChunk, n, ch.Size)
+	}
+	if !bytes.Equal(h.Sum(nil), ch.SHA256[:]) {
+		return fmt.Errorf("%w: SHA-256 mismatch", ErrBadChunk)
+	}
+	return nil
+}
+
+// errWriter stores the error of w in *err and pretends to have succeeded, so
+// that the error isn't mistaken for one reading the source of a copy.
+type errWriter struct {
+	w   io.Writer
+	err *error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if *w.err == nil {
+		_, *w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// VerifyChunks checks the chunks in dir against the manifest written by
+// WriteChunks. For chunks that are missing, have the wrong size or don't match
+// their hash, it returns a ChunkError each, joined together. Use BadChunks to
+// get their indices.
+func VerifyChunks(dir string) (ChunkManifest, error) {
+	m, err := ReadChunkManifest(filepath.Join(dir, ChunkManifestName))
+	if err != nil {
+		return ChunkManifest{}, err
+	}
+	return m, m.copyChunks(io.Discard)
+}
+
+// AssembleChunks checks the chunks in dir, see VerifyChunks, and concatenates
+// them into the file path, which is replaced atomically. It leaves path
+// untouched if any chunk is bad.
+func AssembleChunks(dir, path string) error {
+	m, err := ReadChunkManifest(filepath.Join(dir, ChunkManifestName))
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := assembleFile(f, m); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// assembleFile copies the chunks of m to f, syncs and closes it.
+func assembleFile(f *os.File, m ChunkManifest) error {
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	if err := m.copyChunks(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// OpenChunked checks the chunks in dir, see VerifyChunks, and reads them into
+// memory as a single table, without writing them to a file first.
+func OpenChunked(dir string, opts ...LoadOption) (*CHD, error) {
+	m, err := ReadChunkManifest(filepath.Join(dir, ChunkManifestName))
+	if err != nil {
+		return nil, err
+	}
+	if int64(int(m.Size)) != m.Size {
+		return nil, fmt.Errorf("%w: %d bytes don't fit in memory", ErrNotCHD, m.Size)
+	}
+	// Allocate words so the buffer is aligned for aliasing.
+	words := make([]uint64, (m.Size+7)/8)
+	var b []byte
+	if len(words) > 0 {
+		b = unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), m.Size)
+	}
+	if err := m.copyChunks(&sliceWriter{b: b}); err != nil {
+		return nil, err
+	}
+	return loadOwned(b, opts)
+}
+
+// sliceWriter writes into b, failing when it's full.
+type sliceWriter struct {
+	b []byte
+	n int
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	if len(p) > len(w.b)-w.n {
+		return 0, io.ErrShortWrite
+	}
+	w.n += copy(w.b[w.n:], p)
+	return len(p), nil
+}
@@ -0,0 +1,118 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteChunks(t *testing.T) {
+	m := randomData(3000, 24)
+	c, err := FromMap(m, WithFilter())
+	require.NoError(t, err)
+	attachColumns(t, c)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	dir := t.TempDir()
+	require.NoError(t, c.WriteChunks(dir, 4096))
+	manifest, err := VerifyChunks(dir)
+	require.NoError(t, err)
+	assert.Equal(t, formatVersion, manifest.FormatVersion)
+	assert.Equal(t, int64(w.Len()), manifest.Size)
+	assert.Equal(t, int64(4096), manifest.ChunkSize)
+	assert.Len(t, manifest.Chunks, (w.Len()+4095)/4096)
+	assert.Equal(t, filepath.Join(dir, "chunk-00001"), manifest.Chunks[1].Path)
+
+	loaded, err := OpenChunked(dir)
+	require.NoError(t, err)
+	assertSameTable(t, c, loaded)
+	assert.Equal(t, []string{"double", "neg"}, loaded.Columns())
+
+	path := filepath.Join(t.TempDir(), "table.chd")
+	require.NoError(t, AssembleChunks(dir, path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, w.Bytes(), b)
+
+	// Writing again replaces the chunks and leaves no temporary files.
+	require.NoError(t, c.WriteChunks(dir, 1<<20))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), ".tmp-")
+	}
+	loaded, err = OpenChunked(dir)
+	require.NoError(t, err)
+	assertSameTable(t, c, loaded)
+}
+
+func TestWriteChunks_bad(t *testing.T) {
+	c := MustFromMap(randomData(3000, 25))
+	dir := t.TempDir()
+	require.NoError(t, c.WriteChunks(dir, 1024))
+	manifest, err := VerifyChunks(dir)
+	require.NoError(t, err)
+	require.Greater(t, len(manifest.Chunks), 5)
+
+	// A partial download, a corrupt chunk and a missing one.
+	require.NoError(t, os.Truncate(manifest.Chunks[1].Path, 100))
+	b, err := os.ReadFile(manifest.Chunks[3].Path)
+	require.NoError(t, err)
+	b[10] ^= 1
+	require.NoError(t, os.WriteFile(manifest.Chunks[3].Path, b, 0o644))
+	require.NoError(t, os.Remove(manifest.Chunks[4].Path))
+
+	_, err = VerifyChunks(dir)
+	assert.ErrorIs(t, err, ErrBadChunk)
+	assert.Equal(t, []int{1, 3, 4}, BadChunks(err))
+	assert.ErrorContains(t, err, "chunk 1 ("+manifest.Chunks[1].Path+"): uint64mph: bad chunk: 100 bytes, want 1024")
+	assert.ErrorContains(t, err, "chunk 3 ("+manifest.Chunks[3].Path+"): uint64mph: bad chunk: SHA-256 mismatch")
+	assert.ErrorContains(t, err, "chunk 4 ("+manifest.Chunks[4].Path+"): uint64mph: bad chunk: missing")
+
+	_, err = OpenChunked(dir)
+	assert.Equal(t, []int{1, 3, 4}, BadChunks(err))
+	path := filepath.Join(t.TempDir(), "table.chd")
+	err = AssembleChunks(dir, path)
+	assert.Equal(t, []int{1, 3, 4}, BadChunks(err))
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// A chunk that's too long is bad too.
+	require.NoError(t, os.WriteFile(manifest.Chunks[4].Path, make([]byte, 2000), 0o644))
+	_, err = VerifyChunks(dir)
+	assert.Equal(t, []int{1, 3, 4}, BadChunks(err))
+	assert.ErrorContains(t, err, "1025 bytes, want 1024")
+}
+
+func TestReadChunkManifest_errors(t *testing.T) {
+	const hash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for name, tc := range map[string]struct {
+		manifest, err string
+	}{
+		"no format":       {"chunk-size 10\nsize 0\n", "format and chunk-size are required"},
+		"future format":   {"format 99\nchunk-size 10\n", "unsupported format version \"99\""},
+		"bad size":        {"format 3\nsize x\n", "invalid size \"x\""},
+		"bad line":        {"format 3\n0 chunk-00000 10\n", "want \"id path size sha256\""},
+		"bad hash":        {"format 3\n0 chunk-00000 10 abc\n", "invalid sha256 \"abc\""},
+		"duplicate":       {"format 3\nchunk-size 10\n0 a 10 " + hash + "\n0 b 10 " + hash + "\n", ":4: chunk 0 is listed twice"},
+		"gap":             {"format 3\nchunk-size 10\nsize 10\n1 a 10 " + hash + "\n", "chunk 1 is listed, but only 1 chunks are"},
+		"short chunk":     {"format 3\nchunk-size 10\nsize 15\n0 a 5 " + hash + "\n1 b 10 " + hash + "\n", "chunk 0 is 5 bytes, chunks are 10"},
+		"size mismatch":   {"format 3\nchunk-size 10\nsize 30\n0 a 10 " + hash + "\n1 b 5 " + hash + "\n", "chunks add up to 15 bytes, the table is 30"},
+		"bad chunk size":  {"format 3\nchunk-size -1\n", "invalid chunk-size \"-1\""},
+		"bad chunk field": {"format 3\nchunk-size 10 20\n", "want \"chunk-size bytes\""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ChunkManifestName)
+			require.NoError(t, os.WriteFile(path, []byte(tc.manifest), 0o644))
+			_, err := ReadChunkManifest(path)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	assert.ErrorContains(t, MustFromMap(sampleData).WriteChunks(t.TempDir(), 0), "invalid chunk size 0")
+}
@@ -0,0 +1,323 @@
+// Command uint64mph builds and inspects uint64mph hash table files.
+//
+// Usage:
+//
+//	uint64mph build [-seed N] [-ratio R] [-format csv|pairs] INPUT OUTPUT
+//	uint64mph inspect FILE
+//	uint64mph get KEY FILE
+//	uint64mph dump FILE
+//	uint64mph verify [-pairs PAIRS] FILE
+//
+// The csv input format has one "key,value" pair per line. The pairs format is a
+// flat sequence of little endian uint64 (key, value) pairs. For tables with two
+// values per key, built with uint64mph.PairBuilder, get prints "v1,v2" and dump
+// prints "key,v1,v2" lines.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Jille/uint64mph"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+const usage = `usage:
+  uint64mph build [-seed N] [-ratio R] [-format csv|pairs] INPUT OUTPUT
+  uint64mph inspect FILE
+  uint64mph get KEY FILE
+  uint64mph dump FILE
+  uint64mph verify [-pairs PAIRS] FILE
+`
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "build":
+		err = build(args[1:], stderr)
+	case "inspect":
+		err = inspect(args[1:], stdout, stderr)
+	case "get":
+		err = get(args[1:], stdout, stderr)
+	case "dump":
+		err = dump(args[1:], stdout, stderr)
+	case "verify":
+		err = verify(args[1:], stdout, stderr)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 2
+		}
+		fmt.Fprintf(stderr, "uint64mph: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+	}
+	return fs
+}
+
+func build(args []string, stderr io.Writer) error {
+	fs := newFlagSet("build", stderr)
+	seed := fs.Int64("seed", 0, "seed for the RNG, making the build reproducible")
+	ratio := fs.Float64("ratio", 2, "average number of keys per bucket")
+	format := fs.String("format", "csv", "format of the input file: csv or pairs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	b := uint64mph.Builder()
+	switch *format {
+	case "csv":
+		err = readCSV(in, b)
+	case "pairs":
+		err = b.AddFromReader(in)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+	opts := []uint64mph.BuildOption{uint64mph.WithRatio(*ratio)}
+	if isFlagSet(fs, "seed") {
+		opts = append(opts, uint64mph.WithSeed(*seed))
+	}
+	c, err := b.Build(opts...)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(out)
+	if err := c.Write(bw); err != nil {
+		out.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func readCSV(r io.Reader, b *uint64mph.CHDBuilder) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		ks, vs, ok := strings.Cut(l, ",")
+		if !ok {
+			return fmt.Errorf("line %d: expected key,value", line)
+		}
+		k, err := strconv.ParseUint(strings.TrimSpace(ks), 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(vs), 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		b.Add(k, v)
+	}
+	return s.Err()
+}
+
+func load(path string) (*uint64mph.CHD, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := uint64mph.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func loadOne(fs *flag.FlagSet, args []string) (*uint64mph.CHD, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, flag.ErrHelp
+	}
+	return load(fs.Arg(0))
+}
+
+func inspect(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("inspect", stderr)
+	c, err := loadOne(fs, args)
+	if err != nil {
+		return err
+	}
+	fi, err := uint64mph.StatFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "format version:  %d\n", fi.Version)
+	fmt.Fprintf(stdout, "flags:           %#x\n", fi.Flags)
+	fmt.Fprintf(stdout, "file size:       %d\n", fi.Size)
+	s := c.Stats()
+	fmt.Fprintf(stdout, "entries:         %d\n", s.Entries)
+	fmt.Fprintf(stdout, "buckets:         %d (%d empty)\n", s.Buckets, s.EmptyBuckets)
+	fmt.Fprintf(stdout, "hash functions:  %d\n", s.HashFunctions)
+	fmt.Fprintf(stdout, "r bytes:         %d\n", s.HashFunctionBytes)
+	fmt.Fprintf(stdout, "indices bytes:   %d\n", s.IndicesBytes)
+	fmt.Fprintf(stdout, "keys bytes:      %d\n", s.KeysBytes)
+	fmt.Fprintf(stdout, "values bytes:    %d\n", s.ValuesBytes)
+	fmt.Fprintf(stdout, "total bytes:     %d\n", s.TotalBytes())
+	if md := c.Metadata(); md != nil {
+		if utf8.Valid(md) {
+			fmt.Fprintf(stdout, "metadata:        %q\n", md)
+		} else {
+			fmt.Fprintf(stdout, "metadata:        %d bytes of binary data\n", len(md))
+		}
+	}
+	return nil
+}
+
+func get(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("get", stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	key, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return err
+	}
+	c, err := load(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if c.PairValues() {
+		v1, v2, ok := c.Get2(key)
+		if !ok {
+			return fmt.Errorf("key %d not found", key)
+		}
+		fmt.Fprintf(stdout, "%d,%d\n", v1, v2)
+		return nil
+	}
+	v, ok := c.GetOK(key)
+	if !ok {
+		return fmt.Errorf("key %d not found", key)
+	}
+	fmt.Fprintf(stdout, "%d\n", v)
+	return nil
+}
+
+func dump(args []string, stdout, stderr io.Writer) error {
+	c, err := loadOne(newFlagSet("dump", stderr), args)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(stdout)
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		if c.PairValues() {
+			k, v1, v2 := it.Get2()
+			fmt.Fprintf(bw, "%d,%d,%d\n", k, v1, v2)
+			continue
+		}
+		k, v := it.Get()
+		fmt.Fprintf(bw, "%d,%d\n", k, v)
+	}
+	return bw.Flush()
+}
+
+func verify(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("verify", stderr)
+	pairs := fs.String("pairs", "", "file with the expected entries in the pairs format")
+	c, err := loadOne(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := c.Verify(); err != nil {
+		return err
+	}
+	if *pairs != "" {
+		if err := verifyPairs(fs.Arg(0), *pairs, stdout); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "OK: %d entries\n", c.Len())
+	return nil
+}
+
+// verifyPairs checks that the table in path contains exactly the entries in the
+// pairs file.
+func verifyPairs(path, pairs string, stdout io.Writer) error {
+	tf, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+	pf, err := os.Open(pairs)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	rep, err := uint64mph.StreamVerify(tf, pf)
+	if err != nil {
+		return err
+	}
+	if rep.OK() {
+		return nil
+	}
+	for _, f := range rep.Failures {
+		if f.Found {
+			fmt.Fprintf(stdout, "key %d: want %d, got %d\n", f.Key, f.Want, f.Got)
+		} else {
+			fmt.Fprintf(stdout, "key %d: want %d, missing\n", f.Key, f.Want)
+		}
+	}
+	return fmt.Errorf("%d pairs, %d entries, %d missing, %d mismatched", rep.Pairs, rep.Entries, rep.Missing, rep.Mismatched)
+}
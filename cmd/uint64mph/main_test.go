@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Jille/uint64mph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestBuildCSV(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.csv")
+	out := filepath.Join(dir, "out.idx")
+	require.NoError(t, os.WriteFile(in, []byte("1,10\n2, 20\n\n3,30\n18446744073709551615,0\n"), 0644))
+
+	code, _, stderr := runCmd(t, "build", "-seed", "1", "-ratio", "1", in, out)
+	require.Equal(t, 0, code, stderr)
+
+	code, stdout, _ := runCmd(t, "get", "2", out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "20\n", stdout)
+
+	code, _, stderr = runCmd(t, "get", "4", out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not found")
+
+	code, stdout, _ = runCmd(t, "dump", out)
+	assert.Equal(t, 0, code)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"1,10", "18446744073709551615,0", "2,20", "3,30"}, lines)
+
+	code, stdout, _ = runCmd(t, "inspect", out)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "format version:  3\n")
+	assert.Contains(t, stdout, "flags:           0x40\n")
+	assert.Contains(t, stdout, "entries:         4\n")
+
+	code, stdout, _ = runCmd(t, "verify", out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "OK: 4 entries\n", stdout)
+}
+
+func TestPairValues(t *testing.T) {
+	b := uint64mph.NewPairBuilder()
+	b.Add2(1, 10, 11)
+	b.Add2(2, 20, 21)
+	c, err := b.Build(uint64mph.WithSeed(1))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "pairs.idx")
+	require.NoError(t, c.WriteFile(path))
+
+	code, stdout, stderr := runCmd(t, "get", "2", path)
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "20,21\n", stdout)
+
+	code, _, stderr = runCmd(t, "get", "3", path)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not found")
+
+	code, stdout, stderr = runCmd(t, "dump", path)
+	require.Equal(t, 0, code, stderr)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"1,10,11", "2,20,21"}, lines)
+}
+
+func TestBuildPairs(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.bin")
+	out := filepath.Join(dir, "out.idx")
+	var buf []byte
+	for i := uint64(0); i < 1000; i++ {
+		buf = binary.LittleEndian.AppendUint64(buf, i*3)
+		buf = binary.LittleEndian.AppendUint64(buf, i)
+	}
+	require.NoError(t, os.WriteFile(in, buf, 0644))
+
+	code, _, stderr := runCmd(t, "build", "-format", "pairs", in, out)
+	require.Equal(t, 0, code, stderr)
+	code, stdout, _ := runCmd(t, "get", "2997", out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "999\n", stdout)
+
+	code, stdout, _ = runCmd(t, "verify", "-pairs", in, out)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "OK: 1000 entries\n", stdout)
+	wrong := filepath.Join(dir, "wrong.bin")
+	require.NoError(t, os.WriteFile(wrong, append(binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, 3), 2), buf[32:]...), 0644))
+	code, stdout, stderr = runCmd(t, "verify", "-pairs", wrong, out)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "key 3: want 2, got 1\n", stdout)
+	assert.Contains(t, stderr, "999 pairs, 1000 entries, 0 missing, 1 mismatched")
+
+	require.NoError(t, os.WriteFile(in, buf[:17], 0644))
+	code, _, stderr = runCmd(t, "build", "-format", "pairs", in, out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not a multiple of 16 bytes")
+}
+
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.csv")
+	out := filepath.Join(dir, "out.idx")
+
+	code, _, _ := runCmd(t)
+	assert.Equal(t, 2, code)
+	code, _, stderr := runCmd(t, "frobnicate")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unknown command")
+	code, _, _ = runCmd(t, "inspect")
+	assert.Equal(t, 2, code)
+
+	require.NoError(t, os.WriteFile(in, []byte("1,10\n1,20\n"), 0644))
+	code, _, stderr = runCmd(t, "build", in, out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "duplicate key 1")
+
+	require.NoError(t, os.WriteFile(in, []byte("1;10\n"), 0644))
+	code, _, stderr = runCmd(t, "build", in, out)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "line 1")
+
+	code, _, _ = runCmd(t, "verify", filepath.Join(dir, "missing"))
+	assert.Equal(t, 1, code)
+}
+
+func TestInspectMetadata(t *testing.T) {
+	dir := t.TempDir()
+	for name, md := range map[string][]byte{
+		"text":   []byte("snapshot 1234"),
+		"binary": {0xff, 0xfe, 0},
+	} {
+		c := uint64mph.MustFromMap(map[uint64]uint64{1: 2})
+		require.NoError(t, c.SetMetadata(md))
+		path := filepath.Join(dir, name+".idx")
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		require.NoError(t, c.Write(f))
+		require.NoError(t, f.Close())
+
+		code, stdout, _ := runCmd(t, "inspect", path)
+		assert.Equal(t, 0, code)
+		if name == "text" {
+			assert.Contains(t, stdout, "metadata:        \"snapshot 1234\"\n")
+		} else {
+			assert.Contains(t, stdout, "metadata:        3 bytes of binary data\n")
+		}
+	}
+}
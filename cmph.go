@@ -0,0 +1,44 @@
+package uint64mph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Algorithm names as written by cmph's cmph_dump.
+var cmphAlgorithms = map[string]bool{
+	"bmz": true, "bmz8": true, "chm": true, "brz": true, "fch": true,
+	"bdz": true, "bdz_ph": true, "chd_ph": true, "chd": true,
+}
+
+// CMPHHeader is the header of a file written by cmph's cmph_dump.
+type CMPHHeader struct {
+	// Name of the algorithm, e.g. "chd" or "chd_ph".
+	Algorithm string
+	// Number of keys the hash function was built for.
+	Size uint32
+}
+
+// ReadCMPHHeader reads the header of a file written by cmph's cmph_dump, to
+// identify such files. They can't be loaded as a CHD: cmph only stores the hash
+// function, which maps keys to a slot number, not the keys or any values, so
+// there is nothing to translate. Rebuild the table from the original keys with
+// Builder instead.
+func ReadCMPHHeader(r io.Reader) (CMPHHeader, error) {
+	br := bufio.NewReader(io.LimitReader(r, 16))
+	name, err := br.ReadString(0)
+	if err != nil {
+		return CMPHHeader{}, fmt.Errorf("not a cmph file: %w", err)
+	}
+	name = name[:len(name)-1]
+	if !cmphAlgorithms[name] {
+		return CMPHHeader{}, fmt.Errorf("not a cmph file: unknown algorithm %q", name)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(br, size[:]); err != nil {
+		return CMPHHeader{}, fmt.Errorf("truncated cmph header: %w", err)
+	}
+	return CMPHHeader{Algorithm: name, Size: binary.LittleEndian.Uint32(size[:])}, nil
+}
@@ -0,0 +1,31 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cmphDump returns the header cmph_dump writes, followed by some payload.
+func cmphDump(algo string, size uint32) []byte {
+	b := append([]byte(algo), 0, byte(size), byte(size>>8), byte(size>>16), byte(size>>24))
+	return append(b, 1, 2, 3, 4)
+}
+
+func TestReadCMPHHeader(t *testing.T) {
+	h, err := ReadCMPHHeader(bytes.NewReader(cmphDump("chd_ph", 1000)))
+	require.NoError(t, err)
+	assert.Equal(t, CMPHHeader{Algorithm: "chd_ph", Size: 1000}, h)
+
+	_, err = ReadCMPHHeader(bytes.NewReader([]byte("chd")))
+	assert.Error(t, err)
+	_, err = ReadCMPHHeader(bytes.NewReader([]byte("chd\x00\x01")))
+	assert.ErrorContains(t, err, "truncated")
+	_, err = ReadCMPHHeader(bytes.NewReader(cmphDump("nope", 1)))
+	assert.ErrorContains(t, err, "not a cmph file")
+	// One of our own files isn't a cmph file.
+	_, err = ReadCMPHHeader(bytes.NewReader(golden1kBytes))
+	assert.Error(t, err)
+}
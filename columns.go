@@ -0,0 +1,190 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoColumn is returned by Column for names no column was attached under.
+var ErrNoColumn = errors.New("uint64mph: no such column")
+
+// The longest column name, in bytes.
+const maxColumnName = 255
+
+// column is a named array of extra values, one per slot, see AttachColumn.
+type column struct {
+	name   string
+	values []uint64
+}
+
+// AttachColumn attaches values to the table as the column name, for storing
+// several values per key without repeating the hash functions and keys for each
+// of them. values holds a value for every key, in the order Iterate returns the
+// keys, so it must be Len long. Attaching a column under an existing name
+// replaces it. The values are copied.
+//
+// Write stores the columns in the file and they're restored by Read and Mmap.
+// WriteSplit stores them in the structure file. Tables derived by RebuildWith,
+// CreatePatch and ApplyPatch don't keep them.
+func (c *CHD) AttachColumn(name string, values []uint64) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	if len(name) == 0 || len(name) > maxColumnName {
+		return fmt.Errorf("invalid column name %q: must be 1 to %d bytes", name, maxColumnName)
+	}
+	if len(values) != c.Len() {
+		return fmt.Errorf("column %q has %d values for %d keys", name, len(values), c.Len())
+	}
+	col := column{name: name, values: make([]uint64, c.numSlots())}
+	n := 0
+	for i := range col.values {
+		if _, ok := c.slotKey(i); ok {
+			col.values[i] = values[n]
+			n++
+		}
+	}
+	i := sort.Search(len(c.columns), func(i int) bool { return c.columns[i].name >= name })
+	if i < len(c.columns) && c.columns[i].name == name {
+		c.columns[i] = col
+		return nil
+	}
+	c.columns = append(c.columns[:i], append([]column{col}, c.columns[i:]...)...)
+	return nil
+}
+
+// Columns returns the names of the columns attached to the table, sorted.
+func (c *CHD) Columns() []string {
+	if c == nil {
+		return nil
+	}
+	names := make([]string, len(c.columns))
+	for i, col := range c.columns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// Column is a column attached to a table with AttachColumn.
+type Column struct {
+	c   *CHD
+	col column
+}
+
+// Column returns the column attached as name, or ErrNoColumn.
+func (c *CHD) Column(name string) (Column, error) {
+	if c != nil {
+		for i := range c.columns {
+			if c.columns[i].name == name {
+				return Column{c, c.columns[i]}, nil
+			}
+		}
+	}
+	return Column{}, fmt.Errorf("%w %q", ErrNoColumn, name)
+}
+
+// Name returns the name of the column.
+func (c Column) Name() string {
+	return c.col.name
+}
+
+// Get returns the value of key in the column, and whether key is in the table.
+func (c Column) Get(key uint64) (uint64, bool) {
+	ti, ok := c.c.Slot(key)
+	if !ok {
+		return 0, false
+	}
+	return c.col.values[ti], true
+}
+
+// GetColumn returns the value of key in the column attached as name, and
+// whether both exist. Use Column to tell a missing column apart from a missing
+// key, and to skip finding the column for every lookup.
+func (c *CHD) GetColumn(name string, key uint64) (uint64, bool) {
+	col, err := c.Column(name)
+	if err != nil {
+		return 0, false
+	}
+	return col.Get(key)
+}
+
+// columnsWords returns the number of uint64s written by e.columns.
+func (c *CHD) columnsWords() int {
+	n := 1
+	for _, col := range c.columns {
+		n += 1 + (len(col.name)+7)/8 + len(col.values)
+	}
+	return n
+}
+
+// columns writes the columns section: the number of columns, and for every
+// column the length of its name, its name padded to 8 bytes and its values.
+func (e *encoder) columns(c *CHD) {
+	e.section(sectionColumns, 8, c.columnsWords())
+	e.uint64(uint64(len(c.columns)))
+	for _, col := range c.columns {
+		e.uint64(uint64(len(col.name)))
+		e.bytes([]byte(col.name))
+		e.pad()
+		for _, v := range col.values {
+			e.uint64(v)
+		}
+	}
+}
+
+func (c *CHD) loadColumns(data func(tag uint32) []byte) error {
+	b := data(sectionColumns)
+	if b == nil {
+		return nil
+	}
+	invalid := fmt.Errorf("%w: invalid columns section", ErrNotCHD)
+	next := func() (uint64, bool) {
+		if len(b) < 8 {
+			return 0, false
+		}
+		v := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		return v, true
+	}
+	n, ok := next()
+	if !ok || n > uint64(len(b)) {
+		return invalid
+	}
+	c.columns = make([]column, 0, n)
+	for i := uint64(0); i < n; i++ {
+		l, ok := next()
+		if !ok || l == 0 || l > maxColumnName || uint64(len(b)) < (l+7)&^7 {
+			return invalid
+		}
+		name := string(b[:l])
+		b = b[(l+7)&^7:]
+		if i > 0 && name <= c.columns[i-1].name {
+			return invalid
+		}
+		size := 8 * c.numSlots()
+		if len(b) < size {
+			return invalid
+		}
+		values := (&sliceReader{b: b[:size]}).ReadUint64Array(uint64(c.numSlots()))
+		b = b[size:]
+		c.columns = append(c.columns, column{name: name, values: values})
+	}
+	if len(b) != 0 {
+		return invalid
+	}
+	return nil
+}
+
+// copyColumns returns a copy of the columns that doesn't alias the file.
+func copyColumns(columns []column) []column {
+	if columns == nil {
+		return nil
+	}
+	out := make([]column, len(columns))
+	for i, col := range columns {
+		out[i] = column{name: col.name, values: append([]uint64(nil), col.values...)}
+	}
+	return out
+}
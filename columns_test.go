@@ -0,0 +1,132 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// attachColumns attaches the columns "double" and "neg", holding twice and the
+// negation of the value of every key.
+func attachColumns(t *testing.T, c *CHD) {
+	t.Helper()
+	var double, neg []uint64
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		_, v := it.Get()
+		double = append(double, 2*v)
+		neg = append(neg, -v)
+	}
+	// Out of order, to check that they're sorted.
+	require.NoError(t, c.AttachColumn("neg", neg))
+	require.NoError(t, c.AttachColumn("double", double))
+}
+
+func TestAttachColumn(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(2000, 18), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash": {randomData(2000, 19), []BuildOption{WithPTHash(7, 0.99)}},
+		"masked": {randomData(2000, 20), []BuildOption{MaskKeys(3)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, tc.opts...)
+			require.NoError(t, err)
+			attachColumns(t, c)
+			assert.Equal(t, []string{"double", "neg"}, c.Columns())
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&FlagColumns)
+
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(3))
+			}
+			mapped, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+			read, err := ReadAt(bytes.NewReader(w.Bytes()), lo...)
+			require.NoError(t, err)
+			structure, _ := writeSplit(t, c)
+			indexOnly, err := MmapSplit(structure, nil, lo...)
+			require.NoError(t, err)
+			for _, l := range []*CHD{c, mapped, read, indexOnly, mapped.Materialize(), c.MapValues(func(_, v uint64) uint64 { return v })} {
+				assert.Equal(t, []string{"double", "neg"}, l.Columns())
+				double, err := l.Column("double")
+				require.NoError(t, err)
+				assert.Equal(t, "double", double.Name())
+				for k, v := range tc.data {
+					got, ok := double.Get(k)
+					assert.True(t, ok)
+					assert.Equal(t, 2*v, got)
+					got, ok = l.GetColumn("neg", k)
+					assert.True(t, ok)
+					assert.Equal(t, -v, got)
+				}
+				_, ok := double.Get(1)
+				assert.False(t, ok)
+				_, ok = l.GetColumn("double", 1)
+				assert.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestAttachColumn_errors(t *testing.T) {
+	c := MustFromMap(randomData(100, 21))
+	assert.ErrorContains(t, c.AttachColumn("short", make([]uint64, 99)), "99 values for 100 keys")
+	assert.ErrorContains(t, c.AttachColumn("", make([]uint64, 100)), "invalid column name")
+	assert.ErrorIs(t, (*CHD)(nil).AttachColumn("x", nil), ErrNilTable)
+	assert.Empty(t, c.Columns())
+
+	_, err := c.Column("missing")
+	assert.ErrorIs(t, err, ErrNoColumn)
+	k := c.keys[0]
+	_, ok := c.GetColumn("missing", k)
+	assert.False(t, ok)
+
+	// Attaching a column again replaces it.
+	require.NoError(t, c.AttachColumn("x", make([]uint64, 100)))
+	ones := make([]uint64, 100)
+	for i := range ones {
+		ones[i] = 1
+	}
+	require.NoError(t, c.AttachColumn("x", ones))
+	assert.Equal(t, []string{"x"}, c.Columns())
+	v, ok := c.GetColumn("x", k)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), v)
+
+	// Remote tables don't load the columns.
+	rc, _ := openRemote(t, c)
+	assert.Empty(t, rc.c.Columns())
+
+	// A columns section that doesn't match the table is rejected.
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+	s, ok := mustHeader(t, b).section(sectionColumns)
+	require.True(t, ok)
+	binary.LittleEndian.PutUint64(b[s.offset:], 2)
+	_, err = Mmap(b)
+	assert.ErrorContains(t, err, "invalid columns section")
+}
+
+func mustHeader(t *testing.T, b []byte) header {
+	t.Helper()
+	h, err := mmapHeader(b)
+	require.NoError(t, err)
+	return h
+}
@@ -0,0 +1,155 @@
+package uint64mph
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// A compressed table is written as an envelope around the normal serialized
+// form:
+//
+//	magic     [8]byte  "U64MPHZ\x00"
+//	nameLen   uint8
+//	name      [nameLen]byte  the name of the Compressor
+//	size      uint64   length of the uncompressed table
+//	crc       uint32   CRC-32 (IEEE) of the uncompressed table
+//	payload   the compressed table
+var compressedMagic = []byte("U64MPHZ\x00")
+
+// ErrCompressed is returned by Mmap for compressed tables, which can't be
+// mapped. Use Read instead.
+var ErrCompressed = errors.New("compressed table can't be mapped, use Read")
+
+// A Compressor compresses serialized tables. Compressors are identified by
+// name in the file, so reading a table requires the same Compressor to be
+// registered with RegisterCompressor.
+type Compressor interface {
+	// Name identifies the compression format. At most 255 bytes.
+	Name() string
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compressorsMtx sync.RWMutex
+	compressors    = map[string]Compressor{}
+)
+
+// RegisterCompressor makes a Compressor available for reading compressed
+// tables. This allows using compression libraries this package doesn't depend
+// on, like zstd.
+func RegisterCompressor(c Compressor) {
+	compressorsMtx.Lock()
+	defer compressorsMtx.Unlock()
+	compressors[c.Name()] = c
+}
+
+func init() {
+	RegisterCompressor(Gzip)
+}
+
+// Gzip is a Compressor using compress/gzip.
+var Gzip Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// WriteCompressed serializes the table like Write, compressed with Gzip at the
+// given level. Read detects and decompresses such tables.
+func (c *CHD) WriteCompressed(w io.Writer, level int) error {
+	return c.WriteCompressedWith(w, Gzip, level)
+}
+
+// WriteCompressedWith is like WriteCompressed, but with the given Compressor.
+func (c *CHD) WriteCompressedWith(w io.Writer, comp Compressor, level int) error {
+	if err := c.checkWritable(w != nil); err != nil {
+		return err
+	}
+	name := comp.Name()
+	if len(name) > 255 {
+		return fmt.Errorf("compressor name %q is too long", name)
+	}
+	var table bytes.Buffer
+	if err := c.Write(&table); err != nil {
+		return err
+	}
+	hdr := append([]byte{}, compressedMagic...)
+	hdr = append(hdr, byte(len(name)))
+	hdr = append(hdr, name...)
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(table.Len()))
+	hdr = binary.LittleEndian.AppendUint32(hdr, crc32.ChecksumIEEE(table.Bytes()))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	cw, err := comp.NewWriter(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(table.Bytes()); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+func isCompressed(b []byte) bool {
+	return bytes.HasPrefix(b, compressedMagic)
+}
+
+// decompress returns the uncompressed table in the envelope b. It fails with
+// ErrTooLarge if that is larger than maxBytes, unless maxBytes is negative.
+func decompress(b []byte, maxBytes int64) ([]byte, error) {
+	b = b[len(compressedMagic):]
+	if len(b) < 1 || len(b) < 1+int(b[0])+12 {
+		return nil, errors.New("truncated compression header")
+	}
+	name := string(b[1 : 1+b[0]])
+	b = b[1+len(name):]
+	size := binary.LittleEndian.Uint64(b)
+	sum := binary.LittleEndian.Uint32(b[8:])
+	b = b[12:]
+	if maxBytes >= 0 && size > uint64(maxBytes) {
+		return nil, fmt.Errorf("%w: decompresses to %d bytes, limit is %d", ErrTooLarge, size, maxBytes)
+	}
+
+	compressorsMtx.RLock()
+	comp, ok := compressors[name]
+	compressorsMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("table is compressed with unknown compressor %q, register it with RegisterCompressor", name)
+	}
+	r, err := comp.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer r.Close()
+	// Don't trust size for the allocation, a corrupt header could claim anything.
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, io.LimitReader(r, int64(size)+1)); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if uint64(out.Len()) != size {
+		return nil, fmt.Errorf("%s: decompressed to %d bytes, expected %d", name, out.Len(), size)
+	}
+	if crc32.ChecksumIEEE(out.Bytes()) != sum {
+		return nil, fmt.Errorf("%s: checksum mismatch in decompressed table", name)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package uint64mph
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type flateCompressor struct{}
+
+func (flateCompressor) Name() string { return "test-flate" }
+
+func (flateCompressor) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return flate.NewWriter(w, level)
+}
+
+func (flateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func compressedSample(t *testing.T) (*CHD, []byte) {
+	b := Builder()
+	for i, w := range words[:10000] {
+		b.Add(w, uint64(i))
+	}
+	c, err := b.Build()
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.WriteCompressed(w, gzip.BestCompression))
+	return c, w.Bytes()
+}
+
+func TestWriteCompressed(t *testing.T) {
+	c, data := compressedSample(t)
+	plain := &bytes.Buffer{}
+	require.NoError(t, c.Write(plain))
+	assert.Less(t, len(data), plain.Len())
+
+	r, err := Read(bytes.NewReader(data))
+	require.NoError(t, err)
+	for i, w := range words[:10000] {
+		assert.Equal(t, uint64(i), r.Get(w))
+	}
+
+	_, err = Mmap(data)
+	assert.ErrorIs(t, err, ErrCompressed)
+	_, err = Stat(bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrCompressed)
+}
+
+func TestWriteCompressedWith(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.WriteCompressedWith(w, flateCompressor{}, flate.BestSpeed))
+	_, err := Read(bytes.NewReader(w.Bytes()))
+	assert.ErrorContains(t, err, `unknown compressor "test-flate"`)
+
+	RegisterCompressor(flateCompressor{})
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v, r.Get(k))
+	}
+}
+
+func TestWriteCompressed_corrupt(t *testing.T) {
+	_, data := compressedSample(t)
+	for name, bad := range map[string][]byte{
+		"truncated header":  data[:len(compressedMagic)+3],
+		"truncated payload": data[:len(data)/2],
+		"payload":           corruptByte(data, len(data)/2),
+		"checksum":          corruptByte(data, len(compressedMagic)+1+len("gzip")+8),
+		"size":              corruptByte(data, len(compressedMagic)+1+len("gzip")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(bad))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func corruptByte(b []byte, off int) []byte {
+	c := append([]byte(nil), b...)
+	c[off] ^= 0xff
+	return c
+}
@@ -0,0 +1,163 @@
+package uint64mph
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Delete hides key from the table until it is rebuilt, and reports whether it
+// was in the table and not deleted yet. Get, Contains, Slot, Iterate, Range and
+// the other lookups act as if the key isn't there, while the structure stays
+// the same: Len keeps counting deleted keys, see DeletedCount, and columns and
+// generations keep a value for them.
+//
+// Deleting doesn't erase the key or its value, it only marks the slot. Write
+// stores the marks in the file, so that tables loaded from it hide the same
+// keys, and RebuildWith drops the deleted keys for good. The marks can also be
+// kept apart from the file and applied when loading it, see WithDeletedKeys.
+//
+// Delete must not be called concurrently with other methods of the table.
+func (c *CHD) Delete(key uint64) bool {
+	if c == nil {
+		return false
+	}
+	c.checkClosed()
+	ti, ok := c.Slot(key)
+	if !ok {
+		return false
+	}
+	if c.deleted == nil {
+		c.deleted = make([]uint64, (c.numSlots()+63)/64)
+	}
+	c.deleted[ti/64] |= 1 << (ti % 64)
+	c.deletedCount++
+	// The digest and aggregates in the file, if any, stay those of its
+	// entries.
+	c.digest, c.digestSection = nil, nil
+	c.aggregatesSection = nil
+	if a := c.aggregates; a != nil {
+		if v := c.value(ti); v == a.min || v == a.max {
+			c.aggregates = nil
+		} else {
+			a.sum -= v
+		}
+	}
+	return true
+}
+
+// DeletedCount returns the number of keys hidden by Delete. Len minus
+// DeletedCount is the number of keys lookups find.
+func (c *CHD) DeletedCount() int {
+	if c == nil {
+		return 0
+	}
+	return c.deletedCount
+}
+
+// DeletedKeys returns the keys hidden by Delete, in the order of their slots.
+func (c *CHD) DeletedKeys() []uint64 {
+	if c == nil || c.deletedCount == 0 {
+		return nil
+	}
+	keys := make([]uint64, 0, c.deletedCount)
+	for w, word := range c.deleted {
+		for ; word != 0; word &= word - 1 {
+			k, _ := c.slotKey(64*w + bits.TrailingZeros64(word))
+			keys = append(keys, c.unmaskKey(k))
+		}
+	}
+	return keys
+}
+
+// WithDeletedKeys deletes keys from the table once it is loaded, as if Delete
+// was called for every one of them. Keys that aren't in the table are ignored.
+// It allows shipping the keys to hide as a small file of their own, next to a
+// table that is only replaced when rebuilt, see DeletedKeys.
+func WithDeletedKeys(keys ...uint64) LoadOption {
+	return func(o *loadOptions) {
+		o.deletedKeys = append(o.deletedKeys, keys...)
+	}
+}
+
+// isDeleted reports whether slot ti holds a key hidden by Delete.
+func (c *CHD) isDeleted(ti int) bool {
+	return c.deleted != nil && c.deleted[ti/64]&(1<<(ti%64)) != 0
+}
+
+// live reports whether slot i holds a key that isn't hidden by Delete.
+func (c *CHD) live(i int) bool {
+	_, ok := c.slotKey(i)
+	return ok && !c.isDeleted(i)
+}
+
+// copyDeletions returns a copy of the deletion marks, which Delete modifies.
+func (c *CHD) copyDeletions() []uint64 {
+	if c.deleted == nil {
+		return nil
+	}
+	return append([]uint64(nil), c.deleted...)
+}
+
+// verifyDeletions checks that only slots holding keys are marked, and that
+// DeletedCount matches the marks.
+func (c *CHD) verifyDeletions() error {
+	if c.deleted == nil {
+		if c.deletedCount != 0 {
+			return fmt.Errorf("%d keys deleted without marks", c.deletedCount)
+		}
+		return nil
+	}
+	if len(c.deleted) != (c.numSlots()+63)/64 {
+		return fmt.Errorf("%d words of deletion marks for %d slots", len(c.deleted), c.numSlots())
+	}
+	n := 0
+	for w, word := range c.deleted {
+		for ; word != 0; word &= word - 1 {
+			ti := 64*w + bits.TrailingZeros64(word)
+			if ti >= c.numSlots() {
+				return fmt.Errorf("deletion mark beyond the %d slots", c.numSlots())
+			}
+			if _, ok := c.slotKey(ti); !ok {
+				return fmt.Errorf("deletion mark on empty slot %d", ti)
+			}
+			n++
+		}
+	}
+	if n != c.deletedCount {
+		return fmt.Errorf("%d deletion marks, but %d keys deleted", n, c.deletedCount)
+	}
+	return nil
+}
+
+// deletions writes the deletions section: a bitmap with a bit for every slot,
+// set for the slots whose key was deleted.
+func (e *encoder) deletions(deleted []uint64) {
+	e.section(sectionDeletions, 8, len(deleted))
+	for _, w := range deleted {
+		e.uint64(w)
+	}
+}
+
+// loadDeletions loads the deletions section, if the file has one, and then
+// deletes keys. The structure must have been loaded. The marks are copied, so
+// that Delete can add to them without writing to the file.
+func (c *CHD) loadDeletions(data func(tag uint32) []byte, keys []uint64) error {
+	if b := data(sectionDeletions); b != nil {
+		c.deleted = (&sliceReader{b: b}).ReadUint64Array(uint64(len(b) / 8))
+		c.deleted = append([]uint64(nil), c.deleted...)
+		c.deletedCount = 0
+		for _, w := range c.deleted {
+			c.deletedCount += bits.OnesCount64(w)
+		}
+		if err := c.verifyDeletions(); err != nil {
+			return fmt.Errorf("%w: %v", ErrNotCHD, err)
+		}
+		if c.deletedCount == 0 {
+			c.deleted = nil
+		}
+	}
+	for _, k := range keys {
+		c.Delete(k)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package uint64mph
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deleteSome deletes every third key of m from c, and returns the remaining
+// entries and the deleted keys.
+func deleteSome(t *testing.T, c *CHD, m map[uint64]uint64) (map[uint64]uint64, []uint64) {
+	t.Helper()
+	live := map[uint64]uint64{}
+	var deleted []uint64
+	i := 0
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		k := it.Key()
+		if i%3 == 0 {
+			require.True(t, c.Delete(k))
+			deleted = append(deleted, k)
+		} else {
+			live[k] = m[k]
+		}
+		i++
+	}
+	return live, deleted
+}
+
+// assertDeleted checks that c holds the entries in live, and that the keys in
+// deleted are hidden.
+func assertDeleted(t *testing.T, live map[uint64]uint64, deleted []uint64, c *CHD) {
+	t.Helper()
+	assert.Equal(t, len(live)+len(deleted), c.Len())
+	assert.Equal(t, len(deleted), c.DeletedCount())
+	got := c.DeletedKeys()
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	want := append([]uint64(nil), deleted...)
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	assert.Equal(t, want, got)
+	for _, k := range deleted {
+		_, ok := c.GetOK(k)
+		assert.False(t, ok)
+		assert.False(t, c.Contains(k))
+		_, ok = c.Slot(k)
+		assert.False(t, ok)
+	}
+	seen := map[uint64]uint64{}
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		seen[k] = v
+	}
+	assert.Equal(t, live, seen)
+	assert.NoError(t, c.Verify())
+}
+
+func TestDelete(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(2000, 70), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash": {randomData(2000, 71), []BuildOption{WithPTHash(7, 0.99)}},
+		"masked": {randomData(2000, 72), []BuildOption{MaskKeys(3)}},
+		"packed": {randomData(2000, 73), []BuildOption{WithPackedValues()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithSeed(70))...)
+			require.NoError(t, err)
+			live, deleted := deleteSome(t, c, tc.data)
+			assertDeleted(t, live, deleted, c)
+			assert.False(t, c.Delete(deleted[0]))
+			assert.False(t, c.Delete(1))
+			assert.Equal(t, len(deleted), c.DeletedCount())
+
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&FlagDeletions)
+
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(3))
+			}
+			mapped, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+			read, err := ReadAt(bytes.NewReader(w.Bytes()), lo...)
+			require.NoError(t, err)
+			structure, values := writeSplit(t, c)
+			split, err := MmapSplit(structure, values, lo...)
+			require.NoError(t, err)
+			for _, l := range []*CHD{mapped, read, split, mapped.Materialize(), c.MapValues(func(_, v uint64) uint64 { return v })} {
+				assertDeleted(t, live, deleted, l)
+			}
+
+			raw, err := OpenRaw(w.Bytes(), lo...)
+			require.NoError(t, err)
+			for _, k := range deleted {
+				assert.False(t, raw.Contains(k))
+			}
+			for k, v := range live {
+				assert.Equal(t, v, raw.Get(k))
+			}
+
+			// Deleting from a derived table leaves the original alone.
+			m := mapped.MapValues(func(_, v uint64) uint64 { return v })
+			k := firstKey(live)
+			require.True(t, m.Delete(k))
+			assert.True(t, mapped.Contains(k))
+		})
+	}
+}
+
+func TestWithDeletedKeys(t *testing.T) {
+	m := randomData(500, 74)
+	c := MustFromMap(m, WithSeed(74))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	live, deleted := deleteSome(t, c, m)
+
+	// The deleted keys can be shipped apart from the table.
+	g, err := MmapWithOptions(w.Bytes(), WithDeletedKeys(c.DeletedKeys()...), WithDeletedKeys(1))
+	require.NoError(t, err)
+	assertDeleted(t, live, deleted, g)
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Zero(t, fi.Flags&FlagDeletions)
+}
+
+func TestDelete_rebuild(t *testing.T) {
+	m := randomData(500, 75)
+	c := MustFromMap(m, WithSeed(75), WithSortedIndex(), WithValueStats())
+	want := c.Digest()
+	live, deleted := deleteSome(t, c, m)
+	assert.NotEqual(t, want, c.Digest())
+
+	// Everything derived from the entries leaves the deleted keys out.
+	r, err := RebuildWith(c, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, len(live), r.Len())
+	assert.Zero(t, r.DeletedCount())
+	assertDeleted(t, live, nil, r)
+	assert.Equal(t, r.Digest(), c.Digest())
+	assertValueStats(t, live, c)
+	assertRanges(t, live, c)
+	w := &bytes.Buffer{}
+	_, err = c.WritePairs(w)
+	require.NoError(t, err)
+	assert.Equal(t, 16*len(live), w.Len())
+
+	// Keys deleted and added again are back.
+	r, err = RebuildWith(c, map[uint64]uint64{deleted[0]: 7}, nil)
+	require.NoError(t, err)
+	live[deleted[0]] = 7
+	assertDeleted(t, live, nil, r)
+}
+
+func TestDelete_closed(t *testing.T) {
+	assert.False(t, (*CHD)(nil).Delete(1))
+	assert.Zero(t, (*CHD)(nil).DeletedCount())
+	c := MustFromMap(sampleData)
+	require.NoError(t, c.Close())
+	assert.PanicsWithValue(t, ErrClosed, func() { c.Delete(1) })
+}
+
+func TestDelete_badSection(t *testing.T) {
+	c := MustFromMap(sampleData, WithSeed(76))
+	c.Delete(firstKey(sampleData))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+	h, err := mmapHeader(b)
+	require.NoError(t, err)
+	s, _ := h.section(sectionDeletions)
+	b[s.offset+7] |= 0x80 // A slot beyond the table.
+	_, err = Mmap(b)
+	assert.ErrorContains(t, err, "deletion mark beyond")
+
+	h.flags &^= FlagDeletions
+	assert.ErrorContains(t, h.check(), "deletions flag doesn't match")
+}
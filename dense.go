@@ -0,0 +1,146 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// denseKeys replaces the hash functions, indices and keys of a dense table.
+// The key in slot i is base+i, if bit i of present is set: lookups subtract
+// base and check the bit.
+type denseKeys struct {
+	base uint64
+	// Number of slots: the length of the values and of the range of keys.
+	span int
+	// Number of keys, the bits set in present.
+	n       int
+	present []uint64
+}
+
+func (d *denseKeys) has(i uint64) bool {
+	return d.present[i/64]&(1<<(i%64)) != 0
+}
+
+// slot returns the slot of key and whether key is in the table.
+func (d *denseKeys) slot(key uint64) (int, bool) {
+	i := key - d.base
+	if i >= uint64(d.span) || !d.has(i) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// numSlots returns the number of slots of the table: the length of its keys,
+// and of its values unless it is index-only.
+func (c *CHD) numSlots() int {
+	if c.dense != nil {
+		return c.dense.span
+	}
+	return len(c.keys)
+}
+
+// slotKey returns the key in slot i, and false if the slot is a hole of a
+// dense table.
+func (c *CHD) slotKey(i int) (uint64, bool) {
+	if c.dense != nil {
+		return c.dense.base + uint64(i), c.dense.has(uint64(i))
+	}
+	return c.keys[i], true
+}
+
+// denseRange returns the smallest key and the number of slots of a dense table
+// holding the entries, and whether the keys are dense enough for one.
+func denseRange(entries *entryChunks, threshold float64) (uint64, int, bool) {
+	if entries.len() == 0 || threshold > 1 {
+		return 0, 0, false
+	}
+	lo, hi := uint64(math.MaxUint64), uint64(0)
+	for _, chunk := range entries.keys {
+		for _, k := range chunk {
+			lo, hi = min(lo, k), max(hi, k)
+		}
+	}
+	// Sections hold at most math.MaxInt32 elements.
+	if hi-lo >= math.MaxInt32 || float64(entries.len())/(float64(hi-lo)+1) < threshold {
+		return 0, 0, false
+	}
+	return lo, int(hi-lo) + 1, true
+}
+
+// buildDense builds a dense table of the entries, whose keys are within
+// [lo, lo+span).
+func buildDense(entries *entryChunks, lo uint64, span int, o buildOptions, start time.Time) (*CHD, error) {
+	d := &denseKeys{base: lo, span: span, n: entries.len(), present: make([]uint64, (span+63)/64)}
+	values := make([]uint64, span)
+	for c, chunk := range entries.keys {
+		for j, k := range chunk {
+			i := k - lo
+			if d.has(i) {
+				return nil, fmt.Errorf("%w %d", ErrDuplicateKey, k)
+			}
+			d.present[i/64] |= 1 << (i % 64)
+			values[i] = entries.values[c][j]
+		}
+	}
+	c := &CHD{
+		dense:  d,
+		values: values,
+		// Dense tables are new in version 3.
+		mixBuckets: true,
+		keyMask:    o.keyMask,
+	}
+	if err := c.shrinkValues(o); err != nil {
+		return nil, err
+	}
+	if o.logger != nil {
+		o.logger.Info("uint64mph: build finished", "entries", d.n, "dense", true, "slots", span, "elapsed", time.Since(start))
+	}
+	if o.stats != nil {
+		*o.stats = BuildStats{
+			TableStats: c.Stats(),
+			Duration:   time.Since(start),
+		}
+	}
+	return c, nil
+}
+
+// writeDense writes the sections replacing the structure of a dense table.
+func (c *CHD) writeDense(e *encoder) {
+	d := c.dense
+	e.section(sectionDense, 8, 3)
+	e.uint64(d.base)
+	e.uint64(uint64(d.span))
+	e.uint64(uint64(d.n))
+	e.section(sectionPresence, 8, len(d.present))
+	for _, w := range d.present {
+		e.uint64(w)
+	}
+}
+
+// loadDense loads the structure of a dense table.
+func (c *CHD) loadDense(h header, data func(tag uint32) []byte) error {
+	b := data(sectionDense)
+	d := &denseKeys{
+		base:    binary.LittleEndian.Uint64(b),
+		present: readUint64s(h, data, sectionPresence),
+	}
+	span, n := binary.LittleEndian.Uint64(b[8:]), binary.LittleEndian.Uint64(b[16:])
+	if span == 0 || (span+63)/64 != uint64(len(d.present)) || d.base+(span-1) < d.base {
+		return fmt.Errorf("%w: dense table of %d slots with %d presence words", ErrNotCHD, span, len(d.present))
+	}
+	if last := span % 64; last != 0 && d.present[len(d.present)-1]>>last != 0 {
+		return fmt.Errorf("%w: dense table has keys beyond its %d slots", ErrNotCHD, span)
+	}
+	d.span = int(span)
+	for _, w := range d.present {
+		d.n += bits.OnesCount64(w)
+	}
+	if uint64(d.n) != n {
+		return fmt.Errorf("%w: dense table claims %d keys but has %d", ErrNotCHD, n, d.n)
+	}
+	c.dense = d
+	return nil
+}
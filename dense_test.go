@@ -0,0 +1,187 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// denseData returns n keys from 1000 on, leaving out every 25th.
+func denseData(n int) map[uint64]uint64 {
+	m := map[uint64]uint64{}
+	for k := uint64(1000); len(m) < n; k++ {
+		if k%25 != 12 {
+			m[k] = k * 3
+		}
+	}
+	return m
+}
+
+func TestDenseTables(t *testing.T) {
+	m := denseData(960)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	require.NotNil(t, c.dense)
+	assert.Empty(t, c.r)
+	assert.Empty(t, c.keys)
+	assert.Equal(t, 1000, c.dense.span)
+	assert.Equal(t, 960, c.Len())
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagDense, fi.Flags)
+	assert.Equal(t, 960, fi.Entries)
+	assert.Equal(t, c.Spec().Size, int64(w.Len()))
+
+	var rewritten offsetBuffer
+	n, err := c.WriteToAt(&rewritten)
+	require.NoError(t, err)
+	assert.Equal(t, int64(w.Len()), n)
+	assert.Equal(t, w.Bytes(), rewritten.b)
+
+	l, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	d := &bytes.Buffer{}
+	require.NoError(t, c.Write(d, WithValueDeltas()))
+	ld, err := Mmap(d.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, FlagDense|FlagValueDeltas, ld.Info().Flags)
+	s, v := writeSplit(t, c)
+	sl, err := MmapSplit(s, v)
+	require.NoError(t, err)
+	for name, g := range map[string]*CHD{"built": c, "mmap": l, "read": r, "deltas": ld, "split": sl, "materialized": l.Materialize()} {
+		t.Run(name, func(t *testing.T) {
+			require.NotNil(t, g.dense)
+			assert.Equal(t, 960, g.Len())
+			for k, v := range m {
+				got, ok := g.GetOK(k)
+				assert.True(t, ok)
+				assert.Equal(t, v, got)
+				ti, ok := g.Slot(k)
+				assert.True(t, ok)
+				assert.Equal(t, int(k-1000), ti)
+			}
+			// Holes and keys on either side of the range are missing.
+			for _, k := range []uint64{0, 999, 1012, 1037, 1987, 2000, math.MaxUint64} {
+				assert.Equal(t, uint64(math.MaxUint64), g.Get(k), k)
+				assert.False(t, g.Contains(k), k)
+			}
+			assert.NoError(t, g.Verify())
+
+			got := map[uint64]uint64{}
+			for it := g.Iterate(); it != nil; it = it.Next() {
+				k, v := it.Get()
+				got[k] = v
+			}
+			assert.Equal(t, m, got)
+
+			keys := []uint64{1000, 1012, 1999, 5}
+			dst := make([]uint64, len(keys))
+			assert.Equal(t, 2, g.GetBatchSorted(keys, dst))
+			assert.Equal(t, []uint64{3000, math.MaxUint64, 5997, math.MaxUint64}, dst)
+		})
+	}
+
+	idx, err := MmapSplit(s, nil)
+	require.NoError(t, err)
+	assert.True(t, idx.IndexOnly())
+	assert.True(t, idx.Contains(1001))
+	assert.False(t, idx.Contains(1012))
+	assert.Panics(t, func() { idx.Get(1001) })
+
+	assert.ErrorIs(t, c.SetValue(1012, 1), ErrKeyNotFound)
+	require.NoError(t, c.SetValue(1013, 1))
+	assert.Equal(t, uint64(1), c.Get(1013))
+	doubled := c.MapValues(func(k, v uint64) uint64 { return 2 * v })
+	assert.Equal(t, uint64(2), doubled.Get(1013))
+	assert.Equal(t, uint64(math.MaxUint64), doubled.Get(1012))
+	assert.Equal(t, 960, c.Stats().Entries)
+	assert.Equal(t, 8*16, c.Stats().KeysBytes)
+
+	pairs := &bytes.Buffer{}
+	written, err := c.WritePairs(pairs)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16*960), written)
+
+	cb := Builder()
+	for k := uint64(0); k < 100; k++ {
+		cb.Add(k, k)
+	}
+	cb.Add(50, 1)
+	_, err = cb.Build()
+	assert.ErrorContains(t, err, "duplicate key 50")
+}
+
+// offsetBuffer is an io.WriterAt that grows to fit.
+type offsetBuffer struct {
+	b []byte
+}
+
+func (o *offsetBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(o.b) {
+		o.b = append(o.b, make([]byte, end-len(o.b))...)
+	}
+	return copy(o.b[off:], p), nil
+}
+
+func TestWithDenseThreshold(t *testing.T) {
+	build := func(n, span int, opts ...BuildOption) *CHD {
+		t.Helper()
+		b := Builder()
+		// Always include both ends, so that the range is span keys wide.
+		b.Add(0, 0)
+		for k := 1; k < n-1; k++ {
+			b.Add(uint64(k), 1)
+		}
+		b.Add(uint64(span-1), 2)
+		c, err := b.Build(opts...)
+		require.NoError(t, err)
+		require.Equal(t, n, c.Len())
+		assert.Equal(t, uint64(2), c.Get(uint64(span-1)))
+		return c
+	}
+	assert.NotNil(t, build(95, 100).dense)
+	assert.Nil(t, build(94, 100).dense)
+	assert.NotNil(t, build(100, 100).dense)
+	assert.NotNil(t, build(75, 100, WithDenseThreshold(0.75)).dense)
+	assert.Nil(t, build(74, 100, WithDenseThreshold(0.75)).dense)
+	assert.Nil(t, build(100, 100, WithDenseThreshold(1.01)).dense)
+	assert.NotNil(t, build(10, 1000, WithDenseThreshold(0.01)).dense)
+	// Small tables stay small.
+	assert.True(t, build(maxSmallTable, maxSmallTable).small)
+
+	for _, d := range []float64{0, -1, math.NaN()} {
+		_, err := FromMap(sampleData, WithDenseThreshold(d))
+		assert.ErrorContains(t, err, "must be positive")
+	}
+}
+
+func TestDenseTables_corrupt(t *testing.T) {
+	c, err := FromMap(denseData(960))
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	l := c.Spec()
+	for name, corrupt := range map[string]func(b []byte){
+		"span":       func(b []byte) { binary.LittleEndian.PutUint64(b[l.Dense.Offset+8:], 2000) },
+		"entries":    func(b []byte) { binary.LittleEndian.PutUint64(b[l.Dense.Offset+16:], 961) },
+		"extra bits": func(b []byte) { b[l.Presence.Offset+l.Presence.Size()-1] = 0xff },
+		"wrap":       func(b []byte) { binary.LittleEndian.PutUint64(b[l.Dense.Offset:], math.MaxUint64-10) },
+		"flag":       func(b []byte) { binary.LittleEndian.PutUint32(b[8:], 0) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := append([]byte(nil), w.Bytes()...)
+			corrupt(b)
+			_, err := Mmap(b)
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+}
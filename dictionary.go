@@ -0,0 +1,140 @@
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The default number of distinct values up to which Build stores the values
+// through a dictionary, see WithDictionaryThreshold.
+const defaultDictionaryThreshold = 256
+
+// The most distinct values a dictionary can hold: codes are at most 16 bits.
+const maxDictionary = 1 << 16
+
+// ErrNotInDictionary is returned by SetValue for values that aren't in the
+// dictionary of a table whose codes can't be changed to make room, like one
+// backed by a file.
+var ErrNotInDictionary = errors.New("uint64mph: value isn't in the dictionary")
+
+// buildDictionary returns the distinct values in the order they first occur,
+// and false if there are more than limit.
+func buildDictionary(values []uint64, limit int) ([]uint64, map[uint64]uint64, bool) {
+	codes := map[uint64]uint64{}
+	var dict []uint64
+	for _, v := range values {
+		if _, ok := codes[v]; ok {
+			continue
+		}
+		if len(dict) == limit {
+			return nil, nil, false
+		}
+		codes[v] = uint64(len(dict))
+		dict = append(dict, v)
+	}
+	return dict, codes, true
+}
+
+// encodeDictionary stores the values as codes into a dictionary of the distinct
+// values. Unless forced, it only does so for at most threshold distinct values
+// taking less space than the values themselves. A forced dictionary fails for
+// more than maxDictionary distinct values.
+func (c *CHD) encodeDictionary(threshold int, force bool) (bool, error) {
+	if len(c.values) == 0 {
+		return false, nil
+	}
+	limit := threshold
+	if force {
+		limit = maxDictionary
+	}
+	dict, codes, ok := buildDictionary(c.values, min(limit, maxDictionary))
+	if !ok {
+		if force {
+			return false, fmt.Errorf("WithValueDictionary: more than %d distinct values", maxDictionary)
+		}
+		return false, nil
+	}
+	w := 1
+	if len(dict) > 1<<8 {
+		w = 2
+	}
+	if !force && 8*len(dict)+w*len(c.values) >= 8*len(c.values) {
+		return false, nil
+	}
+	packed := make([]byte, w*len(c.values))
+	for i, v := range c.values {
+		putPacked(packed, w, i, codes[v])
+	}
+	c.packed, c.valueWidth, c.dict, c.values = packed, w, dict, nil
+	return true, nil
+}
+
+// shrinkValues stores the values of a freshly built table as configured by
+// WithValueDictionary, WithDictionaryThreshold and WithPackedValues, and
+// computes their aggregates for WithValueStats. It also sorts the keys for
+// WithSortedIndex, as every build ends here.
+func (c *CHD) shrinkValues(o buildOptions) error {
+	if o.valueStats {
+		c.aggregates = c.computeAggregates()
+	}
+	if o.sortedIndex {
+		c.sorted = c.sortKeys()
+	}
+	if ok, err := c.encodeDictionary(o.dictionaryThreshold, o.dictionary); ok || err != nil {
+		return err
+	}
+	if o.packValues {
+		c.packValues()
+	}
+	return nil
+}
+
+// setDictionaryValue sets the value in slot ti of a table with a dictionary.
+// Values that aren't in it yet are added if there's room for their code, and
+// otherwise the table's values are unpacked. Neither can be done to codes that
+// alias the buffer the table was loaded from.
+func (c *CHD) setDictionaryValue(ti int, v uint64) error {
+	code := -1
+	for i, d := range c.dict {
+		if d == v {
+			code = i
+			break
+		}
+	}
+	if code < 0 {
+		if c.aliases(c.valuesPointer()) {
+			return fmt.Errorf("%w: %d, and the dictionary can't grow", ErrNotInDictionary, v)
+		}
+		if len(c.dict) >= 1<<(8*c.valueWidth) {
+			c.unpackValues()
+			c.values[ti] = v
+			return nil
+		}
+		// Never append to a dictionary that aliases the buffer.
+		c.dict = append(c.dict[:len(c.dict):len(c.dict)], v)
+		code = len(c.dict) - 1
+	}
+	putPacked(c.packed, c.valueWidth, ti, uint64(code))
+	return nil
+}
+
+// Dictionary returns a copy of the distinct values of a table that stores its
+// values through a dictionary, or nil for other tables. See
+// WithDictionaryThreshold.
+func (c *CHD) Dictionary() []uint64 {
+	if c == nil || c.dict == nil {
+		return nil
+	}
+	return append([]uint64(nil), c.dict...)
+}
+
+// checkDictionary returns an error if any slot has a code beyond the end of
+// the dictionary.
+func (c *CHD) checkDictionary() error {
+	for i, n := 0, c.numValues(); i < n; i++ {
+		if code := c.packedCode(i); code >= uint64(len(c.dict)) {
+			return fmt.Errorf("slot %d has code %d, but the dictionary has %d values", i, code, len(c.dict))
+		}
+	}
+	return nil
+}
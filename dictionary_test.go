@@ -0,0 +1,196 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// categories returns n words mapped to one of distinct large values.
+func categories(n, distinct int) map[uint64]uint64 {
+	m := map[uint64]uint64{}
+	for i, w := range words[:n] {
+		m[w] = 1<<40 + uint64(i%distinct)*7
+	}
+	return m
+}
+
+func TestValueDictionary(t *testing.T) {
+	m := categories(10000, 200)
+	c, err := FromMap(m, WithSeed(1))
+	require.NoError(t, err)
+	plain, err := FromMap(m, WithSeed(1), WithDictionaryThreshold(0))
+	require.NoError(t, err)
+	assert.Len(t, c.Dictionary(), 200)
+	assert.Nil(t, plain.Dictionary())
+	assert.Equal(t, 1, c.ValueWidth())
+	assert.Equal(t, 10000+8*200, c.Stats().ValuesBytes)
+
+	w, plainW := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	require.NoError(t, plain.Write(plainW))
+	// 7 of the 8 bytes of every value are saved, minus the dictionary and its
+	// section header.
+	assert.Equal(t, plainW.Len()-7*10000+8*200+sectionHeaderSize, w.Len())
+	t.Logf("%d bytes instead of %d", w.Len(), plainW.Len())
+	assert.Equal(t, c.Spec().Size, int64(w.Len()))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagPackedValues|FlagDictionary, fi.Flags)
+	assert.Equal(t, int64(10000+8*200), fi.ValuesBytes)
+
+	var at offsetBuffer
+	_, err = c.WriteToAt(&at)
+	require.NoError(t, err)
+	assert.Equal(t, w.Bytes(), at.b)
+
+	l, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	s, v := writeSplit(t, c)
+	sl, err := MmapSplit(s, v)
+	require.NoError(t, err)
+	for name, g := range map[string]*CHD{"built": c, "mmap": l, "read": r, "split": sl, "materialized": l.Materialize()} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, c.Dictionary(), g.Dictionary())
+			assert.NoError(t, g.Verify())
+			for k, v := range m {
+				assert.Equal(t, v, g.Get(k))
+			}
+			got := map[uint64]uint64{}
+			for it := g.Iterate(); it != nil; it = it.Next() {
+				k, v := it.Get()
+				got[k] = v
+			}
+			assert.Equal(t, m, got)
+		})
+	}
+
+	mapped := c.MapValues(func(k, v uint64) uint64 { return v / 7 })
+	assert.Len(t, mapped.Dictionary(), 200)
+	assert.Equal(t, m[words[5]]/7, mapped.Get(words[5]))
+}
+
+func TestValueDictionary_threshold(t *testing.T) {
+	for _, tc := range []struct {
+		distinct int
+		opts     []BuildOption
+		dict     int
+		width    int
+	}{
+		{256, nil, 256, 1},
+		{257, nil, 0, 8},
+		{257, []BuildOption{WithDictionaryThreshold(257)}, 257, 2},
+		{257, []BuildOption{WithDictionaryThreshold(257), WithPackedValues()}, 257, 2},
+		{257, []BuildOption{WithPackedValues()}, 0, 8},
+		{10, []BuildOption{WithDictionaryThreshold(0)}, 0, 8},
+	} {
+		t.Run(fmt.Sprint(tc.distinct, len(tc.opts)), func(t *testing.T) {
+			m := categories(5000, tc.distinct)
+			c, err := FromMap(m, tc.opts...)
+			require.NoError(t, err)
+			assert.Len(t, c.Dictionary(), tc.dict)
+			assert.Equal(t, tc.width, c.ValueWidth())
+			for k, v := range m {
+				assert.Equal(t, v, c.Get(k))
+			}
+		})
+	}
+
+	// Dictionaries that don't save space aren't used unless forced.
+	m := map[uint64]uint64{1: 10, 2: 20}
+	assert.Nil(t, MustFromMap(m).Dictionary())
+	c, err := FromMap(m, WithValueDictionary())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{10, 20}, c.Dictionary())
+	assert.Equal(t, uint64(20), c.Get(2))
+
+	_, err = FromMap(categories(10, 10), WithDictionaryThreshold(-1))
+	assert.ErrorContains(t, err, "must not be negative")
+	b := Builder()
+	for i := uint64(0); i <= maxDictionary; i++ {
+		b.Add(i*3, i)
+	}
+	_, err = b.Build(WithValueDictionary())
+	assert.ErrorContains(t, err, "more than 65536 distinct values")
+}
+
+func TestValueDictionary_setValue(t *testing.T) {
+	m := categories(1000, 255)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	require.Len(t, c.Dictionary(), 255)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	// Values in the dictionary reuse its codes, new ones are added while their
+	// code fits, after which the values are unpacked.
+	require.NoError(t, c.SetValue(words[0], m[words[1]]))
+	assert.Len(t, c.Dictionary(), 255)
+	require.NoError(t, c.SetValue(words[0], 5))
+	assert.Len(t, c.Dictionary(), 256)
+	assert.Equal(t, uint64(5), c.Get(words[0]))
+	require.NoError(t, c.SetValue(words[1], 6))
+	assert.Nil(t, c.Dictionary())
+	assert.Equal(t, 8, c.ValueWidth())
+	assert.Equal(t, uint64(5), c.Get(words[0]))
+	assert.Equal(t, uint64(6), c.Get(words[1]))
+	assert.Equal(t, m[words[2]], c.Get(words[2]))
+
+	// The codes of a mapped table can't change their meaning, unless Mmap
+	// copied them.
+	l, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, l.SetValue(words[0], m[words[1]]))
+	assert.Equal(t, m[words[1]], l.Get(words[0]))
+	if zeroCopy {
+		assert.ErrorIs(t, l.SetValue(words[0], 5), ErrNotInDictionary)
+	} else {
+		assert.NoError(t, l.SetValue(words[0], 5))
+	}
+
+	// But a journal can be applied to a copy.
+	j := &bytes.Buffer{}
+	vj, err := NewValueJournal(j, l)
+	require.NoError(t, err)
+	require.NoError(t, vj.AppendUpdate(words[0], 5))
+	r, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	_, err = ApplyJournal(r, bytes.NewReader(j.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), r.Get(words[0]))
+}
+
+func TestValueDictionary_corrupt(t *testing.T) {
+	c, err := FromMap(categories(1000, 10))
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	l := c.Spec()
+
+	b := append([]byte(nil), w.Bytes()...)
+	b[l.Values.Offset+3] = 10
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	assert.ErrorContains(t, g.Verify(), "slot 3 has code 10, but the dictionary has 10 values")
+	// Lookups of the slot miss, as they do in a RawTable, rather than panic.
+	k, ok := g.slotKey(3)
+	require.True(t, ok)
+	_, ok = g.GetOK(k)
+	assert.False(t, ok)
+	dst := []uint64{0}
+	assert.Zero(t, g.GetBatchSorted([]uint64{k}, dst))
+	raw, err := OpenRaw(b)
+	require.NoError(t, err)
+	_, ok = raw.GetOK(k)
+	assert.False(t, ok)
+
+	b = append([]byte(nil), w.Bytes()...)
+	b[8+1] &^= byte(FlagDictionary >> 8)
+	_, err = Mmap(b)
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
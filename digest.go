@@ -0,0 +1,143 @@
+package uint64mph
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// digestMagic starts the input of the hash computed by Digest, and tells
+// tables with pair values apart from others.
+const (
+	digestMagic     = "uint64mph digest 1\n"
+	pairDigestMagic = "uint64mph pair digest 1\n"
+)
+
+// Digest returns a SHA-256 hash of the entries of the table, for cache keys and
+// ETags. It only depends on the keys and values: tables with the same entries
+// have the same digest, however they were built, laid out or serialized. The
+// metadata, columns and generations don't count, nor do keys hidden by Delete.
+//
+// The digest is the SHA-256 of "uint64mph digest 1\n" followed by the number
+// of entries and every key and its value in ascending order of key, all as
+// little endian uint64s. Tables with pair values hash "uint64mph pair digest
+// 1\n" and both values instead.
+//
+// Computing the digest reads and sorts all entries, unless the table was
+// loaded from a file written with WithDigest, which stores it. Index-only
+// tables without a stored digest panic with ErrNoValues.
+func (c *CHD) Digest() [32]byte {
+	c.checkClosed()
+	if c.digest != nil {
+		return *c.digest
+	}
+	if c.IndexOnly() {
+		panic(ErrNoValues)
+	}
+	return c.computeDigest()
+}
+
+// computeDigest computes the digest of the entries, see Digest.
+func (c *CHD) computeDigest() [32]byte {
+	sorted := c.sorted
+	if sorted == nil {
+		sorted = c.sortKeys()
+	}
+	h := sha256.New()
+	magic := digestMagic
+	if c.pairValues != nil {
+		magic = pairDigestMagic
+	}
+	h.Write([]byte(magic))
+	buf := binary.LittleEndian.AppendUint64(make([]byte, 0, 64<<10), uint64(len(sorted)-c.deletedCount))
+	for _, ti := range sorted {
+		if c.isDeleted(int(ti)) {
+			continue
+		}
+		k, _ := c.slotKey(int(ti))
+		buf = binary.LittleEndian.AppendUint64(buf, c.unmaskKey(k))
+		if c.pairValues != nil {
+			buf = binary.LittleEndian.AppendUint64(buf, c.pairValues[2*ti])
+			buf = binary.LittleEndian.AppendUint64(buf, c.pairValues[2*ti+1])
+		} else {
+			buf = binary.LittleEndian.AppendUint64(buf, c.value(int(ti)))
+		}
+		if len(buf) > cap(buf)-24 {
+			h.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	h.Write(buf)
+	var d [32]byte
+	h.Sum(d[:0])
+	return d
+}
+
+// WithDigest stores the digest of the table in the file, so that Stat reports
+// it and tables loaded from the file return it from Digest without reading
+// their entries. The digest is computed if the table doesn't have one stored
+// yet. Only Write and WriteSplit, which puts it in the structure file, support
+// it.
+//
+// SetValue drops the stored digest. For tables opened by OpenMmapFileRW, it
+// zeroes the digest in the file too.
+func WithDigest() WriteOption {
+	return func(o *writeOptions) {
+		o.digest = true
+	}
+}
+
+// writeDigest returns the digest to write for o, or nil if none. Index-only
+// tables aren't written, so they don't need a stored digest.
+func (c *CHD) writeDigest(o writeOptions) *[32]byte {
+	if !o.digest {
+		return nil
+	}
+	if c.digest != nil {
+		return c.digest
+	}
+	d := c.computeDigest()
+	return &d
+}
+
+// dropDigest drops the stored digest after a value changed. If inPlace, the
+// value was changed in the buffer the table was loaded from, and the digest in
+// it is zeroed too.
+func (c *CHD) dropDigest(inPlace bool) {
+	c.digest = nil
+	s := c.digestSection
+	if inPlace && s != nil && c.aliases(unsafe.Pointer(&s[0])) {
+		clear(s)
+	}
+	c.digestSection = nil
+}
+
+// verifyDigest checks that the stored digest, if any, matches the entries.
+func (c *CHD) verifyDigest() error {
+	if c.digest == nil || c.IndexOnly() {
+		return nil
+	}
+	if d := c.computeDigest(); d != *c.digest {
+		return fmt.Errorf("stored digest %x doesn't match the entries' %x", *c.digest, d)
+	}
+	return nil
+}
+
+// digest writes the digest section.
+func (e *encoder) digest(d *[32]byte) {
+	e.section(sectionDigest, 1, len(d))
+	e.bytes(d[:])
+}
+
+// loadDigest loads the digest section, if the file has one whose digest isn't
+// zeroed.
+func (c *CHD) loadDigest(data func(tag uint32) []byte) {
+	b := data(sectionDigest)
+	if b == nil || bytes.Equal(b, make([]byte, len(b))) {
+		return
+	}
+	c.digestSection = b
+	c.digest = (*[32]byte)(bytes.Clone(b))
+}
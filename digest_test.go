@@ -0,0 +1,194 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigest(t *testing.T) {
+	m := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		m[5000+i] = i % 7
+	}
+	want := MustFromMap(m, WithSeed(50)).Digest()
+	for name, opts := range map[string][]BuildOption{
+		"seed":    {WithSeed(51)},
+		"hashed":  {WithSeed(52), hashed},
+		"packed":  {WithSeed(53), WithPackedValues()},
+		"dict":    {WithSeed(54), WithValueDictionary()},
+		"dense":   {WithSeed(55), WithDenseThreshold(0.5)},
+		"pthash":  {WithSeed(56), WithPTHash(7, 0.99)},
+		"masked":  {WithSeed(57), MaskKeys(3)},
+		"sorted":  {WithSeed(58), WithSortedIndex()},
+		"outer":   {WithSeed(59), WithOuterSeed(12)},
+		"metrics": {WithSeed(60), WithValueStats()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(m, opts...)
+			require.NoError(t, err)
+			assert.Equal(t, want, c.Digest())
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w, WithValueDeltas()))
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(3))
+			}
+			g, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+			assert.Equal(t, want, g.Digest())
+		})
+	}
+}
+
+func TestDigest_changes(t *testing.T) {
+	m := randomData(300, 51)
+	c := MustFromMap(m, WithSeed(51))
+	want := c.Digest()
+	for k, v := range m {
+		require.NoError(t, c.SetValue(k, v+1))
+		assert.NotEqual(t, want, c.Digest(), "value of %d", k)
+		require.NoError(t, c.SetValue(k, v))
+	}
+	assert.Equal(t, want, c.Digest())
+
+	// Adding, removing or renaming a key changes it too.
+	k := firstKey(m)
+	require.NotContains(t, m, k+1)
+	for _, change := range []func(map[uint64]uint64){
+		func(n map[uint64]uint64) { n[k+1] = 0 },
+		func(n map[uint64]uint64) { delete(n, k) },
+		func(n map[uint64]uint64) { n[k+1] = n[k]; delete(n, k) },
+	} {
+		n := map[uint64]uint64{}
+		for k, v := range m {
+			n[k] = v
+		}
+		change(n)
+		assert.NotEqual(t, want, MustFromMap(n, WithSeed(52)).Digest())
+	}
+
+	// Pair values hash both values.
+	b := NewPairBuilder()
+	b.Seed(53)
+	b.Add2(1, 2, 3)
+	p, err := b.Build()
+	require.NoError(t, err)
+	b = NewPairBuilder()
+	b.Seed(53)
+	b.Add2(1, 2, 4)
+	q, err := b.Build()
+	require.NoError(t, err)
+	assert.NotEqual(t, p.Digest(), q.Digest())
+	assert.NotEqual(t, p.Digest(), MustFromMap(map[uint64]uint64{1: 2}).Digest())
+}
+
+func TestWithDigest(t *testing.T) {
+	m := randomData(500, 54)
+	c := MustFromMap(m, WithSeed(54))
+	want := c.Digest()
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Zero(t, fi.Flags&FlagDigest)
+	assert.Zero(t, fi.Digest)
+
+	w.Reset()
+	require.NoError(t, c.Write(w, WithDigest()))
+	fi, err = Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagDigest)
+	assert.Equal(t, want, fi.Digest)
+	assert.Equal(t, fi.Size, int64(w.Len()))
+
+	g, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	require.NotNil(t, g.digest)
+	assert.Equal(t, want, g.Digest())
+	assert.NoError(t, g.Verify())
+	assert.Equal(t, want, g.Materialize().Digest())
+
+	// Index-only tables return the stored digest.
+	idx, err := MmapWithOptions(w.Bytes(), SkipValues())
+	require.NoError(t, err)
+	assert.Equal(t, want, idx.Digest())
+	idx.digest = nil
+	assert.PanicsWithValue(t, ErrNoValues, func() { idx.Digest() })
+
+	structure, values := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.WriteSplit(structure, values, WithDigest()))
+	fi, err = Stat(bytes.NewReader(structure.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, want, fi.Digest)
+	s, err := MmapSplit(structure.Bytes(), values.Bytes())
+	require.NoError(t, err)
+	require.NotNil(t, s.digest)
+	assert.Equal(t, want, s.Digest())
+}
+
+func TestWithDigest_setValue(t *testing.T) {
+	m := randomData(200, 55)
+	c := MustFromMap(m, WithSeed(55))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w, WithDigest()))
+	g, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	k := firstKey(m)
+	require.NoError(t, g.SetValue(k, m[k]+1))
+	assert.Nil(t, g.digest)
+	m[k]++
+	assert.Equal(t, MustFromMap(m, WithSeed(56)).Digest(), g.Digest())
+}
+
+func TestWithDigest_mmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	m := randomData(200, 56)
+	c := MustFromMap(m, WithSeed(56))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w, WithDigest()))
+	path := filepath.Join(t.TempDir(), "table.idx")
+	require.NoError(t, os.WriteFile(path, w.Bytes(), 0644))
+
+	rw, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	k := firstKey(m)
+	require.NoError(t, rw.SetValue(k, m[k]+1))
+	m[k]++
+	require.NoError(t, rw.Close())
+
+	// The stale digest is zeroed in the file.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	fi, err := Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagDigest)
+	assert.Zero(t, fi.Digest)
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	assert.Nil(t, g.digest)
+	assert.Equal(t, MustFromMap(m, WithSeed(57)).Digest(), g.Digest())
+}
+
+func TestWithDigest_corrupt(t *testing.T) {
+	c := MustFromMap(sampleData, WithSeed(57))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w, WithDigest()))
+	b := w.Bytes()
+	h, err := mmapHeader(b)
+	require.NoError(t, err)
+	s, _ := h.section(sectionDigest)
+	b[s.offset]++
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	assert.ErrorContains(t, g.Verify(), "stored digest")
+
+	h.flags &^= FlagDigest
+	assert.ErrorContains(t, h.check(), "digest flag doesn't match")
+}
@@ -0,0 +1,73 @@
+package uint64mph
+
+// Number of entries in every chunk of a builder's storage, except for the first
+// one, which grows until it has this many.
+const entryChunkSize = 1 << 20
+
+// entryChunks stores the entries added to a builder in chunks, so adding
+// entries never copies more than a chunk and memory grows in small steps, even
+// for billions of entries.
+type entryChunks struct {
+	keys   [][]uint64
+	values [][]uint64
+	n      int
+}
+
+func (e *entryChunks) add(key, value uint64) {
+	last := len(e.keys) - 1
+	if last < 0 || len(e.keys[last]) == entryChunkSize {
+		var size int
+		if last >= 0 {
+			// Don't bother growing chunks once entries don't fit in one.
+			size = entryChunkSize
+		}
+		e.keys = append(e.keys, make([]uint64, 0, size))
+		e.values = append(e.values, make([]uint64, 0, size))
+		last++
+	}
+	e.keys[last] = append(e.keys[last], key)
+	e.values[last] = append(e.values[last], value)
+	e.n++
+}
+
+// addSlices adds the entries keys[i], values[i].
+func (e *entryChunks) addSlices(keys, values []uint64) {
+	for len(keys) > 0 {
+		last := len(e.keys) - 1
+		if last < 0 || len(e.keys[last]) == entryChunkSize {
+			e.add(keys[0], values[0])
+			keys, values = keys[1:], values[1:]
+			continue
+		}
+		n := min(len(keys), entryChunkSize-len(e.keys[last]))
+		e.keys[last] = append(e.keys[last], keys[:n]...)
+		e.values[last] = append(e.values[last], values[:n]...)
+		e.n += n
+		keys, values = keys[n:], values[n:]
+	}
+}
+
+// reserve makes room for n more entries, so adding them doesn't grow the first
+// chunk several times. Later chunks are allocated at full size anyway.
+func (e *entryChunks) reserve(n int) {
+	if n <= 0 || len(e.keys) > 1 {
+		return
+	}
+	size := min(e.n+n, entryChunkSize)
+	if len(e.keys) == 0 {
+		e.keys = [][]uint64{make([]uint64, 0, size)}
+		e.values = [][]uint64{make([]uint64, 0, size)}
+	} else if cap(e.keys[0]) < size {
+		e.keys[0] = append(make([]uint64, 0, size), e.keys[0]...)
+		e.values[0] = append(make([]uint64, 0, size), e.values[0]...)
+	}
+}
+
+func (e *entryChunks) len() int {
+	return e.n
+}
+
+// key returns the key of the i'th entry. All chunks but the last are full.
+func (e *entryChunks) key(i int) uint64 {
+	return e.keys[i/entryChunkSize][i%entryChunkSize]
+}
@@ -0,0 +1,88 @@
+package uint64mph
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryChunks(t *testing.T) {
+	var e entryChunks
+	e.add(0, 0)
+	keys := make([]uint64, entryChunkSize+10)
+	for i := range keys {
+		keys[i] = uint64(i + 1)
+	}
+	e.addSlices(keys, keys)
+	e.add(uint64(len(keys)+1), uint64(len(keys)+1))
+	require.Equal(t, len(keys)+2, e.len())
+	assert.Len(t, e.keys, 2)
+	assert.Len(t, e.keys[0], entryChunkSize)
+	assert.Len(t, e.keys[1], 12)
+	var want uint64
+	for c, chunk := range e.keys {
+		for i, k := range chunk {
+			assert.Equal(t, want, k)
+			assert.Equal(t, want, e.values[c][i])
+			want++
+		}
+	}
+
+	// Duplicates of keys in the second chunk are merged into the right entry.
+	e.add(entryChunkSize+3, 1000)
+	out, err := resolveDuplicates(&e, func(key, existing, incoming uint64) (uint64, error) {
+		return existing + incoming, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, len(keys)+2, out.len())
+	assert.Equal(t, uint64(entryChunkSize+1003), out.values[1][3])
+}
+
+func TestEntryChunksReserve(t *testing.T) {
+	var e entryChunks
+	e.add(1, 1)
+	e.reserve(99)
+	assert.Equal(t, 100, cap(e.keys[0]))
+	assert.Equal(t, []uint64{1}, e.values[0])
+	// The first chunk never grows beyond a full chunk.
+	e.reserve(entryChunkSize)
+	assert.Equal(t, entryChunkSize, cap(e.keys[0]))
+	assert.Equal(t, 1, e.len())
+}
+
+func TestEntryChunks_memory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a lot of memory")
+	}
+	const n = 4 << 20
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	var keys, values []uint64
+	plain := allocated(func() {
+		for i := uint64(0); i < n; i++ {
+			keys = append(keys, i)
+			values = append(values, i)
+		}
+	})
+	b := Builder()
+	chunked := allocated(func() {
+		for i := uint64(0); i < n; i++ {
+			b.Add(i, i)
+		}
+	})
+	runtime.KeepAlive(keys)
+	runtime.KeepAlive(values)
+	t.Logf("appending %d entries allocated %d MiB, chunked %d MiB", n, plain>>20, chunked>>20)
+	// Growing a single slice allocates several times its final size, the
+	// chunked builder only copies while growing the first chunk.
+	assert.Less(t, chunked, plain/2)
+	assert.Less(t, chunked, uint64(3*16*n))
+}
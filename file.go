@@ -0,0 +1,135 @@
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrFileTruncated is returned by Revalidate when the mapped file shrank.
+	// Lookups touching the lost pages crash the process with SIGBUS, so the
+	// table must not be used anymore.
+	ErrFileTruncated = errors.New("uint64mph: mapped file was truncated")
+	// ErrFileReplaced is returned by Revalidate when another file took the
+	// path of the mapped one, like WriteFile does. The table keeps working
+	// on the old file, but is stale: open the path again to see the new one.
+	ErrFileReplaced = errors.New("uint64mph: mapped file was replaced")
+)
+
+// Revalidate checks whether the file of a table opened by OpenMmapFile or
+// OpenMmapFileRW is still safe to use. It returns ErrFileTruncated if the
+// mapped file is now shorter than when it was opened, and ErrFileReplaced if
+// the path now holds another file. It does nothing for other tables.
+//
+// A mapped file must never be truncated or rewritten in place: lookups reading
+// a page that no longer exists in the file kill the process with SIGBUS, and
+// Revalidate only detects that after the fact. Write a new file and rename it
+// over the old one instead, as WriteFile does, and reopen the path when
+// Revalidate returns ErrFileReplaced. See also CopyStructure.
+func (c *CHD) Revalidate() error {
+	if c == nil {
+		return nil
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if r, ok := c.closer.(interface{ revalidate() error }); ok {
+		return r.revalidate()
+	}
+	return nil
+}
+
+// mappedFile records the file behind a mapping, to check in revalidate that it
+// is still as it was when mapped.
+type mappedFile struct {
+	path string
+	// The mapped file, if kept open.
+	file   *os.File
+	opened os.FileInfo
+}
+
+// fileInfo returns the file as it was when mapped.
+func (m *mappedFile) fileInfo() os.FileInfo {
+	return m.opened
+}
+
+func (m *mappedFile) revalidate() error {
+	if m.file != nil {
+		fi, err := m.file.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() < m.opened.Size() {
+			return fmt.Errorf("%s: %w to %d bytes, %d are mapped", m.path, ErrFileTruncated, fi.Size(), m.opened.Size())
+		}
+	}
+	fi, err := os.Stat(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w: the file was removed", m.path, ErrFileReplaced)
+	}
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, m.opened) {
+		return fmt.Errorf("%s: %w", m.path, ErrFileReplaced)
+	}
+	return nil
+}
+
+// WriteFile writes the table to a new file next to path and renames it to
+// path once it is synced, so that tables mapping the old file keep working and
+// readers never see a partial file. The file is created with mode 0644.
+func (c *CHD) WriteFile(path string, opts ...WriteOption) error {
+	if err := c.checkWritable(true); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(f, c, opts); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// writeFile writes c to f, syncs and closes it.
+func writeFile(f *os.File, c *CHD, opts []WriteOption) error {
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := c.Write(f, opts...); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// mapRange checks that the size bytes at off lie within a file of fileSize
+// bytes and fit in memory, and returns their size. A size of 0 selects the
+// rest of the file.
+func mapRange(fileSize, off, size int64) (int64, error) {
+	if off < 0 || size < 0 || off > fileSize || size > fileSize-off {
+		return 0, fmt.Errorf("%w: %d bytes at offset %d are beyond the end of the %d byte file", ErrNotCHD, size, off, fileSize)
+	}
+	if size == 0 {
+		size = fileSize - off
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("%w: empty file", ErrNotCHD)
+	}
+	if int64(int(size)) != size {
+		return 0, fmt.Errorf("file too large to map (%d bytes)", size)
+	}
+	return size, nil
+}
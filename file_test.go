@@ -0,0 +1,50 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "table")
+	c := MustFromMap(sampleData)
+	require.NoError(t, c.WriteFile(path))
+	require.NoError(t, MustFromMap(map[uint64]uint64{1: 2}).WriteFile(path, WithValueDeltas()))
+
+	want := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(map[uint64]uint64{1: 2}).Write(want, WithValueDeltas()))
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want.Bytes(), got)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files are left behind")
+
+	assert.Error(t, c.WriteFile(filepath.Join(dir, "missing", "table")))
+	var nilTable *CHD
+	assert.ErrorIs(t, nilTable.WriteFile(path), ErrNilTable)
+
+	// Tables that weren't opened from a file are always valid.
+	assert.NoError(t, c.Revalidate())
+	assert.NoError(t, nilTable.Revalidate())
+}
+
+func TestCopyStructure(t *testing.T) {
+	c := MustFromMap(randomData(1000, 1), hashed, WithFilter())
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	l, err := MmapWithOptions(w.Bytes(), CopyStructure())
+	require.NoError(t, err)
+	assert.False(t, l.aliases(unsafe.Pointer(unsafe.SliceData(l.r))))
+	assert.False(t, l.aliases(unsafe.Pointer(unsafe.SliceData(l.indices))))
+	assert.False(t, l.aliases(unsafe.Pointer(unsafe.SliceData(l.filter.fingerprints))))
+	assert.Equal(t, zeroCopy, l.aliases(unsafe.Pointer(unsafe.SliceData(l.keys))))
+	assert.NoError(t, l.Verify())
+}
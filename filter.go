@@ -0,0 +1,165 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"math/rand"
+)
+
+// xorFilter is an xor filter with 8 bit fingerprints (Graf and Lemire, "Xor
+// Filters: Faster and Smaller Than Bloom and Cuckoo Filters"). It uses about 9.8
+// bits per key and has a false positive rate of about 0.4%, and never reports
+// a key that was added as absent.
+type xorFilter struct {
+	seed         uint64
+	blockLength  uint32
+	fingerprints []uint8
+}
+
+// Size of the filter section header: the seed and the block length, padded.
+const filterHeaderSize = 16
+
+// Number of seeds tried before giving up on building a filter. Every attempt
+// succeeds with a probability of about 90%.
+const maxFilterAttempts = 100
+
+func murmur64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// reduce maps x uniformly onto [0, n).
+func reduce(x, n uint32) uint32 {
+	return uint32((uint64(x) * uint64(n)) >> 32)
+}
+
+func (f *xorFilter) fingerprint(hash uint64) uint8 {
+	return uint8(hash ^ (hash >> 32))
+}
+
+// locations returns the three fingerprint indices of a hashed key.
+func (f *xorFilter) locations(hash uint64) (uint32, uint32, uint32) {
+	h0 := reduce(uint32(hash), f.blockLength)
+	h1 := reduce(uint32(bits.RotateLeft64(hash, 21)), f.blockLength) + f.blockLength
+	h2 := reduce(uint32(bits.RotateLeft64(hash, 42)), f.blockLength) + 2*f.blockLength
+	return h0, h1, h2
+}
+
+// contains reports whether key might be in the set. False positives are
+// possible, false negatives are not.
+func (f *xorFilter) contains(key uint64) bool {
+	hash := murmur64(key + f.seed)
+	h0, h1, h2 := f.locations(hash)
+	return f.fingerprint(hash) == f.fingerprints[h0]^f.fingerprints[h1]^f.fingerprints[h2]
+}
+
+// newXorFilter builds a filter containing keys, which must be unique.
+func newXorFilter(keys []uint64, rng *rand.Rand) (*xorFilter, error) {
+	capacity := 32 + uint32(1.23*float64(len(keys)))
+	capacity = capacity / 3 * 3
+	f := &xorFilter{
+		blockLength:  capacity / 3,
+		fingerprints: make([]uint8, capacity),
+	}
+
+	type xorSet struct {
+		mask  uint64
+		count uint32
+	}
+	type keyIndex struct {
+		hash  uint64
+		index uint32
+	}
+	sets := make([]xorSet, capacity)
+	queue := make([]uint32, 0, capacity)
+	stack := make([]keyIndex, 0, len(keys))
+	for attempt := 0; attempt < maxFilterAttempts; attempt++ {
+		f.seed = rng.Uint64()
+		for i := range sets {
+			sets[i] = xorSet{}
+		}
+		for _, k := range keys {
+			hash := murmur64(k + f.seed)
+			h0, h1, h2 := f.locations(hash)
+			for _, h := range [3]uint32{h0, h1, h2} {
+				sets[h].mask ^= hash
+				sets[h].count++
+			}
+		}
+
+		// Peel off the locations that only a single key maps to.
+		queue = queue[:0]
+		for i, s := range sets {
+			if s.count == 1 {
+				queue = append(queue, uint32(i))
+			}
+		}
+		stack = stack[:0]
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if sets[i].count != 1 {
+				continue
+			}
+			hash := sets[i].mask
+			stack = append(stack, keyIndex{hash, i})
+			h0, h1, h2 := f.locations(hash)
+			for _, h := range [3]uint32{h0, h1, h2} {
+				sets[h].mask ^= hash
+				sets[h].count--
+				if sets[h].count == 1 {
+					queue = append(queue, h)
+				}
+			}
+		}
+		if len(stack) != len(keys) {
+			continue
+		}
+
+		for i := len(stack) - 1; i >= 0; i-- {
+			ki := stack[i]
+			h0, h1, h2 := f.locations(ki.hash)
+			f.fingerprints[ki.index] = 0
+			f.fingerprints[ki.index] = f.fingerprint(ki.hash) ^ f.fingerprints[h0] ^ f.fingerprints[h1] ^ f.fingerprints[h2]
+		}
+		return f, nil
+	}
+	return nil, errors.New("failed to build a filter")
+}
+
+func (e *encoder) filter(f *xorFilter) {
+	e.section(sectionFilter, 1, filterHeaderSize+len(f.fingerprints))
+	e.uint64(f.seed)
+	e.uint32(f.blockLength)
+	e.uint32(0)
+	e.bytes(f.fingerprints)
+	e.pad()
+}
+
+// decodeFilter decodes the data of a filter section. It returns nil if the
+// section is invalid.
+func decodeFilter(b []byte) *xorFilter {
+	if len(b) < filterHeaderSize {
+		return nil
+	}
+	f := &xorFilter{
+		seed:         binary.LittleEndian.Uint64(b),
+		blockLength:  binary.LittleEndian.Uint32(b[8:]),
+		fingerprints: b[filterHeaderSize:len(b):len(b)],
+	}
+	if uint64(len(f.fingerprints)) != 3*uint64(f.blockLength) || f.blockLength == 0 {
+		return nil
+	}
+	return f
+}
+
+// HasFilter reports whether the table has a filter to speed up lookups of
+// missing keys, see WithFilter.
+func (c *CHD) HasFilter() bool {
+	return c != nil && c.filter != nil
+}
@@ -0,0 +1,93 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXorFilter(t *testing.T) {
+	f, err := newXorFilter(words, rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	for _, w := range words {
+		require.True(t, f.contains(w))
+	}
+	bitsPerKey := float64(8*len(f.fingerprints)) / float64(len(words))
+	assert.Less(t, bitsPerKey, 10.0)
+
+	rng := rand.New(rand.NewSource(2))
+	fp := 0
+	const probes = 100000
+	for i := 0; i < probes; i++ {
+		if f.contains(rng.Uint64()) {
+			fp++
+		}
+	}
+	// The expected false positive rate is 1/256.
+	assert.Less(t, float64(fp)/probes, 0.006)
+
+	empty, err := newXorFilter(nil, rng)
+	require.NoError(t, err)
+	assert.False(t, empty.contains(1))
+}
+
+func TestWithFilter(t *testing.T) {
+	b := Builder()
+	for i, w := range words[:10000] {
+		b.Add(w, uint64(i))
+	}
+	c, err := b.Build(WithFilter(), WithSeed(1))
+	require.NoError(t, err)
+	assert.True(t, c.HasFilter())
+	s := c.Stats()
+	assert.Equal(t, len(c.filter.fingerprints), s.FilterBytes)
+	assert.Equal(t, int64(s.FilterBytes), c.MemoryFootprint().Filter)
+
+	plain, err := b.Build(WithSeed(1))
+	require.NoError(t, err)
+	assert.False(t, plain.HasFilter())
+	assert.Zero(t, plain.Stats().FilterBytes)
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagFilter, fi.Flags)
+	st, v := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.WriteSplit(st, v))
+
+	for name, load := range map[string]func() (*CHD, error){
+		"Mmap":   func() (*CHD, error) { return Mmap(w.Bytes()) },
+		"ReadAt": func() (*CHD, error) { return ReadAt(bytes.NewReader(w.Bytes())) },
+		"split":  func() (*CHD, error) { return MmapSplit(st.Bytes(), v.Bytes()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			g, err := load()
+			require.NoError(t, err)
+			require.True(t, g.HasFilter())
+			for _, h := range []*CHD{g, g.Materialize(), g.MapValues(func(k, v uint64) uint64 { return v })} {
+				for i, k := range words[:10000] {
+					assert.Equal(t, uint64(i), h.Get(k))
+				}
+				for _, k := range words[10000:11000] {
+					assert.False(t, h.Contains(k))
+					_, ok := h.GetOK(k)
+					assert.False(t, ok)
+				}
+				assert.NoError(t, h.Verify())
+			}
+		})
+	}
+
+	// Corrupt the block length of the filter.
+	bad := append([]byte(nil), w.Bytes()...)
+	l := c.Spec()
+	assert.Equal(t, int64(w.Len()), l.Size)
+	off := l.Values.Offset + l.Values.Size() + sectionHeaderSize + 8
+	bad[off]++
+	_, err = Mmap(bad)
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
@@ -0,0 +1,120 @@
+package uint64mph
+
+import (
+	"io"
+	"math"
+)
+
+// FloatBuilder builds a hash table with float64 values. It is a thin wrapper
+// around CHDBuilder that stores every value as its bit pattern, see
+// math.Float64bits.
+//
+// The serialized form is identical to that of a CHD, so a table written by a
+// CHDFloat can be read as a CHD and vice versa. Values round-trip bit-exactly,
+// including negative zero and the payload of every NaN. Note that NaN isn't
+// equal to itself, so compare values read back with math.IsNaN or their bits.
+type FloatBuilder struct {
+	b *CHDBuilder
+}
+
+// Create a new builder for a hash table with float64 values.
+func NewFloatBuilder() *FloatBuilder {
+	return &FloatBuilder{b: Builder()}
+}
+
+// Seed the RNG. See CHDBuilder.Seed.
+func (b *FloatBuilder) Seed(seed int64) {
+	b.b.Seed(seed)
+}
+
+// Add a key and value to the hash table.
+func (b *FloatBuilder) Add(key uint64, value float64) {
+	b.b.Add(key, math.Float64bits(value))
+}
+
+// Build the hash table. See CHDBuilder.Build.
+func (b *FloatBuilder) Build(opts ...BuildOption) (*CHDFloat, error) {
+	c, err := b.b.Build(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDFloat{c: c}, nil
+}
+
+// CHDFloat is a hash table lookup with float64 values.
+type CHDFloat struct {
+	c *CHD
+}
+
+// NewCHDFloat interprets the values of c as float64s.
+func NewCHDFloat(c *CHD) *CHDFloat {
+	return &CHDFloat{c: c}
+}
+
+// ReadFloat reads a serialized CHD and interprets its values as float64s.
+func ReadFloat(r io.Reader) (*CHDFloat, error) {
+	c, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDFloat{c: c}, nil
+}
+
+// MmapFloat is like Mmap but interprets the values as float64s.
+func MmapFloat(b []byte) (*CHDFloat, error) {
+	c, err := Mmap(b)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDFloat{c: c}, nil
+}
+
+// CHD returns the underlying table.
+func (c *CHDFloat) CHD() *CHD {
+	return c.c
+}
+
+// Get an entry from the hash table and report whether it was present. Missing
+// keys return (0, false): there is no sentinel value, as every bit pattern is
+// some float64.
+func (c *CHDFloat) Get(key uint64) (float64, bool) {
+	v, ok := c.c.GetOK(key)
+	if !ok {
+		return 0, false
+	}
+	return math.Float64frombits(v), true
+}
+
+func (c *CHDFloat) Len() int {
+	return c.c.Len()
+}
+
+// Iterate over entries in the hash table.
+func (c *CHDFloat) Iterate() *FloatIterator {
+	it := c.c.Iterate()
+	if it == nil {
+		return nil
+	}
+	return &FloatIterator{it: it}
+}
+
+// Serialize the hash table. See CHD.Write.
+func (c *CHDFloat) Write(w io.Writer) error {
+	return c.c.Write(w)
+}
+
+type FloatIterator struct {
+	it *Iterator
+}
+
+func (c *FloatIterator) Get() (key uint64, value float64) {
+	k, v := c.it.Get()
+	return k, math.Float64frombits(v)
+}
+
+func (c *FloatIterator) Next() *FloatIterator {
+	if c.it.Next() == nil {
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,69 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A NaN with a payload other than that of math.NaN.
+var nanPayload = math.Float64frombits(0x7ff8000000000123)
+
+var floatData = map[uint64]float64{
+	1: 1.5,
+	2: math.Copysign(0, -1),
+	3: math.Inf(-1),
+	4: math.MaxFloat64,
+	5: math.SmallestNonzeroFloat64,
+	6: nanPayload,
+	7: math.NaN(),
+	8: 0,
+}
+
+func TestCHDFloat(t *testing.T) {
+	b := NewFloatBuilder()
+	b.Seed(5)
+	for k, v := range floatData {
+		b.Add(k, v)
+	}
+	c, err := b.Build(hashed)
+	assert.NoError(t, err)
+	assert.Equal(t, len(floatData), c.Len())
+	for k, v := range floatData {
+		got, ok := c.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, math.Float64bits(v), math.Float64bits(got), "key %d", k)
+	}
+	v, ok := c.Get(9)
+	assert.False(t, ok)
+	assert.Zero(t, v)
+
+	w := &bytes.Buffer{}
+	assert.NoError(t, c.Write(w))
+	n, err := MmapFloat(w.Bytes())
+	assert.NoError(t, err)
+	seen := map[uint64]uint64{}
+	for it := n.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		seen[k] = math.Float64bits(v)
+	}
+	assert.Len(t, seen, len(floatData))
+	for k, v := range floatData {
+		assert.Equal(t, math.Float64bits(v), seen[k])
+	}
+
+	// The on-disk representation is the uint64 bit pattern.
+	u, err := Mmap(w.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x7ff8000000000123), u.Get(6))
+	assert.Equal(t, uint64(1<<63), u.Get(2))
+	r, err := ReadFloat(bytes.NewReader(w.Bytes()))
+	assert.NoError(t, err)
+	v, ok = r.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, v)
+	v, _ = NewCHDFloat(u).Get(7)
+	assert.True(t, math.IsNaN(v))
+}
@@ -0,0 +1,167 @@
+package uint64mph
+
+import "unsafe"
+
+// Footprint describes the memory used by a table.
+type Footprint struct {
+	// Bytes used by each section. The keys of dense tables are their presence
+	// bitmap. The hash functions of PTHash tables are their free slots, and the
+	// indices their pilots.
+	HashFunctions int64
+	Indices       int64
+	Keys          int64
+	Values        int64
+	// Bytes used by the filter, see WithFilter.
+	Filter int64
+	// Bytes used by the CHD struct itself, including the slice headers.
+	Overhead int64
+	// Sum of all the above.
+	Total int64
+	// Bytes of Total that alias the buffer passed to Mmap (typically an mmapped
+	// file) rather than being allocated by this package.
+	Aliased int64
+	// Bytes of Total that are allocated on the heap by this package.
+	Heap int64
+}
+
+// MemoryFootprint returns how much memory the table uses.
+func (c *CHD) MemoryFootprint() Footprint {
+	if c == nil {
+		return Footprint{}
+	}
+	f := Footprint{
+		HashFunctions: 8 * int64(cap(c.r)),
+		Indices:       2 * int64(cap(c.indices)),
+		Keys:          8 * int64(cap(c.keys)),
+		Values:        8*int64(cap(c.values)) + int64(cap(c.packed)) + 8*int64(cap(c.dict)) + 8*int64(cap(c.pairValues)),
+		Overhead:      int64(unsafe.Sizeof(*c)),
+	}
+	r, indices := unsafe.Pointer(unsafe.SliceData(c.r)), unsafe.Pointer(unsafe.SliceData(c.indices))
+	if c.pthash != nil {
+		r, indices = unsafe.Pointer(unsafe.SliceData(c.pthash.free)), unsafe.Pointer(unsafe.SliceData(c.pthash.pilots))
+		f.HashFunctions = 4 * int64(cap(c.pthash.free))
+		f.Indices = 8 * int64(cap(c.pthash.pilots))
+		f.Overhead += int64(unsafe.Sizeof(*c.pthash))
+	}
+	keys := c.keys
+	if c.dense != nil {
+		keys = c.dense.present
+		f.Keys = 8 * int64(cap(keys))
+		f.Overhead += int64(unsafe.Sizeof(*c.dense))
+	}
+	var fingerprints []uint8
+	if c.filter != nil {
+		fingerprints = c.filter.fingerprints
+		f.Filter = int64(cap(fingerprints))
+		f.Overhead += int64(unsafe.Sizeof(*c.filter))
+	}
+	f.Total = f.HashFunctions + f.Indices + f.Keys + f.Values + f.Filter + f.Overhead
+	for _, s := range []struct {
+		p    unsafe.Pointer
+		size int64
+	}{
+		{r, f.HashFunctions},
+		{indices, f.Indices},
+		{unsafe.Pointer(unsafe.SliceData(keys)), f.Keys},
+		{c.valuesPointer(), f.Values - 8*int64(cap(c.dict))},
+		{unsafe.Pointer(unsafe.SliceData(c.dict)), 8 * int64(cap(c.dict))},
+		{unsafe.Pointer(unsafe.SliceData(fingerprints)), f.Filter},
+	} {
+		if s.size > 0 && c.aliases(s.p) {
+			f.Aliased += s.size
+		}
+	}
+	f.Heap = f.Total - f.Aliased
+	return f
+}
+
+// aliases returns whether p points into the buffer passed to Mmap.
+func (c *CHD) aliases(p unsafe.Pointer) bool {
+	for _, b := range c.backing {
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+		if uintptr(p) >= start && uintptr(p) < start+uintptr(len(b)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Materialize returns a table that doesn't alias the buffer passed to Mmap, so
+// the buffer can be unmapped or reused. If c already owns all its memory, c
+// itself is returned. Otherwise all sections are copied into a single new
+// allocation.
+func (c *CHD) Materialize() *CHD {
+	if c == nil || c.backing == nil {
+		return c
+	}
+	indexWords := (len(c.indices) + 3) / 4
+	packedWords := (len(c.packed) + 7) / 8
+	arena := make([]uint64, len(c.r)+indexWords+len(c.keys)+len(c.values)+packedWords+len(c.dict)+len(c.pairValues))
+	take := func(n int) []uint64 {
+		s := arena[:n:n]
+		arena = arena[n:]
+		return s
+	}
+	n := &CHD{
+		r: take(len(c.r)),
+	}
+	if indexWords > 0 {
+		n.indices = unsafe.Slice((*uint16)(unsafe.Pointer(&take(indexWords)[0])), len(c.indices))
+	}
+	n.keys = take(len(c.keys))
+	n.values = take(len(c.values))
+	if packedWords > 0 {
+		n.packed = unsafe.Slice((*byte)(unsafe.Pointer(&take(packedWords)[0])), len(c.packed))
+	}
+	copy(n.r, c.r)
+	copy(n.indices, c.indices)
+	copy(n.keys, c.keys)
+	copy(n.values, c.values)
+	if c.dict != nil {
+		n.dict = take(len(c.dict))
+	}
+	if c.pairValues != nil {
+		n.pairValues = take(len(c.pairValues))
+	}
+	copy(n.packed, c.packed)
+	copy(n.dict, c.dict)
+	copy(n.pairValues, c.pairValues)
+	n.valueWidth = c.valueWidth
+	if c.metadata != nil {
+		n.metadata = append([]byte(nil), c.metadata...)
+	}
+	n.info = c.info
+	n.mixBuckets = c.mixBuckets
+	n.r32 = c.r32
+	n.small = c.small
+	n.setHasher(c.hasher)
+	n.keyMask = c.keyMask
+	n.columns = copyColumns(c.columns)
+	n.generations, n.nextGeneration = copyGenerations(c.generations), c.nextGeneration
+	if c.aggregates != nil {
+		a := *c.aggregates
+		n.aggregates = &a
+	}
+	if c.sorted != nil {
+		n.sorted = append([]uint32{}, c.sorted...)
+	}
+	n.digest = c.digest
+	n.deleted, n.deletedCount = c.copyDeletions(), c.deletedCount
+	if c.filter != nil {
+		f := *c.filter
+		f.fingerprints = append([]uint8(nil), f.fingerprints...)
+		n.filter = &f
+	}
+	if c.dense != nil {
+		d := *c.dense
+		d.present = append([]uint64(nil), d.present...)
+		n.dense = &d
+	}
+	if c.pthash != nil {
+		t := *c.pthash
+		t.pilots = append([]uint64(nil), t.pilots...)
+		t.free = append([]uint32(nil), t.free...)
+		n.pthash = &t
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryFootprint(t *testing.T) {
+	var bs BuildStats
+	b := Builder()
+	for _, w := range words[:1000] {
+		b.Add(w, w)
+	}
+	c, err := b.Build(WithSeed(1), WithStats(&bs))
+	require.NoError(t, err)
+
+	overhead := int64(unsafe.Sizeof(CHD{}))
+	data := int64(8*cap(c.r) + 2*500 + 8*1000 + 8*1000)
+	f := c.MemoryFootprint()
+	assert.Equal(t, Footprint{
+		HashFunctions: int64(8 * cap(c.r)),
+		Indices:       2 * 500,
+		Keys:          8 * 1000,
+		Values:        8 * 1000,
+		Overhead:      overhead,
+		Total:         data + overhead,
+		Heap:          data + overhead,
+	}, f)
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	rf := r.MemoryFootprint()
+	assert.Equal(t, int64(8*bs.HashFunctions), rf.HashFunctions)
+	assert.Equal(t, int64(0), rf.Aliased)
+	assert.Equal(t, rf.Total, rf.Heap)
+
+	m, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	mf := m.MemoryFootprint()
+	assert.Equal(t, rf.Total, mf.Total)
+	if zeroCopy {
+		assert.Equal(t, int64(8*bs.HashFunctions+2*500+8*1000+8*1000), mf.Aliased)
+		assert.Equal(t, overhead, mf.Heap)
+	} else {
+		assert.Equal(t, int64(0), mf.Aliased)
+	}
+
+	// MapValues allocates a fresh values section.
+	mv := m.MapValues(func(k, v uint64) uint64 { return v })
+	if zeroCopy {
+		assert.Equal(t, mf.Aliased-8*1000, mv.MemoryFootprint().Aliased)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	c := MustFromMap(sampleData)
+	assert.Same(t, c, c.Materialize())
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	buf := w.Bytes()
+	m, err := Mmap(buf)
+	require.NoError(t, err)
+	n := m.Materialize()
+	if zeroCopy {
+		assert.NotSame(t, m, n)
+	}
+	f := n.MemoryFootprint()
+	assert.Equal(t, int64(0), f.Aliased)
+	assert.Same(t, n, n.Materialize())
+
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	for k, v := range sampleData {
+		assert.Equal(t, v, n.Get(k))
+	}
+	assert.NoError(t, n.Verify())
+}
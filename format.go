@@ -0,0 +1,861 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Files written by Write start with this magic, followed by a little endian
+// uint16 format version. Files without it use the legacy format (version 1).
+const formatMagic = "U64MPH"
+
+// The format version written by Write. Version 3 has the same layout as
+// version 2, but picks buckets with mixBucketHash. Tables loaded from version 2
+// files are written as version 2.
+const formatVersion = 3
+
+// The oldest version with a header.
+const minHeaderVersion = 2
+
+// Size of the file header: magic, version, flags and the number of sections.
+const headerSize = 16
+
+// Size of a section header: tag, element width and element count.
+const sectionHeaderSize = 16
+
+// Flags stored in the header of version 2 and later files. They are reported by
+// Stat.
+const (
+	// FlagValueDeltas is set when the values are stored as the difference to
+	// their key, see WithValueDeltas.
+	FlagValueDeltas uint32 = 1 << iota
+	// FlagSplitStructure is set for files written by WriteSplit that hold
+	// everything but the values.
+	FlagSplitStructure
+	// FlagSplitValues is set for files written by WriteSplit that only hold
+	// the values.
+	FlagSplitValues
+	// FlagMetadata is set when the file holds a metadata blob, see
+	// SetMetadata.
+	FlagMetadata
+	// FlagFilter is set when the file holds a filter for missing keys, see
+	// WithFilter.
+	FlagFilter
+	// FlagHashFunctions32 is set when the random values of the hash functions
+	// are stored as uint32s, see WithHashFunctions32.
+	FlagHashFunctions32
+	// FlagSmall is set for tables with so few keys that lookups scan the
+	// keys instead of hashing them. The file has no hash functions and
+	// indices sections, and the keys are sorted.
+	FlagSmall
+	// FlagHasher is set when the keys are hashed with a Hasher, whose name is
+	// stored in the file, see WithHasher.
+	FlagHasher
+	// FlagUniformKeys is set when the keys are used as their own hash, see
+	// AssumeUniformKeys.
+	FlagUniformKeys
+	// FlagDense is set for tables whose keys cover most of a range, see
+	// WithDenseThreshold. The file has a dense and a presence section instead
+	// of the hash functions, indices and keys sections.
+	FlagDense
+	// FlagPackedValues is set when the values are stored in 1, 2 or 4 bytes,
+	// the width of the values section, see WithPackedValues.
+	FlagPackedValues
+	// FlagDictionary is set when the packed values are codes into a
+	// dictionary of the distinct values, see WithDictionaryThreshold.
+	FlagDictionary
+	// FlagPTHash is set for tables built with WithPTHash. The file has
+	// PTHash, pilots and free slots sections instead of the hash functions and
+	// indices sections.
+	FlagPTHash
+	// FlagMaskedKeys is set when the keys are stored masked, see MaskKeys. The
+	// file has a key mask section to recognize the secret by.
+	FlagMaskedKeys
+	// FlagPairValues is set when every key has two values, stored together
+	// in the pair values section instead of the values section, see
+	// PairBuilder.
+	FlagPairValues
+	// FlagColumns is set when the file holds extra columns of values, see
+	// AttachColumn.
+	FlagColumns
+	// FlagValueAggregates is set when the file holds the smallest, largest
+	// and sum of the values, see ValueStats.
+	FlagValueAggregates
+	// FlagSortedIndex is set when the file holds the slots of the keys sorted
+	// by key, see WithSortedIndex.
+	FlagSortedIndex
+	// FlagGenerations is set when the file holds generations of values, see
+	// AddGeneration.
+	FlagGenerations
+	// FlagDigest is set when the file holds the digest of the table, see
+	// WithDigest.
+	FlagDigest
+	// FlagDeletions is set when the file marks deleted keys, see Delete.
+	FlagDeletions
+	// FlagChecksum is set when the file holds its checksum, see WithChecksum.
+	FlagChecksum
+)
+
+// Section tags. Readers reject sections they don't know unless the tag has
+// sectionOptional set, in which case they skip them.
+const (
+	sectionHashFunctions uint32 = 1 + iota
+	sectionIndices
+	sectionKeys
+	sectionValues
+	sectionValueDeltas
+	sectionSplitID
+	sectionHasher
+	sectionDense
+	sectionPresence
+	sectionPTHash
+	sectionPilots
+	sectionFreeSlots
+	sectionKeyMask
+	sectionPairValues
+
+	sectionOptional uint32 = 1 << 31
+
+	sectionMetadata = sectionOptional | 1
+	sectionFilter   = sectionOptional | 2
+	// Readers that skip the dictionary reject the packed values section
+	// holding the codes into it.
+	sectionDictionary = sectionOptional | 3
+	// All columns share a single section, as older readers reject duplicate
+	// sections even if they would skip them.
+	sectionColumns = sectionOptional | 4
+	// The flags, smallest value, largest value and sum of the values.
+	sectionValueAggregates = sectionOptional | 5
+	// The slot of every key, sorted by key.
+	sectionSortedIndex = sectionOptional | 6
+	// All generations share a single section, like the columns.
+	sectionGenerations = sectionOptional | 7
+	// The SHA-256 digest of the entries, see Digest.
+	sectionDigest = sectionOptional | 8
+	// A bit for every slot, set if its key was deleted, see Delete.
+	sectionDeletions = sectionOptional | 9
+	// The CRC-32 of the file up to this section, which is the last one. See
+	// WithChecksum.
+	sectionChecksum = sectionOptional | 10
+)
+
+// A WriteOption configures a single call to Write.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	valueDeltas bool
+	// See WithDigest.
+	digest bool
+	// See WithChecksum.
+	checksum bool
+}
+
+// WithValueDeltas stores every value as its difference to the key (modulo
+// 2^64) in 32 bits, halving the size of the values section for tables where
+// values are close to their keys. If any difference doesn't fit in an int32, or
+// the values are packed (see WithPackedValues), the values are stored as-is.
+// Readers reconstruct the values when loading the
+// table, so lookups aren't slowed down, but the values are no longer aliased by
+// Mmap.
+func WithValueDeltas() WriteOption {
+	return func(o *writeOptions) {
+		o.valueDeltas = true
+	}
+}
+
+// valueDeltas returns the 32 bit differences between the values and the keys,
+// or false if any of them doesn't fit.
+func (c *CHD) valueDeltas() ([]uint32, bool) {
+	deltas := make([]uint32, len(c.values))
+	for i, v := range c.values {
+		k, ok := c.slotKey(i)
+		if !ok {
+			// Holes in dense tables have no value.
+			continue
+		}
+		d := int64(v - k)
+		if d < math.MinInt32 || d > math.MaxInt32 {
+			return nil, false
+		}
+		deltas[i] = uint32(int32(d))
+	}
+	return deltas, true
+}
+
+// encoder writes little endian numbers to w through a fixed size buffer.
+type encoder struct {
+	w   io.Writer
+	buf []byte
+	off int64
+	err error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	return &encoder{w: w, buf: make([]byte, 0, 64<<10)}
+}
+
+func (e *encoder) reserve(n int) {
+	if len(e.buf)+n > cap(e.buf) {
+		e.flush()
+	}
+	e.off += int64(n)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.reserve(2)
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.reserve(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.reserve(8)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// pad writes zeroes up to the next multiple of 8 bytes.
+func (e *encoder) pad() {
+	for e.off%8 != 0 {
+		e.reserve(1)
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(p []byte) {
+	e.reserve(len(p))
+	e.buf = append(e.buf, p...)
+}
+
+func (e *encoder) section(tag uint32, width, count int) {
+	e.uint32(tag)
+	e.uint32(uint32(width))
+	e.uint64(uint64(count))
+}
+
+func (e *encoder) flush() error {
+	if e.err == nil && len(e.buf) > 0 {
+		_, e.err = e.w.Write(e.buf)
+	}
+	e.buf = e.buf[:0]
+	return e.err
+}
+
+func (e *encoder) header(version int, flags uint32, sections int) {
+	e.bytes([]byte(formatMagic))
+	e.uint16(uint16(version))
+	e.uint32(flags)
+	e.uint32(uint32(sections))
+}
+
+func (c *CHD) write(w io.Writer, o writeOptions) error {
+	if c.IndexOnly() {
+		return ErrNoValues
+	}
+	digest := c.writeDigest(o)
+	flags, deltas := c.encodeValues(o)
+	oflags, osections := c.optionalSections(digest)
+	var sum hash.Hash32
+	if o.checksum {
+		oflags |= FlagChecksum
+		osections++
+		sum = crc32.NewIEEE()
+		w = io.MultiWriter(w, sum)
+	}
+	e := newEncoder(w)
+	e.header(c.writeVersion(), flags|oflags|c.structureFlags(), c.structureSections()+c.valuesSections()+osections)
+	c.writeStructure(e)
+	c.writeValues(e, deltas)
+	c.writeOptional(e, digest)
+	if sum != nil {
+		e.checksum(sum)
+	}
+	return e.flush()
+}
+
+// writeVersion returns the format version to write c in: tables that pick
+// buckets without mixing can only be represented by version 2.
+func (c *CHD) writeVersion() int {
+	if c.mixBuckets {
+		return formatVersion
+	}
+	return minHeaderVersion
+}
+
+// structureFlags returns the flags describing how the structure is written.
+func (c *CHD) structureFlags() uint32 {
+	var flags uint32
+	if c.r32 {
+		flags |= FlagHashFunctions32
+	}
+	if c.small {
+		flags |= FlagSmall
+	}
+	if c.dense != nil {
+		flags |= FlagDense
+	}
+	if c.pthash != nil {
+		flags |= FlagPTHash
+	}
+	if c.uniformKeys {
+		flags |= FlagUniformKeys
+	} else if c.hasher != nil {
+		flags |= FlagHasher
+	}
+	if c.keyMask != nil {
+		flags |= FlagMaskedKeys
+	}
+	return flags
+}
+
+// structureSections returns the number of sections written by writeStructure.
+func (c *CHD) structureSections() int {
+	n := 0
+	if c.keyMask != nil {
+		n++
+	}
+	switch {
+	case c.small:
+		return n + 1
+	case c.dense != nil:
+		return n + 2
+	case c.pthash != nil:
+		n += 4
+	default:
+		n += 3
+	}
+	if c.hasherSection() {
+		n++
+	}
+	return n
+}
+
+// encodeValues returns the flags describing how the values will be written, and
+// the deltas if they're written as such.
+func (c *CHD) encodeValues(o writeOptions) (uint32, []uint32) {
+	if c.pairValues != nil {
+		return FlagPairValues, nil
+	}
+	if c.dict != nil {
+		return FlagPackedValues | FlagDictionary, nil
+	}
+	if c.valueWidth != 0 {
+		return FlagPackedValues, nil
+	}
+	if o.valueDeltas {
+		if d, ok := c.valueDeltas(); ok {
+			return FlagValueDeltas, d
+		}
+	}
+	return 0, nil
+}
+
+// writeStructure writes the sections needed to find the slot of a key.
+func (c *CHD) writeStructure(e *encoder) {
+	if c.keyMask != nil {
+		e.section(sectionKeyMask, 8, 1)
+		e.uint64(c.keyMask.check())
+	}
+	if c.dense != nil {
+		c.writeDense(e)
+		return
+	}
+	c.writeHashFunctions(e)
+	e.section(sectionKeys, 8, len(c.keys))
+	for _, k := range c.keys {
+		e.uint64(k)
+	}
+}
+
+// writeHashFunctions writes the hash functions and indices sections, or the
+// sections replacing them in PTHash tables, unless the table is small.
+func (c *CHD) writeHashFunctions(e *encoder) {
+	if c.small {
+		return
+	}
+	if c.hasherSection() {
+		name := c.hasher.Name()
+		e.section(sectionHasher, 1, len(name))
+		e.bytes([]byte(name))
+		e.pad()
+	}
+	if c.pthash != nil {
+		c.writePTHash(e)
+		return
+	}
+	if c.r32 {
+		e.section(sectionHashFunctions, 4, len(c.r))
+		for _, r := range c.r {
+			e.uint32(uint32(r))
+		}
+		e.pad()
+	} else {
+		e.section(sectionHashFunctions, 8, len(c.r))
+		for _, r := range c.r {
+			e.uint64(r)
+		}
+	}
+	e.section(sectionIndices, 2, len(c.indices))
+	for _, i := range c.indices {
+		e.uint16(i)
+	}
+	e.pad()
+}
+
+// optionalSections returns the flags and number of the optional sections
+// written by writeOptional.
+func (c *CHD) optionalSections(digest *[32]byte) (uint32, int) {
+	var flags uint32
+	n := 0
+	if digest != nil {
+		flags |= FlagDigest
+		n++
+	}
+	if c.metadata != nil {
+		flags |= FlagMetadata
+		n++
+	}
+	if c.filter != nil {
+		flags |= FlagFilter
+		n++
+	}
+	if c.columns != nil {
+		flags |= FlagColumns
+		n++
+	}
+	if c.aggregates != nil {
+		flags |= FlagValueAggregates
+		n++
+	}
+	if c.sorted != nil {
+		flags |= FlagSortedIndex
+		n++
+	}
+	if c.generations != nil {
+		flags |= FlagGenerations
+		n++
+	}
+	if c.deleted != nil {
+		flags |= FlagDeletions
+		n++
+	}
+	return flags, n
+}
+
+// writeOptional writes the metadata, the filter, the columns, the value
+// aggregates, the sorted index, the generations and the deletion marks, if the
+// table has them, and the digest if it isn't nil.
+func (c *CHD) writeOptional(e *encoder, digest *[32]byte) {
+	if c.metadata != nil {
+		e.metadata(c.metadata)
+	}
+	if c.filter != nil {
+		e.filter(c.filter)
+	}
+	if c.columns != nil {
+		e.columns(c)
+	}
+	if c.aggregates != nil {
+		e.aggregates(c.aggregates)
+	}
+	if c.sorted != nil {
+		e.sortedIndex(c.sorted)
+	}
+	if c.generations != nil {
+		e.generations(c)
+	}
+	if c.deleted != nil {
+		e.deletions(c.deleted)
+	}
+	if digest != nil {
+		e.digest(digest)
+	}
+}
+
+// valuesSections returns the number of sections written by writeValues.
+func (c *CHD) valuesSections() int {
+	if c.dict != nil {
+		return 2
+	}
+	return 1
+}
+
+// writeValues writes the values section, or the value deltas section if deltas
+// isn't nil, and the dictionary if the table has one.
+func (c *CHD) writeValues(e *encoder, deltas []uint32) {
+	if deltas != nil {
+		e.section(sectionValueDeltas, 4, len(deltas))
+		for _, d := range deltas {
+			e.uint32(d)
+		}
+		e.pad()
+		return
+	}
+	if c.pairValues != nil {
+		e.section(sectionPairValues, 16, len(c.pairValues)/2)
+		for _, v := range c.pairValues {
+			e.uint64(v)
+		}
+		return
+	}
+	if c.valueWidth != 0 {
+		e.section(sectionValues, c.valueWidth, c.numValues())
+		e.bytes(c.packed)
+		e.pad()
+		if c.dict != nil {
+			e.section(sectionDictionary, 8, len(c.dict))
+			for _, v := range c.dict {
+				e.uint64(v)
+			}
+		}
+		return
+	}
+	e.section(sectionValues, 8, len(c.values))
+	for _, v := range c.values {
+		e.uint64(v)
+	}
+}
+
+// hasFormatMagic reports whether b starts with the header of a version 2 or
+// later file.
+func hasFormatMagic(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(formatMagic))
+}
+
+// rawSection is a section of a serialized table.
+type rawSection struct {
+	tag   uint32
+	width int
+	count int
+	// Offset of the data from the start of the file.
+	offset int64
+}
+
+func (s rawSection) size() int64 {
+	return int64(s.width) * int64(s.count)
+}
+
+// header is the decoded header of a version 2 or later file.
+type header struct {
+	version  int
+	flags    uint32
+	sections []rawSection
+	// Size of the file according to the header.
+	size int64
+}
+
+// Element width of the known sections, by tag.
+var sectionWidths = map[uint32]int{
+	sectionHashFunctions: 8,
+	sectionIndices:       2,
+	sectionKeys:          8,
+	sectionValues:        8,
+	sectionValueDeltas:   4,
+	sectionSplitID:       1,
+	sectionHasher:        1,
+	sectionDense:         8,
+	sectionPresence:      8,
+	sectionPTHash:        8,
+	sectionPilots:        8,
+	sectionFreeSlots:     4,
+	sectionKeyMask:       8,
+	sectionPairValues:    16,
+	sectionMetadata:      1,
+	sectionFilter:        1,
+	sectionDictionary:    8,
+	sectionColumns:       8,
+}
+
+// readHeader decodes the header and section table of a version 2 or later file from r.
+func readHeader(r io.ReaderAt) (header, error) {
+	var buf [headerSize]byte
+	if err := readFullAt(r, buf[:], 0, "header"); err != nil {
+		return header{}, err
+	}
+	if !hasFormatMagic(buf[:]) {
+		return header{}, fmt.Errorf("%w: bad magic", ErrNotCHD)
+	}
+	h := header{
+		version: int(binary.LittleEndian.Uint16(buf[6:])),
+		flags:   binary.LittleEndian.Uint32(buf[8:]),
+	}
+	if h.version < minHeaderVersion || h.version > formatVersion {
+		return header{}, fmt.Errorf("%w: unsupported format version %d", ErrNotCHD, h.version)
+	}
+	n := binary.LittleEndian.Uint32(buf[12:])
+	off := int64(headerSize)
+	seen := map[uint32]bool{}
+	for i := uint32(0); i < n; i++ {
+		if err := readFullAt(r, buf[:sectionHeaderSize], off, "section header"); err != nil {
+			return header{}, err
+		}
+		s, err := h.addSection(binary.LittleEndian.Uint32(buf[0:]), binary.LittleEndian.Uint32(buf[4:]), binary.LittleEndian.Uint64(buf[8:]), off+sectionHeaderSize, seen)
+		if err != nil {
+			return header{}, err
+		}
+		off = s.offset + (s.size()+7)&^7
+	}
+	h.size = off
+	if err := h.check(); err != nil {
+		return header{}, err
+	}
+	return h, nil
+}
+
+// addSection checks the section with the given tag, element width and count,
+// whose data is at offset, and adds it to h. seen holds the tags of the
+// sections added before.
+func (h *header) addSection(tag, width uint32, count uint64, offset int64, seen map[uint32]bool) (rawSection, error) {
+	s := rawSection{tag: tag, width: int(width), offset: offset}
+	if s.width == 0 || s.width > 8 && s.tag != sectionPairValues || count > math.MaxInt32 || count > uint64(math.MaxInt/s.width) {
+		return s, fmt.Errorf("%w: section %d has %d elements of %d bytes", ErrNotCHD, s.tag, count, width)
+	}
+	s.count = int(count)
+	if seen[s.tag] {
+		return s, fmt.Errorf("%w: duplicate section %d", ErrNotCHD, s.tag)
+	}
+	seen[s.tag] = true
+	if w, ok := sectionWidths[s.tag]; ok {
+		if s.tag == sectionHashFunctions && h.flags&FlagHashFunctions32 != 0 {
+			w = 4
+		}
+		if s.tag == sectionValues && h.flags&FlagPackedValues != 0 && (s.width == 1 || s.width == 2 || s.width == 4) {
+			w = s.width
+		}
+		if s.width != w {
+			return s, fmt.Errorf("%w: section %d has %d byte elements, want %d", ErrNotCHD, s.tag, s.width, w)
+		}
+	} else if s.tag&sectionOptional == 0 {
+		return s, fmt.Errorf("%w: unsupported section %d", ErrNotCHD, s.tag)
+	}
+	h.sections = append(h.sections, s)
+	return s, nil
+}
+
+func (h header) section(tag uint32) (rawSection, bool) {
+	for _, s := range h.sections {
+		if s.tag == tag {
+			return s, true
+		}
+	}
+	return rawSection{}, false
+}
+
+// check verifies that the required sections are present and consistent.
+func (h header) check() error {
+	split := h.flags & (FlagSplitStructure | FlagSplitValues)
+	if split == FlagSplitStructure|FlagSplitValues {
+		return fmt.Errorf("%w: both split flags set", ErrNotCHD)
+	}
+	if _, ok := h.section(sectionSplitID); ok != (split != 0) {
+		return fmt.Errorf("%w: split flags don't match the sections", ErrNotCHD)
+	}
+	if s, ok := h.section(sectionMetadata); ok != (h.flags&FlagMetadata != 0) {
+		return fmt.Errorf("%w: metadata flag doesn't match the sections", ErrNotCHD)
+	} else if s.count > MaxMetadataSize {
+		return fmt.Errorf("%w: %d bytes of metadata", ErrNotCHD, s.count)
+	}
+	if _, ok := h.section(sectionFilter); ok != (h.flags&FlagFilter != 0) {
+		return fmt.Errorf("%w: filter flag doesn't match the sections", ErrNotCHD)
+	}
+	if _, ok := h.section(sectionColumns); ok != (h.flags&FlagColumns != 0) {
+		return fmt.Errorf("%w: columns flag doesn't match the sections", ErrNotCHD)
+	}
+	if s, ok := h.section(sectionValueAggregates); ok != (h.flags&FlagValueAggregates != 0) {
+		return fmt.Errorf("%w: value aggregates flag doesn't match the sections", ErrNotCHD)
+	} else if ok && (s.width != 8 || s.count != aggregatesWords) {
+		return fmt.Errorf("%w: value aggregates section of %d elements of %d bytes", ErrNotCHD, s.count, s.width)
+	}
+	if s, ok := h.section(sectionSortedIndex); ok != (h.flags&FlagSortedIndex != 0) {
+		return fmt.Errorf("%w: sorted index flag doesn't match the sections", ErrNotCHD)
+	} else if ok && s.width != 4 {
+		return fmt.Errorf("%w: sorted index of %d byte elements", ErrNotCHD, s.width)
+	}
+	if s, ok := h.section(sectionGenerations); ok != (h.flags&FlagGenerations != 0) {
+		return fmt.Errorf("%w: generations flag doesn't match the sections", ErrNotCHD)
+	} else if ok && s.width != 8 {
+		return fmt.Errorf("%w: generations of %d byte elements", ErrNotCHD, s.width)
+	}
+	if s, ok := h.section(sectionDeletions); ok != (h.flags&FlagDeletions != 0) {
+		return fmt.Errorf("%w: deletions flag doesn't match the sections", ErrNotCHD)
+	} else if ok && s.width != 8 {
+		return fmt.Errorf("%w: deletions of %d byte elements", ErrNotCHD, s.width)
+	}
+	if s, ok := h.section(sectionChecksum); ok != (h.flags&FlagChecksum != 0) {
+		return fmt.Errorf("%w: checksum flag doesn't match the sections", ErrNotCHD)
+	} else if ok && (s.width != 4 || s.count != 1 || s.tag != h.sections[len(h.sections)-1].tag) {
+		return fmt.Errorf("%w: checksum section of %d elements of %d bytes, or not the last one", ErrNotCHD, s.count, s.width)
+	}
+	if s, ok := h.section(sectionDigest); ok != (h.flags&FlagDigest != 0) {
+		return fmt.Errorf("%w: digest flag doesn't match the sections", ErrNotCHD)
+	} else if ok && (s.width != 1 || s.count != 32) {
+		return fmt.Errorf("%w: digest section of %d elements of %d bytes", ErrNotCHD, s.count, s.width)
+	}
+	if s, ok := h.section(sectionHasher); ok != (h.flags&FlagHasher != 0) {
+		return fmt.Errorf("%w: hasher flag doesn't match the sections", ErrNotCHD)
+	} else if ok && (s.count == 0 || s.count > maxHasherName) {
+		return fmt.Errorf("%w: hasher name of %d bytes", ErrNotCHD, s.count)
+	}
+	if h.flags&(FlagHasher|FlagUniformKeys) == FlagHasher|FlagUniformKeys {
+		return fmt.Errorf("%w: both hasher flags set", ErrNotCHD)
+	}
+	if s, ok := h.section(sectionKeyMask); ok != (h.flags&FlagMaskedKeys != 0) {
+		return fmt.Errorf("%w: masked keys flag doesn't match the sections", ErrNotCHD)
+	} else if ok && s.count != 1 {
+		return fmt.Errorf("%w: key mask section with %d elements", ErrNotCHD, s.count)
+	}
+	if h.flags&FlagSplitValues == 0 {
+		if err := h.checkStructure(); err != nil {
+			return err
+		}
+	}
+	if h.flags&FlagSplitStructure == 0 {
+		return h.checkValues()
+	}
+	if _, ok := h.values(); ok || h.flags&(FlagValueDeltas|FlagPackedValues|FlagDictionary|FlagPairValues) != 0 {
+		return fmt.Errorf("%w: structure file holds values", ErrNotCHD)
+	}
+	return nil
+}
+
+func (h header) checkStructure() error {
+	dense, hasDense := h.section(sectionDense)
+	presence, hasPresence := h.section(sectionPresence)
+	if h.flags&FlagDense == 0 && (hasDense || hasPresence) {
+		return fmt.Errorf("%w: dense flag doesn't match the sections", ErrNotCHD)
+	}
+	pthash, hasPTHash := h.section(sectionPTHash)
+	pilots, hasPilots := h.section(sectionPilots)
+	_, hasFree := h.section(sectionFreeSlots)
+	if h.flags&FlagPTHash == 0 && (hasPTHash || hasPilots || hasFree) {
+		return fmt.Errorf("%w: PTHash flag doesn't match the sections", ErrNotCHD)
+	}
+	if h.flags&FlagDense != 0 {
+		_, r := h.section(sectionHashFunctions)
+		_, indices := h.section(sectionIndices)
+		_, keys := h.section(sectionKeys)
+		_, hasher := h.section(sectionHasher)
+		if r || indices || keys || hasher || h.flags&(FlagSmall|FlagUniformKeys|FlagHashFunctions32|FlagPTHash) != 0 || !hasDense || !hasPresence {
+			return fmt.Errorf("%w: dense table with the wrong sections", ErrNotCHD)
+		}
+		if dense.count != 3 || presence.count == 0 {
+			return fmt.Errorf("%w: dense table with %d dense and %d presence elements", ErrNotCHD, dense.count, presence.count)
+		}
+		return nil
+	}
+	if h.flags&FlagPTHash != 0 {
+		_, r := h.section(sectionHashFunctions)
+		_, indices := h.section(sectionIndices)
+		_, keys := h.section(sectionKeys)
+		if r || indices || h.flags&(FlagSmall|FlagHashFunctions32) != 0 || !hasPTHash || !hasPilots || !hasFree || !keys {
+			return fmt.Errorf("%w: PTHash table with the wrong sections", ErrNotCHD)
+		}
+		if pthash.count != 6 || pilots.count == 0 {
+			return fmt.Errorf("%w: PTHash table with %d PTHash and %d pilots elements", ErrNotCHD, pthash.count, pilots.count)
+		}
+		return nil
+	}
+	if h.flags&FlagSmall != 0 {
+		_, r := h.section(sectionHashFunctions)
+		_, indices := h.section(sectionIndices)
+		_, hasher := h.section(sectionHasher)
+		keys, ok := h.section(sectionKeys)
+		if r || indices || hasher || h.flags&FlagUniformKeys != 0 || !ok {
+			return fmt.Errorf("%w: small table with the wrong sections", ErrNotCHD)
+		}
+		if keys.count == 0 || keys.count > maxSmallTable {
+			return fmt.Errorf("%w: small table with %d keys", ErrNotCHD, keys.count)
+		}
+		return nil
+	}
+	for _, tag := range []uint32{sectionHashFunctions, sectionIndices, sectionKeys} {
+		if _, ok := h.section(tag); !ok {
+			return fmt.Errorf("%w: missing section %d", ErrNotCHD, tag)
+		}
+	}
+	r, _ := h.section(sectionHashFunctions)
+	indices, _ := h.section(sectionIndices)
+	if r.count == 0 || r.count > maxHashFunctions {
+		return fmt.Errorf("%w: invalid hash function count %d", ErrNotCHD, r.count)
+	}
+	if indices.count == 0 {
+		return fmt.Errorf("%w: invalid bucket count %d", ErrNotCHD, indices.count)
+	}
+	return nil
+}
+
+func (h header) checkValues() error {
+	present := 0
+	for _, tag := range []uint32{sectionValues, sectionValueDeltas, sectionPairValues} {
+		if _, ok := h.section(tag); ok {
+			present++
+		}
+	}
+	if present > 1 {
+		return fmt.Errorf("%w: more than one values section present", ErrNotCHD)
+	}
+	values, ok := h.values()
+	if !ok {
+		return fmt.Errorf("%w: missing values", ErrNotCHD)
+	}
+	if (values.tag == sectionValueDeltas) != (h.flags&FlagValueDeltas != 0) {
+		return fmt.Errorf("%w: value deltas flag doesn't match the sections", ErrNotCHD)
+	}
+	if (values.tag == sectionPairValues) != (h.flags&FlagPairValues != 0) {
+		return fmt.Errorf("%w: pair values flag doesn't match the sections", ErrNotCHD)
+	}
+	if h.flags&FlagPackedValues != 0 && (values.tag != sectionValues || values.width == 8) {
+		return fmt.Errorf("%w: packed values flag doesn't match the sections", ErrNotCHD)
+	}
+	if dict, ok := h.section(sectionDictionary); ok != (h.flags&FlagDictionary != 0) || ok && h.flags&FlagPackedValues == 0 {
+		return fmt.Errorf("%w: dictionary flag doesn't match the sections", ErrNotCHD)
+	} else if ok && (dict.count == 0 || values.width > 2 || dict.count > 1<<(8*values.width)) {
+		return fmt.Errorf("%w: dictionary of %d values for %d byte codes", ErrNotCHD, dict.count, values.width)
+	}
+	if keys, ok := h.section(sectionKeys); ok && values.count != keys.count {
+		return fmt.Errorf("%w: %d keys but %d values", ErrNotCHD, keys.count, values.count)
+	}
+	return nil
+}
+
+// values returns the section holding the values, in whatever encoding.
+func (h header) values() (rawSection, bool) {
+	if s, ok := h.section(sectionValues); ok {
+		return s, true
+	}
+	if s, ok := h.section(sectionPairValues); ok {
+		return s, true
+	}
+	return h.section(sectionValueDeltas)
+}
+
+func readFullAt(r io.ReaderAt, buf []byte, off int64, what string) error {
+	// ReadAt may return io.EOF along with a full buffer at the end of r.
+	if n, err := r.ReadAt(buf, off); n < len(buf) {
+		if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated while reading %s at offset %d", ErrNotCHD, what, off)
+		}
+		return err
+	}
+	return nil
+}
+
+// mmapHeader decodes the header of a version 2 or later file and checks that b holds
+// all its sections.
+func mmapHeader(b []byte) (header, error) {
+	h, err := readHeader(bytes.NewReader(b))
+	if err != nil {
+		return header{}, err
+	}
+	if h.size != int64(len(b)) {
+		return header{}, fmt.Errorf("%w: file is %d bytes, its sections need %d", ErrNotCHD, len(b), h.size)
+	}
+	return h, nil
+}
@@ -0,0 +1,155 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithValueDeltas(t *testing.T) {
+	m := map[uint64]uint64{
+		1:                  1,
+		2:                  10,
+		1000:               999,
+		math.MaxUint64:     4,                  // wraps around to a delta of 5
+		3:                  math.MaxUint64 - 1, // wraps around to a delta of -5
+		1 << 40:            1<<40 + math.MaxInt32,
+		1<<40 + 1:          1<<40 + 1 - (1 << 31),
+		math.MaxUint64 - 1: math.MaxUint64,
+		42:                 40,
+	}
+	c := MustFromMap(m, WithSeed(1))
+
+	plain := &bytes.Buffer{}
+	require.NoError(t, c.Write(plain))
+	packed := &bytes.Buffer{}
+	require.NoError(t, c.Write(packed, WithValueDeltas()))
+	// The deltas are padded to a multiple of 8 bytes.
+	assert.Equal(t, plain.Len()-8*len(m)+(4*len(m)+7)&^7, packed.Len())
+
+	fi, err := Stat(bytes.NewReader(packed.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagValueDeltas, fi.Flags)
+	assert.Equal(t, int64(4*len(m)), fi.ValuesBytes)
+	assert.Equal(t, int64(packed.Len()), fi.Size)
+
+	for _, b := range [][]byte{plain.Bytes(), packed.Bytes()} {
+		g, err := Mmap(b)
+		require.NoError(t, err)
+		assert.Equal(t, len(m), g.Len())
+		for k, v := range m {
+			got, ok := g.GetOK(k)
+			assert.True(t, ok)
+			assert.Equal(t, v, got, "key %d", k)
+		}
+		assert.NoError(t, g.Verify())
+	}
+}
+
+func TestWithValueDeltas_fallback(t *testing.T) {
+	// The delta of the second entry doesn't fit in 32 bits.
+	for _, v := range []uint64{1 << 31, math.MaxUint64 - 1<<31} {
+		c := MustFromMap(map[uint64]uint64{1: 2, 0: v}, WithSeed(1))
+		plain := &bytes.Buffer{}
+		require.NoError(t, c.Write(plain))
+		w := &bytes.Buffer{}
+		require.NoError(t, c.Write(w, WithValueDeltas()))
+		assert.Equal(t, plain.Bytes(), w.Bytes())
+
+		fi, err := Stat(bytes.NewReader(w.Bytes()))
+		require.NoError(t, err)
+		assert.Zero(t, fi.Flags&FlagValueDeltas)
+	}
+}
+
+func TestWithValueDeltas_sizeReduction(t *testing.T) {
+	b := Builder()
+	for i := uint64(0); i < 10000; i++ {
+		k := i * 7919
+		b.Add(k, k+i%100)
+	}
+	c, err := b.Build(WithSeed(3))
+	require.NoError(t, err)
+
+	plain := &bytes.Buffer{}
+	require.NoError(t, c.Write(plain))
+	packed := &bytes.Buffer{}
+	require.NoError(t, c.Write(packed, WithValueDeltas()))
+	assert.Less(t, float64(packed.Len()), 0.8*float64(plain.Len()))
+
+	g, err := Read(packed)
+	require.NoError(t, err)
+	for i := uint64(0); i < 10000; i++ {
+		k := i * 7919
+		assert.Equal(t, k+i%100, g.Get(k))
+	}
+}
+
+func TestMmap_badHeader(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	modified := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte{}, w.Bytes()...))
+	}
+	for name, data := range map[string][]byte{
+		"truncated header": w.Bytes()[:10],
+		"truncated":        w.Bytes()[:w.Len()-1],
+		"trailing":         modified(func(b []byte) []byte { return append(b, 0) }),
+		"version": modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[6:], formatVersion+1)
+			return b
+		}),
+		"flags": modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[8:], FlagValueDeltas)
+			return b
+		}),
+		"unknown section": modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[headerSize:], 100)
+			return b
+		}),
+		"width": modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[headerSize+4:], 4)
+			return b
+		}),
+		"missing section": modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[12:], 3)
+			return b[:c.Spec().Values.Offset-sectionHeaderSize]
+		}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Mmap(data)
+			assert.ErrorIs(t, err, ErrNotCHD)
+			_, err = Stat(bytes.NewReader(data))
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+}
+
+func TestMmap_optionalSection(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+
+	// Append a section that readers must skip: 3 bytes of data, padded to 8.
+	binary.LittleEndian.PutUint32(b[12:], 5)
+	b = binary.LittleEndian.AppendUint32(b, sectionOptional|100)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint64(b, 3)
+	b = append(b, 1, 2, 3, 0, 0, 0, 0, 0)
+
+	g, err := Mmap(b)
+	require.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v, g.Get(k))
+	}
+	fi, err := Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(b)), fi.Size)
+}
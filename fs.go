@@ -0,0 +1,38 @@
+package uint64mph
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// MmapFS loads the table in file name from fsys. The file is read into memory
+// once and the table aliases that buffer where the platform allows.
+//
+// embed.FS doesn't expose the memory backing its files, so loading from one
+// always costs a single copy. To avoid even that, embed the file into a []byte
+// variable and pass it to Mmap.
+func MmapFS(fsys fs.FS, name string) (*CHD, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Mmap(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+// ReadFS reads the table in file name from fsys.
+func ReadFS(fsys fs.FS, name string) (*CHD, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,94 @@
+package uint64mph
+
+import (
+	"bytes"
+	"embed"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"unsafe"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/golden/1k.idx
+var golden1kFS embed.FS
+
+//go:embed testdata/golden/1k.idx
+var golden1kBytes []byte
+
+// aliases returns whether s points into b.
+func aliases(b []byte, s []uint64) bool {
+	if len(b) == 0 || len(s) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(&b[0]))
+	p := uintptr(unsafe.Pointer(&s[0]))
+	return p >= start && p < start+uintptr(len(b))
+}
+
+func assertGolden1k(t *testing.T, c *CHD) {
+	gc := golden.Cases()[2]
+	assert.Equal(t, len(gc.Keys), c.Len())
+	for i, k := range gc.Keys {
+		v, ok := c.GetOK(k)
+		assert.True(t, ok)
+		assert.Equal(t, gc.Values[i], v)
+	}
+}
+
+func TestMmapFS(t *testing.T) {
+	c, err := MmapFS(golden1kFS, "testdata/golden/1k.idx")
+	require.NoError(t, err)
+	assertGolden1k(t, c)
+
+	c, err = ReadFS(golden1kFS, "testdata/golden/1k.idx")
+	require.NoError(t, err)
+	assertGolden1k(t, c)
+
+	_, err = MmapFS(golden1kFS, "missing")
+	assert.Error(t, err)
+	_, err = ReadFS(golden1kFS, "missing")
+	assert.Error(t, err)
+
+	c, err = MmapFS(fstest.MapFS{"1k.idx": {Data: golden1kBytes}}, "1k.idx")
+	require.NoError(t, err)
+	assertGolden1k(t, c)
+}
+
+func TestMmap_embeddedBytes(t *testing.T) {
+	c, err := Mmap(golden1kBytes)
+	require.NoError(t, err)
+	assertGolden1k(t, c)
+	assert.Equal(t, zeroCopy, aliases(golden1kBytes, c.keys))
+	assert.Equal(t, zeroCopy, aliases(golden1kBytes, c.values))
+}
+
+// TestMmap_allocations checks that on platforms with the zero-copy reader,
+// Mmap's allocations don't grow with the table size.
+func TestMmap_allocations(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("this platform copies tables in Mmap")
+	}
+	c := MustFromMap(func() map[uint64]uint64 {
+		m := map[uint64]uint64{}
+		for _, w := range words[:100000] {
+			m[w] = w
+		}
+		return m
+	}())
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	n, err := Mmap(b)
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(4096), "Mmap allocated memory for a %d byte table", len(b))
+	assert.Equal(t, c.Len(), n.Len())
+}
@@ -0,0 +1,165 @@
+package uint64mph
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// FuzzBuild builds tables from structured key sets: count keys from base on,
+// stride apart, with mask applied, the first dups of them added again. The bits
+// of opts pick build options.
+func FuzzBuild(f *testing.F) {
+	f.Add(uint16(1000), uint64(0), uint64(1), ^uint64(0), uint8(0), uint8(0))
+	// Keys sharing their low bits, used as their own hash.
+	f.Add(uint16(1024), uint64(0), uint64(1)<<20, ^uint64(0), uint8(0), uint8(1))
+	f.Add(uint16(500), uint64(12345), uint64(3), ^uint64(0), uint8(0), uint8(1))
+	// Arithmetic progressions that wrap around.
+	f.Add(uint16(3000), ^uint64(0)-1000, uint64(7), ^uint64(0), uint8(0), uint8(6))
+	// Masks that make keys collide, resolved or not.
+	f.Add(uint16(300), uint64(0), uint64(1), uint64(0xff), uint8(0), uint8(0))
+	f.Add(uint16(300), uint64(0), uint64(1), uint64(0xff), uint8(0), uint8(16))
+	f.Add(uint16(20), uint64(5), uint64(0x10001), ^uint64(0), uint8(3), uint8(8))
+	f.Fuzz(func(t *testing.T, count uint16, base, stride, mask uint64, dups, opts uint8) {
+		n := int(count % 4096)
+		var keys []uint64
+		values := map[uint64]uint64{}
+		for i := 0; i < n; i++ {
+			k := (base + uint64(i)*stride) & mask
+			keys = append(keys, k)
+			values[k] = uint64(i)
+		}
+		keys = append(keys, keys[:min(int(dups), n)]...)
+
+		build := []BuildOption{WithSeed(int64(opts)), WithMaxAttempts(100000)}
+		if opts&1 != 0 {
+			build = append(build, AssumeUniformKeys())
+		}
+		if opts&2 != 0 {
+			build = append(build, WithHashFunctions32())
+		}
+		if opts&4 != 0 {
+			build = append(build, WithFilter())
+		}
+		if opts&8 != 0 {
+			build = append(build, func(o *buildOptions) { o.strategy = StrategySorted })
+		}
+		resolve := opts&16 != 0
+		if resolve {
+			build = append(build, OnDuplicate(func(key, existing, incoming uint64) (uint64, error) {
+				return max(existing, incoming), nil
+			}))
+		}
+		if opts&32 != 0 {
+			build = append(build, hashed)
+		}
+		if opts&64 != 0 {
+			build = append(build, WithRatio(5))
+		}
+
+		b := Builder()
+		for i, k := range keys {
+			b.Add(k, uint64(i%n))
+		}
+		c, err := b.Build(build...)
+		if err != nil {
+			if len(keys) > len(values) && !resolve {
+				if !errors.Is(err, ErrDuplicateKey) {
+					t.Fatalf("Build of keys with duplicates failed with %v", err)
+				}
+				return
+			}
+			// Structured keys used as their own hash may not be placeable,
+			// and neither may structured keys in tables of an even number of
+			// slots, whose low bits only depend on the low bits of the
+			// hashes. Other tables can always be built.
+			placeable := opts&1 == 0 && len(values)%2 == 1
+			if placeable || !errors.Is(err, ErrNoHashFunction) {
+				t.Fatalf("Build failed with %v", err)
+			}
+			return
+		}
+		if len(keys) > len(values) && !resolve {
+			t.Fatalf("Build of keys with duplicates succeeded")
+		}
+		if c.Len() != len(values) {
+			t.Fatalf("Len() = %d, want %d", c.Len(), len(values))
+		}
+		if err := c.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		w := &bytes.Buffer{}
+		if err := c.Write(w); err != nil {
+			t.Fatal(err)
+		}
+		l, err := Mmap(w.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range values {
+			for _, g := range []*CHD{c, l} {
+				if got, ok := g.GetOK(k); !ok || got != v {
+					t.Fatalf("GetOK(%d) = %d, %v; want %d", k, got, ok, v)
+				}
+			}
+		}
+	})
+}
+
+// FuzzMmap loads arbitrary bytes as a table. Mmap and Read must reject them
+// with an error or return a table whose lookups don't panic, although they may
+// return garbage if only Verify would have noticed.
+func FuzzMmap(f *testing.F) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 300; i += 1 + i%3/2 {
+		dense[5000+i] = i
+	}
+	for _, tc := range []struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		{nil, nil},
+		{sampleData, nil},
+		{sampleData, []BuildOption{hashed}},
+		{randomData(200, 1), []BuildOption{WithFilter(), WithSortedIndex()}},
+		{randomData(200, 2), []BuildOption{WithHashFunctions32(), WithPackedValues()}},
+		{randomData(200, 3), []BuildOption{WithPTHash(7, 0.99)}},
+		{randomData(200, 4), []BuildOption{WithValueDictionary(), WithValueStats()}},
+		{dense, []BuildOption{WithDenseThreshold(0.5)}},
+	} {
+		c, err := FromMap(tc.data, append(tc.opts, WithSeed(1))...)
+		if err != nil {
+			f.Fatal(err)
+		}
+		w := &bytes.Buffer{}
+		if err := c.Write(w, WithDigest()); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(w.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Mmap requires aligned input, which the fuzzer doesn't guarantee.
+		b = append(make([]byte, 0, len(b)), b...)
+		for _, load := range []func() (*CHD, error){
+			func() (*CHD, error) { return Mmap(b) },
+			func() (*CHD, error) { return Read(bytes.NewReader(b)) },
+		} {
+			c, err := load()
+			if err != nil {
+				continue
+			}
+			n := 0
+			for it := c.Iterate(); it != nil && n < 1000; it = it.Next() {
+				k, _ := it.Get()
+				c.GetOK(k)
+				n++
+			}
+			for _, k := range []uint64{0, 1, 5000, 341165985643372816, ^uint64(0)} {
+				c.GetOK(k)
+				c.Contains(k)
+			}
+			c.Len()
+			c.Verify()
+		}
+	})
+}
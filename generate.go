@@ -0,0 +1,70 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"strconv"
+)
+
+// GenerateGo writes a Go source file to w that declares a variable varName of
+// type *CHD in package pkg, initialized to a copy of c. This allows embedding
+// small tables into a binary, typically from a go:generate directive.
+func GenerateGo(w io.Writer, pkg, varName string, c *CHD) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("invalid package name %q", pkg)
+	}
+	if !token.IsIdentifier(varName) {
+		return fmt.Errorf("invalid variable name %q", varName)
+	}
+	var data bytes.Buffer
+	if err := c.Write(&data); err != nil {
+		return err
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by uint64mph.GenerateGo. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n\n", pkg)
+	fmt.Fprintf(&src, "import \"github.com/Jille/uint64mph\"\n\n")
+	fmt.Fprintf(&src, "// %s is a hash table with %d entries.\n", varName, c.Len())
+	fmt.Fprintf(&src, "var %s *uint64mph.CHD\n\n", varName)
+	fmt.Fprintf(&src, "func init() {\n")
+	fmt.Fprintf(&src, "\tc, err := uint64mph.Mmap([]byte(%sData))\n", varName)
+	fmt.Fprintf(&src, "\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	fmt.Fprintf(&src, "\t%s = c\n", varName)
+	fmt.Fprintf(&src, "}\n\n")
+	fmt.Fprintf(&src, "const %sData = \"\" +\n", varName)
+	b := data.Bytes()
+	for len(b) > 0 {
+		n := 32
+		if n > len(b) {
+			n = len(b)
+		}
+		fmt.Fprintf(&src, "\t%s", hexQuote(b[:n]))
+		b = b[n:]
+		if len(b) > 0 {
+			src.WriteString(" +")
+		}
+		src.WriteByte('\n')
+	}
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+// hexQuote returns a Go string literal for b with every byte hex escaped.
+func hexQuote(b []byte) string {
+	s := make([]byte, 0, 2+4*len(b))
+	s = append(s, '"')
+	for _, c := range b {
+		s = append(s, '\\', 'x')
+		s = strconv.AppendUint(s, uint64(c)>>4, 16)
+		s = strconv.AppendUint(s, uint64(c)&0xf, 16)
+	}
+	return string(append(s, '"'))
+}
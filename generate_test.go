@@ -0,0 +1,80 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateGo(t *testing.T) {
+	c := MustFromMap(sampleData, WithSeed(1))
+	var src bytes.Buffer
+	require.NoError(t, GenerateGo(&src, "tables", "Sample", c))
+	_, err := parser.ParseFile(token.NewFileSet(), "sample.go", src.Bytes(), 0)
+	require.NoError(t, err)
+
+	assert.Error(t, GenerateGo(&src, "not a package", "Sample", c))
+	assert.Error(t, GenerateGo(&src, "tables", "1nvalid", c))
+}
+
+// TestGenerateGo_compile builds and runs a program using a generated table.
+func TestGenerateGo_compile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not available")
+	}
+	repo, err := os.Getwd()
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	c := MustFromMap(sampleData, WithSeed(1))
+	var src bytes.Buffer
+	require.NoError(t, GenerateGo(&src, "main", "table", c))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "table.go"), src.Bytes(), 0644))
+
+	var keys []uint64
+	for k := range sampleData {
+		keys = append(keys, k)
+	}
+	var main bytes.Buffer
+	main.WriteString("package main\n\nimport \"fmt\"\n\nfunc main() {\n")
+	for _, k := range keys {
+		fmt.Fprintf(&main, "\tfmt.Println(table.Get(%d))\n", k)
+	}
+	main.WriteString("}\n")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), main.Bytes(), 0644))
+
+	gomod := fmt.Sprintf("module generated\n\ngo 1.21\n\nrequire github.com/Jille/uint64mph v0.0.0\n\nreplace github.com/Jille/uint64mph => %s\n", repo)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644))
+	gosum, err := os.ReadFile(filepath.Join(repo, "go.sum"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.sum"), gosum, 0644))
+
+	goCmd := func(args ...string) string {
+		cmd := exec.Command(goBin, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "go %v: %s", args, out)
+		return string(out)
+	}
+	goCmd("vet", ".")
+	out := goCmd("run", ".")
+
+	var want bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintln(&want, sampleData[k])
+	}
+	assert.Equal(t, want.String(), out)
+}
@@ -0,0 +1,245 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrNoGeneration is returned when loading a table with WithGenerations for a
+// generation the file doesn't hold.
+var ErrNoGeneration = errors.New("uint64mph: no such generation")
+
+// The longest generation label, in bytes.
+const maxGenerationLabel = 255
+
+// The most generations a table can have had, so that numbers fit in an int.
+const maxGenerationNumber = math.MaxInt32
+
+// generation is a numbered array of values, one per slot, see AddGeneration.
+type generation struct {
+	number int
+	label  string
+	values []uint64
+}
+
+// Generation describes a generation of values added with AddGeneration.
+type Generation struct {
+	// Number addresses the generation in GetAt.
+	Number int
+	// The label passed to AddGeneration, like the date of a snapshot.
+	Label string
+}
+
+// AddGeneration adds values to the table as a new generation, for keeping
+// snapshots of the values of the same keys over time without repeating the hash
+// functions and keys for each of them. values holds a value for every key, in
+// the order Iterate returns the keys, so it must be Len long. The values are
+// copied. label describes the generation, and is at most 255 bytes.
+//
+// AddGeneration returns the number of the generation, with which GetAt reads
+// it. Generations are numbered from 0 in the order they're added. Numbers stay
+// the same when older generations are dropped by PruneGenerations, and aren't
+// reused.
+//
+// Write stores the generations in the file and they're restored by Read and
+// Mmap, or only some of them with WithGenerations. WriteSplit stores them in
+// the structure file. Tables derived by MapValues keep them, those derived by
+// RebuildWith, CreatePatch and ApplyPatch don't.
+func (c *CHD) AddGeneration(label string, values []uint64) (int, error) {
+	if c == nil {
+		return 0, ErrNilTable
+	}
+	if len(label) > maxGenerationLabel {
+		return 0, fmt.Errorf("invalid generation label %q: must be at most %d bytes", label, maxGenerationLabel)
+	}
+	if len(values) != c.Len() {
+		return 0, fmt.Errorf("generation %q has %d values for %d keys", label, len(values), c.Len())
+	}
+	if c.nextGeneration >= maxGenerationNumber {
+		return 0, fmt.Errorf("table already had %d generations", c.nextGeneration)
+	}
+	g := generation{number: c.nextGeneration, label: label, values: make([]uint64, c.numSlots())}
+	n := 0
+	for i := range g.values {
+		if _, ok := c.slotKey(i); ok {
+			g.values[i] = values[n]
+			n++
+		}
+	}
+	// MapValues shares the generations, so never append in place.
+	c.generations = append(c.generations[:len(c.generations):len(c.generations)], g)
+	c.nextGeneration++
+	return g.number, nil
+}
+
+// Generations returns the generations of the table, oldest first.
+func (c *CHD) Generations() []Generation {
+	if c == nil {
+		return nil
+	}
+	gens := make([]Generation, len(c.generations))
+	for i, g := range c.generations {
+		gens[i] = Generation{Number: g.number, Label: g.label}
+	}
+	return gens
+}
+
+// GetAt returns the value of key in the given generation, and whether both
+// exist. Generations that were pruned, or not loaded because of
+// WithGenerations, don't exist.
+func (c *CHD) GetAt(key uint64, generation int) (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	i, ok := c.generationIndex(generation)
+	if !ok {
+		return 0, false
+	}
+	ti, ok := c.Slot(key)
+	if !ok {
+		return 0, false
+	}
+	return c.generations[i].values[ti], true
+}
+
+// generationIndex returns the index in c.generations of the generation with
+// the given number, and whether there is one.
+func (c *CHD) generationIndex(number int) (int, bool) {
+	i := sort.Search(len(c.generations), func(i int) bool { return c.generations[i].number >= number })
+	return i, i < len(c.generations) && c.generations[i].number == number
+}
+
+// PruneGenerations drops all but the newest keep generations, and returns how
+// many it dropped.
+func (c *CHD) PruneGenerations(keep int) int {
+	if c == nil || keep >= len(c.generations) {
+		return 0
+	}
+	keep = max(keep, 0)
+	dropped := len(c.generations) - keep
+	c.generations = c.generations[dropped:]
+	return dropped
+}
+
+// WithGenerations loads only the generations with the given numbers, see
+// AddGeneration. Loading fails with ErrNoGeneration if the file doesn't hold
+// one of them. The table doesn't keep the other generations, so writing it
+// leaves them out.
+func WithGenerations(numbers ...int) LoadOption {
+	return func(o *loadOptions) {
+		o.generations = map[int]bool{}
+		for _, n := range numbers {
+			o.generations[n] = true
+		}
+	}
+}
+
+// copyGenerations returns a copy of the generations that doesn't alias the
+// file.
+func copyGenerations(gens []generation) []generation {
+	if gens == nil {
+		return nil
+	}
+	out := make([]generation, len(gens))
+	for i, g := range gens {
+		out[i] = generation{number: g.number, label: g.label, values: append([]uint64(nil), g.values...)}
+	}
+	return out
+}
+
+// generationsWords returns the number of uint64s written by e.generations.
+func (c *CHD) generationsWords() int {
+	n := 2
+	for _, g := range c.generations {
+		n += 2 + (len(g.label)+7)/8 + len(g.values)
+	}
+	return n
+}
+
+// generations writes the generations section: the number of the next
+// generation, the number of generations, and for every generation its number,
+// the length of its label, its label padded to 8 bytes and its values.
+func (e *encoder) generations(c *CHD) {
+	e.section(sectionGenerations, 8, c.generationsWords())
+	e.uint64(uint64(c.nextGeneration))
+	e.uint64(uint64(len(c.generations)))
+	for _, g := range c.generations {
+		e.uint64(uint64(g.number))
+		e.uint64(uint64(len(g.label)))
+		e.bytes([]byte(g.label))
+		e.pad()
+		for _, v := range g.values {
+			e.uint64(v)
+		}
+	}
+}
+
+// loadGenerations loads the generations section, if the file has one. Only the
+// generations selected by WithGenerations are kept.
+func (c *CHD) loadGenerations(data func(tag uint32) []byte, o loadOptions) error {
+	b := data(sectionGenerations)
+	if b == nil {
+		for number := range o.generations {
+			return fmt.Errorf("%w %d", ErrNoGeneration, number)
+		}
+		return nil
+	}
+	invalid := fmt.Errorf("%w: invalid generations section", ErrNotCHD)
+	next := func() (uint64, bool) {
+		if len(b) < 8 {
+			return 0, false
+		}
+		v := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		return v, true
+	}
+	nextNumber, ok := next()
+	if !ok || nextNumber > maxGenerationNumber {
+		return invalid
+	}
+	n, ok := next()
+	if !ok || n > uint64(len(b)) {
+		return invalid
+	}
+	c.nextGeneration = int(nextNumber)
+	c.generations = make([]generation, 0, n)
+	found := 0
+	last := -1
+	for i := uint64(0); i < n; i++ {
+		number, ok := next()
+		if !ok || number >= nextNumber || int(number) <= last {
+			return invalid
+		}
+		last = int(number)
+		l, ok := next()
+		if !ok || l > maxGenerationLabel || uint64(len(b)) < (l+7)&^7 {
+			return invalid
+		}
+		label := string(b[:l])
+		b = b[(l+7)&^7:]
+		size := 8 * c.numSlots()
+		if len(b) < size {
+			return invalid
+		}
+		if o.generations == nil || o.generations[last] {
+			values := (&sliceReader{b: b[:size]}).ReadUint64Array(uint64(c.numSlots()))
+			c.generations = append(c.generations, generation{number: last, label: label, values: values})
+			found++
+		}
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		return invalid
+	}
+	if o.generations != nil && found != len(o.generations) {
+		for number := range o.generations {
+			if _, ok := c.generationIndex(number); !ok {
+				return fmt.Errorf("%w %d", ErrNoGeneration, number)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package uint64mph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addGenerations adds n generations to c, labeled "day0" and up, in which every
+// key has the value key*10 + the generation's number.
+func addGenerations(t *testing.T, c *CHD, n int) {
+	t.Helper()
+	for g := 0; g < n; g++ {
+		var values []uint64
+		for it := c.Iterate(); it != nil; it = it.Next() {
+			values = append(values, it.Key()*10+uint64(g))
+		}
+		number, err := c.AddGeneration("day"+string(rune('0'+g)), values)
+		require.NoError(t, err)
+		require.Equal(t, g, number)
+	}
+}
+
+// assertGenerations checks that c holds the generations in numbers, as added by
+// addGenerations.
+func assertGenerations(t *testing.T, m map[uint64]uint64, c *CHD, numbers ...int) {
+	t.Helper()
+	var want []Generation
+	for _, g := range numbers {
+		want = append(want, Generation{Number: g, Label: "day" + string(rune('0'+g))})
+	}
+	assert.Equal(t, want, append([]Generation(nil), c.Generations()...))
+	for k, v := range m {
+		for _, g := range numbers {
+			got, ok := c.GetAt(k, g)
+			assert.True(t, ok)
+			assert.Equal(t, k*10+uint64(g), got)
+		}
+		assert.Equal(t, v, c.Get(k))
+	}
+	_, ok := c.GetAt(1, numbers[0])
+	assert.False(t, ok)
+}
+
+func TestAddGeneration(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(2000, 40), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash": {randomData(2000, 41), []BuildOption{WithPTHash(7, 0.99)}},
+		"masked": {randomData(2000, 42), []BuildOption{MaskKeys(3)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithSeed(40))...)
+			require.NoError(t, err)
+			addGenerations(t, c, 3)
+			assertGenerations(t, tc.data, c, 0, 1, 2)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&FlagGenerations)
+
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(3))
+			}
+			mapped, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+			read, err := ReadAt(bytes.NewReader(w.Bytes()), lo...)
+			require.NoError(t, err)
+			structure, values := writeSplit(t, c)
+			split, err := MmapSplit(structure, values, lo...)
+			require.NoError(t, err)
+			for _, l := range []*CHD{mapped, read, split, mapped.Materialize(), c.MapValues(func(_, v uint64) uint64 { return v })} {
+				assertGenerations(t, tc.data, l, 0, 1, 2)
+			}
+
+			// Only the selected generations are loaded.
+			some, err := MmapWithOptions(w.Bytes(), append(lo, WithGenerations(2, 0))...)
+			require.NoError(t, err)
+			assertGenerations(t, tc.data, some, 0, 2)
+			_, ok := some.GetAt(firstKey(tc.data), 1)
+			assert.False(t, ok)
+			_, err = MmapWithOptions(w.Bytes(), append(lo, WithGenerations(3))...)
+			assert.ErrorIs(t, err, ErrNoGeneration)
+		})
+	}
+}
+
+func TestPruneGenerations(t *testing.T) {
+	m := randomData(500, 43)
+	c := MustFromMap(m, WithSeed(43))
+	assert.Zero(t, c.PruneGenerations(0))
+	addGenerations(t, c, 4)
+	shared := c.MapValues(func(_, v uint64) uint64 { return v })
+
+	assert.Equal(t, 2, c.PruneGenerations(2))
+	assertGenerations(t, m, c, 2, 3)
+	assert.Zero(t, c.PruneGenerations(5))
+	assertGenerations(t, m, shared, 0, 1, 2, 3)
+
+	// Numbers aren't reused, also after a round trip without generations.
+	assert.Equal(t, 2, c.PruneGenerations(0))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	g, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	assert.Empty(t, g.Generations())
+	number, err := g.AddGeneration("day4", make([]uint64, g.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, 4, number)
+	number, err = shared.AddGeneration("day4", make([]uint64, g.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, 4, number)
+}
+
+func TestAddGeneration_errors(t *testing.T) {
+	c := MustFromMap(sampleData)
+	_, err := c.AddGeneration("x", []uint64{1})
+	assert.ErrorContains(t, err, "has 1 values")
+	_, err = c.AddGeneration(strings.Repeat("x", 256), make([]uint64, c.Len()))
+	assert.ErrorContains(t, err, "invalid generation label")
+	_, err = (*CHD)(nil).AddGeneration("x", nil)
+	assert.ErrorIs(t, err, ErrNilTable)
+
+	// Files without generations have none to select.
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	_, err = MmapWithOptions(w.Bytes(), WithGenerations(0))
+	assert.ErrorIs(t, err, ErrNoGeneration)
+	g, err := MmapWithOptions(w.Bytes(), WithGenerations())
+	require.NoError(t, err)
+	assert.Empty(t, g.Generations())
+
+	// A corrupt section is rejected.
+	addGenerations(t, c, 1)
+	w.Reset()
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+	h, err := mmapHeader(b)
+	require.NoError(t, err)
+	s, _ := h.section(sectionGenerations)
+	b[s.offset+16] = 5 // The number of the generation, beyond the next one.
+	_, err = Mmap(b)
+	assert.ErrorContains(t, err, "invalid generations section")
+}
@@ -0,0 +1,8 @@
+//go:build !uint64mph_unsafe
+// +build !uint64mph_unsafe
+
+package uint64mph
+
+// Whether GetOK skips the bounds checks, see getOKUnchecked. Build with the
+// uint64mph_unsafe tag to enable it.
+const uncheckedGet = false
@@ -0,0 +1,7 @@
+//go:build uint64mph_unsafe
+// +build uint64mph_unsafe
+
+package uint64mph
+
+// Whether GetOK skips the bounds checks, see getOKUnchecked.
+const uncheckedGet = true
@@ -5,6 +5,7 @@ go 1.21.6
 require (
 	github.com/alecthomas/unsafeslice v0.2.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.20.0
 )
 
 require (
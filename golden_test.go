@@ -0,0 +1,135 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGolden fails if the serialized format changes. If the change is
+// deliberate, regenerate the files with `go run ./internal/gengolden`.
+func TestGolden(t *testing.T) {
+	for _, gc := range golden.Cases() {
+		t.Run(gc.Name, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata/golden", gc.Name))
+			require.NoError(t, err)
+
+			b := Builder()
+			for i, k := range gc.Keys {
+				b.Add(k, gc.Values[i])
+			}
+			c, err := b.Build(WithSeed(gc.Seed))
+			require.NoError(t, err)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.True(t, bytes.Equal(want, w.Bytes()), "serialized output differs from the golden file")
+
+			g, err := Read(bytes.NewReader(want))
+			require.NoError(t, err)
+			assert.Equal(t, len(gc.Keys), g.Len())
+			for i, k := range gc.Keys {
+				v, ok := g.GetOK(k)
+				assert.True(t, ok)
+				assert.Equal(t, gc.Values[i], v)
+			}
+		})
+	}
+}
+
+func TestGolden_insertionOrder(t *testing.T) {
+	gc := golden.Cases()[2]
+	want, err := os.ReadFile(filepath.Join("testdata/golden", gc.Name))
+	require.NoError(t, err)
+
+	b := Builder()
+	for i := len(gc.Keys) - 1; i >= 0; i-- {
+		b.Add(gc.Keys[i], gc.Values[i])
+	}
+	c, err := b.Build(WithSeed(gc.Seed))
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	assert.True(t, bytes.Equal(want, w.Bytes()), "serialized output depends on insertion order")
+}
+
+// TestGolden_oldVersions checks that files written in older versions of the
+// format can still be read, and are written back as version 2. These
+// files can't be regenerated.
+func TestGolden_oldVersions(t *testing.T) {
+	for _, version := range []int{legacyFormatVersion, 2} {
+		for _, gc := range golden.Cases() {
+			t.Run(fmt.Sprintf("v%d/%s", version, gc.Name), func(t *testing.T) {
+				data, err := os.ReadFile(filepath.Join(fmt.Sprintf("testdata/golden/v%d", version), gc.Name))
+				require.NoError(t, err)
+				fi, err := Stat(bytes.NewReader(data))
+				require.NoError(t, err)
+				assert.Equal(t, version, fi.Version)
+
+				g, err := Mmap(data)
+				require.NoError(t, err)
+				assert.Equal(t, len(gc.Keys), g.Len())
+				for i, k := range gc.Keys {
+					v, ok := g.GetOK(k)
+					assert.True(t, ok)
+					assert.Equal(t, gc.Values[i], v)
+				}
+				assert.NoError(t, g.Verify())
+
+				w := &bytes.Buffer{}
+				require.NoError(t, g.Materialize().Write(w))
+				if version == 2 {
+					assert.True(t, bytes.Equal(data, w.Bytes()), "rewritten file differs")
+				}
+				g, err = Read(w)
+				require.NoError(t, err)
+				assert.Equal(t, 2, g.Info().Version)
+				assert.NoError(t, g.Verify())
+			})
+		}
+	}
+}
+
+func TestFormatSniffing(t *testing.T) {
+	legacy, err := os.ReadFile("testdata/golden/v1/1k.idx")
+	require.NoError(t, err)
+	current, err := os.ReadFile("testdata/golden/1k.idx")
+	require.NoError(t, err)
+
+	c, err := Mmap(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, Info{Version: 1}, c.Info())
+	c, err = Read(bytes.NewReader(current))
+	require.NoError(t, err)
+	assert.Equal(t, Info{Version: 3}, c.Info())
+	assert.Equal(t, Info{Version: 3}, c.Materialize().Info())
+	assert.Equal(t, Info{}, MustFromMap(sampleData).Info())
+
+	for name, data := range map[string][]byte{
+		// Not the full magic, so parsed as a legacy file with a huge number
+		// of hash functions.
+		"partial magic": append([]byte(formatMagic[:5]+"_"), current[6:]...),
+		// The magic followed by garbage.
+		"magic only":     []byte(formatMagic),
+		"garbage":        append([]byte(formatMagic), legacy[6:]...),
+		"zero version":   append(append([]byte(formatMagic), 0, 0), current[8:]...),
+		"future version": append(append([]byte(formatMagic), 4, 0), current[8:]...),
+		// A legacy file claiming more hash functions than possible.
+		"legacy too many hash functions": append([]byte{0, 0, 2, 0}, legacy[4:]...),
+		"legacy no hash functions":       append([]byte{0, 0, 0, 0}, legacy[4:]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Mmap(data)
+			assert.ErrorIs(t, err, ErrNotCHD)
+			_, err = Read(bytes.NewReader(data))
+			assert.ErrorIs(t, err, ErrNotCHD)
+			_, err = Stat(bytes.NewReader(data))
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+}
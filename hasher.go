@@ -0,0 +1,140 @@
+package uint64mph
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// A Hasher replaces the function tables hash their keys with, see WithHasher.
+// Hashers are identified by name in the file, so loading a table requires the
+// same Hasher to be registered with RegisterHasher.
+type Hasher interface {
+	// Name identifies the hash function. At most 255 bytes.
+	Name() string
+	// Hash returns the hash of key. It must be deterministic and should spread
+	// keys uniformly over all 64 bits.
+	Hash(key uint64) uint64
+}
+
+var (
+	hashersMtx sync.RWMutex
+	hashers    = map[string]Hasher{}
+)
+
+// Longest name of a Hasher.
+const maxHasherName = 255
+
+// RegisterHasher makes a Hasher available for loading tables built with it.
+func RegisterHasher(h Hasher) {
+	if len(h.Name()) == 0 || len(h.Name()) > maxHasherName {
+		panic(fmt.Sprintf("uint64mph: invalid hasher name %q", h.Name()))
+	}
+	hashersMtx.Lock()
+	defer hashersMtx.Unlock()
+	hashers[h.Name()] = h
+}
+
+func lookupHasher(name string) (Hasher, bool) {
+	hashersMtx.RLock()
+	defer hashersMtx.RUnlock()
+	h, ok := hashers[name]
+	return h, ok
+}
+
+func init() {
+	RegisterHasher(Identity)
+}
+
+// Identity is a Hasher that uses keys as their own hash, for keys that already
+// are the output of a strong hash function.
+var Identity Hasher = identityHasher{}
+
+type identityHasher struct{}
+
+func (identityHasher) Name() string {
+	return "identity"
+}
+
+func (identityHasher) Hash(key uint64) uint64 {
+	return key
+}
+
+// Number of keys checkUniformKeys looks at.
+const uniformKeysSample = 4096
+
+// checkUniformKeys looks for a bit that is set in too many or too few of a
+// sample of the keys, which is a sign that they aren't uniformly distributed.
+// It returns the first such bit, the number of sampled keys it is set in and
+// the number of sampled keys, with a bit of -1 if all bits look fine.
+func checkUniformKeys(e *entryChunks) (bit, ones, sampled int) {
+	n := e.len()
+	step := max(1, n/uniformKeysSample)
+	var counts [64]int
+	for i := 0; i < n; i += step {
+		k := e.key(i)
+		for b := range counts {
+			counts[b] += int(k >> b & 1)
+		}
+		sampled++
+	}
+	// For uniform keys a bit is set in half of them, with a standard deviation
+	// of sqrt(sampled)/2. Being 6 standard deviations off by accident is
+	// vanishingly unlikely.
+	limit := 3 * math.Sqrt(float64(sampled))
+	for b, c := range counts {
+		if math.Abs(float64(c)-float64(sampled)/2) > limit {
+			return b, c, sampled
+		}
+	}
+	return -1, 0, sampled
+}
+
+// hash returns the hash of key, with the table's Hasher if it has one.
+func (c *CHD) hash(key uint64) uint64 {
+	if c.hasher == nil {
+		return Hash(key)
+	}
+	if c.uniformKeys {
+		return key
+	}
+	return c.hasher.Hash(key)
+}
+
+func (c *CHD) setHasher(h Hasher) {
+	c.hasher = h
+	c.uniformKeys = h == Identity
+}
+
+// hasherSection reports whether the name of the table's Hasher is written to
+// the file. Identity is recorded by FlagUniformKeys alone.
+func (c *CHD) hasherSection() bool {
+	return c.hasher != nil && !c.uniformKeys
+}
+
+// Hasher returns the Hasher the table was built with, or nil if it uses Hash.
+func (c *CHD) Hasher() Hasher {
+	if c == nil {
+		return nil
+	}
+	return c.hasher
+}
+
+// loadHasher looks up the Hasher named by the hasher section, if the file has
+// one.
+func (c *CHD) loadHasher(h header, data func(tag uint32) []byte) error {
+	if h.flags&FlagUniformKeys != 0 {
+		c.setHasher(Identity)
+		return nil
+	}
+	b := data(sectionHasher)
+	if b == nil {
+		return nil
+	}
+	hasher, ok := lookupHasher(string(b))
+	if !ok {
+		return fmt.Errorf("%w: the table was built with hasher %q, which isn't registered (see RegisterHasher)", ErrNotCHD, b)
+	}
+	c.setHasher(hasher)
+	return nil
+}
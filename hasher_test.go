@@ -0,0 +1,171 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splitmixHasher is the finalizer of SplitMix64, which is a bijection.
+type splitmixHasher struct {
+	name string
+}
+
+func (h splitmixHasher) Name() string {
+	return h.name
+}
+
+func (splitmixHasher) Hash(key uint64) uint64 {
+	key = (key ^ (key >> 30)) * 0xbf58476d1ce4e5b9
+	key = (key ^ (key >> 27)) * 0x94d049bb133111eb
+	return key ^ (key >> 31)
+}
+
+func init() {
+	RegisterHasher(splitmixHasher{"splitmix64"})
+}
+
+func TestWithHasher(t *testing.T) {
+	m := map[uint64]uint64{}
+	for i := uint64(0); i < 10000; i++ {
+		// Keys differing only in their high bits.
+		m[i<<40] = i
+	}
+	for _, h := range []Hasher{Identity, splitmixHasher{"splitmix64"}} {
+		t.Run(h.Name(), func(t *testing.T) {
+			c, err := FromMap(m, WithHasher(h), WithSeed(1))
+			require.NoError(t, err)
+			assert.Equal(t, h, c.Hasher())
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&(FlagHasher|FlagUniformKeys))
+			assert.Equal(t, int64(w.Len()), c.Spec().Size)
+
+			mapped, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			read, err := Read(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			readAt, err := ReadAt(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			s, v := writeSplit(t, c)
+			split, err := MmapSplit(s, v)
+			require.NoError(t, err)
+			for _, g := range []*CHD{c, mapped, read, readAt, split} {
+				assert.Equal(t, h, g.Hasher())
+				for k, v := range m {
+					got, ok := g.GetOK(k)
+					require.True(t, ok, "key %d", k)
+					require.Equal(t, v, got)
+				}
+				assert.False(t, g.Contains(12345))
+				assert.NoError(t, g.Verify())
+			}
+
+			keys := make([]uint64, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			dst := make([]uint64, len(keys))
+			assert.Equal(t, len(keys), c.GetBatchSorted(keys, dst))
+			assert.Equal(t, len(keys), c.GetBatch(keys, dst))
+
+			// The built-in hash gives a different table.
+			plain := &bytes.Buffer{}
+			require.NoError(t, MustFromMap(m, WithSeed(1)).Write(plain))
+			assert.NotEqual(t, plain.Bytes(), w.Bytes())
+		})
+	}
+}
+
+func TestWithHasher_unregistered(t *testing.T) {
+	h := splitmixHasher{"unregistered"}
+	c, err := FromMap(map[uint64]uint64{1: 2, 3: 4, 5: 6, 7: 8, 9: 10, 11: 12, 13: 14, 15: 16, 17: 18}, WithHasher(h))
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	_, err = Mmap(w.Bytes())
+	assert.ErrorIs(t, err, ErrNotCHD)
+	assert.ErrorContains(t, err, `"unregistered"`)
+	s, v := writeSplit(t, c)
+	_, err = MmapSplit(s, v)
+	assert.ErrorIs(t, err, ErrNotCHD)
+
+	RegisterHasher(h)
+	defer func() {
+		hashersMtx.Lock()
+		delete(hashers, h.Name())
+		hashersMtx.Unlock()
+	}()
+	g, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(18), g.Get(17))
+}
+
+func TestWithHasher_invalid(t *testing.T) {
+	// Small tables don't hash their keys.
+	c := MustFromMap(sampleData, WithHasher(Identity))
+	assert.Nil(t, c.Hasher())
+
+	_, err := FromMap(sampleData, hashed, WithHasher(splitmixHasher{""}))
+	assert.ErrorContains(t, err, "invalid hasher name")
+	_, err = FromMap(sampleData, hashed, WithHasher(splitmixHasher{fmt.Sprintf("%256d", 0)}))
+	assert.ErrorContains(t, err, "invalid hasher name")
+	assert.Panics(t, func() { RegisterHasher(splitmixHasher{""}) })
+}
+
+func TestAssumeUniformKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	m := map[uint64]uint64{}
+	for len(m) < 10000 {
+		m[rng.Uint64()] = uint64(len(m))
+	}
+	h := &captureHandler{}
+	c, err := FromMap(m, AssumeUniformKeys(), WithLogger(slog.New(h)))
+	require.NoError(t, err)
+	for _, r := range h.records {
+		assert.NotEqual(t, slog.LevelWarn, r.Level, r.Message)
+	}
+	assert.True(t, c.uniformKeys)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagUniformKeys, fi.Flags)
+	// The flag is all that is stored.
+	hdr, err := readHeader(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	_, ok := hdr.section(sectionHasher)
+	assert.False(t, ok)
+
+	g, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, Identity, g.Hasher())
+	assert.True(t, g.uniformKeys)
+	for k, v := range m {
+		assert.Equal(t, v, g.Get(k))
+	}
+	assert.NoError(t, g.Verify())
+
+	// Sequential keys are far from uniform, which Build warns about. They're
+	// spread out so that the table isn't dense.
+	h = &captureHandler{}
+	b := Builder()
+	for i := uint64(0); i < 10000; i++ {
+		b.Add(3*i, 3*i)
+	}
+	c, err = b.Build(AssumeUniformKeys(), WithLogger(slog.New(h)))
+	require.NoError(t, err)
+	var warned bool
+	for _, r := range h.records {
+		warned = warned || r.Level == slog.LevelWarn && r.Message == "uint64mph: keys don't look uniformly distributed, but are used as their own hash"
+	}
+	assert.True(t, warned)
+	assert.Equal(t, uint64(3702), c.Get(3702))
+}
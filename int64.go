@@ -0,0 +1,111 @@
+package uint64mph
+
+import "io"
+
+// Int64Builder builds a hash table with int64 keys and values. It is a thin
+// wrapper around CHDBuilder that converts keys and values to and from uint64
+// with the usual two's complement conversion.
+//
+// The serialized form is identical to that of a CHD: keys and values are stored
+// as the uint64 with the same bit pattern. This means a table written by an
+// Int64CHD can be read as a CHD and vice versa.
+type Int64Builder struct {
+	b *CHDBuilder
+}
+
+// Create a new builder for a hash table with int64 keys and values.
+func NewInt64Builder() *Int64Builder {
+	return &Int64Builder{b: Builder()}
+}
+
+// Seed the RNG. See CHDBuilder.Seed.
+func (b *Int64Builder) Seed(seed int64) {
+	b.b.Seed(seed)
+}
+
+// Add a key and value to the hash table.
+func (b *Int64Builder) Add(key, value int64) {
+	b.b.Add(uint64(key), uint64(value))
+}
+
+// Build the hash table. See CHDBuilder.Build.
+func (b *Int64Builder) Build(opts ...BuildOption) (*Int64CHD, error) {
+	c, err := b.b.Build(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Int64CHD{c: c}, nil
+}
+
+// Int64CHD is a hash table lookup with int64 keys and values.
+type Int64CHD struct {
+	c *CHD
+}
+
+// NewInt64CHD interprets the keys and values of c as int64s.
+func NewInt64CHD(c *CHD) *Int64CHD {
+	return &Int64CHD{c: c}
+}
+
+// ReadInt64 reads a serialized CHD and interprets its keys and values as int64s.
+func ReadInt64(r io.Reader) (*Int64CHD, error) {
+	c, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Int64CHD{c: c}, nil
+}
+
+// MmapInt64 is like Mmap but interprets the keys and values as int64s.
+func MmapInt64(b []byte) (*Int64CHD, error) {
+	c, err := Mmap(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Int64CHD{c: c}, nil
+}
+
+// CHD returns the underlying table.
+func (c *Int64CHD) CHD() *CHD {
+	return c.c
+}
+
+// Get an entry from the hash table and report whether it was present.
+func (c *Int64CHD) Get(key int64) (int64, bool) {
+	v, ok := c.c.GetOK(uint64(key))
+	return int64(v), ok
+}
+
+func (c *Int64CHD) Len() int {
+	return c.c.Len()
+}
+
+// Iterate over entries in the hash table.
+func (c *Int64CHD) Iterate() *Int64Iterator {
+	it := c.c.Iterate()
+	if it == nil {
+		return nil
+	}
+	return &Int64Iterator{it: it}
+}
+
+// Serialize the hash table. See CHD.Write.
+func (c *Int64CHD) Write(w io.Writer) error {
+	return c.c.Write(w)
+}
+
+type Int64Iterator struct {
+	it *Iterator
+}
+
+func (c *Int64Iterator) Get() (key, value int64) {
+	k, v := c.it.Get()
+	return int64(k), int64(v)
+}
+
+func (c *Int64Iterator) Next() *Int64Iterator {
+	if c.it.Next() == nil {
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,53 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var int64Data = map[int64]int64{
+	math.MinInt64: math.MaxInt64,
+	math.MaxInt64: math.MinInt64,
+	-1:            -1,
+	0:             0,
+	1:             -2,
+	-1337:         42,
+}
+
+func TestInt64CHD(t *testing.T) {
+	b := NewInt64Builder()
+	b.Seed(5)
+	for k, v := range int64Data {
+		b.Add(k, v)
+	}
+	c, err := b.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, len(int64Data), c.Len())
+	for k, v := range int64Data {
+		got, ok := c.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, v, got)
+	}
+	_, ok := c.Get(-2)
+	assert.False(t, ok)
+
+	w := &bytes.Buffer{}
+	assert.NoError(t, c.Write(w))
+	n, err := MmapInt64(w.Bytes())
+	assert.NoError(t, err)
+	seen := map[int64]int64{}
+	for it := n.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		seen[k] = v
+	}
+	assert.Equal(t, int64Data, seen)
+
+	// The on-disk representation is the uint64 bit pattern.
+	u, err := Mmap(w.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1<<63), u.Get(uint64(math.MaxInt64)))
+	assert.Equal(t, uint64(math.MaxUint64), u.Get(math.MaxUint64))
+}
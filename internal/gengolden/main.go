@@ -0,0 +1,81 @@
+// Command gengolden regenerates the golden serialized tables in
+// testdata/golden and the conformance test vector in testdata/conformance. Only
+// run this when deliberately changing the file format.
+//
+//	go run ./internal/gengolden
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/Jille/uint64mph"
+	"github.com/Jille/uint64mph/internal/golden"
+)
+
+var dir = flag.String("dir", "testdata", "directory to write the golden files to")
+
+func main() {
+	flag.Parse()
+	for _, c := range golden.Cases() {
+		writeFile(filepath.Join("golden", c.Name), serialize(build(c)))
+	}
+
+	cc := golden.Conformance()
+	h := build(cc)
+	writeFile(filepath.Join("conformance", cc.Name), serialize(h))
+	var vec golden.ConformanceVector
+	for i, k := range cc.Keys {
+		slot, ok := h.Slot(k)
+		if !ok {
+			log.Fatalf("key %d is missing from the conformance table", k)
+		}
+		vec.Entries = append(vec.Entries, golden.ConformanceEntry{Key: k, Slot: slot, Value: cc.Values[i]})
+	}
+	rng := rand.New(rand.NewSource(cc.Seed))
+	for len(vec.Misses) < 16 {
+		if k := rng.Uint64(); h.Get(k) == ^uint64(0) {
+			vec.Misses = append(vec.Misses, golden.ConformanceMiss{Key: k})
+		}
+	}
+	js, err := json.MarshalIndent(vec, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeFile(filepath.Join("conformance", "conformance.json"), append(js, '\n'))
+}
+
+func build(c golden.Case) *uint64mph.CHD {
+	b := uint64mph.Builder()
+	for i, k := range c.Keys {
+		b.Add(k, c.Values[i])
+	}
+	h, err := b.Build(uint64mph.WithSeed(c.Seed))
+	if err != nil {
+		log.Fatalf("%s: %v", c.Name, err)
+	}
+	return h
+}
+
+func serialize(h *uint64mph.CHD) []byte {
+	var buf bytes.Buffer
+	if err := h.Write(&buf); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(name string, data []byte) {
+	path := filepath.Join(*dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
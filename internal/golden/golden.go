@@ -0,0 +1,68 @@
+// Package golden defines the inputs of the golden serialized tables in
+// testdata/golden and testdata/conformance. Regenerate the files with
+// `go run ./internal/gengolden`.
+package golden
+
+import "math/rand"
+
+// A Case is the input for a single golden file.
+type Case struct {
+	// Name of the file in testdata/golden.
+	Name string
+	// Seed passed to the builder.
+	Seed int64
+	// Keys and the values for them, added to the builder in this order.
+	Keys   []uint64
+	Values []uint64
+}
+
+// Conformance is the input for the conformance test vector in
+// testdata/conformance.
+func Conformance() Case {
+	return random("conformance.idx", 50, 7)
+}
+
+// ConformanceVector is the content of testdata/conformance/conformance.json.
+type ConformanceVector struct {
+	Entries []ConformanceEntry `json:"entries"`
+	// Keys that aren't in the table.
+	Misses []ConformanceMiss `json:"misses"`
+}
+
+// ConformanceMiss is a key that isn't in the conformance table.
+type ConformanceMiss struct {
+	Key uint64 `json:"key,string"`
+}
+
+// ConformanceEntry is a key in the conformance table with the slot it is
+// stored in and its value.
+type ConformanceEntry struct {
+	Key   uint64 `json:"key,string"`
+	Slot  int    `json:"slot"`
+	Value uint64 `json:"value,string"`
+}
+
+// Cases returns all golden cases.
+func Cases() []Case {
+	return []Case{
+		{Name: "empty.idx", Seed: 1},
+		{Name: "one.idx", Seed: 1, Keys: []uint64{13}, Values: []uint64{37}},
+		random("1k.idx", 1000, 42),
+	}
+}
+
+func random(name string, n int, seed int64) Case {
+	rng := rand.New(rand.NewSource(seed))
+	c := Case{Name: name, Seed: seed}
+	seen := map[uint64]bool{}
+	for len(c.Keys) < n {
+		k := rng.Uint64()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		c.Keys = append(c.Keys, k)
+		c.Values = append(c.Values, rng.Uint64())
+	}
+	return c
+}
@@ -0,0 +1,205 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A value journal records changes to the values of a table that can't be
+// modified in place, like a published read-only file. It is laid out as:
+//
+//	magic  [8]byte   "U64MPHJ\x00"
+//	id     [16]byte  the structure identifier of the table, see WriteSplit
+//
+// followed by records of:
+//
+//	key    uint64
+//	value  uint64
+//	crc    uint32    CRC-32 (IEEE) of key and value
+var journalMagic = []byte("U64MPHJ\x00")
+
+const (
+	journalHeaderSize = 8 + 16
+	journalRecordSize = 8 + 8 + 4
+)
+
+// ErrCorruptJournal is returned by ApplyJournal for journals with a record
+// that doesn't match its checksum.
+var ErrCorruptJournal = errors.New("uint64mph: corrupt value journal")
+
+// ValueJournal appends value changes to a journal, to be replayed over the
+// table by ApplyJournal after loading it. Every update is written with a single
+// Write call, but nothing is synced: call Sync on the underlying file to make
+// the updates durable. A ValueJournal must not be used by multiple goroutines
+// at once.
+type ValueJournal struct {
+	w io.Writer
+	c *CHD
+	// Bytes in the journal, including the header.
+	size      int64
+	threshold int64
+	buf       [journalRecordSize]byte
+}
+
+// NewValueJournal starts a new journal for c in w by writing its header.
+// Identifying the table hashes its whole structure.
+func NewValueJournal(w io.Writer, c *CHD) (*ValueJournal, error) {
+	if err := c.checkWritable(w != nil); err != nil {
+		return nil, err
+	}
+	return startValueJournal(w, c, c.structureID())
+}
+
+func startValueJournal(w io.Writer, c *CHD, id [16]byte) (*ValueJournal, error) {
+	if _, err := w.Write(append(append([]byte{}, journalMagic...), id[:]...)); err != nil {
+		return nil, err
+	}
+	return newValueJournal(w, c, journalHeaderSize), nil
+}
+
+// ResumeValueJournal continues appending to an existing journal for c of size
+// bytes, as returned by ApplyJournal. The file must be truncated to size first,
+// in case it ends with a partially written update.
+func ResumeValueJournal(w io.Writer, c *CHD, size int64) *ValueJournal {
+	return newValueJournal(w, c, size)
+}
+
+func newValueJournal(w io.Writer, c *CHD, size int64) *ValueJournal {
+	// Replaying a quarter of the values section takes about as long as loading
+	// a fresh one.
+	threshold := max(int64(8*c.numSlots())/4, 64<<10)
+	return &ValueJournal{w: w, c: c, size: size, threshold: threshold}
+}
+
+// AppendUpdate records that the value of key is now value. It returns
+// ErrKeyNotFound for keys that aren't in the table, and ErrValueTooLarge for
+// values that don't fit in its packed values. The table itself isn't changed,
+// use SetValue for that.
+func (j *ValueJournal) AppendUpdate(key, value uint64) error {
+	if !j.c.Contains(key) {
+		return ErrKeyNotFound
+	}
+	if err := j.c.checkValue(value); err != nil {
+		return err
+	}
+	b := j.buf[:0]
+	b = binary.LittleEndian.AppendUint64(b, key)
+	b = binary.LittleEndian.AppendUint64(b, value)
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	n, err := j.w.Write(b)
+	j.size += int64(n)
+	return err
+}
+
+// Size returns the size of the journal in bytes.
+func (j *ValueJournal) Size() int64 {
+	return j.size
+}
+
+// SetCompactionThreshold sets the journal size beyond which ShouldCompact
+// reports true. It defaults to a quarter of the size of the table's values.
+func (j *ValueJournal) SetCompactionThreshold(bytes int64) {
+	j.threshold = bytes
+}
+
+// ShouldCompact reports whether the journal has grown past its compaction
+// threshold, see CompactJournal.
+func (j *ValueJournal) ShouldCompact() bool {
+	return j.size > j.threshold
+}
+
+// ApplyJournal replays the updates in the journal r over the values of c. If
+// the values alias the buffer c was loaded from, they're copied first so that
+// the buffer isn't modified. It returns the size of the valid part of the
+// journal: a partially written update at its end is ignored, so that a journal
+// torn by a crash can still be applied. Truncate the journal to the returned
+// size before resuming it with ResumeValueJournal.
+//
+// ApplyJournal returns ErrCorruptJournal if a complete update doesn't match its
+// checksum, and ErrNotCHD if the journal belongs to a different table. The
+// updates before the corrupt one have been applied.
+func ApplyJournal(c *CHD, r io.Reader) (int64, error) {
+	if c == nil {
+		return 0, ErrNilTable
+	}
+	if r == nil {
+		return 0, ErrNilReader
+	}
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if c.IndexOnly() {
+		return 0, ErrNoValues
+	}
+	var hdr [journalHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("%w: truncated journal header", ErrCorruptJournal)
+		}
+		return 0, err
+	}
+	if !bytes.Equal(hdr[:8], journalMagic) {
+		return 0, fmt.Errorf("%w: not a value journal", ErrCorruptJournal)
+	}
+	if id := c.structureID(); !bytes.Equal(hdr[8:], id[:]) {
+		return 0, fmt.Errorf("%w: journal belongs to a different table", ErrNotCHD)
+	}
+	if c.numValues() > 0 && c.aliases(c.valuesPointer()) {
+		c.values = append([]uint64(nil), c.values...)
+		c.packed = append([]byte(nil), c.packed...)
+		c.dict = append([]uint64(nil), c.dict...)
+		c.readOnly = false
+	}
+
+	size := int64(journalHeaderSize)
+	var rec [journalRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return size, nil
+			}
+			return size, err
+		}
+		if crc32.ChecksumIEEE(rec[:16]) != binary.LittleEndian.Uint32(rec[16:]) {
+			return size, fmt.Errorf("%w: update at offset %d doesn't match its checksum", ErrCorruptJournal, size)
+		}
+		key := binary.LittleEndian.Uint64(rec[:8])
+		// Keys deleted since are still updated, in case they weren't deleted
+		// when the update was journaled.
+		ti, ok := c.slot(c.maskKey(key))
+		if !ok {
+			return size, fmt.Errorf("%w: update at offset %d is for key %d, which isn't in the table", ErrCorruptJournal, size, key)
+		}
+		v := binary.LittleEndian.Uint64(rec[8:16])
+		if err := c.setSlot(ti, v); err != nil {
+			return size, fmt.Errorf("update at offset %d: %w", size, err)
+		}
+		size += journalRecordSize
+	}
+}
+
+// CompactJournal writes the values of c, which should have the journal applied,
+// as a fresh values file to values, like WriteSplit does, and starts a new
+// empty journal in journal. Once both are durable, the values file replaces the
+// previous one and the old journal can be deleted.
+func CompactJournal(c *CHD, values, journal io.Writer, opts ...WriteOption) (*ValueJournal, error) {
+	if err := c.checkWritable(values != nil && journal != nil); err != nil {
+		return nil, err
+	}
+	if c.IndexOnly() {
+		return nil, ErrNoValues
+	}
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	id := c.structureID()
+	if err := c.writeSplitValues(values, id, o); err != nil {
+		return nil, err
+	}
+	return startValueJournal(journal, c, id)
+}
@@ -0,0 +1,128 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueJournal(t *testing.T) {
+	table := MustFromMap(sampleData, hashed)
+	w := &bytes.Buffer{}
+	require.NoError(t, table.Write(w))
+	published := append([]byte{}, w.Bytes()...)
+
+	journal := &bytes.Buffer{}
+	j, err := NewValueJournal(journal, table)
+	require.NoError(t, err)
+	want := map[uint64]uint64{}
+	for k, v := range sampleData {
+		want[k] = v
+	}
+	for k := range sampleData {
+		require.NoError(t, j.AppendUpdate(k, 1))
+		require.NoError(t, j.AppendUpdate(k, k^7))
+		want[k] = k ^ 7
+	}
+	assert.ErrorIs(t, j.AppendUpdate(12345, 1), ErrKeyNotFound)
+	assert.Equal(t, int64(journal.Len()), j.Size())
+	assert.Equal(t, int64(journalHeaderSize+2*len(sampleData)*journalRecordSize), j.Size())
+	k := firstKey(sampleData)
+	assert.Equal(t, sampleData[k], table.Get(k), "the table was modified")
+
+	c, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	size, err := ApplyJournal(c, bytes.NewReader(journal.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, j.Size(), size)
+	for k, v := range want {
+		assert.Equal(t, v, c.Get(k))
+	}
+	assert.Equal(t, published, w.Bytes(), "the mapped buffer was modified")
+
+	// Compaction writes the values with the journal applied.
+	structure, _ := writeSplit(t, table)
+	values, fresh := &bytes.Buffer{}, &bytes.Buffer{}
+	j, err = CompactJournal(c, values, fresh)
+	require.NoError(t, err)
+	assert.Equal(t, int64(journalHeaderSize), j.Size())
+	d, err := MmapSplit(structure, values.Bytes())
+	require.NoError(t, err)
+	for k, v := range want {
+		assert.Equal(t, v, d.Get(k))
+	}
+	size, err = ApplyJournal(d, bytes.NewReader(fresh.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(journalHeaderSize), size)
+
+	// Journals of other tables are rejected.
+	_, err = ApplyJournal(MustFromMap(map[uint64]uint64{1: 2}), bytes.NewReader(journal.Bytes()))
+	assert.ErrorIs(t, err, ErrNotCHD)
+	_, err = ApplyJournal(c, bytes.NewReader([]byte("not a journal, definitely not")))
+	assert.ErrorIs(t, err, ErrCorruptJournal)
+	_, err = ApplyJournal(c, bytes.NewReader(journal.Bytes()[:journalHeaderSize-1]))
+	assert.ErrorIs(t, err, ErrCorruptJournal)
+}
+
+func TestValueJournal_tail(t *testing.T) {
+	table := MustFromMap(sampleData)
+	k := firstKey(sampleData)
+	journal := &bytes.Buffer{}
+	j, err := NewValueJournal(journal, table)
+	require.NoError(t, err)
+	require.NoError(t, j.AppendUpdate(k, 1))
+	require.NoError(t, j.AppendUpdate(k, 2))
+	full := journal.Bytes()
+
+	t.Run("partial", func(t *testing.T) {
+		for cut := 1; cut < journalRecordSize; cut++ {
+			c := MustFromMap(sampleData)
+			size, err := ApplyJournal(c, bytes.NewReader(full[:len(full)-cut]))
+			require.NoError(t, err)
+			assert.Equal(t, int64(journalHeaderSize+journalRecordSize), size)
+			assert.Equal(t, uint64(1), c.Get(k))
+		}
+
+		// Resuming after truncating the torn update keeps the journal valid.
+		resumed := bytes.NewBuffer(append([]byte{}, full[:journalHeaderSize+journalRecordSize]...))
+		j := ResumeValueJournal(resumed, table, int64(resumed.Len()))
+		require.NoError(t, j.AppendUpdate(k, 3))
+		c := MustFromMap(sampleData)
+		size, err := ApplyJournal(c, resumed)
+		require.NoError(t, err)
+		assert.Equal(t, j.Size(), size)
+		assert.Equal(t, uint64(3), c.Get(k))
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		corrupt := append([]byte{}, full...)
+		corrupt[len(corrupt)-5] ^= 1
+		c := MustFromMap(sampleData)
+		size, err := ApplyJournal(c, bytes.NewReader(corrupt))
+		assert.ErrorIs(t, err, ErrCorruptJournal)
+		assert.Equal(t, int64(journalHeaderSize+journalRecordSize), size)
+		assert.Equal(t, uint64(1), c.Get(k))
+	})
+}
+
+func TestValueJournal_shouldCompact(t *testing.T) {
+	table := MustFromMap(sampleData)
+	j, err := NewValueJournal(&bytes.Buffer{}, table)
+	require.NoError(t, err)
+	assert.False(t, j.ShouldCompact())
+	j.SetCompactionThreshold(journalHeaderSize + journalRecordSize)
+	k := firstKey(sampleData)
+	require.NoError(t, j.AppendUpdate(k, 1))
+	assert.False(t, j.ShouldCompact())
+	require.NoError(t, j.AppendUpdate(k, 2))
+	assert.True(t, j.ShouldCompact())
+}
+
+func firstKey(m map[uint64]uint64) uint64 {
+	for k := range m {
+		return k
+	}
+	panic("empty map")
+}
@@ -0,0 +1,144 @@
+package uint64mph
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrKeyMask is returned when loading a table with masked keys without the
+// secret they were masked with, see MaskKeys.
+var ErrKeyMask = errors.New("uint64mph: wrong key mask secret")
+
+// keyMask is the invertible mix that MaskKeys stores the keys with. Tables with
+// masked keys are built over the masked keys, so everything inside the table
+// deals with masked keys, and only the methods that take or return keys mask
+// and unmask them.
+type keyMask struct {
+	secret uint64
+	xor    uint64
+	// Odd multipliers and their inverses modulo 2^64.
+	mul1, mul2 uint64
+	inv1, inv2 uint64
+}
+
+func newKeyMask(secret uint64) *keyMask {
+	m := &keyMask{secret: secret}
+	s := secret
+	m.xor = splitmix64(&s)
+	m.mul1 = splitmix64(&s) | 1
+	m.mul2 = splitmix64(&s) | 1
+	m.inv1, m.inv2 = inverse(m.mul1), inverse(m.mul2)
+	return m
+}
+
+// splitmix64 advances the SplitMix64 generator with state s.
+func splitmix64(s *uint64) uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := *s
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+// inverse returns the multiplicative inverse of the odd number a modulo 2^64,
+// with Newton's method: every step doubles the number of correct low bits.
+func inverse(a uint64) uint64 {
+	x := a
+	for i := 0; i < 5; i++ {
+		x *= 2 - a*x
+	}
+	return x
+}
+
+func (m *keyMask) mask(k uint64) uint64 {
+	k ^= m.xor
+	k *= m.mul1
+	k ^= k >> 32
+	k *= m.mul2
+	return k ^ k>>29
+}
+
+func (m *keyMask) unmask(k uint64) uint64 {
+	k ^= k>>29 ^ k>>58
+	k *= m.inv2
+	k ^= k >> 32
+	k *= m.inv1
+	return k ^ m.xor
+}
+
+// check returns the value stored in the file to recognize the secret by. Unlike
+// the mask, it can't be inverted to find the secret.
+func (m *keyMask) check() uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], m.secret)
+	sum := sha256.Sum256(append([]byte("uint64mph key mask\x00"), b[:]...))
+	return binary.LittleEndian.Uint64(sum[:])
+}
+
+// maskKey returns key as stored in the table.
+func (c *CHD) maskKey(key uint64) uint64 {
+	if c.keyMask == nil {
+		return key
+	}
+	return c.keyMask.mask(key)
+}
+
+// unmaskKey returns the key stored in the table as k.
+func (c *CHD) unmaskKey(k uint64) uint64 {
+	if c.keyMask == nil {
+		return k
+	}
+	return c.keyMask.unmask(k)
+}
+
+// maskKeys returns keys as stored in the table, copying them if they're masked.
+func (c *CHD) maskKeys(keys []uint64) []uint64 {
+	if c.keyMask == nil {
+		return keys
+	}
+	masked := make([]uint64, len(keys))
+	for i, k := range keys {
+		masked[i] = c.keyMask.mask(k)
+	}
+	return masked
+}
+
+// MaskedKeys reports whether the keys of the table are masked, see MaskKeys.
+func (c *CHD) MaskedKeys() bool {
+	return c != nil && c.keyMask != nil
+}
+
+// maskEntries returns the entries with their keys masked.
+func (m *keyMask) maskEntries(entries *entryChunks) *entryChunks {
+	out := &entryChunks{}
+	for c, chunk := range entries.keys {
+		keys := make([]uint64, len(chunk))
+		for i, k := range chunk {
+			keys[i] = m.mask(k)
+		}
+		out.addSlices(keys, entries.values[c])
+	}
+	return out
+}
+
+// loadKeyMask checks the secret passed to WithKeyMask against the one the keys
+// were masked with, if any.
+func (c *CHD) loadKeyMask(data func(tag uint32) []byte, o loadOptions) error {
+	b := data(sectionKeyMask)
+	if b == nil {
+		if o.keyMask != nil {
+			return fmt.Errorf("%w: the keys of the table aren't masked", ErrKeyMask)
+		}
+		return nil
+	}
+	if o.keyMask == nil {
+		return fmt.Errorf("%w: the keys of the table are masked, load it with WithKeyMask", ErrKeyMask)
+	}
+	if binary.LittleEndian.Uint64(b) != o.keyMask.check() {
+		return fmt.Errorf("%w: the keys of the table were masked with another secret", ErrKeyMask)
+	}
+	c.keyMask = o.keyMask
+	return nil
+}
@@ -0,0 +1,154 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyMask(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, secret := range []uint64{0, 1, 42, rng.Uint64()} {
+		m := newKeyMask(secret)
+		assert.Equal(t, uint64(1), m.mul1*m.inv1)
+		assert.Equal(t, uint64(1), m.mul2*m.inv2)
+		for _, k := range []uint64{0, 1, 2, 1 << 63, ^uint64(0), rng.Uint64()} {
+			assert.Equal(t, k, m.unmask(m.mask(k)))
+		}
+	}
+	// Consecutive keys don't stay close together.
+	m := newKeyMask(42)
+	assert.Greater(t, m.mask(2)-m.mask(1), uint64(1<<32))
+	assert.NotEqual(t, newKeyMask(1).check(), newKeyMask(2).check())
+}
+
+func TestMaskKeys(t *testing.T) {
+	m := map[uint64]uint64{}
+	for i := uint64(0); i < 2000; i++ {
+		m[1000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {m, nil},
+		"small":  {sampleData, nil},
+		"pthash": {m, []BuildOption{WithPTHash(7, 0.99)}},
+		"filter": {m, []BuildOption{WithFilter()}},
+		"packed": {m, []BuildOption{WithPackedValues()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, MaskKeys(42))...)
+			require.NoError(t, err)
+			require.NoError(t, c.Verify())
+			assert.True(t, c.MaskedKeys())
+			// The keys are consecutive, but aren't built into a dense table.
+			assert.Nil(t, c.dense)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			l := c.Spec()
+			assert.Equal(t, int64(w.Len()), l.Size)
+			keys := w.Bytes()[l.Keys.Offset : l.Keys.Offset+l.Keys.Size()]
+			for k := range tc.data {
+				assert.False(t, bytes.Contains(keys, binary.LittleEndian.AppendUint64(nil, k)), "key %d is in the file", k)
+			}
+
+			_, err = Mmap(w.Bytes())
+			assert.ErrorIs(t, err, ErrKeyMask)
+			_, err = MmapWithOptions(w.Bytes(), WithKeyMask(43))
+			assert.ErrorIs(t, err, ErrKeyMask)
+			mapped, err := MmapWithOptions(w.Bytes(), WithKeyMask(42))
+			require.NoError(t, err)
+			read, err := ReadAt(bytes.NewReader(w.Bytes()), WithKeyMask(42))
+			require.NoError(t, err)
+			for _, l := range []*CHD{c, mapped, read} {
+				require.NoError(t, l.Verify())
+				for k, v := range tc.data {
+					assert.Equal(t, v, l.Get(k))
+					assert.True(t, l.Contains(k))
+				}
+				assert.False(t, l.Contains(1))
+				got := map[uint64]uint64{}
+				for it := l.Iterate(); it != nil; it = it.Next() {
+					k, v := it.Get()
+					got[k] = v
+				}
+				assert.Equal(t, tc.data, got)
+			}
+
+			rep, err := StreamVerify(bytes.NewReader(w.Bytes()), pairsOf(t, c), WithKeyMask(42))
+			require.NoError(t, err)
+			assert.True(t, rep.OK())
+			rc, err := OpenRemote(bytes.NewReader(w.Bytes()), int64(w.Len()), WithRemoteLoadOptions(WithKeyMask(42)))
+			require.NoError(t, err)
+			for k, v := range tc.data {
+				got, ok, err := rc.Lookup(k)
+				require.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, v, got)
+			}
+		})
+	}
+}
+
+func TestMaskKeys_derived(t *testing.T) {
+	m := randomData(1000, 14)
+	c, err := FromMap(m, MaskKeys(7))
+	require.NoError(t, err)
+	var k uint64
+	for k = range m {
+		break
+	}
+
+	mapped := c.MapValues(func(key, old uint64) uint64 {
+		assert.Equal(t, m[key], old)
+		return key
+	})
+	assert.Equal(t, k, mapped.Get(k))
+	assert.Equal(t, m[k], c.Materialize().Get(k))
+	dst := make([]uint64, 2)
+	assert.Equal(t, 1, c.GetBatchSorted([]uint64{k, 1}, dst))
+	assert.Equal(t, m[k], dst[0])
+
+	r, err := RebuildWith(c, map[uint64]uint64{1: 2}, map[uint64]uint64{k: 0})
+	require.NoError(t, err)
+	assert.True(t, r.MaskedKeys())
+	assert.Equal(t, uint64(2), r.Get(1))
+	assert.False(t, r.Contains(k))
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w, WithValueDeltas()))
+	d, err := MmapWithOptions(w.Bytes(), WithKeyMask(7))
+	require.NoError(t, err)
+	assert.Equal(t, m[k], d.Get(k))
+
+	structure, values := writeSplit(t, c)
+	_, err = MmapSplit(structure, values)
+	assert.ErrorIs(t, err, ErrKeyMask)
+	s, err := MmapSplit(structure, values, WithKeyMask(7))
+	require.NoError(t, err)
+	assert.Equal(t, m[k], s.Get(k))
+
+	fi, err := Stat(bytes.NewReader(structure))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagMaskedKeys)
+
+	// Tables without masked keys can't be loaded with a secret.
+	w.Reset()
+	require.NoError(t, MustFromMap(m).Write(w))
+	_, err = MmapWithOptions(w.Bytes(), WithKeyMask(7))
+	assert.ErrorIs(t, err, ErrKeyMask)
+}
+
+// pairsOf returns the entries of c in the pairs format.
+func pairsOf(t *testing.T, c *CHD) *bytes.Buffer {
+	t.Helper()
+	b := &bytes.Buffer{}
+	_, err := c.WritePairs(b)
+	require.NoError(t, err)
+	return b
+}
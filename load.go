@@ -0,0 +1,480 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// Info describes the file a table was loaded from.
+type Info struct {
+	// Version of the serialization format. Files without a header are
+	// version 1, and are parsed with less validation as they have no magic
+	// number. Zero for tables that weren't loaded from a file.
+	Version int
+	// Flags set in the header, like FlagValueDeltas.
+	Flags uint32
+}
+
+// Info returns information about the file the table was loaded from.
+func (c *CHD) Info() Info {
+	if c == nil {
+		return Info{}
+	}
+	return c.info
+}
+
+// A LoadOption configures how a table is loaded by MmapWithOptions,
+// ReadWithOptions and ReadAt.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	skipValues    bool
+	copyStructure bool
+	// Whether to leave the keys of hashed tables out, see RemoteCHD.
+	skipKeys bool
+	mlock    MlockRegion
+	// Whether OpenMmapFile fails if the region can't be locked.
+	mlockRequired bool
+	// See WithKeyMask. May be nil.
+	keyMask *keyMask
+	// The numbers of the generations to load, see WithGenerations. Nil loads
+	// all of them.
+	generations map[int]bool
+	// See WithDeletedKeys.
+	deletedKeys []uint64
+	// See SkipChecksum.
+	skipChecksum bool
+}
+
+// SkipValues loads the table without its values, for when only membership is
+// needed. The values aren't decoded, and ReadAt doesn't even read them. The
+// table is index-only: Contains works, but looking up values panics with
+// ErrNoValues. The columns and generations aren't loaded either, see
+// AttachColumn and AddGeneration.
+func SkipValues() LoadOption {
+	return func(o *loadOptions) {
+		o.skipValues = true
+	}
+}
+
+// CopyStructure copies the parts of the file read by every lookup (the hash
+// functions and indices, or what replaces them, and the filter and metadata)
+// to the heap, rather than aliasing them like Mmap otherwise does. Only the
+// keys and values then stay in the mapping, so a file that is truncated while
+// mapped can only crash lookups of keys whose slots are gone, rather than all
+// of them. The copy costs memory and time in proportion to the number of
+// buckets, which is usually a small part of the file. See Revalidate.
+func CopyStructure() LoadOption {
+	return func(o *loadOptions) {
+		o.copyStructure = true
+	}
+}
+
+// WithKeyMask loads a table built with MaskKeys(secret). Loading fails with
+// ErrKeyMask if the secret doesn't match, or if the keys of the table aren't
+// masked.
+func WithKeyMask(secret uint64) LoadOption {
+	return func(o *loadOptions) {
+		o.keyMask = newKeyMask(secret)
+	}
+}
+
+// MlockRegion selects the part of a mapped file that WithMlock locks into
+// memory.
+type MlockRegion int
+
+const (
+	// MlockStructure locks the hash functions and indices, the pilots and
+	// free slots of a PTHash table or the presence bitmap of a dense table, which are read by every lookup but are only a
+	// small part of the file.
+	MlockStructure MlockRegion = 1 + iota
+	// MlockAll locks the whole file.
+	MlockAll
+)
+
+// WithMlock makes OpenMmapFile and OpenMmapFileRW lock region of the file into
+// memory with mlock, so that the kernel never evicts it from the page cache and
+// lookups don't stall on reading it back from disk. Opening the file fails if
+// the region can't be locked, typically because RLIMIT_MEMLOCK is too low: use
+// TryMlock to open it regardless. The pages are unlocked by Unlock or Close.
+// Other loaders ignore this option.
+//
+// Locking reads the whole region from disk before OpenMmapFile returns. Locked
+// pages count towards the memory limit of the process' cgroup and can't be
+// reclaimed under memory pressure, so locking more than the machine can spare
+// gets the process killed rather than slowed down. The lock isn't inherited by
+// child processes. Processes without CAP_IPC_LOCK can lock at most
+// RLIMIT_MEMLOCK bytes in total (see ulimit -l), which is only a few megabytes
+// on many systems.
+func WithMlock(region MlockRegion) LoadOption {
+	return func(o *loadOptions) {
+		o.mlock = region
+		o.mlockRequired = true
+	}
+}
+
+// TryMlock is like WithMlock, but opens the file unlocked if the region can't
+// be locked. Locked reports whether it was.
+func TryMlock(region MlockRegion) LoadOption {
+	return func(o *loadOptions) {
+		o.mlock = region
+		o.mlockRequired = false
+	}
+}
+
+// mlockRanges returns the parts of the mapping b to lock for region, rounded to
+// whole pages.
+func (c *CHD) mlockRanges(b []byte, region MlockRegion) [][]byte {
+	if region == MlockAll {
+		return [][]byte{b}
+	}
+	var ranges [][]byte
+	start := uintptr(unsafe.Pointer(&b[0]))
+	page := uintptr(os.Getpagesize())
+	add := func(p unsafe.Pointer, size uintptr) {
+		if size == 0 || !c.aliases(p) {
+			return
+		}
+		from := (uintptr(p) - start) &^ (page - 1)
+		to := min((uintptr(p)-start+size+page-1)&^(page-1), uintptr(len(b)))
+		ranges = append(ranges, b[from:to])
+	}
+	add(unsafe.Pointer(unsafe.SliceData(c.r)), 8*uintptr(len(c.r)))
+	add(unsafe.Pointer(unsafe.SliceData(c.indices)), 2*uintptr(len(c.indices)))
+	if c.dense != nil {
+		add(unsafe.Pointer(unsafe.SliceData(c.dense.present)), 8*uintptr(len(c.dense.present)))
+	}
+	if c.pthash != nil {
+		add(unsafe.Pointer(unsafe.SliceData(c.pthash.pilots)), 8*uintptr(len(c.pthash.pilots)))
+		add(unsafe.Pointer(unsafe.SliceData(c.pthash.free)), 4*uintptr(len(c.pthash.free)))
+	}
+	return ranges
+}
+
+// Locked reports whether some of the table is locked into memory, see
+// WithMlock.
+func (c *CHD) Locked() bool {
+	if c == nil {
+		return false
+	}
+	l, ok := c.closer.(interface{ locked() bool })
+	return ok && l.locked()
+}
+
+// Unlock unlocks the memory locked by WithMlock, keeping the table usable. It
+// does nothing for tables that aren't locked.
+func (c *CHD) Unlock() error {
+	if c == nil {
+		return nil
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if u, ok := c.closer.(interface{ Unlock() error }); ok {
+		return u.Unlock()
+	}
+	return nil
+}
+
+// MmapWithOptions is like Mmap, but configured by opts. It is the same as
+// MmapAliased.
+func MmapWithOptions(b []byte, opts ...LoadOption) (*CHD, error) {
+	if isCompressed(b) {
+		return nil, ErrCompressed
+	}
+	h, err := sniffHeader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	// Legacy files have always been accepted with trailing garbage.
+	if h.size > int64(len(b)) || (h.version != legacyFormatVersion && h.size != int64(len(b))) {
+		return nil, fmt.Errorf("%w: file is %d bytes, its sections need %d", ErrNotCHD, len(b), h.size)
+	}
+	if err := verifyChecksum(h, b, opts); err != nil {
+		return nil, err
+	}
+	c, err := load(h, mmapSection(h, b), opts)
+	if err != nil {
+		return nil, err
+	}
+	if zeroCopy {
+		c.backing = [][]byte{b}
+	}
+	return c, nil
+}
+
+// ReadAt reads the table from r, like Read, but only reads the sections it
+// needs.
+func ReadAt(r io.ReaderAt, opts ...LoadOption) (*CHD, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+	var magic [8]byte
+	if n, _ := r.ReadAt(magic[:], 0); isCompressed(magic[:n]) {
+		return nil, ErrCompressed
+	}
+	h, err := sniffHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// Check that the sections are all there before allocating memory for them.
+	var last [1]byte
+	if err := readFullAt(r, last[:], h.size-1, "last section"); err != nil {
+		return nil, err
+	}
+	var readErr error
+	c, err := load(h, func(tag uint32) []byte {
+		s, ok := h.section(tag)
+		if !ok || readErr != nil {
+			return nil
+		}
+		b := make([]byte, s.size())
+		readErr = readFullAt(r, b, s.offset, "section")
+		return b
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return c, nil
+}
+
+// mmapSection returns a function returning the data of a section within b. On
+// platforms where Mmap doesn't alias its input, it returns a copy, so that
+// sections kept as bytes, like packed values, don't alias b either.
+func mmapSection(h header, b []byte) func(tag uint32) []byte {
+	return func(tag uint32) []byte {
+		s, ok := h.section(tag)
+		if !ok {
+			return nil
+		}
+		d := b[s.offset : s.offset+s.size() : s.offset+s.size()]
+		if !zeroCopy {
+			return append([]byte(nil), d...)
+		}
+		return d
+	}
+}
+
+// load creates a table from the sections returned by data.
+func load(h header, data func(tag uint32) []byte, opts []LoadOption) (*CHD, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if h.flags&FlagSplitValues != 0 {
+		return nil, fmt.Errorf("%w: file only holds values, load it with MmapSplit", ErrNotCHD)
+	}
+	c := &CHD{info: Info{Version: h.version, Flags: h.flags}, mixBuckets: h.version >= 3, small: h.flags&FlagSmall != 0}
+	if err := c.loadStructure(h, data, o.skipKeys); err != nil {
+		return nil, err
+	}
+	if err := c.loadHasher(h, data); err != nil {
+		return nil, err
+	}
+	if err := c.loadKeyMask(data, o); err != nil {
+		return nil, err
+	}
+	c.loadMetadata(data)
+	c.loadDigest(data)
+	c.loadChecksum(data)
+	if err := c.loadFilter(data); err != nil {
+		return nil, err
+	}
+	if !o.skipValues {
+		if err := c.loadColumns(data); err != nil {
+			return nil, err
+		}
+		if err := c.loadGenerations(data, o); err != nil {
+			return nil, err
+		}
+	}
+	if !o.skipKeys {
+		if err := c.loadSorted(h, data); err != nil {
+			return nil, err
+		}
+	}
+	if h.flags&FlagSplitStructure == 0 && !o.skipValues {
+		if s, _ := h.values(); s.count != c.numSlots() {
+			return nil, fmt.Errorf("%w: %d slots but %d values", ErrNotCHD, c.numSlots(), s.count)
+		}
+		c.loadValues(h, data)
+		c.loadAggregates(h, data)
+	}
+	if !o.skipKeys {
+		if err := c.loadDeletions(data, o.deletedKeys); err != nil {
+			return nil, err
+		}
+	}
+	if o.copyStructure {
+		c.copyStructure()
+	}
+	return c, nil
+}
+
+// copyStructure replaces the sections read by every lookup with copies on the
+// heap, see CopyStructure.
+func (c *CHD) copyStructure() {
+	c.r = append([]uint64(nil), c.r...)
+	c.indices = append([]uint16(nil), c.indices...)
+	if c.small {
+		c.keys = append([]uint64(nil), c.keys...)
+	}
+	if c.metadata != nil {
+		c.metadata = append([]byte(nil), c.metadata...)
+	}
+	if c.dict != nil {
+		c.dict = append([]uint64(nil), c.dict...)
+	}
+	if c.filter != nil {
+		f := *c.filter
+		f.fingerprints = append([]uint8(nil), f.fingerprints...)
+		c.filter = &f
+	}
+	if c.dense != nil {
+		d := *c.dense
+		d.present = append([]uint64(nil), d.present...)
+		c.dense = &d
+	}
+	if c.pthash != nil {
+		t := *c.pthash
+		t.pilots = append([]uint64(nil), t.pilots...)
+		t.free = append([]uint32(nil), t.free...)
+		c.pthash = &t
+	}
+}
+
+// loadStructure loads the hash functions and keys, or what replaces them. With
+// skipKeys, the keys of hashed tables are left out.
+func (c *CHD) loadStructure(h header, data func(tag uint32) []byte, skipKeys bool) error {
+	if h.flags&FlagDense != 0 {
+		return c.loadDense(h, data)
+	}
+	if h.flags&FlagPTHash != 0 {
+		return c.loadPTHash(h, data, skipKeys)
+	}
+	if h.flags&FlagHashFunctions32 != 0 {
+		s, _ := h.section(sectionHashFunctions)
+		b := data(sectionHashFunctions)
+		c.r = make([]uint64, s.count)
+		for i := range c.r {
+			c.r[i] = uint64(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		c.r32 = true
+	} else {
+		c.r = readUint64s(h, data, sectionHashFunctions)
+	}
+	s, _ := h.section(sectionIndices)
+	c.indices = (&sliceReader{b: data(sectionIndices)}).ReadUint16Array(uint64(s.count))
+	if !skipKeys {
+		c.keys = readUint64s(h, data, sectionKeys)
+	}
+	return nil
+}
+
+// loadValues loads the values. The structure must have been loaded, and have as
+// many slots as there are values.
+func (c *CHD) loadValues(h header, data func(tag uint32) []byte) {
+	if h.flags&FlagPairValues != 0 {
+		s, _ := h.values()
+		c.pairValues = (&sliceReader{b: data(sectionPairValues)}).ReadUint64Array(2 * uint64(s.count))
+		return
+	}
+	if h.flags&FlagPackedValues != 0 {
+		s, _ := h.values()
+		c.packed, c.valueWidth = data(sectionValues), s.width
+		if h.flags&FlagDictionary != 0 {
+			c.dict = readUint64s(h, data, sectionDictionary)
+		}
+		return
+	}
+	if h.flags&FlagValueDeltas == 0 {
+		c.values = readUint64s(h, data, sectionValues)
+		return
+	}
+	d := data(sectionValueDeltas)
+	c.values = make([]uint64, c.numSlots())
+	for i := range c.values {
+		if k, ok := c.slotKey(i); ok {
+			c.values[i] = k + uint64(int64(int32(binary.LittleEndian.Uint32(d[4*i:]))))
+		}
+	}
+}
+
+func (c *CHD) loadMetadata(data func(tag uint32) []byte) {
+	c.metadata = data(sectionMetadata)
+}
+
+func (c *CHD) loadFilter(data func(tag uint32) []byte) error {
+	if b := data(sectionFilter); b != nil {
+		if c.filter = decodeFilter(b); c.filter == nil {
+			return fmt.Errorf("%w: invalid filter", ErrNotCHD)
+		}
+	}
+	return nil
+}
+
+func readUint64s(h header, data func(tag uint32) []byte, tag uint32) []uint64 {
+	s, _ := h.section(tag)
+	return (&sliceReader{b: data(tag)}).ReadUint64Array(uint64(s.count))
+}
+
+// sniffHeader decodes the header of a file in any format version. Files
+// starting with the magic are parsed as version 2 or later, anything else as
+// version 1.
+func sniffHeader(r io.ReaderAt) (header, error) {
+	var magic [len(formatMagic)]byte
+	if n, _ := r.ReadAt(magic[:], 0); hasFormatMagic(magic[:n]) {
+		return readHeader(r)
+	}
+	return legacyHeader(r)
+}
+
+// legacyHeader describes the sections of a version 1 file as if it had a
+// header.
+func legacyHeader(r io.ReaderAt) (header, error) {
+	var buf [4]byte
+	readCount := func(off int64, what string) (int, error) {
+		if err := readFullAt(r, buf[:], off, what); err != nil {
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint32(buf[:])
+		if n > math.MaxInt32 {
+			return 0, fmt.Errorf("%w: invalid %s %d", ErrNotCHD, what, n)
+		}
+		return int(n), nil
+	}
+	h := header{version: legacyFormatVersion}
+	off := int64(0)
+	for _, s := range []struct {
+		tag   uint32
+		width int
+		what  string
+	}{
+		{sectionHashFunctions, 8, "hash function count"},
+		{sectionIndices, 2, "bucket count"},
+		{sectionKeys, 8, "entry count"},
+	} {
+		n, err := readCount(off, s.what)
+		if err != nil {
+			return header{}, err
+		}
+		off += 4
+		h.sections = append(h.sections, rawSection{tag: s.tag, width: s.width, count: n, offset: off})
+		off += int64(n) * int64(s.width)
+	}
+	keys := h.sections[2]
+	h.sections = append(h.sections, rawSection{tag: sectionValues, width: 8, count: keys.count, offset: off})
+	h.size = off + 8*int64(keys.count)
+	if err := h.checkStructure(); err != nil {
+		return header{}, err
+	}
+	return h, nil
+}
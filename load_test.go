@@ -0,0 +1,146 @@
+package uint64mph
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingReaderAt records the byte ranges read from it.
+type recordingReaderAt struct {
+	r     *bytes.Reader
+	mtx   sync.Mutex
+	reads [][2]int64
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mtx.Lock()
+	r.reads = append(r.reads, [2]int64{off, off + int64(len(p))})
+	r.mtx.Unlock()
+	return r.r.ReadAt(p, off)
+}
+
+// eofReaderAt returns io.EOF along with reads that reach the end of r, as
+// io.ReaderAt allows.
+type eofReaderAt struct {
+	r *bytes.Reader
+}
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	if err == nil && off+int64(n) == r.r.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestReadAt_eofAtEnd(t *testing.T) {
+	m := randomData(1000, 49)
+	c := MustFromMap(m, WithSeed(49))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	r := eofReaderAt{bytes.NewReader(w.Bytes())}
+
+	for _, opts := range [][]LoadOption{nil, {SkipValues()}} {
+		g, err := ReadAt(r, opts...)
+		require.NoError(t, err)
+		for k := range m {
+			assert.True(t, g.Contains(k))
+		}
+	}
+	fi, err := Stat(r)
+	require.NoError(t, err)
+	assert.Equal(t, int64(w.Len()), fi.Size)
+	pairs := &bytes.Buffer{}
+	_, err = c.WritePairs(pairs)
+	require.NoError(t, err)
+	rep, err := StreamVerify(r, pairs)
+	require.NoError(t, err)
+	assert.True(t, rep.OK())
+
+	// Short reads are still caught.
+	_, err = ReadAt(eofReaderAt{bytes.NewReader(w.Bytes()[:w.Len()-1])})
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
+
+func TestSkipValues(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+
+	rr := &recordingReaderAt{r: bytes.NewReader(b)}
+	for name, load := range map[string]func() (*CHD, error){
+		"Mmap": func() (*CHD, error) { return MmapWithOptions(b, SkipValues()) },
+		"Read": func() (*CHD, error) { return ReadWithOptions(bytes.NewReader(b), SkipValues()) },
+		"ReadAt": func() (*CHD, error) {
+			return ReadAt(rr, SkipValues())
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			g, err := load()
+			require.NoError(t, err)
+			assert.True(t, g.IndexOnly())
+			assert.Equal(t, len(sampleData), g.Len())
+			assert.Zero(t, g.Stats().ValuesBytes)
+			for k := range sampleData {
+				assert.True(t, g.Contains(k))
+				assert.PanicsWithValue(t, ErrNoValues, func() { g.Get(k) })
+			}
+			assert.False(t, g.Contains(5))
+			_, ok := g.GetOK(5)
+			assert.False(t, ok)
+			assert.NoError(t, g.Verify())
+		})
+	}
+
+	// Apart from the last byte, read to check that the file isn't truncated,
+	// the values aren't read.
+	values := c.Spec().Values
+	for _, rd := range rr.reads {
+		if rd != [2]int64{values.Offset + values.Size() - 1, values.Offset + values.Size()} {
+			assert.False(t, rd[1] > values.Offset && rd[0] < values.Offset+values.Size(), "read %v overlaps the values", rd)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	c := MustFromMap(sampleData)
+	require.NoError(t, c.SetMetadata([]byte("hello")))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w, WithValueDeltas()))
+
+	g, err := ReadAt(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.False(t, g.IndexOnly())
+	assert.True(t, g.Contains(4497751427889084562))
+	for k, v := range sampleData {
+		assert.Equal(t, v, g.Get(k))
+	}
+	assert.Equal(t, []byte("hello"), g.Metadata())
+
+	for _, gc := range golden.Cases() {
+		f, err := os.Open(filepath.Join("testdata/golden/v1", gc.Name))
+		require.NoError(t, err)
+		g, err := ReadAt(f)
+		f.Close()
+		require.NoError(t, err)
+		for i, k := range gc.Keys {
+			assert.Equal(t, gc.Values[i], g.Get(k))
+		}
+	}
+
+	_, err = ReadAt(bytes.NewReader(w.Bytes()[:w.Len()-1]))
+	assert.ErrorIs(t, err, ErrNotCHD)
+	z := &bytes.Buffer{}
+	require.NoError(t, c.WriteCompressed(z, -1))
+	_, err = ReadAt(bytes.NewReader(z.Bytes()))
+	assert.ErrorIs(t, err, ErrCompressed)
+}
@@ -0,0 +1,55 @@
+package uint64mph
+
+import "math"
+
+// MemoCHD wraps a table and remembers the result of the last lookup, so that
+// looking up the same key again returns without hashing it or touching the
+// table. This pays off for workloads that look up one key many times in a row,
+// like a request fanning out, at the cost of an extra branch for every other
+// lookup.
+//
+// A MemoCHD must not be used by multiple goroutines at once: give each
+// goroutine its own. It doesn't see changes made by SetValue to the table
+// after the key was remembered: call Reset after changing values.
+type MemoCHD struct {
+	c     *CHD
+	key   uint64
+	value uint64
+	found bool
+	// Whether key holds a lookup result.
+	valid bool
+}
+
+// NewMemoCHD returns a MemoCHD looking up keys in c.
+func NewMemoCHD(c *CHD) *MemoCHD {
+	return &MemoCHD{c: c}
+}
+
+// Table returns the wrapped table.
+func (m *MemoCHD) Table() *CHD {
+	return m.c
+}
+
+// Get is like CHD.Get.
+func (m *MemoCHD) Get(key uint64) uint64 {
+	v, ok := m.GetOK(key)
+	if !ok {
+		return math.MaxUint64
+	}
+	return v
+}
+
+// GetOK is like CHD.GetOK.
+func (m *MemoCHD) GetOK(key uint64) (uint64, bool) {
+	if m.valid && m.key == key {
+		return m.value, m.found
+	}
+	v, ok := m.c.GetOK(key)
+	m.key, m.value, m.found, m.valid = key, v, ok, true
+	return v, ok
+}
+
+// Reset forgets the remembered lookup.
+func (m *MemoCHD) Reset() {
+	m.valid = false
+}
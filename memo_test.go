@@ -0,0 +1,78 @@
+package uint64mph
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoCHD(t *testing.T) {
+	c := MustFromMap(sampleData)
+	m := NewMemoCHD(c)
+	assert.Same(t, c, m.Table())
+	for k, v := range sampleData {
+		for i := 0; i < 3; i++ {
+			got, ok := m.GetOK(k)
+			assert.True(t, ok)
+			assert.Equal(t, v, got)
+			assert.Equal(t, v, m.Get(k))
+		}
+	}
+	// A new MemoCHD doesn't remember zero as found.
+	_, ok := NewMemoCHD(c).GetOK(0)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(math.MaxUint64), m.Get(0))
+
+	// The remembered value is stale until Reset.
+	var k uint64
+	for k = range sampleData {
+		break
+	}
+	m.Get(k)
+	require.NoError(t, c.SetValue(k, 42))
+	assert.Equal(t, sampleData[k], m.Get(k))
+	m.Reset()
+	assert.Equal(t, uint64(42), m.Get(k))
+}
+
+// burstyQueries repeats every key of q burst times in a row.
+func burstyQueries(q []uint64, burst int) []uint64 {
+	out := make([]uint64, 0, len(q))
+	for i := 0; len(out) < len(q); i++ {
+		for j := 0; j < burst && len(out) < len(q); j++ {
+			out = append(out, q[i])
+		}
+	}
+	return out
+}
+
+func BenchmarkMemoCHD(b *testing.B) {
+	for _, n := range benchSizes() {
+		d := getBenchDataset(b, n)
+		uniform := uniformQueries(d.keys, 1)
+		for _, pattern := range []struct {
+			name string
+			q    []uint64
+		}{
+			{"uniform", uniform},
+			{"burst=4", burstyQueries(uniform, 4)},
+			{"burst=100", burstyQueries(uniform, 100)},
+		} {
+			q := pattern.q
+			b.Run(fmt.Sprintf("n=%d/%s/chd", n, pattern.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					d.table.GetOK(q[i%len(q)])
+				}
+			})
+			b.Run(fmt.Sprintf("n=%d/%s/memo", n, pattern.name), func(b *testing.B) {
+				m := NewMemoCHD(d.table)
+				for i := 0; i < b.N; i++ {
+					m.GetOK(q[i%len(q)])
+				}
+			})
+		}
+	}
+}
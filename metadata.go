@@ -0,0 +1,40 @@
+package uint64mph
+
+import "fmt"
+
+// MaxMetadataSize is the size in bytes of the largest metadata blob a table can
+// hold.
+const MaxMetadataSize = 64 << 10
+
+// SetMetadata attaches an arbitrary blob to the table, like its provenance.
+// Write stores it in the file and it's restored by Read and Mmap; it doesn't
+// affect lookups. The blob is copied. Pass nil to remove the metadata.
+func (c *CHD) SetMetadata(b []byte) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	if len(b) > MaxMetadataSize {
+		return fmt.Errorf("metadata is %d bytes, at most %d are allowed", len(b), MaxMetadataSize)
+	}
+	if len(b) == 0 {
+		c.metadata = nil
+		return nil
+	}
+	c.metadata = append([]byte(nil), b...)
+	return nil
+}
+
+// Metadata returns a copy of the blob set by SetMetadata, or nil if there is
+// none.
+func (c *CHD) Metadata() []byte {
+	if c == nil || c.metadata == nil {
+		return nil
+	}
+	return append([]byte(nil), c.metadata...)
+}
+
+func (e *encoder) metadata(b []byte) {
+	e.section(sectionMetadata, 1, len(b))
+	e.bytes(b)
+	e.pad()
+}
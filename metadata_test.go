@@ -0,0 +1,64 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	assert.Nil(t, c.Metadata())
+	plain := &bytes.Buffer{}
+	require.NoError(t, c.Write(plain))
+
+	md := []byte(`{"snapshot": 42}`)
+	require.NoError(t, c.SetMetadata(md))
+	md[0] = 'x'
+	assert.Equal(t, []byte(`{"snapshot": 42}`), c.Metadata())
+	c.Metadata()[0] = 'x'
+	assert.Equal(t, []byte(`{"snapshot": 42}`), c.Metadata())
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagMetadata, fi.Flags)
+	// The metadata is stored after the other sections, padded to 8 bytes.
+	assert.Equal(t, plain.Bytes()[headerSize:], w.Bytes()[headerSize:plain.Len()])
+	assert.Equal(t, plain.Len()+sectionHeaderSize+16, w.Len())
+
+	for _, load := range []func([]byte) (*CHD, error){
+		Mmap,
+		func(b []byte) (*CHD, error) { return Read(bytes.NewReader(b)) },
+	} {
+		g, err := load(w.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, c.Metadata(), g.Metadata())
+		assert.Equal(t, c.Metadata(), g.Materialize().Metadata())
+		assert.Equal(t, c.Metadata(), g.MapValues(func(k, v uint64) uint64 { return v }).Metadata())
+		for k, v := range sampleData {
+			assert.Equal(t, v, g.Get(k))
+		}
+	}
+
+	s, v := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.WriteSplit(s, v))
+	g, err := MmapSplit(s.Bytes(), v.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, c.Metadata(), g.Metadata())
+
+	require.NoError(t, c.SetMetadata(nil))
+	w.Reset()
+	require.NoError(t, c.Write(w))
+	assert.Equal(t, plain.Bytes(), w.Bytes())
+}
+
+func TestMetadata_tooLarge(t *testing.T) {
+	c := MustFromMap(sampleData)
+	assert.NoError(t, c.SetMetadata(make([]byte, MaxMetadataSize)))
+	assert.Error(t, c.SetMetadata(make([]byte, MaxMetadataSize+1)))
+	assert.Len(t, c.Metadata(), MaxMetadataSize)
+}
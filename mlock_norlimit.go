@@ -0,0 +1,7 @@
+//go:build unix && !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package uint64mph
+
+func memlockHint(err error) string {
+	return ""
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// memlockHint explains an mlock error caused by RLIMIT_MEMLOCK.
+func memlockHint(err error) string {
+	if !errors.Is(err, unix.ENOMEM) && !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.EAGAIN) {
+		return ""
+	}
+	var rl unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rl) != nil {
+		return ""
+	}
+	return fmt.Sprintf(" (RLIMIT_MEMLOCK is %d bytes: raise it with ulimit -l or grant CAP_IPC_LOCK)", rl.Cur)
+}
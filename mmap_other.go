@@ -0,0 +1,60 @@
+//go:build !unix && !windows
+
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// OpenMmapFile loads the table in the file at path. This platform doesn't
+// support mmap, so the file is read into memory instead, and WithMlock fails.
+func OpenMmapFile(path string, opts ...LoadOption) (*CHD, error) {
+	return openMmapFileRange(path, 0, 0, opts)
+}
+
+// openMmapFileRange is like OpenMmapFile, but reads the size bytes of the file
+// at off, or the rest of the file if size is 0.
+func openMmapFileRange(path string, off, size int64, opts []LoadOption) (*CHD, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.mlock != 0 && o.mlockRequired {
+		return nil, fmt.Errorf("%s: mlock isn't supported on this platform", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, err = mapRange(fi.Size(), off, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	c, err := MmapWithOptions(b, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// OpenMmapFileRW isn't supported on this platform.
+func OpenMmapFileRW(path string, opts ...LoadOption) (*CHD, error) {
+	return nil, fmt.Errorf("%s: writable mappings aren't supported on this platform", path)
+}
+
+const externalBuildSupported = false
+
+func mapScratch(n uint64) ([]uint64, func() error, error) {
+	return nil, nil, errors.New("external builds aren't supported on this platform")
+}
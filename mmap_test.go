@@ -0,0 +1,221 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTempTable(t *testing.T, c *CHD) string {
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	path := filepath.Join(t.TempDir(), "table.idx")
+	require.NoError(t, os.WriteFile(path, w.Bytes(), 0644))
+	return path
+}
+
+func TestOpenMmapFile(t *testing.T) {
+	path := writeTempTable(t, MustFromMap(sampleData))
+	c, err := OpenMmapFile(path)
+	require.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+	assert.Equal(t, 0, c.Len())
+	assert.Nil(t, c.Iterate())
+	assert.ErrorIs(t, c.Write(&bytes.Buffer{}), ErrClosed)
+	assert.PanicsWithValue(t, ErrClosed, func() { c.Get(1) })
+	assert.PanicsWithValue(t, ErrClosed, func() { c.GetOK(1) })
+
+	_, err = OpenMmapFile(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(empty, nil, 0644))
+	_, err = OpenMmapFile(empty)
+	assert.Error(t, err)
+}
+
+type countingCloser struct {
+	closed int
+	err    error
+}
+
+func (c *countingCloser) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestMmapWithCloser(t *testing.T) {
+	w := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData).Write(w))
+	cc := &countingCloser{err: errors.New("boom")}
+	c, err := MmapWithCloser(w.Bytes(), cc)
+	require.NoError(t, err)
+	assert.EqualError(t, c.Close(), "boom")
+	assert.NoError(t, c.Close())
+	assert.Equal(t, 1, cc.closed)
+
+	// Tables without a closer can be closed too.
+	d := MustFromMap(sampleData)
+	assert.NoError(t, d.Close())
+	assert.PanicsWithValue(t, ErrClosed, func() { d.Get(1) })
+}
+
+// scribble overwrites b with garbage.
+func scribble(b []byte) {
+	for i := range b {
+		b[i] = 0xa5
+	}
+}
+
+func TestReadBytes(t *testing.T) {
+	m := randomData(1000, 44)
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[500+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data       map[uint64]uint64
+		opts       []BuildOption
+		compressed bool
+	}{
+		"chd":        {m, []BuildOption{WithFilter()}, false},
+		"packed":     {byteValues(), []BuildOption{WithPackedValues()}, false},
+		"dense":      {dense, []BuildOption{WithDenseThreshold(0.5)}, false},
+		"compressed": {m, nil, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithSeed(44))...)
+			require.NoError(t, err)
+			require.NoError(t, c.SetMetadata([]byte("meta")))
+			attachColumns(t, c)
+			w := &bytes.Buffer{}
+			if tc.compressed {
+				require.NoError(t, c.WriteCompressed(w, 1))
+			} else {
+				require.NoError(t, c.Write(w))
+			}
+			b := w.Bytes()
+			orig := append([]byte(nil), b...)
+
+			g, err := ReadBytes(b)
+			require.NoError(t, err)
+			scribble(b)
+			assert.Zero(t, g.MemoryFootprint().Aliased)
+			require.NoError(t, g.Verify())
+			for k, v := range tc.data {
+				assert.Equal(t, v, g.Get(k))
+				got, ok := g.GetColumn("double", k)
+				assert.True(t, ok)
+				assert.Equal(t, 2*v, got)
+			}
+			assert.Equal(t, []byte("meta"), g.Metadata())
+			if !tc.compressed {
+				again := &bytes.Buffer{}
+				require.NoError(t, g.Write(again))
+				assert.Equal(t, orig, again.Bytes())
+			}
+		})
+	}
+
+	_, err := ReadBytes([]byte("garbage"))
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
+
+func TestMmapAliased(t *testing.T) {
+	m := randomData(1000, 45)
+	c := MustFromMap(m, WithSeed(45))
+	k := firstKey(m)
+	ti, _ := c.Slot(k)
+	values := c.Spec().Values
+	for name, load := range map[string]func(b []byte) (*CHD, error){
+		"MmapAliased": func(b []byte) (*CHD, error) { return MmapAliased(b) },
+		"Mmap":        Mmap,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			b := w.Bytes()
+			g, err := load(b)
+			require.NoError(t, err)
+			materialized := g.Materialize()
+			assert.Zero(t, materialized.MemoryFootprint().Aliased)
+
+			// Changing the buffer changes the table where it's borrowed, and
+			// only there.
+			binary.LittleEndian.PutUint64(b[values.Offset+int64(8*ti):], 12345)
+			if zeroCopy {
+				assert.Equal(t, uint64(12345), g.Get(k))
+				assert.NotZero(t, g.MemoryFootprint().Aliased)
+			} else {
+				assert.Equal(t, m[k], g.Get(k))
+				assert.Zero(t, g.MemoryFootprint().Aliased)
+			}
+			scribble(b)
+			assert.Equal(t, m[k], materialized.Get(k))
+			require.NoError(t, materialized.Verify())
+		})
+	}
+}
+
+func TestMmapAliased_sameAsReadBytes(t *testing.T) {
+	b := Builder()
+	for i, w := range words {
+		b.Add(w, uint64(i))
+	}
+	c, err := b.Build(WithSeed(46), WithFilter())
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	aliased, err := MmapAliased(w.Bytes())
+	require.NoError(t, err)
+	copied, err := ReadBytes(w.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, zeroCopy, aliased.MemoryFootprint().Aliased > 0)
+	assert.Zero(t, copied.MemoryFootprint().Aliased)
+	assertSameTable(t, copied, aliased)
+	for i, k := range words {
+		v, ok := aliased.GetOK(k)
+		if !assert.True(t, ok) || !assert.Equal(t, uint64(i), v) {
+			break
+		}
+		assert.True(t, copied.Contains(k))
+	}
+	for k := uint64(0); k < 1000; k++ {
+		v1, ok1 := aliased.GetOK(k)
+		v2, ok2 := copied.GetOK(k)
+		assert.Equal(t, ok2, ok1)
+		assert.Equal(t, v2, v1)
+	}
+}
+
+func TestTryMlock(t *testing.T) {
+	path := writeTempTable(t, MustFromMap(sampleData, hashed))
+	for _, region := range []MlockRegion{MlockStructure, MlockAll} {
+		c, err := OpenMmapFile(path, TryMlock(region))
+		require.NoError(t, err)
+		for k, v := range sampleData {
+			assert.Equal(t, v, c.Get(k))
+		}
+		assert.NoError(t, c.Unlock())
+		assert.False(t, c.Locked())
+		require.NoError(t, c.Close())
+		assert.ErrorIs(t, c.Unlock(), ErrClosed)
+	}
+
+	// Tables that weren't opened from a file are never locked.
+	c := MustFromMap(sampleData)
+	assert.False(t, c.Locked())
+	assert.NoError(t, c.Unlock())
+}
@@ -0,0 +1,182 @@
+//go:build unix
+
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenMmapFile maps the file at path into memory read-only and creates a table
+// aliasing it, without copying. Call Close on the table to unmap the file;
+// the table must not be used afterwards. The file must not be truncated or
+// rewritten while it is mapped: replace it with WriteFile instead, see
+// Revalidate.
+func OpenMmapFile(path string, opts ...LoadOption) (*CHD, error) {
+	return openMmapFileRange(path, 0, 0, opts)
+}
+
+// openMmapFileRange is like OpenMmapFile, but maps the size bytes of the file
+// at off, or the rest of the file if size is 0.
+func openMmapFileRange(path string, off, size int64, opts []LoadOption) (*CHD, error) {
+	c, err := openMmap(path, off, size, os.O_RDONLY, unix.PROT_READ, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.readOnly = true
+	return c, nil
+}
+
+// OpenMmapFileRW is like OpenMmapFile, but maps the file writable so that
+// SetValue modifies the file. Changes reach the file eventually, or when Sync
+// is called.
+//
+// Values are stored aligned to their width and updated with a single store, so
+// after a crash every value is either the old or the new one: a file is never
+// torn within a value, but updates that weren't synced may be lost in any
+// combination. Only files in the current format storing plain or packed values
+// can be opened, and only on platforms where Mmap aliases its input.
+func OpenMmapFileRW(path string, opts ...LoadOption) (*CHD, error) {
+	if !zeroCopy {
+		return nil, fmt.Errorf("%s: writable mappings aren't supported on this platform", path)
+	}
+	c, err := openMmap(path, 0, 0, os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p := c.valuesPointer(); c.numValues() > 0 && (!c.aliases(p) || uintptr(p)%uintptr(c.ValueWidth()) != 0) {
+		c.Close()
+		return nil, fmt.Errorf("%s: values aren't stored aligned and can't be written in place", path)
+	}
+	return c, nil
+}
+
+func openMmap(path string, off, size int64, flag, prot int, opts []LoadOption) (*CHD, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, err = mapRange(fi.Size(), off, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// mmap takes offsets in whole pages.
+	start := off &^ int64(os.Getpagesize()-1)
+	b, err := unix.Mmap(int(f.Fd()), start, int(off-start+size), prot, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: mmap: %w", path, err)
+	}
+	// Keep the file open, so that Revalidate can check its size.
+	m := &mapping{b: b, mappedFile: mappedFile{path: path, file: f, opened: fi}}
+	b = b[off-start:]
+	c, err := MmapWithOptions(b, opts...)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.closer = m
+	if o.mlock != 0 {
+		if err := m.lock(c.mlockRanges(b, o.mlock)); err != nil && o.mlockRequired {
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+// mlock is unix.Mlock, replaced by tests.
+var mlock = unix.Mlock
+
+// mapping unmaps a memory mapping and closes the mapped file, if any, when
+// closed.
+type mapping struct {
+	b []byte
+	mappedFile
+	// The parts of b locked by lock.
+	mlocked [][]byte
+}
+
+// lock locks ranges of the mapping into memory. If any can't be locked, none
+// are.
+func (m *mapping) lock(ranges [][]byte) error {
+	for _, r := range ranges {
+		if err := mlock(r); err != nil {
+			m.Unlock()
+			return fmt.Errorf("mlock %d bytes: %w%s", len(r), err, memlockHint(err))
+		}
+		m.mlocked = append(m.mlocked, r)
+	}
+	return nil
+}
+
+func (m *mapping) locked() bool {
+	return len(m.mlocked) > 0
+}
+
+// Unlock unlocks the ranges locked by lock.
+func (m *mapping) Unlock() error {
+	var firstErr error
+	for _, r := range m.mlocked {
+		if err := unix.Munlock(r); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("munlock: %w", err)
+		}
+	}
+	m.mlocked = nil
+	return firstErr
+}
+
+func (m *mapping) Close() error {
+	err := unix.Munmap(m.b)
+	if m.file != nil {
+		err = errors.Join(err, m.file.Close())
+	}
+	return err
+}
+
+// Sync writes changes to the mapping back to the file.
+func (m *mapping) Sync() error {
+	return unix.Msync(m.b, unix.MS_SYNC)
+}
+
+const externalBuildSupported = true
+
+// mapScratch returns n uint64s backed by a temporary file, and a function to
+// release them.
+func mapScratch(n uint64) ([]uint64, func() error, error) {
+	if n == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	f, err := os.CreateTemp("", "uint64mph-build-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	// The mapping stays valid after the file is removed.
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, nil, err
+	}
+	if err := f.Truncate(int64(8 * n)); err != nil {
+		return nil, nil, err
+	}
+	b, err := unix.Mmap(int(f.Fd()), 0, int(8*n), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mmap: %w", err)
+	}
+	m := &mapping{b: b}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), n), m.Close, nil
+}
@@ -0,0 +1,181 @@
+//go:build unix
+
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenMmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	path := writeTempTable(t, MustFromMap(sampleData))
+	c, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	for k := range sampleData {
+		require.NoError(t, c.SetValue(k, k*1000))
+	}
+	assert.ErrorIs(t, c.SetValue(12345, 1), ErrKeyNotFound)
+	require.NoError(t, c.Sync())
+	require.NoError(t, c.Close())
+	assert.ErrorIs(t, c.Sync(), ErrClosed)
+
+	c, err = OpenMmapFile(path)
+	require.NoError(t, err)
+	defer c.Close()
+	for k := range sampleData {
+		assert.Equal(t, k*1000, c.Get(k))
+	}
+	assert.ErrorIs(t, c.SetValue(1, 1), ErrReadOnly)
+	assert.NoError(t, c.Sync())
+}
+
+func TestOpenMmapFileRW_unsupported(t *testing.T) {
+	c := MustFromMap(map[uint64]uint64{10: 11, 20: 21, 30: 31, 40: 41, 50: 51})
+	f, err := os.CreateTemp(t.TempDir(), "deltas")
+	require.NoError(t, err)
+	require.NoError(t, c.Write(f, WithValueDeltas()))
+	require.NoError(t, f.Close())
+
+	_, err = OpenMmapFileRW(f.Name())
+	assert.Error(t, err)
+}
+
+func TestWithMlock(t *testing.T) {
+	path := writeTempTable(t, MustFromMap(sampleData, hashed))
+	c, err := OpenMmapFile(path, WithMlock(MlockAll))
+	if err != nil {
+		// Unprivileged processes may not be allowed to lock anything.
+		assert.ErrorContains(t, err, "RLIMIT_MEMLOCK")
+		t.Skipf("can't mlock: %v", err)
+	}
+	assert.True(t, c.Locked())
+	require.NoError(t, c.Unlock())
+	assert.False(t, c.Locked())
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	require.NoError(t, c.Close())
+
+	if !zeroCopy {
+		return
+	}
+	c, err = OpenMmapFileRW(path, WithMlock(MlockStructure))
+	require.NoError(t, err)
+	assert.True(t, c.Locked())
+	require.NoError(t, c.Close())
+}
+
+func TestWithMlock_fallback(t *testing.T) {
+	defer func(orig func([]byte) error) { mlock = orig }(mlock)
+	calls := 0
+	mlock = func(b []byte) error {
+		calls++
+		return unix.ENOMEM
+	}
+	path := writeTempTable(t, MustFromMap(sampleData, hashed))
+
+	_, err := OpenMmapFile(path, WithMlock(MlockAll))
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.ErrorContains(t, err, "RLIMIT_MEMLOCK")
+
+	c, err := OpenMmapFile(path, TryMlock(MlockAll))
+	require.NoError(t, err)
+	defer c.Close()
+	assert.False(t, c.Locked())
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestMlockRanges(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("only aliased sections are locked")
+	}
+	m := map[uint64]uint64{}
+	for i := uint64(0); i < 10000; i++ {
+		m[i*7919] = i
+	}
+	path := writeTempTable(t, MustFromMap(m))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// Mmap the data at a page boundary, like the kernel does.
+	page := os.Getpagesize()
+	buf := make([]byte, len(b)+page)
+	off := page - int(uintptr(unsafe.Pointer(&buf[0]))%uintptr(page))
+	aligned := buf[off : off+len(b)]
+	copy(aligned, b)
+	c, err := Mmap(aligned)
+	require.NoError(t, err)
+
+	assert.Equal(t, [][]byte{aligned}, c.mlockRanges(aligned, MlockAll))
+	ranges := c.mlockRanges(aligned, MlockStructure)
+	require.Len(t, ranges, 2)
+	structure := c.Spec()
+	for i, s := range []Section{structure.HashFunctions, structure.Indices} {
+		from := int(uintptr(unsafe.Pointer(&ranges[i][0])) - uintptr(unsafe.Pointer(&aligned[0])))
+		assert.Zero(t, from%page)
+		assert.LessOrEqual(t, int64(from), s.Offset)
+		assert.GreaterOrEqual(t, int64(from+len(ranges[i])), s.Offset+s.Size())
+		assert.Less(t, int64(from+len(ranges[i])), structure.Keys.Offset+int64(page))
+	}
+}
+
+func TestApplyPatchFile(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	old := MustFromMap(sampleData, hashed, WithSeed(1))
+	newData := map[uint64]uint64{}
+	for k := range sampleData {
+		newData[k] = k * 3
+	}
+	patch := &bytes.Buffer{}
+	require.NoError(t, CreatePatch(old, MustFromMap(newData, hashed, WithSeed(1)), patch))
+	path := writeTempTable(t, old)
+	require.NoError(t, ApplyPatchFile(path, bytes.NewReader(patch.Bytes())))
+	c, err := OpenMmapFile(path)
+	require.NoError(t, err)
+	defer c.Close()
+	for k, v := range newData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	assert.ErrorIs(t, ApplyPatchFile(path, bytes.NewReader(patch.Bytes())), ErrPatchMismatch)
+}
+
+func TestRevalidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	require.NoError(t, MustFromMap(sampleData, hashed).WriteFile(path))
+	c, err := OpenMmapFile(path, CopyStructure())
+	require.NoError(t, err)
+	defer c.Close()
+	assert.NoError(t, c.Revalidate())
+
+	// Replacing the file leaves the mapping intact.
+	require.NoError(t, MustFromMap(map[uint64]uint64{1: 2}).WriteFile(path))
+	assert.ErrorIs(t, c.Revalidate(), ErrFileReplaced)
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+
+	// Truncating it doesn't, which Revalidate detects without touching the
+	// lost pages.
+	d, err := OpenMmapFile(path)
+	require.NoError(t, err)
+	defer d.Close()
+	require.NoError(t, os.Truncate(path, 16))
+	assert.ErrorIs(t, d.Revalidate(), ErrFileTruncated)
+
+	require.NoError(t, d.Close())
+	assert.ErrorIs(t, d.Revalidate(), ErrClosed)
+}
@@ -0,0 +1,228 @@
+//go:build windows
+
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// OpenMmapFile maps the file at path into memory read-only and creates a table
+// aliasing it, without copying. Call Close on the table to unmap the file;
+// the table must not be used afterwards. The file must not be truncated or
+// rewritten while it is mapped: replace it with WriteFile instead, see
+// Revalidate.
+func OpenMmapFile(path string, opts ...LoadOption) (*CHD, error) {
+	return openMmapFileRange(path, 0, 0, opts)
+}
+
+// openMmapFileRange is like OpenMmapFile, but maps the size bytes of the file
+// at off, or the rest of the file if size is 0.
+func openMmapFileRange(path string, off, size int64, opts []LoadOption) (*CHD, error) {
+	c, err := openMmap(path, off, size, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.readOnly = true
+	return c, nil
+}
+
+// OpenMmapFileRW is like OpenMmapFile, but maps the file writable so that
+// SetValue modifies the file. Changes reach the file eventually, or when Sync
+// is called.
+//
+// Values are stored aligned to their width and updated with a single store, so
+// after a crash every value is either the old or the new one: a file is never
+// torn within a value, but updates that weren't synced may be lost in any
+// combination. Only files in the current format storing plain or packed values
+// can be opened, and only on platforms where Mmap aliases its input.
+func OpenMmapFileRW(path string, opts ...LoadOption) (*CHD, error) {
+	if !zeroCopy {
+		return nil, fmt.Errorf("%s: writable mappings aren't supported on this platform", path)
+	}
+	c, err := openMmap(path, 0, 0, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	if p := c.valuesPointer(); c.numValues() > 0 && (!c.aliases(p) || uintptr(p)%uintptr(c.ValueWidth()) != 0) {
+		c.Close()
+		return nil, fmt.Errorf("%s: values aren't stored aligned and can't be written in place", path)
+	}
+	return c, nil
+}
+
+// sizeHighLow splits size into the high and low 32 bits, as taken by
+// CreateFileMapping.
+func sizeHighLow(size int64) (uint32, uint32) {
+	return uint32(uint64(size) >> 32), uint32(size)
+}
+
+func openMmap(path string, off, size int64, writable bool, opts []LoadOption) (*CHD, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	flag, prot, access := os.O_RDONLY, uint32(windows.PAGE_READONLY), uint32(windows.FILE_MAP_READ)
+	if writable {
+		flag, prot, access = os.O_RDWR, windows.PAGE_READWRITE, windows.FILE_MAP_WRITE
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, err = mapRange(fi.Size(), off, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m, err := mapFile(windows.Handle(f.Fd()), off, size, prot, access)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m.path, m.opened = path, fi
+	if writable {
+		// Sync flushes the file's buffers, so keep it open. Windows refuses
+		// to truncate mapped files, so read-only mappings don't need it for
+		// Revalidate.
+		m.file = f
+	} else {
+		f.Close()
+	}
+	b := m.b[off-m.start:]
+	c, err := MmapWithOptions(b, opts...)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.closer = m
+	if o.mlock != 0 {
+		if err := m.lock(c.mlockRanges(b, o.mlock)); err != nil && o.mlockRequired {
+			m.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+// allocationGranularity is what MapViewOfFile requires offsets to be a multiple
+// of.
+const allocationGranularity = 64 << 10
+
+// mapFile maps size bytes of file at off, which may be windows.InvalidHandle to
+// map memory backed by the paging file instead. The view starts at m.start,
+// which is off rounded down to the allocation granularity.
+func mapFile(file windows.Handle, off, size int64, prot, access uint32) (*mapping, error) {
+	hi, lo := sizeHighLow(off + size)
+	h, err := windows.CreateFileMapping(file, nil, prot, hi, lo, nil)
+	if err != nil {
+		return nil, fmt.Errorf("CreateFileMapping: %w", err)
+	}
+	start := off &^ (allocationGranularity - 1)
+	size += off - start
+	offHi, offLo := sizeHighLow(start)
+	addr, err := windows.MapViewOfFile(h, access, offHi, offLo, uintptr(size))
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, fmt.Errorf("MapViewOfFile: %w", err)
+	}
+	// Convert through a pointer to addr, as converting a uintptr to a pointer
+	// directly is only allowed for some system calls.
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	return &mapping{b: unsafe.Slice((*byte)(p), size), start: start, handle: h}, nil
+}
+
+// mlock is VirtualLock, replaced by tests.
+var mlock = func(b []byte) error {
+	return windows.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
+
+// mapping unmaps a view of a file mapping and closes its handles when closed.
+type mapping struct {
+	b []byte
+	// The offset of b in the file.
+	start  int64
+	handle windows.Handle
+	// The file of writable mappings is kept open, that of others isn't.
+	mappedFile
+	// The parts of b locked by lock.
+	mlocked [][]byte
+}
+
+// lock locks ranges of the mapping into memory. If any can't be locked, none
+// are.
+func (m *mapping) lock(ranges [][]byte) error {
+	for _, r := range ranges {
+		if err := mlock(r); err != nil {
+			m.Unlock()
+			return fmt.Errorf("VirtualLock %d bytes: %w (the process's minimum working set size limits how much can be locked)", len(r), err)
+		}
+		m.mlocked = append(m.mlocked, r)
+	}
+	return nil
+}
+
+func (m *mapping) locked() bool {
+	return len(m.mlocked) > 0
+}
+
+// Unlock unlocks the ranges locked by lock.
+func (m *mapping) Unlock() error {
+	var firstErr error
+	for _, r := range m.mlocked {
+		if err := windows.VirtualUnlock(uintptr(unsafe.Pointer(&r[0])), uintptr(len(r))); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("VirtualUnlock: %w", err)
+		}
+	}
+	m.mlocked = nil
+	return firstErr
+}
+
+func (m *mapping) Close() error {
+	err := windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&m.b[0])))
+	if err != nil {
+		err = fmt.Errorf("UnmapViewOfFile: %w", err)
+	}
+	if cerr := windows.CloseHandle(m.handle); cerr != nil {
+		err = errors.Join(err, fmt.Errorf("CloseHandle: %w", cerr))
+	}
+	if m.file != nil {
+		err = errors.Join(err, m.file.Close())
+	}
+	return err
+}
+
+// Sync writes changes to the mapping back to the file.
+func (m *mapping) Sync() error {
+	if err := windows.FlushViewOfFile(uintptr(unsafe.Pointer(&m.b[0])), uintptr(len(m.b))); err != nil {
+		return fmt.Errorf("FlushViewOfFile: %w", err)
+	}
+	if m.file != nil {
+		return m.file.Sync()
+	}
+	return nil
+}
+
+const externalBuildSupported = true
+
+// mapScratch returns n uint64s backed by the paging file, and a function to
+// release them.
+func mapScratch(n uint64) ([]uint64, func() error, error) {
+	if n == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	m, err := mapFile(windows.InvalidHandle, 0, int64(8*n), windows.PAGE_READWRITE, windows.FILE_MAP_WRITE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&m.b[0])), n), m.Close, nil
+}
@@ -0,0 +1,58 @@
+//go:build windows
+
+package uint64mph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings need a zero copy Mmap")
+	}
+	path := writeTempTable(t, MustFromMap(sampleData))
+	c, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	for k := range sampleData {
+		require.NoError(t, c.SetValue(k, k*1000))
+	}
+	require.NoError(t, c.Sync())
+	require.NoError(t, c.Close())
+
+	c, err = OpenMmapFile(path)
+	require.NoError(t, err)
+	defer c.Close()
+	for k := range sampleData {
+		assert.Equal(t, k*1000, c.Get(k))
+	}
+	assert.ErrorIs(t, c.SetValue(1, 1), ErrReadOnly)
+}
+
+func TestSizeHighLow(t *testing.T) {
+	for _, tc := range []struct {
+		size   int64
+		hi, lo uint32
+	}{
+		{1, 0, 1},
+		{1<<32 - 1, 0, 1<<32 - 1},
+		{1 << 32, 1, 0},
+		{5<<32 + 7, 5, 7},
+	} {
+		hi, lo := sizeHighLow(tc.size)
+		assert.Equal(t, tc.hi, hi, tc.size)
+		assert.Equal(t, tc.lo, lo, tc.size)
+	}
+}
+
+func TestMapScratch(t *testing.T) {
+	s, release, err := mapScratch(1 << 20)
+	require.NoError(t, err)
+	for i := range s {
+		s[i] = uint64(i)
+	}
+	assert.Equal(t, uint64(12345), s[12345])
+	require.NoError(t, release())
+}
@@ -0,0 +1,130 @@
+// Package mph is a drop-in replacement for the API of
+// github.com/alecthomas/mph, restricted to 8-byte keys and values and
+// implemented on top of uint64mph.
+//
+// It exists to ease migrations: switch the import path first, then move call
+// sites over to uint64mph's integer API gradually. Keys and values are
+// converted to uint64s as little endian, so the tables are interchangeable
+// with uint64mph tables.
+package mph
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Jille/uint64mph"
+)
+
+// Size in bytes of every key and value.
+const Size = 8
+
+// CHDBuilder builds a CHD hash table.
+type CHDBuilder struct {
+	b *uint64mph.CHDBuilder
+}
+
+// Create a new CHD hash table builder.
+func Builder() *CHDBuilder {
+	return &CHDBuilder{b: uint64mph.Builder()}
+}
+
+// Seed the RNG. This can be used to reproducible building.
+func (b *CHDBuilder) Seed(seed int64) {
+	b.b.Seed(seed)
+}
+
+// Add a key and value to the hash table. Both must be exactly 8 bytes long.
+func (b *CHDBuilder) Add(key []byte, value []byte) error {
+	if len(key) != Size {
+		return fmt.Errorf("key is %d bytes, must be %d", len(key), Size)
+	}
+	if len(value) != Size {
+		return fmt.Errorf("value is %d bytes, must be %d", len(value), Size)
+	}
+	b.b.Add(binary.LittleEndian.Uint64(key), binary.LittleEndian.Uint64(value))
+	return nil
+}
+
+func (b *CHDBuilder) Build() (*CHD, error) {
+	c, err := b.b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &CHD{c: c}, nil
+}
+
+// CHD hash table lookup.
+type CHD struct {
+	c *uint64mph.CHD
+}
+
+// Read a serialized CHD.
+func Read(r io.Reader) (*CHD, error) {
+	c, err := uint64mph.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &CHD{c: c}, nil
+}
+
+// Mmap creates a new CHD aliasing the CHD structure over an existing byte region (typically mmapped).
+func Mmap(b []byte) (*CHD, error) {
+	c, err := uint64mph.Mmap(b)
+	if err != nil {
+		return nil, err
+	}
+	return &CHD{c: c}, nil
+}
+
+// Get an entry from the hash table. Returns nil if the key is not present or
+// isn't 8 bytes long.
+func (c *CHD) Get(key []byte) []byte {
+	if len(key) != Size {
+		return nil
+	}
+	v, ok := c.c.GetOK(binary.LittleEndian.Uint64(key))
+	if !ok {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func (c *CHD) Len() int {
+	return c.c.Len()
+}
+
+// Iterate over entries in the hash table.
+func (c *CHD) Iterate() *Iterator {
+	it := c.c.Iterate()
+	if it == nil {
+		return nil
+	}
+	return &Iterator{it: it}
+}
+
+// Serialize the CHD. The serialized form is that of uint64mph.CHD.
+func (c *CHD) Write(w io.Writer) error {
+	return c.c.Write(w)
+}
+
+// CHD returns the underlying uint64mph table.
+func (c *CHD) CHD() *uint64mph.CHD {
+	return c.c
+}
+
+type Iterator struct {
+	it *uint64mph.Iterator
+}
+
+func (c *Iterator) Get() (key []byte, value []byte) {
+	k, v := c.it.Get()
+	return binary.LittleEndian.AppendUint64(nil, k), binary.LittleEndian.AppendUint64(nil, v)
+}
+
+func (c *Iterator) Next() *Iterator {
+	if c.it.Next() == nil {
+		return nil
+	}
+	return c
+}
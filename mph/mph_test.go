@@ -0,0 +1,113 @@
+package mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func key(s string) []byte {
+	b := make([]byte, Size)
+	copy(b, s)
+	return b
+}
+
+var (
+	sampleData = map[string]string{
+		"one":   "1",
+		"two":   "2",
+		"three": "3",
+		"four":  "4",
+		"five":  "5",
+		"six":   "6",
+		"seven": "7",
+	}
+)
+
+var (
+	words [][]byte
+)
+
+func init() {
+	rng := rand.New(rand.NewSource(1))
+	seen := map[uint64]bool{}
+	for len(words) < 10000 {
+		v := rng.Uint64()
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		words = append(words, binary.LittleEndian.AppendUint64(nil, v))
+	}
+}
+
+func TestCHDBuilder(t *testing.T) {
+	b := Builder()
+	for k, v := range sampleData {
+		assert.NoError(t, b.Add(key(k), key(v)))
+	}
+	c, err := b.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, c.Len())
+	for k, v := range sampleData {
+		assert.Equal(t, key(v), c.Get(key(k)))
+	}
+	assert.Nil(t, c.Get(key("monkey")))
+	assert.Nil(t, c.Get([]byte("one")))
+}
+
+func TestCHDBuilder_lengths(t *testing.T) {
+	b := Builder()
+	assert.Error(t, b.Add([]byte("short"), key("1")))
+	assert.Error(t, b.Add(key("1"), []byte("much too long")))
+	c, err := b.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCHDSerialization(t *testing.T) {
+	cb := Builder()
+	for _, v := range words {
+		assert.NoError(t, cb.Add(v, v))
+	}
+	m, err := cb.Build()
+	assert.NoError(t, err)
+	w := &bytes.Buffer{}
+	err = m.Write(w)
+	assert.NoError(t, err)
+
+	n, err := Mmap(w.Bytes())
+	assert.NoError(t, err)
+	for _, v := range words {
+		assert.Equal(t, v, n.Get(v))
+	}
+
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, len(words), r.Len())
+	// The table is a plain uint64mph table.
+	k := binary.LittleEndian.Uint64(words[0])
+	assert.Equal(t, k, r.CHD().Get(k))
+}
+
+func TestCHDIterate(t *testing.T) {
+	b := Builder()
+	for k, v := range sampleData {
+		assert.NoError(t, b.Add(key(k), key(v)))
+	}
+	c, err := b.Build()
+	assert.NoError(t, err)
+	seen := map[string]string{}
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		seen[string(bytes.TrimRight(k, "\x00"))] = string(bytes.TrimRight(v, "\x00"))
+	}
+	assert.Equal(t, sampleData, seen)
+
+	e, err := Builder().Build()
+	assert.NoError(t, err)
+	assert.Nil(t, e.Iterate())
+}
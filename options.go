@@ -0,0 +1,304 @@
+package uint64mph
+
+import (
+	"log/slog"
+	"time"
+)
+
+// The default average number of keys per bucket.
+const defaultRatio = 2
+
+// How often Build logs its progress if a logger is configured.
+const defaultLogInterval = 10 * time.Second
+
+// Buckets with more keys than this are logged as a warning.
+const defaultLargeBucket = 32
+
+// Build fails right away if a pinned outer seed puts more keys than this in a
+// single bucket. Random seeds practically never do, and placing such a bucket
+// would take forever.
+const maxOuterSeedBucket = 64
+
+// The default number of new hash functions Build tries for a single bucket, see
+// WithMaxAttempts.
+const defaultMaxAttempts = 10000000
+
+// Tables with at most this many keys are built as small tables, which are
+// looked up by scanning the keys.
+const maxSmallTable = 8
+
+// The default density at and above which Build creates a dense table, see
+// WithDenseThreshold.
+const defaultDenseThreshold = 0.95
+
+// A BuildOption configures a single call to Build.
+type BuildOption func(*buildOptions)
+
+type buildOptions struct {
+	seed   int64
+	seeded bool
+	ratio  float64
+	stats  *BuildStats
+	filter bool
+
+	outerSeed   uint64
+	outerSeeded bool
+	onDuplicate func(key, existing, incoming uint64) (uint64, error)
+	r32         bool
+	packValues  bool
+	hasher      Hasher
+	// See WithDictionaryThreshold and WithValueDictionary.
+	dictionaryThreshold int
+	dictionary          bool
+	// See WithDenseThreshold.
+	denseThreshold float64
+	// See WithMaxAttempts.
+	maxAttempts int
+	// See WithPTHash.
+	pthash      bool
+	pthashC     float64
+	pthashAlpha float64
+	// See MaskKeys. May be nil.
+	keyMask *keyMask
+	// Disables small and dense tables, for tests of the hashed structure.
+	forceHashed bool
+	// Overridden by the builder's MemoryBudget.
+	strategy BuildStrategy
+
+	logger      *slog.Logger
+	logInterval time.Duration
+	progress    func(done, total int)
+	// See WithTrace.
+	trace func(TraceEvent)
+	// See WithYieldInterval and WithCPUFraction.
+	yieldInterval int
+	cpuFraction   float64
+	largeBucket   int
+	// See WithBestOfSeeds.
+	bestOfSeeds int
+	// See WithValueStats.
+	valueStats bool
+	// See WithSortedIndex.
+	sortedIndex bool
+}
+
+// WithSeed seeds the RNG, making the build reproducible. It is equivalent to
+// calling Seed on the builder.
+func WithSeed(seed int64) BuildOption {
+	return func(o *buildOptions) {
+		o.seed = seed
+		o.seeded = true
+	}
+}
+
+// WithRatio sets the average number of keys per bucket. Higher ratios result in
+// fewer buckets (and thus a smaller table), at the expense of a slower build.
+// The default is 2.
+func WithRatio(ratio float64) BuildOption {
+	return func(o *buildOptions) {
+		o.ratio = ratio
+	}
+}
+
+// WithLogger makes Build log its progress to l. Progress is logged periodically,
+// a warning is logged when a bucket is unusually large or needs many attempts to
+// place, and a summary is logged at the end.
+func WithLogger(l *slog.Logger) BuildOption {
+	return func(o *buildOptions) {
+		o.logger = l
+	}
+}
+
+// WithProgress makes Build call progress with the number of buckets placed so
+// far and the total number of buckets, periodically while placing them and once
+// when all are placed. Small and dense tables have no buckets to place, so
+// their builds don't call it. If Build starts over with another outer hash,
+// done drops back to zero.
+func WithProgress(progress func(done, total int)) BuildOption {
+	return func(o *buildOptions) {
+		o.progress = progress
+	}
+}
+
+// WithYieldInterval makes Build call runtime.Gosched after every n buckets and
+// attempts to place a bucket, to give other goroutines a turn when building
+// inside a latency-sensitive process. The runtime already preempts long-running
+// goroutines, but only every 10ms or so. The default of zero never yields.
+func WithYieldInterval(n int) BuildOption {
+	return func(o *buildOptions) {
+		o.yieldInterval = n
+	}
+}
+
+// WithCPUFraction limits builds that run in parallel, like those of
+// ShardedBuilder, to the given fraction of GOMAXPROCS goroutines, but at least
+// one. It must be in (0, 1]. A single Build runs in one goroutine, unless
+// WithBestOfSeeds is used.
+func WithCPUFraction(f float64) BuildOption {
+	return func(o *buildOptions) {
+		o.cpuFraction = f
+	}
+}
+
+// WithFilter adds a filter of about 10 bits per key to the table, which Get
+// consults first to reject most missing keys without touching the other
+// arrays. This speeds up lookups of missing keys, especially for large
+// mmapped tables. The filter is stored in the serialized table.
+func WithFilter() BuildOption {
+	return func(o *buildOptions) {
+		o.filter = true
+	}
+}
+
+// WithOuterSeed pins r[0], the seed that assigns keys to buckets, instead of
+// drawing it from the RNG. Tables built over the same bucket count with the
+// same outer seed assign keys with the same Hash to the same bucket, which
+// makes bucket indices comparable across shards. The per-bucket hash functions
+// are still random.
+//
+// Not every seed works for every key set: Build fails if the seed puts an
+// unreasonable number of keys in a single bucket.
+func WithOuterSeed(r0 uint64) BuildOption {
+	return func(o *buildOptions) {
+		o.outerSeed = r0
+		o.outerSeeded = true
+	}
+}
+
+// OnDuplicate makes Build call resolve for every key that was added more than
+// once, instead of failing. It is called once for every extra occurrence, in
+// the order they were added, with the value so far and the value of that
+// occurrence, and returns the value to keep. An error returned by resolve
+// aborts the build.
+func OnDuplicate(resolve func(key, existing, incoming uint64) (uint64, error)) BuildOption {
+	return func(o *buildOptions) {
+		o.onDuplicate = resolve
+	}
+}
+
+// WithHashFunctions32 limits the random values of the hash functions to 32
+// bits. They are only XORed into the hash of a key, where the low 32 bits
+// suffice to pick a slot, and are stored in half the space. WithOuterSeed
+// must fit in 32 bits too.
+func WithHashFunctions32() BuildOption {
+	return func(o *buildOptions) {
+		o.r32 = true
+	}
+}
+
+// WithPackedValues stores the values in 8, 16 or 32 bits instead of 64, the
+// fewest that fit the largest value, in memory and in the file. Lookups unpack
+// them on the fly. Afterwards SetValue fails with ErrValueTooLarge for values
+// that don't fit. Values that need more than 32 bits aren't packed. See
+// ValueWidth.
+func WithPackedValues() BuildOption {
+	return func(o *buildOptions) {
+		o.packValues = true
+	}
+}
+
+// WithDictionaryThreshold sets the number of distinct values up to which Build
+// stores the values through a dictionary: the distinct values are stored once,
+// and every slot holds an 8 or 16 bit code into them, which lookups translate.
+// This is only done if it makes the table smaller. The default is 256, and 0
+// disables dictionaries. SetValue adds new values to the dictionary, but fails
+// with ErrNotInDictionary for new values of a table backed by a file. See
+// Dictionary.
+func WithDictionaryThreshold(distinct int) BuildOption {
+	return func(o *buildOptions) {
+		o.dictionaryThreshold = distinct
+	}
+}
+
+// WithValueDictionary makes Build store the values through a dictionary
+// regardless of their number and of the space saved, see
+// WithDictionaryThreshold. Build fails if there are more than 65536 distinct
+// values.
+func WithValueDictionary() BuildOption {
+	return func(o *buildOptions) {
+		o.dictionary = true
+	}
+}
+
+// AssumeUniformKeys uses the keys as their own hash, skipping the hash function
+// in Build and in every lookup. This is only safe for keys that are uniformly
+// distributed over all 64 bits, like the output of a strong hash function:
+// otherwise Build is slow and may fail. Build samples the keys and logs a
+// warning if they look structured, see WithLogger. It is equivalent to
+// WithHasher(Identity), and recorded in the file by FlagUniformKeys.
+func AssumeUniformKeys() BuildOption {
+	return WithHasher(Identity)
+}
+
+// WithHasher hashes the keys with h instead of Hash, for keys that Hash spreads
+// poorly, or that already are hashes (see Identity). The name of h is stored in
+// the file, and loading it fails unless h is registered with RegisterHasher.
+// Distinct keys must have distinct hashes, or Build fails. Tables small enough
+// to be scanned don't hash their keys and ignore h.
+func WithHasher(h Hasher) BuildOption {
+	return func(o *buildOptions) {
+		o.hasher = h
+	}
+}
+
+// WithDenseThreshold sets the density at and above which Build stores the table
+// as a dense table: when the keys cover at least this fraction of the range
+// from the smallest to the largest key, the values are stored in an array
+// indexed by the key minus the smallest key, with a bitmap marking the holes.
+// Lookups in a dense table are a bounds check and a load, and hash nothing.
+// Dense tables ignore WithFilter, WithHasher and the other options of the
+// hashed structure. The default is 0.95. A threshold above 1 disables dense
+// tables.
+func WithDenseThreshold(density float64) BuildOption {
+	return func(o *buildOptions) {
+		o.denseThreshold = density
+	}
+}
+
+// WithMaxAttempts limits the number of new hash functions Build tries for a
+// single bucket before failing with ErrNoHashFunction. Unless WithOuterSeed
+// pins the outer hash, Build first starts over with other outer hashes, trying
+// fewer hash functions per bucket. The default of 10 million practically never
+// runs out for keys with well distributed hashes; a lower limit bounds the time
+// wasted on key sets that can't be placed.
+func WithMaxAttempts(n int) BuildOption {
+	return func(o *buildOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// WithPTHash builds the table with PTHash instead of CHD. PTHash groups the keys
+// into about c·n/log2(n) buckets and finds a pilot for every bucket that moves
+// its keys to free positions out of n/alpha, storing the pilots in as few bits
+// as the largest one needs. Compared to CHD the structure is about half the
+// size, and lookups read a single pilot instead of an index and a hash function.
+// Larger c and smaller alpha make the build faster and the table larger; c
+// around 7 and alpha between 0.94 and 0.99 are good starting points, see
+// BenchmarkBackends. alpha must be in (0, 1].
+//
+// Small and dense tables are still built as such. WithRatio and
+// WithHashFunctions32 don't apply to PTHash tables, and WithMaxAttempts limits
+// the pilots tried for a single bucket.
+func WithPTHash(c, alpha float64) BuildOption {
+	return func(o *buildOptions) {
+		o.pthash = true
+		o.pthashC, o.pthashAlpha = c, alpha
+	}
+}
+
+// MaskKeys stores the keys in the table and its files transformed by an
+// invertible mix keyed by secret, so that the keys section doesn't list the
+// keys as they are. Lookups, iteration and the other methods mask and unmask
+// keys transparently. The file records that the keys are masked and a value to
+// recognize the secret by, but not the secret: loading the file fails with
+// ErrKeyMask unless the same secret is passed with WithKeyMask.
+//
+// This is obfuscation, not encryption. The mix is fast and simple, and anyone
+// who knows some of the keys can likely recover the secret and unmask all of
+// them. Use it to keep identifiers from being read off a file at a glance, not
+// to protect them from a determined attacker.
+func MaskKeys(secret uint64) BuildOption {
+	return func(o *buildOptions) {
+		o.keyMask = newKeyMask(secret)
+	}
+}
@@ -0,0 +1,295 @@
+package uint64mph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type captureHandler struct {
+	mtx     sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func TestBuildWithLogger(t *testing.T) {
+	h := &captureHandler{}
+	b := Builder()
+	for _, k := range words[:10000] {
+		b.Add(k, k)
+	}
+	logAlways := func(o *buildOptions) { o.logInterval = 0 }
+	_, err := b.Build(WithLogger(slog.New(h)), logAlways)
+	assert.NoError(t, err)
+
+	var progress int
+	for _, r := range h.records[:len(h.records)-1] {
+		if r.Message == "uint64mph: build progress" {
+			progress++
+		}
+	}
+	assert.Greater(t, progress, 0)
+	last := h.records[len(h.records)-1]
+	assert.Equal(t, "uint64mph: build finished", last.Message)
+	attrs := map[string]slog.Value{}
+	last.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	assert.Equal(t, uint64(10000), attrs["entries"].Uint64())
+}
+
+func TestBuildWithLogger_largeBucket(t *testing.T) {
+	h := &captureHandler{}
+	smallThreshold := func(o *buildOptions) { o.largeBucket = 1 }
+	_, err := FromMap(sampleData, WithLogger(slog.New(h)), smallThreshold, hashed)
+	assert.NoError(t, err)
+	var warnings int
+	for _, r := range h.records {
+		if r.Level == slog.LevelWarn {
+			assert.Equal(t, "uint64mph: large bucket", r.Message)
+			warnings++
+		}
+	}
+	assert.Greater(t, warnings, 0)
+}
+
+func TestWithOuterSeed(t *testing.T) {
+	const r0 = 0x0123456789abcdef
+	var tables []*CHD
+	for shard := 0; shard < 2; shard++ {
+		b := Builder()
+		for _, k := range words[shard*5000 : (shard+1)*5000] {
+			b.Add(k, k)
+		}
+		var stats BuildStats
+		c, err := b.Build(WithOuterSeed(r0), WithStats(&stats))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(r0), c.r[0])
+		assert.Equal(t, uint64(r0), stats.OuterSeed)
+		for _, k := range words[shard*5000 : (shard+1)*5000] {
+			assert.Equal(t, k, c.Get(k))
+		}
+		tables = append(tables, c)
+	}
+	// The per-bucket hash functions are still random.
+	assert.NotEqual(t, tables[0].r[1:], tables[1].r[1:])
+
+	var stats BuildStats
+	_, err := FromMap(sampleData, WithStats(&stats), hashed)
+	require.NoError(t, err)
+	assert.NotZero(t, stats.OuterSeed)
+}
+
+func TestWithOuterSeed_hopeless(t *testing.T) {
+	// 100 keys make 50 buckets. Put 80 of them in bucket 0.
+	const r0 = 42
+	b := Builder()
+	var same, other int
+	for k := uint64(0); same < 80 || other < 20; k++ {
+		if bucketFor(Hash(k)^r0, 50, true) == 0 {
+			if same < 80 {
+				b.Add(k, k)
+				same++
+			}
+		} else if other < 20 {
+			b.Add(k, k)
+			other++
+		}
+	}
+	_, err := b.Build(WithOuterSeed(r0))
+	assert.ErrorContains(t, err, "WithOuterSeed puts 80 keys in a single bucket")
+}
+
+func TestOnDuplicate(t *testing.T) {
+	b := Builder()
+	b.Add(1, 0x1)
+	b.Add(2, 0x10)
+	b.Add(1, 0x2)
+	b.Add(3, 0x100)
+	b.Add(1, 0x4)
+	b.Add(2, 0x20)
+	b.Add(1, 0x8)
+	type call struct{ key, existing, incoming uint64 }
+	var calls []call
+	c, err := b.Build(OnDuplicate(func(key, existing, incoming uint64) (uint64, error) {
+		calls = append(calls, call{key, existing, incoming})
+		return existing | incoming, nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []call{
+		{1, 0x1, 0x2},
+		{1, 0x3, 0x4},
+		{2, 0x10, 0x20},
+		{1, 0x7, 0x8},
+	}, calls)
+	assert.Equal(t, 3, c.Len())
+	assert.Equal(t, uint64(0xf), c.Get(1))
+	assert.Equal(t, uint64(0x30), c.Get(2))
+	assert.Equal(t, uint64(0x100), c.Get(3))
+
+	errConflict := errors.New("conflict")
+	_, err = b.Build(OnDuplicate(func(key, existing, incoming uint64) (uint64, error) {
+		if key == 2 {
+			return 0, errConflict
+		}
+		return incoming, nil
+	}))
+	assert.ErrorIs(t, err, errConflict)
+	assert.ErrorContains(t, err, "duplicate key 2")
+}
+
+func TestWithHashFunctions32(t *testing.T) {
+	b := Builder()
+	for i, w := range words[:10000] {
+		b.Add(w, uint64(i))
+	}
+	c, err := b.Build(WithHashFunctions32())
+	require.NoError(t, err)
+	for _, r := range c.r {
+		assert.LessOrEqual(t, r, uint64(math.MaxUint32))
+	}
+	assert.Equal(t, 4*len(c.r), c.Stats().HashFunctionBytes)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.Write(&buf))
+	assert.Equal(t, c.Spec().Size, int64(buf.Len()))
+	loaded, err := Mmap(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, FlagHashFunctions32, loaded.Info().Flags)
+	assert.Equal(t, c.r, loaded.r)
+	assert.NoError(t, loaded.Verify())
+	for i, w := range words[:10000] {
+		assert.Equal(t, uint64(i), loaded.Get(w))
+	}
+	var rewritten bytes.Buffer
+	require.NoError(t, loaded.Write(&rewritten))
+	assert.Equal(t, buf.Bytes(), rewritten.Bytes())
+
+	_, err = b.Build(WithHashFunctions32(), WithOuterSeed(1<<32))
+	assert.ErrorContains(t, err, "doesn't fit in 32 bits")
+	c, err = b.Build(WithHashFunctions32(), WithOuterSeed(1<<32-1))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<32-1), c.r[0])
+}
+
+// TestWithHashFunctions32_placement checks that 32-bit hash functions place
+// buckets about as easily as 64-bit ones.
+func TestWithHashFunctions32_placement(t *testing.T) {
+	var full, half BuildStats
+	for seed := int64(0); seed < 20; seed++ {
+		for _, n := range []int{1000, 10007} {
+			b := Builder()
+			for i, w := range words[:n] {
+				b.Add(w, uint64(i))
+			}
+			for _, tc := range []struct {
+				total *BuildStats
+				opts  []BuildOption
+			}{
+				{&full, nil},
+				{&half, []BuildOption{WithHashFunctions32()}},
+			} {
+				var stats BuildStats
+				_, err := b.Build(append(tc.opts, WithSeed(seed), WithStats(&stats))...)
+				require.NoError(t, err)
+				tc.total.HashFunctions += stats.HashFunctions
+				tc.total.MaxAttempts += stats.MaxAttempts
+			}
+		}
+	}
+	t.Logf("64 bits: %d hash functions, %d max attempts; 32 bits: %d hash functions, %d max attempts",
+		full.HashFunctions, full.MaxAttempts, half.HashFunctions, half.MaxAttempts)
+	assert.Less(t, float64(half.HashFunctions), 1.1*float64(full.HashFunctions))
+	assert.Less(t, float64(half.MaxAttempts), 1.2*float64(full.MaxAttempts))
+}
+
+func TestWithYieldInterval(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	b := Builder()
+	r := rand.New(rand.NewSource(1))
+	for i := uint64(0); i < 50000; i++ {
+		b.Add(r.Uint64(), i)
+	}
+
+	// Measure how late a goroutine that sleeps in a loop wakes up, while
+	// Build runs on the only P.
+	stop := make(chan struct{})
+	lateness := make(chan []time.Duration)
+	go func() {
+		var late []time.Duration
+		for {
+			select {
+			case <-stop:
+				lateness <- late
+				return
+			default:
+			}
+			start := time.Now()
+			time.Sleep(100 * time.Microsecond)
+			late = append(late, time.Since(start)-100*time.Microsecond)
+		}
+	}()
+	_, err := b.Build(WithRatio(5), WithYieldInterval(64))
+	require.NoError(t, err)
+	close(stop)
+	late := <-lateness
+	require.NotEmpty(t, late)
+	sort.Slice(late, func(i, j int) bool { return late[i] < late[j] })
+	assert.Less(t, late[len(late)*99/100], 5*time.Millisecond)
+
+	_, err = b.Build(WithYieldInterval(-1))
+	assert.ErrorContains(t, err, "invalid yield interval")
+}
+
+func TestWithCPUFraction(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	for _, tc := range []struct {
+		f    float64
+		want int
+	}{{1, 8}, {0.5, 4}, {0.3, 2}, {0.01, 1}} {
+		n, err := cpuWorkers([]BuildOption{WithCPUFraction(tc.f)})
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, n, tc.f)
+	}
+	n, err := cpuWorkers(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 8, n)
+
+	s := NewShardedBuilder(4)
+	for k, v := range sampleData {
+		s.Add(k, v)
+	}
+	sc, err := s.Build(WithCPUFraction(0.25))
+	require.NoError(t, err)
+	for k, v := range sampleData {
+		assert.Equal(t, v, sc.Get(k))
+	}
+	for _, f := range []float64{0, -1, 1.5, math.NaN()} {
+		_, err = s.Build(WithCPUFraction(f))
+		assert.ErrorContains(t, err, "invalid CPU fraction")
+		_, err = FromMap(sampleData, WithCPUFraction(f))
+		assert.ErrorContains(t, err, "invalid CPU fraction")
+	}
+}
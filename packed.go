@@ -0,0 +1,190 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ErrValueTooLarge is returned by SetValue for values that don't fit in the
+// packed values of the table, see WithPackedValues.
+var ErrValueTooLarge = errors.New("uint64mph: value doesn't fit in the packed values")
+
+// packedWidth returns the smallest width in bytes of 1, 2 and 4 that fits all
+// values, or 0 if they need all 8.
+func packedWidth(values []uint64) int {
+	var all uint64
+	for _, v := range values {
+		all |= v
+	}
+	switch {
+	case all <= 0xff:
+		return 1
+	case all <= 0xffff:
+		return 2
+	case all <= 0xffffffff:
+		return 4
+	}
+	return 0
+}
+
+// packValues stores the values at the smallest width that fits them.
+func (c *CHD) packValues() {
+	w := packedWidth(c.values)
+	if w == 0 {
+		return
+	}
+	packed := make([]byte, w*len(c.values))
+	for i, v := range c.values {
+		putPacked(packed, w, i, v)
+	}
+	c.packed, c.valueWidth, c.values = packed, w, nil
+}
+
+func putPacked(b []byte, width, i int, v uint64) {
+	switch width {
+	case 1:
+		b[i] = byte(v)
+	case 2:
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(v))
+	}
+}
+
+// ValueWidth returns the number of bytes every value is stored in: 8, unless
+// the table was built with WithPackedValues, or 16 for both values of a table
+// with pair values.
+func (c *CHD) ValueWidth() int {
+	if c != nil && c.valueWidth != 0 {
+		return c.valueWidth
+	}
+	if c != nil && c.pairValues != nil {
+		return 16
+	}
+	return 8
+}
+
+// numValues returns the number of values, packed or not.
+func (c *CHD) numValues() int {
+	if c.pairValues != nil {
+		return len(c.pairValues) / 2
+	}
+	if c.valueWidth != 0 {
+		return len(c.packed) / c.valueWidth
+	}
+	return len(c.values)
+}
+
+// value returns the value in slot ti. It panics with ErrNoValues for
+// index-only tables, and with ErrPairValues for tables with pair values.
+func (c *CHD) value(ti int) uint64 {
+	v, _ := c.valueOK(ti)
+	return v
+}
+
+// valueOK is value for lookups, which treat a slot without a value as a miss,
+// see packedValue.
+func (c *CHD) valueOK(ti int) (uint64, bool) {
+	if ti < len(c.values) {
+		return c.values[ti], true
+	}
+	return c.packedValue(ti)
+}
+
+// packedValue returns the value in slot ti of a table with packed values or a
+// dictionary. It panics with ErrNoValues if there is no such value, and with
+// ErrPairValues if the slot has two. It reports false, and returns 0, for a
+// code beyond the dictionary.
+func (c *CHD) packedValue(ti int) (uint64, bool) {
+	if c.pairValues != nil {
+		panic(ErrPairValues)
+	}
+	if c.valueWidth == 0 || ti >= len(c.packed)/c.valueWidth {
+		panic(ErrNoValues)
+	}
+	if c.dict != nil {
+		code := c.packedCode(ti)
+		if code >= uint64(len(c.dict)) {
+			// Only corrupt files have codes beyond the dictionary, which
+			// Verify reports. Mmap doesn't read all the codes to find them.
+			return 0, false
+		}
+		return c.dict[code], true
+	}
+	return c.packedCode(ti), true
+}
+
+// packedCode returns the number stored in slot ti of the packed values.
+func (c *CHD) packedCode(ti int) uint64 {
+	switch c.valueWidth {
+	case 1:
+		return uint64(c.packed[ti])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(c.packed[2*ti:]))
+	default:
+		return uint64(binary.LittleEndian.Uint32(c.packed[4*ti:]))
+	}
+}
+
+// checkValue returns an error if v doesn't fit in the values of the table.
+// Values that aren't in the dictionary are checked by setSlot.
+func (c *CHD) checkValue(v uint64) error {
+	if c.valueWidth != 0 && c.dict == nil && v>>(8*c.valueWidth) != 0 {
+		return fmt.Errorf("%w: %d needs more than the %d bits of the table's values", ErrValueTooLarge, v, 8*c.valueWidth)
+	}
+	return nil
+}
+
+// setSlot sets the value in slot ti and updates the aggregates, or returns why
+// it can't.
+func (c *CHD) setSlot(ti int, v uint64) error {
+	if c.pairValues != nil {
+		return ErrPairValues
+	}
+	old, inPlace := c.value(ti), c.aliases(c.valuesPointer())
+	if err := c.storeSlot(ti, v); err != nil {
+		return err
+	}
+	c.updateAggregates(old, v, inPlace)
+	c.dropDigest(inPlace)
+	c.dropChecksum(inPlace)
+	return nil
+}
+
+// storeSlot stores v in slot ti, see setSlot.
+func (c *CHD) storeSlot(ti int, v uint64) error {
+	if c.dict != nil {
+		return c.setDictionaryValue(ti, v)
+	}
+	if err := c.checkValue(v); err != nil {
+		return err
+	}
+	if c.valueWidth != 0 {
+		putPacked(c.packed, c.valueWidth, ti, v)
+		return nil
+	}
+	c.values[ti] = v
+	return nil
+}
+
+// unpackValues replaces packed values and the dictionary by plain values.
+func (c *CHD) unpackValues() {
+	values := make([]uint64, c.numValues())
+	for i := range values {
+		values[i], _ = c.packedValue(i)
+	}
+	c.values, c.packed, c.valueWidth, c.dict = values, nil, 0, nil
+}
+
+// valuesPointer returns a pointer to the first value, packed or not.
+func (c *CHD) valuesPointer() unsafe.Pointer {
+	if c.valueWidth != 0 {
+		return unsafe.Pointer(unsafe.SliceData(c.packed))
+	}
+	if c.pairValues != nil {
+		return unsafe.Pointer(unsafe.SliceData(c.pairValues))
+	}
+	return unsafe.Pointer(unsafe.SliceData(c.values))
+}
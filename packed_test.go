@@ -0,0 +1,178 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPackedValues(t *testing.T) {
+	for _, tc := range []struct {
+		max   uint64
+		width int
+	}{
+		{0, 1},
+		{1<<8 - 1, 1},
+		{1 << 8, 2},
+		{1<<16 - 1, 2},
+		{1 << 16, 4},
+		{1 << 20, 4},
+		{1<<32 - 1, 4},
+		{1 << 32, 8},
+		{math.MaxUint64, 8},
+	} {
+		t.Run(fmt.Sprint(tc.max), func(t *testing.T) {
+			m := map[uint64]uint64{}
+			for i, w := range words[:1000] {
+				m[w] = uint64(i) * (tc.max / 1000)
+			}
+			m[words[0]] = tc.max
+
+			plain, err := FromMap(m, WithSeed(1), WithDictionaryThreshold(0))
+			require.NoError(t, err)
+			c, err := FromMap(m, WithSeed(1), WithDictionaryThreshold(0), WithPackedValues())
+			require.NoError(t, err)
+			assert.Equal(t, tc.width, c.ValueWidth())
+			assert.Equal(t, 8, plain.ValueWidth())
+			assert.Equal(t, tc.width*1000, c.Stats().ValuesBytes)
+			assert.Equal(t, int64(tc.width*1000), c.MemoryFootprint().Values)
+
+			w, plainW := &bytes.Buffer{}, &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			require.NoError(t, plain.Write(plainW))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			assert.Equal(t, plainW.Len()-8*1000+(tc.width*1000+7)&^7, w.Len())
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, tc.width != 8, fi.Flags&FlagPackedValues != 0)
+			assert.Equal(t, int64(tc.width*1000), fi.ValuesBytes)
+
+			var at offsetBuffer
+			_, err = c.WriteToAt(&at)
+			require.NoError(t, err)
+			assert.Equal(t, w.Bytes(), at.b)
+
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			s, v := writeSplit(t, c)
+			sl, err := MmapSplit(s, v)
+			require.NoError(t, err)
+			for _, g := range []*CHD{c, l, sl, l.Materialize()} {
+				assert.Equal(t, tc.width, g.ValueWidth())
+				for k, v := range m {
+					assert.Equal(t, v, g.Get(k))
+				}
+				got := map[uint64]uint64{}
+				for it := g.Iterate(); it != nil; it = it.Next() {
+					k, v := it.Get()
+					got[k] = v
+				}
+				assert.Equal(t, m, got)
+			}
+
+			if tc.width != 8 {
+				// The largest value that fits can be set, the next one can't.
+				limit := uint64(1)<<(8*tc.width) - 1
+				require.NoError(t, c.SetValue(words[1], limit))
+				assert.Equal(t, limit, c.Get(words[1]))
+				err := c.SetValue(words[1], limit+1)
+				assert.ErrorIs(t, err, ErrValueTooLarge)
+				assert.ErrorContains(t, err, fmt.Sprintf("more than the %d bits", 8*tc.width))
+				assert.Equal(t, limit, c.Get(words[1]))
+			}
+			require.NoError(t, c.SetValue(words[2], 0))
+			assert.Equal(t, uint64(0), c.Get(words[2]))
+		})
+	}
+}
+
+func TestWithPackedValues_tables(t *testing.T) {
+	// Small and dense tables, and value deltas, which packed tables ignore.
+	for name, m := range map[string]map[uint64]uint64{"small": {1: 2, 1000: 300}, "dense": denseData(960)} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(m, WithPackedValues())
+			require.NoError(t, err)
+			assert.Equal(t, 2, c.ValueWidth())
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w, WithValueDeltas()))
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			assert.Zero(t, l.Info().Flags&FlagValueDeltas)
+			for k, v := range m {
+				assert.Equal(t, v, l.Get(k))
+			}
+			doubled := l.MapValues(func(k, v uint64) uint64 { return v << 16 })
+			assert.Equal(t, 4, doubled.ValueWidth())
+			for k, v := range m {
+				assert.Equal(t, v<<16, doubled.Get(k))
+			}
+		})
+	}
+}
+
+// byteValues returns a table of 100 words and values that fit in a byte.
+func byteValues() map[uint64]uint64 {
+	m := map[uint64]uint64{}
+	for i, w := range words[:100] {
+		m[w] = uint64(i)
+	}
+	return m
+}
+
+func TestWithPackedValues_journal(t *testing.T) {
+	m := byteValues()
+	c, err := FromMap(m, WithPackedValues())
+	require.NoError(t, err)
+	require.Equal(t, 1, c.ValueWidth())
+	k := firstKey(m)
+	j := &bytes.Buffer{}
+	vj, err := NewValueJournal(j, c)
+	require.NoError(t, err)
+	assert.ErrorIs(t, vj.AppendUpdate(k, 256), ErrValueTooLarge)
+	require.NoError(t, vj.AppendUpdate(k, 255))
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	l, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	_, err = ApplyJournal(l, bytes.NewReader(j.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(255), l.Get(k))
+	// The buffer isn't modified.
+	orig, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, m[k], orig.Get(k))
+}
+
+func TestWithPackedValues_mmapFileRW(t *testing.T) {
+	if !zeroCopy {
+		t.Skip("writable mappings aren't supported on this platform")
+	}
+	m := byteValues()
+	c, err := FromMap(m, WithPackedValues())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "table")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(f))
+	require.NoError(t, f.Close())
+
+	rw, err := OpenMmapFileRW(path)
+	require.NoError(t, err)
+	k := firstKey(m)
+	require.NoError(t, rw.SetValue(k, 200))
+	assert.ErrorIs(t, rw.SetValue(k, 300), ErrValueTooLarge)
+	require.NoError(t, rw.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	l, err := Mmap(b)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), l.Get(k))
+}
@@ -0,0 +1,76 @@
+package uint64mph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The pairs format is a flat sequence of (key, value) pairs without any header.
+// Every pair is 16 bytes: the key as a little endian uint64, followed by the
+// value as a little endian uint64. A file with n entries is exactly 16*n bytes.
+
+// ErrPartialPair is returned when a pairs stream ends in the middle of a pair.
+var ErrPartialPair = errors.New("pairs stream length is not a multiple of 16 bytes")
+
+// WritePairs writes all entries in the pairs format to w, in slot order,
+// leaving out keys hidden by Delete. It returns the number of bytes written.
+func (c *CHD) WritePairs(w io.Writer) (int64, error) {
+	if err := c.checkWritable(w != nil); err != nil {
+		return 0, err
+	}
+	if c.IndexOnly() {
+		return 0, ErrNoValues
+	}
+	if c.pairValues != nil {
+		return 0, ErrPairValues
+	}
+	bw := bufio.NewWriter(w)
+	var written int64
+	var buf [16]byte
+	for i := 0; i < c.numSlots(); i++ {
+		k, ok := c.slotKey(i)
+		if !ok || c.isDeleted(i) {
+			continue
+		}
+		binary.LittleEndian.PutUint64(buf[:8], c.unmaskKey(k))
+		binary.LittleEndian.PutUint64(buf[8:], c.value(i))
+		n, err := bw.Write(buf[:])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return written - int64(bw.Buffered()), err
+	}
+	return written, nil
+}
+
+// AddFromReader adds all entries read in the pairs format from r.
+func (b *CHDBuilder) AddFromReader(r io.Reader) error {
+	br := bufio.NewReader(r)
+	var buf [16]byte
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return ErrPartialPair
+			}
+			return err
+		}
+		b.Add(binary.LittleEndian.Uint64(buf[:8]), binary.LittleEndian.Uint64(buf[8:]))
+	}
+}
+
+// BuildFromPairs builds a table from entries read in the pairs format from r.
+func BuildFromPairs(r io.Reader, opts ...BuildOption) (*CHD, error) {
+	b := Builder()
+	if err := b.AddFromReader(r); err != nil {
+		return nil, err
+	}
+	return b.Build(opts...)
+}
@@ -0,0 +1,55 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairs(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	n, err := c.WritePairs(w)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16*len(sampleData)), n)
+	assert.Equal(t, 16*len(sampleData), w.Len())
+
+	// Check the documented layout.
+	b := w.Bytes()
+	for i := 0; i < len(b); i += 16 {
+		k := binary.LittleEndian.Uint64(b[i:])
+		v := binary.LittleEndian.Uint64(b[i+8:])
+		assert.Equal(t, sampleData[k], v)
+	}
+
+	d, err := BuildFromPairs(bytes.NewReader(b), WithSeed(1))
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleData), d.Len())
+	for k, v := range sampleData {
+		assert.Equal(t, v, d.Get(k))
+	}
+}
+
+func TestPairs_empty(t *testing.T) {
+	c, err := Builder().Build()
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	n, err := c.WritePairs(w)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	d, err := BuildFromPairs(w)
+	require.NoError(t, err)
+	assert.Equal(t, 0, d.Len())
+}
+
+func TestPairs_partial(t *testing.T) {
+	_, err := BuildFromPairs(bytes.NewReader(make([]byte, 17)))
+	assert.ErrorIs(t, err, ErrPartialPair)
+
+	b := Builder()
+	assert.ErrorIs(t, b.AddFromReader(bytes.NewReader(make([]byte, 40))), ErrPartialPair)
+}
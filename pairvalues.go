@@ -0,0 +1,107 @@
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPairValues is returned, or panicked with, when using the single value API
+// on a table with pair values, or the pair value API on a table without.
+var ErrPairValues = errors.New("uint64mph: pair values and single values don't mix")
+
+// PairBuilder builds a hash table with two values for every key, like an
+// (offset, length) pair that doesn't fit in one uint64. The table is a CHD
+// whose values are looked up with Get2 and Iterator.Get2. The single value API
+// panics on it, or returns ErrPairValues.
+//
+// Both values of a key are stored next to each other, so a lookup reads them
+// together. They are always stored as uint64s: WithPackedValues and the value
+// dictionary don't apply.
+type PairBuilder struct {
+	b *CHDBuilder
+	// The values of the entries, in the order they were added.
+	first, second []uint64
+}
+
+// Create a new builder for a hash table with pair values.
+func NewPairBuilder() *PairBuilder {
+	return &PairBuilder{b: Builder()}
+}
+
+// Seed the RNG. See CHDBuilder.Seed.
+func (b *PairBuilder) Seed(seed int64) {
+	b.b.Seed(seed)
+}
+
+// Add2 adds a key and its two values to the hash table.
+func (b *PairBuilder) Add2(key, v1, v2 uint64) {
+	b.b.Add(key, uint64(len(b.first)))
+	b.first = append(b.first, v1)
+	b.second = append(b.second, v2)
+}
+
+// Build the hash table. See CHDBuilder.Build. OnDuplicate isn't supported.
+func (b *PairBuilder) Build(opts ...BuildOption) (*CHD, error) {
+	var o buildOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.onDuplicate != nil {
+		return nil, fmt.Errorf("OnDuplicate can't resolve duplicate keys of pair values")
+	}
+	// Build a table from the keys to the index of their entry, and replace
+	// those by the values.
+	c, err := b.b.Build(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.valueWidth != 0 {
+		c.unpackValues()
+	}
+	c.pairValues = make([]uint64, 2*len(c.values))
+	for ti, i := range c.values {
+		if _, ok := c.slotKey(ti); ok {
+			c.pairValues[2*ti], c.pairValues[2*ti+1] = b.first[i], b.second[i]
+		}
+	}
+	c.values, c.aggregates = nil, nil
+	if o.stats != nil {
+		o.stats.TableStats = c.Stats()
+	}
+	return c, nil
+}
+
+// PairValues reports whether the table has two values for every key, see
+// PairBuilder.
+func (c *CHD) PairValues() bool {
+	return c != nil && c.pairValues != nil
+}
+
+// Get2 gets both values of key from a table with pair values, and reports
+// whether key was present. It panics with ErrPairValues for tables with a single
+// value per key, and with ErrNoValues for index-only tables.
+func (c *CHD) Get2(key uint64) (uint64, uint64, bool) {
+	if c == nil {
+		return 0, 0, false
+	}
+	if c.pairValues == nil {
+		if c.IndexOnly() {
+			panic(ErrNoValues)
+		}
+		panic(ErrPairValues)
+	}
+	ti, ok := c.Slot(key)
+	if !ok {
+		return 0, 0, false
+	}
+	return c.pairValues[2*ti], c.pairValues[2*ti+1], true
+}
+
+// Get2 returns the current entry of a table with pair values. It panics with
+// ErrPairValues for other tables.
+func (c *Iterator) Get2() (key, v1, v2 uint64) {
+	if c.c.pairValues == nil {
+		panic(ErrPairValues)
+	}
+	return c.Key(), c.c.pairValues[2*c.i], c.c.pairValues[2*c.i+1]
+}
@@ -0,0 +1,128 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairValues(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i++ {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(2000, 15), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash": {randomData(2000, 16), []BuildOption{WithPTHash(7, 0.99)}},
+		// Neither applies to the values.
+		"packed": {randomData(2000, 17), []BuildOption{WithPackedValues(), WithValueDictionary()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := NewPairBuilder()
+			for k, v := range tc.data {
+				b.Add2(k, v, ^v)
+			}
+			c, err := b.Build(tc.opts...)
+			require.NoError(t, err)
+			assert.True(t, c.PairValues())
+			assert.Equal(t, 16, c.ValueWidth())
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			assertSameSlice(t, c.pairValues, l.pairValues)
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			assert.Equal(t, 16*l.numValues(), l.Stats().ValuesBytes)
+			for _, tbl := range []*CHD{c, l, l.Materialize()} {
+				assert.Equal(t, len(tc.data), tbl.Len())
+				for k, v := range tc.data {
+					v1, v2, ok := tbl.Get2(k)
+					assert.True(t, ok)
+					assert.Equal(t, v, v1)
+					assert.Equal(t, ^v, v2)
+				}
+				_, _, ok := tbl.Get2(1)
+				assert.False(t, ok)
+				n := 0
+				for it := tbl.Iterate(); it != nil; it = it.Next() {
+					k, v1, v2 := it.Get2()
+					assert.Equal(t, tc.data[k], v1)
+					assert.Equal(t, ^v1, v2)
+					n++
+				}
+				assert.Equal(t, len(tc.data), n)
+			}
+
+			structure, values := writeSplit(t, c)
+			s, err := MmapSplit(structure, values)
+			require.NoError(t, err)
+			for k, v := range tc.data {
+				v1, v2, ok := s.Get2(k)
+				assert.True(t, ok)
+				assert.Equal(t, []uint64{v, ^v}, []uint64{v1, v2})
+				break
+			}
+		})
+	}
+}
+
+func TestPairValues_singleAPI(t *testing.T) {
+	b := NewPairBuilder()
+	b.Add2(1, 10, 11)
+	b.Add2(2, 20, 21)
+	c, err := b.Build()
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, ErrPairValues, func() { c.Get(1) })
+	assert.PanicsWithValue(t, ErrPairValues, func() { c.Iterate().Get() })
+	assert.ErrorIs(t, c.SetValue(1, 5), ErrPairValues)
+	_, err = c.WritePairs(&bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrPairValues)
+	_, err = RebuildWith(c, nil, nil)
+	assert.ErrorIs(t, err, ErrPairValues)
+	assert.ErrorIs(t, CreatePatch(c, c, &bytes.Buffer{}), ErrPairValues)
+	assert.Equal(t, "uint64mph.CHD{1: (10, 11), 2: (20, 21); ", c.GoString()[:len("uint64mph.CHD{1: (10, 11), 2: (20, 21); ")])
+	// Missing keys aren't an error.
+	_, ok := c.GetOK(3)
+	assert.False(t, ok)
+
+	rc, _ := openRemote(t, c)
+	_, _, err = rc.Lookup(1)
+	assert.ErrorIs(t, err, ErrPairValues)
+
+	single := MustFromMap(sampleData)
+	assert.PanicsWithValue(t, ErrPairValues, func() { single.Get2(1) })
+	assert.PanicsWithValue(t, ErrPairValues, func() { single.Iterate().Get2() })
+	assert.False(t, single.PairValues())
+
+	b.Add2(1, 12, 13)
+	_, err = b.Build()
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+	_, err = b.Build(OnDuplicate(func(key, existing, incoming uint64) (uint64, error) { return incoming, nil }))
+	assert.Error(t, err)
+}
+
+func TestPairValues_close(t *testing.T) {
+	b := NewPairBuilder()
+	for k, v := range randomData(2000, 18) {
+		b.Add2(k, v, ^v)
+	}
+	c, err := b.Build(WithSeed(18))
+	require.NoError(t, err)
+	l, err := OpenMmapFile(writeTempTable(t, c))
+	require.NoError(t, err)
+	assert.True(t, l.PairValues())
+	require.NoError(t, l.Close())
+	// Nothing refers to the unmapped file anymore.
+	assert.False(t, l.PairValues())
+	l.Prefault()
+
+	_, _, ok := (*CHD)(nil).Get2(1)
+	assert.False(t, ok)
+}
@@ -0,0 +1,255 @@
+package uint64mph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// A value patch turns the values of one table into those of another with the
+// same structure, like two seeded builds over the same keys. It is laid out as:
+//
+//	magic   [8]byte   "U64MPHD\x00"
+//	id      [16]byte  the structure identifier of the tables, see WriteSplit
+//	before  uint32    CRC-32 (IEEE) of the values the patch applies to
+//	after   uint32    CRC-32 (IEEE) of the values it results in
+//	count   uint64    the number of changed slots
+//
+// followed by count records of:
+//
+//	gap     uvarint   the slot minus the previous record's slot plus one
+//	value   uint64
+//
+// and finally:
+//
+//	crc     uint32    CRC-32 (IEEE) of everything before it
+//
+// The values are checksummed as little endian uint64s in slot order.
+var patchMagic = []byte("U64MPHD\x00")
+
+const patchHeaderSize = 8 + 16 + 4 + 4 + 8
+
+var (
+	// ErrCorruptPatch is returned by ApplyPatch for patches that are truncated
+	// or don't match their checksum.
+	ErrCorruptPatch = errors.New("uint64mph: corrupt value patch")
+	// ErrPatchMismatch is returned by ApplyPatch if the table doesn't have
+	// the values the patch was created from, for example because it was
+	// already applied.
+	ErrPatchMismatch = errors.New("uint64mph: patch doesn't apply to the table's values")
+)
+
+// valuesChecksum returns the CRC-32 of the values of c.
+func valuesChecksum(c *CHD) uint32 {
+	h := crc32.NewIEEE()
+	var buf [8 * 1024]byte
+	b := buf[:0]
+	for ti := 0; ti < c.numSlots(); ti++ {
+		b = binary.LittleEndian.AppendUint64(b, c.value(ti))
+		if len(b) == len(buf) {
+			h.Write(b)
+			b = buf[:0]
+		}
+	}
+	h.Write(b)
+	return h.Sum32()
+}
+
+// CreatePatch writes a patch to w that turns the values of old into those of
+// new, to be applied by ApplyPatch. The tables must have the same structure:
+// the same keys in the same slots, with the same hash functions.
+func CreatePatch(old, new *CHD, w io.Writer) error {
+	if err := old.checkWritable(w != nil); err != nil {
+		return err
+	}
+	if err := new.checkWritable(true); err != nil {
+		return err
+	}
+	if old.IndexOnly() || new.IndexOnly() {
+		return ErrNoValues
+	}
+	if old.pairValues != nil || new.pairValues != nil {
+		return ErrPairValues
+	}
+	id := old.structureID()
+	if id != new.structureID() {
+		return fmt.Errorf("%w: the tables have different structures", ErrNotCHD)
+	}
+	var changed []int
+	for ti := 0; ti < old.numSlots(); ti++ {
+		if old.value(ti) != new.value(ti) {
+			changed = append(changed, ti)
+		}
+	}
+
+	h := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	hdr := append(append([]byte{}, patchMagic...), id[:]...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, valuesChecksum(old))
+	hdr = binary.LittleEndian.AppendUint32(hdr, valuesChecksum(new))
+	hdr = binary.LittleEndian.AppendUint64(hdr, uint64(len(changed)))
+	bw.Write(hdr)
+	var rec []byte
+	next := 0
+	for _, ti := range changed {
+		rec = binary.AppendUvarint(rec[:0], uint64(ti-next))
+		rec = binary.LittleEndian.AppendUint64(rec, new.value(ti))
+		bw.Write(rec)
+		next = ti + 1
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, h.Sum32()))
+	return err
+}
+
+// ApplyPatch applies a patch created by CreatePatch to the values of c, which
+// must be those of the patch's old table. Like SetValue, it writes to the
+// buffer of tables created by Mmap and to the file of tables opened by
+// OpenMmapFileRW, and returns ErrReadOnly for other mapped files.
+//
+// The whole patch is read and checked before any value changes: ApplyPatch
+// returns ErrCorruptPatch for a damaged patch, ErrNotCHD if it belongs to a
+// table with another structure, and ErrPatchMismatch if c doesn't have the
+// values it was created from. The values of c are checked against those the
+// patch results in afterwards.
+func ApplyPatch(c *CHD, r io.Reader) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	if r == nil {
+		return ErrNilReader
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.IndexOnly() {
+		return ErrNoValues
+	}
+	if c.pairValues != nil {
+		return ErrPairValues
+	}
+	h := crc32.NewIEEE()
+	br := &crcReader{r: bufio.NewReader(r), h: h}
+	var hdr [patchHeaderSize]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return patchReadError(err)
+	}
+	if !bytes.Equal(hdr[:8], patchMagic) {
+		return fmt.Errorf("%w: not a value patch", ErrCorruptPatch)
+	}
+	if id := c.structureID(); !bytes.Equal(hdr[8:24], id[:]) {
+		return fmt.Errorf("%w: patch belongs to a different table", ErrNotCHD)
+	}
+	before := binary.LittleEndian.Uint32(hdr[24:])
+	after := binary.LittleEndian.Uint32(hdr[28:])
+	count := binary.LittleEndian.Uint64(hdr[32:])
+	if count > uint64(c.numSlots()) {
+		return fmt.Errorf("%w: %d changes to a table of %d slots", ErrCorruptPatch, count, c.numSlots())
+	}
+	slots := make([]int, count)
+	values := make([]uint64, count)
+	next := uint64(0)
+	for i := range slots {
+		gap, err := binary.ReadUvarint(br)
+		if err != nil {
+			return patchReadError(err)
+		}
+		if gap >= uint64(c.numSlots())-next {
+			return fmt.Errorf("%w: change %d is beyond the last slot", ErrCorruptPatch, i)
+		}
+		var v [8]byte
+		if _, err := io.ReadFull(br, v[:]); err != nil {
+			return patchReadError(err)
+		}
+		slots[i], values[i] = int(next+gap), binary.LittleEndian.Uint64(v[:])
+		next += gap + 1
+	}
+	sum := h.Sum32()
+	var crc [4]byte
+	if _, err := io.ReadFull(br.r, crc[:]); err != nil {
+		return patchReadError(err)
+	}
+	if binary.LittleEndian.Uint32(crc[:]) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptPatch)
+	}
+
+	if valuesChecksum(c) != before {
+		return ErrPatchMismatch
+	}
+	fixedDict := c.dict != nil && c.aliases(c.valuesPointer())
+	for _, v := range values {
+		if err := c.checkValue(v); err != nil {
+			return err
+		}
+		if fixedDict && !slices.Contains(c.dict, v) {
+			return fmt.Errorf("%w: %d, and the dictionary can't grow", ErrNotInDictionary, v)
+		}
+	}
+	for i, ti := range slots {
+		if err := c.setSlot(ti, values[i]); err != nil {
+			return err
+		}
+	}
+	if valuesChecksum(c) != after {
+		return fmt.Errorf("%w: the patched values don't match the patch's checksum", ErrPatchMismatch)
+	}
+	return nil
+}
+
+// ApplyPatchFile applies a patch created by CreatePatch to the table file at
+// path in place, see ApplyPatch. The file is synced before ApplyPatchFile
+// returns.
+func ApplyPatchFile(path string, patch io.Reader) error {
+	c, err := OpenMmapFileRW(path)
+	if err != nil {
+		return err
+	}
+	if err := ApplyPatch(c, patch); err != nil {
+		c.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.Sync(); err != nil {
+		c.Close()
+		return err
+	}
+	return c.Close()
+}
+
+// patchReadError translates running out of input into ErrCorruptPatch.
+func patchReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated patch", ErrCorruptPatch)
+	}
+	return err
+}
+
+// crcReader hashes everything read from r.
+type crcReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
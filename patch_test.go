@@ -0,0 +1,73 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatch(t *testing.T) {
+	newData := map[uint64]uint64{}
+	changed := 0
+	for k, v := range sampleData {
+		if changed < 3 {
+			v = k ^ 7
+			changed++
+		}
+		newData[k] = v
+	}
+	old := MustFromMap(sampleData, hashed, WithSeed(1))
+	new := MustFromMap(newData, hashed, WithSeed(1))
+	patch := &bytes.Buffer{}
+	require.NoError(t, CreatePatch(old, new, patch))
+	// The gaps between the changed slots of a table this small fit in a byte.
+	assert.Equal(t, patchHeaderSize+changed*(1+8)+4, patch.Len())
+
+	w := &bytes.Buffer{}
+	require.NoError(t, old.Write(w))
+	c, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, ApplyPatch(c, bytes.NewReader(patch.Bytes())))
+	for k, v := range newData {
+		assert.Equal(t, v, c.Get(k))
+	}
+	// The patch was already applied.
+	assert.ErrorIs(t, ApplyPatch(c, bytes.NewReader(patch.Bytes())), ErrPatchMismatch)
+
+	// An empty patch.
+	empty := &bytes.Buffer{}
+	require.NoError(t, CreatePatch(new, new, empty))
+	require.NoError(t, ApplyPatch(c, bytes.NewReader(empty.Bytes())))
+
+	other := MustFromMap(sampleData, hashed, WithSeed(2))
+	assert.ErrorIs(t, CreatePatch(old, other, &bytes.Buffer{}), ErrNotCHD)
+	assert.ErrorIs(t, ApplyPatch(other, bytes.NewReader(patch.Bytes())), ErrNotCHD)
+	assert.ErrorIs(t, CreatePatch(old, nil, &bytes.Buffer{}), ErrNilTable)
+	assert.ErrorIs(t, CreatePatch(old, new, nil), ErrNilWriter)
+}
+
+func TestApplyPatch_corrupt(t *testing.T) {
+	old := MustFromMap(sampleData, hashed, WithSeed(1))
+	newData := map[uint64]uint64{}
+	for k := range sampleData {
+		newData[k] = k
+	}
+	patch := &bytes.Buffer{}
+	require.NoError(t, CreatePatch(old, MustFromMap(newData, hashed, WithSeed(1)), patch))
+	for _, n := range []int{0, 10, patchHeaderSize, patch.Len() - 1} {
+		c := MustFromMap(sampleData, hashed, WithSeed(1))
+		assert.ErrorIs(t, ApplyPatch(c, bytes.NewReader(patch.Bytes()[:n])), ErrCorruptPatch, n)
+	}
+	for _, off := range []int{0, patchHeaderSize + 3, patch.Len() - 2} {
+		b := append([]byte{}, patch.Bytes()...)
+		b[off] ^= 0x10
+		c := MustFromMap(sampleData, hashed, WithSeed(1))
+		assert.ErrorIs(t, ApplyPatch(c, bytes.NewReader(b)), ErrCorruptPatch, off)
+		// Nothing was changed.
+		for k, v := range sampleData {
+			assert.Equal(t, v, c.Get(k))
+		}
+	}
+}
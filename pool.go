@@ -0,0 +1,100 @@
+package uint64mph
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// BuildAll builds every builder, running up to workers builds concurrently.
+// If workers is not positive, GOMAXPROCS is used. The returned tables are in
+// the same order as builders, and are the same as when built one by one, so
+// seeded builders give identical tables for any number of workers.
+//
+// The first failing build cancels the builds that haven't finished yet, and its
+// error is returned, along with the tables that were built successfully (the
+// others are nil). Cancelling ctx has the same effect.
+func BuildAll(ctx context.Context, builders []*CHDBuilder, workers int) ([]*CHD, error) {
+	return buildAll(ctx, len(builders), workers, func(ctx context.Context, i int) (*CHD, error) {
+		return builders[i].BuildContext(ctx)
+	})
+}
+
+func checkCPUFraction(f float64) error {
+	if !(f > 0 && f <= 1) {
+		return fmt.Errorf("invalid CPU fraction %v: must be in (0, 1]", f)
+	}
+	return nil
+}
+
+// cpuWorkers returns the number of parallel builds allowed by the
+// WithCPUFraction in opts.
+func cpuWorkers(opts []BuildOption) (int, error) {
+	o := buildOptions{cpuFraction: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.cpuWorkers()
+}
+
+// cpuWorkers returns the number of parallel builds allowed by o.cpuFraction.
+func (o *buildOptions) cpuWorkers() (int, error) {
+	if err := checkCPUFraction(o.cpuFraction); err != nil {
+		return 0, err
+	}
+	return max(1, int(o.cpuFraction*float64(runtime.GOMAXPROCS(0)))), nil
+}
+
+func buildAll(ctx context.Context, n, workers int, build func(ctx context.Context, i int) (*CHD, error)) ([]*CHD, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*CHD, n)
+	work := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				c, err := build(ctx, i)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("builder %d: %w", i, err)
+						cancel()
+					})
+					continue
+				}
+				results[i] = c
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return results, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	return results, nil
+}
@@ -0,0 +1,98 @@
+package uint64mph
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildAll(t *testing.T) {
+	var builders []*CHDBuilder
+	for i := 0; i < 20; i++ {
+		b := Builder()
+		for _, w := range words[i*100 : (i+1)*100] {
+			b.Add(w, uint64(i))
+		}
+		builders = append(builders, b)
+	}
+	tables, err := BuildAll(context.Background(), builders, 4)
+	require.NoError(t, err)
+	require.Len(t, tables, 20)
+	for i, c := range tables {
+		assert.Equal(t, 100, c.Len())
+		assert.Equal(t, uint64(i), c.Get(words[i*100]))
+	}
+}
+
+func TestBuildAll_error(t *testing.T) {
+	good := Builder()
+	good.Add(1, 1)
+	bad := Builder()
+	bad.Add(1, 1)
+	bad.Add(1, 2)
+	tables, err := BuildAll(context.Background(), []*CHDBuilder{good, bad}, 1)
+	assert.ErrorContains(t, err, "builder 1: duplicate key 1")
+	assert.NotNil(t, tables[0])
+	assert.Nil(t, tables[1])
+}
+
+func TestBuildAll_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := Builder()
+	for _, w := range words[:1000] {
+		b.Add(w, w)
+	}
+	_, err := BuildAll(ctx, []*CHDBuilder{b, b}, 2)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = b.BuildContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBuildAll_workers(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	var mtx sync.Mutex
+	order := map[int]bool{}
+	tables, err := buildAll(context.Background(), 50, 3, func(ctx context.Context, i int) (*CHD, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		mtx.Lock()
+		order[i] = true
+		mtx.Unlock()
+		return MustFromMap(map[uint64]uint64{uint64(i): uint64(i)}), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), maxRunning.Load())
+	assert.Len(t, order, 50)
+	for i, c := range tables {
+		assert.Equal(t, uint64(i), c.Get(uint64(i)))
+	}
+}
+
+func TestBuildAll_stopsAfterError(t *testing.T) {
+	var started atomic.Int32
+	_, err := buildAll(context.Background(), 100, 2, func(ctx context.Context, i int) (*CHD, error) {
+		started.Add(1)
+		if i == 0 {
+			return nil, errors.New("boom")
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	assert.EqualError(t, err, "builder 0: boom")
+	assert.Less(t, started.Load(), int32(5))
+}
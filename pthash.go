@@ -0,0 +1,386 @@
+package uint64mph
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"runtime"
+	"time"
+)
+
+// Keys whose mixed hash is below pthashSkew, about 60% of them, go to the first
+// pthashDenseFraction of the buckets, as PTHash suggests: the resulting large
+// buckets are placed first, while most slots are still free.
+const (
+	pthashSkew          = math.MaxUint64 / 10 * 6
+	pthashDenseFraction = 0.3
+)
+
+// pthashTable replaces the hash functions and indices of a table built with
+// WithPTHash. Every bucket has a pilot, which moves its keys to
+// (h ^ pilotHash(pilot)) % size, with h the hash of the key mixed with seed.
+// Positions of at least n, the number of keys, are mapped to the slots left
+// free below n through free.
+type pthashTable struct {
+	seed    uint64
+	buckets uint64
+	// Keys whose mixed hash is below skew go to the first denseBuckets
+	// buckets, the others to the rest.
+	denseBuckets uint64
+	skew         uint64
+	// Number of positions the pilots pick from, at least n.
+	size uint64
+	n    uint64
+	// The pilots, pilotBits each, packed into words starting at the least
+	// significant bit.
+	pilotBits uint
+	pilots    []uint64
+	// The slot of every position at and above n.
+	free []uint32
+}
+
+// pilotHash spreads the bits of a pilot over the whole word.
+func pilotHash(pilot uint64) uint64 {
+	return mixBucketHash(pilot * 0x9e3779b97f4a7c15)
+}
+
+// bucket returns the bucket of h, the hash of a key mixed with seed.
+func (t *pthashTable) bucket(h uint64) uint64 {
+	x := mixBucketHash(h)
+	// Use other bits than the comparison with skew to pick the bucket.
+	y := x * 0x9e3779b97f4a7c15
+	if x < t.skew {
+		hi, _ := bits.Mul64(y, t.denseBuckets)
+		return hi
+	}
+	hi, _ := bits.Mul64(y, t.buckets-t.denseBuckets)
+	return t.denseBuckets + hi
+}
+
+// pilot returns the pilot of bucket i.
+func (t *pthashTable) pilot(i uint64) uint64 {
+	off := i * uint64(t.pilotBits)
+	w, shift := off/64, off%64
+	p := t.pilots[w] >> shift
+	if shift+uint64(t.pilotBits) > 64 {
+		p |= t.pilots[w+1] << (64 - shift)
+	}
+	return p & (1<<t.pilotBits - 1)
+}
+
+// slot returns the slot a key with hash h would be in.
+func (t *pthashTable) slot(h uint64) uint64 {
+	h ^= t.seed
+	pos := (h ^ pilotHash(t.pilot(t.bucket(h)))) % t.size
+	if pos >= t.n {
+		return uint64(t.free[pos-t.n])
+	}
+	return pos
+}
+
+// params returns the arguments to WithPTHash that result in a table like t.
+func (t *pthashTable) params() (c, alpha float64) {
+	return float64(t.buckets) * math.Log2(max(float64(t.n), 2)) / float64(t.n), float64(t.n) / float64(t.size)
+}
+
+// pthashSlot finds key in a table built with WithPTHash.
+func (c *CHD) pthashSlot(key uint64) (int, bool) {
+	if c.filter != nil && !c.filter.contains(key) {
+		return 0, false
+	}
+	ti := c.pthash.slot(c.hash(key))
+	if c.keys[ti] != key {
+		return 0, false
+	}
+	return int(ti), true
+}
+
+// buildPTHash builds a table of the entries with PTHash rather than CHD, see
+// WithPTHash.
+func buildPTHash(ctx context.Context, entries *entryChunks, o buildOptions, start time.Time) (*CHD, error) {
+	n := uint64(entries.len())
+	m := max(uint64(math.Ceil(o.pthashC*float64(n)/math.Log2(max(float64(n), 2)))), 2)
+	size := max(uint64(math.Ceil(float64(n)/o.pthashAlpha)), n)
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("PTHash table of %d positions is too large", size)
+	}
+	hasher := newCHDHasher(n, m, o.seed, o.seeded)
+	hasher.keyHasher, hasher.uniformKeys = o.hasher, o.hasher == Identity
+	if o.outerSeeded {
+		hasher.r[0] = o.outerSeed
+	}
+
+	keys := make([]uint64, 0, n)
+	values := make([]uint64, 0, n)
+	for i, chunk := range entries.keys {
+		keys = append(keys, chunk...)
+		values = append(values, entries.values[i]...)
+	}
+	hashes := make([]uint64, n)
+	for i, k := range keys {
+		hashes[i] = hasher.hash(k)
+	}
+
+	t := &pthashTable{
+		buckets:      m,
+		denseBuckets: min(max(uint64(pthashDenseFraction*float64(m)), 1), m-1),
+		skew:         pthashSkew,
+		size:         size,
+		n:            n,
+	}
+	// The keys by bucket: those of bucket i are byBucket[first[i]:first[i+1]].
+	first := make([]uint32, m+1)
+	byBucket := make([]uint32, n)
+	pilots := make([]uint64, m)
+	taken := newSlotBitset(size)
+	var positions []uint64
+	sinceYield := 0
+	maxPilot := uint64(0)
+reseed:
+	for reseeds := 0; ; reseeds++ {
+		t.seed = hasher.r[0]
+		clear(first)
+		clear(pilots)
+		clear(taken)
+		for _, h := range hashes {
+			first[t.bucket(h^t.seed)+1]++
+		}
+		for i := range pilots {
+			first[i+1] += first[i]
+		}
+		next := append([]uint32(nil), first[:m]...)
+		for i, h := range hashes {
+			b := t.bucket(h ^ t.seed)
+			byBucket[next[b]] = uint32(i)
+			next[b]++
+		}
+		order := pthashOrder(first)
+
+		maxPilot = 0
+	nextBucket:
+		for i, b := range order {
+			bucket := byBucket[first[b]:first[b+1]]
+			if sinceYield++; o.yieldInterval > 0 && sinceYield >= o.yieldInterval {
+				sinceYield = 0
+				runtime.Gosched()
+			}
+			if i%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				if o.progress != nil {
+					o.progress(i, len(order))
+				}
+			}
+			for j, x := range bucket {
+				for _, y := range bucket[:j] {
+					if hashes[x] != hashes[y] {
+						continue
+					}
+					if keys[x] == keys[y] {
+						return nil, fmt.Errorf("%w %d", ErrDuplicateKey, keys[x])
+					}
+					return nil, fmt.Errorf("%w for bucket %d: keys %d and %d have the same hash", ErrNoHashFunction, b, keys[x], keys[y])
+				}
+			}
+			if cap(positions) < len(bucket) {
+				positions = make([]uint64, len(bucket))
+			}
+			positions = positions[:len(bucket)]
+			for p := uint64(0); p < uint64(o.maxAttempts); p++ {
+				if sinceYield++; o.yieldInterval > 0 && sinceYield >= o.yieldInterval {
+					sinceYield = 0
+					runtime.Gosched()
+				}
+				if p%ctxCheckInterval == ctxCheckInterval-1 {
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+				}
+				if pthashFits(taken, hashes, bucket, t.seed^pilotHash(p), size, positions) {
+					for _, pos := range positions {
+						taken.add(pos)
+					}
+					pilots[b] = p
+					maxPilot = max(maxPilot, p)
+					continue nextBucket
+				}
+			}
+			if !o.outerSeeded && reseeds < maxReseeds {
+				if o.logger != nil {
+					o.logger.Warn("uint64mph: no pilot found, retrying with another seed", "bucket", b, "keys", len(bucket))
+				}
+				hasher.r[0] = hasher.rand.Uint64()
+				continue reseed
+			}
+			err := fmt.Errorf("%w after %d pilots, for bucket %d/%d with %d entries", ErrNoHashFunction, o.maxAttempts, i, len(order), len(bucket))
+			if o.outerSeeded {
+				err = fmt.Errorf("%w (the outer seed %#x was pinned by WithOuterSeed, try another seed)", err, o.outerSeed)
+			}
+			return nil, err
+		}
+		if o.progress != nil {
+			o.progress(len(order), len(order))
+		}
+		break
+	}
+
+	// Map the positions at and above n to the free slots below it.
+	t.free = make([]uint32, size-n)
+	freeSlot := uint64(0)
+	for pos := n; pos < size; pos++ {
+		if !taken.has(pos) {
+			continue
+		}
+		for taken.has(freeSlot) {
+			freeSlot++
+		}
+		t.free[pos-n] = uint32(freeSlot)
+		freeSlot++
+	}
+	t.pilotBits = uint(max(bits.Len64(maxPilot), 1))
+	t.pilots = make([]uint64, (m*uint64(t.pilotBits)+63)/64)
+	for i, p := range pilots {
+		off := uint64(i) * uint64(t.pilotBits)
+		t.pilots[off/64] |= p << (off % 64)
+		if off%64+uint64(t.pilotBits) > 64 {
+			t.pilots[off/64+1] |= p >> (64 - off%64)
+		}
+	}
+
+	c := &CHD{
+		pthash:     t,
+		keys:       make([]uint64, n),
+		values:     make([]uint64, n),
+		mixBuckets: true,
+		keyMask:    o.keyMask,
+	}
+	c.setHasher(o.hasher)
+	for i, h := range hashes {
+		ti := t.slot(h)
+		c.keys[ti], c.values[ti] = keys[i], values[i]
+	}
+	if err := c.shrinkValues(o); err != nil {
+		return nil, err
+	}
+	if o.filter {
+		f, err := newXorFilter(c.keys, hasher.rand)
+		if err != nil {
+			return nil, err
+		}
+		c.filter = f
+	}
+	if o.logger != nil {
+		o.logger.Info("uint64mph: build finished", "entries", n, "pthash", true, "buckets", m, "pilot_bits", t.pilotBits, "elapsed", time.Since(start))
+	}
+	if o.stats != nil {
+		*o.stats = BuildStats{
+			TableStats:  c.Stats(),
+			Duration:    time.Since(start),
+			MaxAttempts: int(maxPilot),
+			OuterSeed:   t.seed,
+		}
+	}
+	return c, nil
+}
+
+// pthashOrder returns the buckets with keys, the largest first, given where
+// the keys of every bucket start.
+func pthashOrder(first []uint32) []uint32 {
+	var bySize [][]uint32
+	for b := range first[:len(first)-1] {
+		size := int(first[b+1] - first[b])
+		if size == 0 {
+			continue
+		}
+		for len(bySize) <= size {
+			bySize = append(bySize, nil)
+		}
+		bySize[size] = append(bySize[size], uint32(b))
+	}
+	var order []uint32
+	for size := len(bySize) - 1; size > 0; size-- {
+		order = append(order, bySize[size]...)
+	}
+	return order
+}
+
+// pthashFits reports whether the keys of bucket, mixed with x, end up in
+// distinct positions that aren't taken yet, and stores those positions.
+func pthashFits(taken slotBitset, hashes []uint64, bucket []uint32, x, size uint64, positions []uint64) bool {
+	for j, k := range bucket {
+		pos := (hashes[k] ^ x) % size
+		if taken.has(pos) {
+			return false
+		}
+		for _, o := range positions[:j] {
+			if o == pos {
+				return false
+			}
+		}
+		positions[j] = pos
+	}
+	return true
+}
+
+// writePTHash writes the sections replacing the hash functions and indices of a
+// table built with WithPTHash.
+func (c *CHD) writePTHash(e *encoder) {
+	t := c.pthash
+	e.section(sectionPTHash, 8, 6)
+	e.uint64(t.seed)
+	e.uint64(t.buckets)
+	e.uint64(t.denseBuckets)
+	e.uint64(t.skew)
+	e.uint64(t.size)
+	e.uint64(uint64(t.pilotBits))
+	e.section(sectionPilots, 8, len(t.pilots))
+	for _, w := range t.pilots {
+		e.uint64(w)
+	}
+	e.section(sectionFreeSlots, 4, len(t.free))
+	for _, s := range t.free {
+		e.uint32(s)
+	}
+	e.pad()
+}
+
+// loadPTHash loads the structure of a table built with WithPTHash.
+func (c *CHD) loadPTHash(h header, data func(tag uint32) []byte, skipKeys bool) error {
+	b := data(sectionPTHash)
+	t := &pthashTable{
+		seed:         binary.LittleEndian.Uint64(b),
+		buckets:      binary.LittleEndian.Uint64(b[8:]),
+		denseBuckets: binary.LittleEndian.Uint64(b[16:]),
+		skew:         binary.LittleEndian.Uint64(b[24:]),
+		size:         binary.LittleEndian.Uint64(b[32:]),
+		pilots:       readUint64s(h, data, sectionPilots),
+	}
+	s, _ := h.section(sectionFreeSlots)
+	t.free = (&sliceReader{b: data(sectionFreeSlots)}).ReadUint32Array(uint64(s.count))
+	if !skipKeys {
+		c.keys = readUint64s(h, data, sectionKeys)
+	}
+	keys, _ := h.section(sectionKeys)
+	t.n = uint64(keys.count)
+	pilotBits := binary.LittleEndian.Uint64(b[40:])
+	if t.buckets < 2 || t.denseBuckets == 0 || t.denseBuckets >= t.buckets {
+		return fmt.Errorf("%w: PTHash table with %d buckets of which %d dense", ErrNotCHD, t.buckets, t.denseBuckets)
+	}
+	if pilotBits == 0 || pilotBits > 64 || uint64(len(t.pilots)) != (t.buckets*pilotBits+63)/64 || t.buckets*pilotBits/pilotBits != t.buckets {
+		return fmt.Errorf("%w: %d words of %d bit pilots for %d buckets", ErrNotCHD, len(t.pilots), pilotBits, t.buckets)
+	}
+	if t.n == 0 || t.size < t.n || t.size-t.n != uint64(len(t.free)) {
+		return fmt.Errorf("%w: PTHash table of %d positions with %d keys and %d free slots", ErrNotCHD, t.size, t.n, len(t.free))
+	}
+	for _, s := range t.free {
+		if uint64(s) >= t.n {
+			return fmt.Errorf("%w: free slot %d of a PTHash table with %d keys", ErrNotCHD, s, t.n)
+		}
+	}
+	t.pilotBits = uint(pilotBits)
+	c.pthash = t
+	return nil
+}
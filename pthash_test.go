@@ -0,0 +1,183 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomData returns n random keys with random values.
+func randomData(n int, seed int64) map[uint64]uint64 {
+	rng := rand.New(rand.NewSource(seed))
+	m := map[uint64]uint64{}
+	for len(m) < n {
+		m[rng.Uint64()] = rng.Uint64()
+	}
+	return m
+}
+
+func TestPTHash(t *testing.T) {
+	m := randomData(10000, 1)
+	c, err := FromMap(m, WithPTHash(7, 0.97), WithSeed(1))
+	require.NoError(t, err)
+	require.NotNil(t, c.pthash)
+	assert.Empty(t, c.r)
+	assert.Empty(t, c.indices)
+	assert.Equal(t, uint64(10310), c.pthash.size)
+	assert.Len(t, c.pthash.free, 310)
+	assert.Equal(t, 10000, c.Len())
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, FlagPTHash, fi.Flags)
+	assert.Equal(t, 10000, fi.Entries)
+	assert.Equal(t, int(c.pthash.buckets), fi.Buckets)
+	assert.Equal(t, int64(c.Stats().IndicesBytes), fi.IndicesBytes)
+	assert.Equal(t, c.Spec().Size, int64(w.Len()))
+
+	var rewritten offsetBuffer
+	n, err := c.WriteToAt(&rewritten)
+	require.NoError(t, err)
+	assert.Equal(t, int64(w.Len()), n)
+	assert.Equal(t, w.Bytes(), rewritten.b)
+
+	l, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	r, err := Read(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	ra, err := ReadAt(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	s, v := writeSplit(t, c)
+	sl, err := MmapSplit(s, v)
+	require.NoError(t, err)
+	for name, g := range map[string]*CHD{"built": c, "mmap": l, "read": r, "readat": ra, "split": sl, "materialized": l.Materialize()} {
+		t.Run(name, func(t *testing.T) {
+			require.NotNil(t, g.pthash)
+			assert.Equal(t, 10000, g.Len())
+			for k, v := range m {
+				got, ok := g.GetOK(k)
+				assert.True(t, ok)
+				assert.Equal(t, v, got)
+			}
+			missing := 0
+			for k := range randomData(1000, 2) {
+				if _, ok := m[k]; !ok {
+					assert.False(t, g.Contains(k), k)
+					missing++
+				}
+			}
+			assert.Equal(t, 1000, missing)
+			assert.NoError(t, g.Verify())
+
+			got := map[uint64]uint64{}
+			for it := g.Iterate(); it != nil; it = it.Next() {
+				k, v := it.Get()
+				got[k] = v
+			}
+			assert.Equal(t, m, got)
+		})
+	}
+
+	var k uint64
+	for k = range m {
+		break
+	}
+	require.NoError(t, c.SetValue(k, 1))
+	assert.Equal(t, uint64(1), c.Get(k))
+	doubled := c.MapValues(func(k, v uint64) uint64 { return 2 * v })
+	assert.Equal(t, uint64(2), doubled.Get(k))
+	assert.NoError(t, doubled.Verify())
+}
+
+func TestPTHash_options(t *testing.T) {
+	m := randomData(2000, 3)
+	for name, opts := range map[string][]BuildOption{
+		"alpha 1":  {WithPTHash(5, 1)},
+		"filter":   {WithPTHash(7, 0.99), WithFilter()},
+		"packed":   {WithPTHash(7, 0.99), WithPackedValues()},
+		"identity": {WithPTHash(7, 0.99), AssumeUniformKeys()},
+		"seeded":   {WithPTHash(7, 0.99), WithOuterSeed(42)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(m, opts...)
+			require.NoError(t, err)
+			require.NotNil(t, c.pthash)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			for k, v := range m {
+				assert.Equal(t, v, l.Get(k))
+			}
+			assert.NoError(t, l.Verify())
+		})
+	}
+
+	// Small tables stay small, unless forced to be hashed.
+	c, err := FromMap(sampleData, WithPTHash(7, 0.99))
+	require.NoError(t, err)
+	assert.True(t, c.small)
+	c, err = FromMap(sampleData, WithPTHash(7, 0.99), hashed)
+	require.NoError(t, err)
+	require.NotNil(t, c.pthash)
+	for k, v := range sampleData {
+		assert.Equal(t, v, c.Get(k))
+	}
+
+	for _, p := range [][2]float64{{0, 0.99}, {-1, 0.99}, {7, 0}, {7, 1.01}, {math.NaN(), 0.99}} {
+		_, err := FromMap(sampleData, WithPTHash(p[0], p[1]))
+		assert.ErrorContains(t, err, "invalid PTHash parameters")
+	}
+
+	b := Builder()
+	for k := range m {
+		b.Add(k, 1)
+	}
+	b.Add(42, 1)
+	b.Add(42, 2)
+	_, err = b.Build(WithPTHash(7, 0.99))
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+}
+
+func TestPTHash_rebuild(t *testing.T) {
+	m := randomData(1000, 4)
+	c, err := FromMap(m, WithPTHash(6, 0.95))
+	require.NoError(t, err)
+	r, err := RebuildWith(c, map[uint64]uint64{1: 2}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, r.pthash)
+	assert.Equal(t, uint64(2), r.Get(1))
+	// The table has one more key, so it may have one more bucket and slot.
+	assert.InDelta(t, float64(c.pthash.buckets), float64(r.pthash.buckets), 1)
+	assert.InDelta(t, float64(c.pthash.size), float64(r.pthash.size), 2)
+}
+
+func TestPTHash_corrupt(t *testing.T) {
+	c, err := FromMap(randomData(1000, 5), WithPTHash(7, 0.95))
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	l := c.Spec()
+	for name, corrupt := range map[string]func(b []byte){
+		"buckets":    func(b []byte) { binary.LittleEndian.PutUint64(b[l.PTHash.Offset+8:], 1) },
+		"dense":      func(b []byte) { binary.LittleEndian.PutUint64(b[l.PTHash.Offset+16:], c.pthash.buckets) },
+		"size":       func(b []byte) { binary.LittleEndian.PutUint64(b[l.PTHash.Offset+32:], 999) },
+		"pilot bits": func(b []byte) { binary.LittleEndian.PutUint64(b[l.PTHash.Offset+40:], 65) },
+		"free slot":  func(b []byte) { binary.LittleEndian.PutUint32(b[l.FreeSlots.Offset:], 1000) },
+		"flag":       func(b []byte) { binary.LittleEndian.PutUint32(b[8:], 0) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := append([]byte(nil), w.Bytes()...)
+			corrupt(b)
+			_, err := Mmap(b)
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// RawTable looks up keys in a serialized table by reading the fields it needs
+// straight from the bytes, without creating slices over them. Opening it only
+// checks the header and the sizes of the sections, so unlike Mmap on platforms
+// where the arrays can't be aliased, it takes no time or memory proportional to
+// the size of the table. Every lookup decodes a few fields with
+// encoding/binary, which makes it somewhat slower than a lookup in a CHD.
+//
+// The filter and columns of the table aren't used, but keys marked deleted in
+// the file are hidden, see Delete. Lookups in a corrupt table may return wrong
+// results, but don't read outside of the buffer.
+type RawTable struct {
+	b []byte
+	// Holds what lookups need besides the sections: the hasher, the key
+	// mask, and the parameters of dense and PTHash tables, but no arrays.
+	c *CHD
+	// The sections lookups read. Those the table doesn't have are empty.
+	r, indices, keys, presence, pilots, free rawSection
+	// The values section, with hasValues false for index-only files.
+	values    rawSection
+	hasValues bool
+	deltas    bool
+	dict      rawSection
+	slots     int
+	// The deletion marks, see Delete. Empty if the file has none.
+	deleted rawSection
+}
+
+// OpenRaw creates a RawTable over the serialized table in b, which must stay
+// unmodified for as long as the RawTable is used. Of the LoadOptions, only
+// WithKeyMask applies. The structure file written by WriteSplit can be opened
+// too, resulting in an index-only table.
+func OpenRaw(b []byte, opts ...LoadOption) (*RawTable, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if isCompressed(b) {
+		return nil, ErrCompressed
+	}
+	h, err := sniffHeader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if h.size > int64(len(b)) || (h.version != legacyFormatVersion && h.size != int64(len(b))) {
+		return nil, fmt.Errorf("%w: file is %d bytes, its sections need %d", ErrNotCHD, len(b), h.size)
+	}
+	if h.flags&FlagSplitValues != 0 {
+		return nil, fmt.Errorf("%w: file only holds values, load it with MmapSplit", ErrNotCHD)
+	}
+	data := func(tag uint32) []byte {
+		s, ok := h.section(tag)
+		if !ok {
+			return nil
+		}
+		return b[s.offset : s.offset+s.size() : s.offset+s.size()]
+	}
+	t := &RawTable{b: b}
+	t.c = &CHD{info: Info{Version: h.version, Flags: h.flags}, mixBuckets: h.version >= 3, small: h.flags&FlagSmall != 0}
+	if err := t.c.loadHasher(h, data); err != nil {
+		return nil, err
+	}
+	if err := t.c.loadKeyMask(data, o); err != nil {
+		return nil, err
+	}
+	t.keys, _ = h.section(sectionKeys)
+	t.slots = t.keys.count
+	switch {
+	case h.flags&FlagDense != 0:
+		if err := t.openDense(h, data); err != nil {
+			return nil, err
+		}
+		t.slots = t.c.dense.span
+	case h.flags&FlagPTHash != 0:
+		if err := t.openPTHash(h, data); err != nil {
+			return nil, err
+		}
+	case !t.c.small:
+		t.r, _ = h.section(sectionHashFunctions)
+		t.indices, _ = h.section(sectionIndices)
+	}
+	if h.flags&FlagSplitStructure == 0 {
+		t.values, t.hasValues = h.values()
+		if t.values.count != t.slots {
+			return nil, fmt.Errorf("%w: %d slots but %d values", ErrNotCHD, t.slots, t.values.count)
+		}
+		t.deltas = t.values.tag == sectionValueDeltas
+		t.dict, _ = h.section(sectionDictionary)
+	}
+	t.deleted, _ = h.section(sectionDeletions)
+	if t.deleted.count != 0 && t.deleted.count != (t.slots+63)/64 {
+		return nil, fmt.Errorf("%w: %d words of deletion marks for %d slots", ErrNotCHD, t.deleted.count, t.slots)
+	}
+	return t, nil
+}
+
+// openDense reads the parameters of a dense table, like loadDense, but leaves
+// the presence bitmap in the buffer. The number of keys isn't checked against
+// the bitmap, as that means reading all of it.
+func (t *RawTable) openDense(h header, data func(tag uint32) []byte) error {
+	b := data(sectionDense)
+	t.presence, _ = h.section(sectionPresence)
+	base, span, n := binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:]), binary.LittleEndian.Uint64(b[16:])
+	if span == 0 || (span+63)/64 != uint64(t.presence.count) || base+(span-1) < base || n > span {
+		return fmt.Errorf("%w: dense table of %d slots with %d presence words", ErrNotCHD, span, t.presence.count)
+	}
+	t.c.dense = &denseKeys{base: base, span: int(span), n: int(n)}
+	return nil
+}
+
+// openPTHash reads the parameters of a PTHash table, like loadPTHash, but
+// leaves the pilots and free slots in the buffer. The free slots are checked by
+// every lookup instead.
+func (t *RawTable) openPTHash(h header, data func(tag uint32) []byte) error {
+	b := data(sectionPTHash)
+	p := &pthashTable{
+		seed:         binary.LittleEndian.Uint64(b),
+		buckets:      binary.LittleEndian.Uint64(b[8:]),
+		denseBuckets: binary.LittleEndian.Uint64(b[16:]),
+		skew:         binary.LittleEndian.Uint64(b[24:]),
+		size:         binary.LittleEndian.Uint64(b[32:]),
+		n:            uint64(t.keys.count),
+	}
+	t.pilots, _ = h.section(sectionPilots)
+	t.free, _ = h.section(sectionFreeSlots)
+	pilotBits := binary.LittleEndian.Uint64(b[40:])
+	if p.buckets < 2 || p.denseBuckets == 0 || p.denseBuckets >= p.buckets {
+		return fmt.Errorf("%w: PTHash table with %d buckets of which %d dense", ErrNotCHD, p.buckets, p.denseBuckets)
+	}
+	if pilotBits == 0 || pilotBits > 64 || uint64(t.pilots.count) != (p.buckets*pilotBits+63)/64 || p.buckets*pilotBits/pilotBits != p.buckets {
+		return fmt.Errorf("%w: %d words of %d bit pilots for %d buckets", ErrNotCHD, t.pilots.count, pilotBits, p.buckets)
+	}
+	if p.n == 0 || p.size < p.n || p.size-p.n != uint64(t.free.count) {
+		return fmt.Errorf("%w: PTHash table of %d positions with %d keys and %d free slots", ErrNotCHD, p.size, p.n, t.free.count)
+	}
+	p.pilotBits = uint(pilotBits)
+	t.c.pthash = p
+	return nil
+}
+
+// GetFromBytes looks up key in the serialized table in b, like OpenRaw
+// followed by GetOK. It checks the header on every call: use OpenRaw for more
+// than a few lookups.
+func GetFromBytes(b []byte, key uint64, opts ...LoadOption) (uint64, bool, error) {
+	t, err := OpenRaw(b, opts...)
+	if err != nil {
+		return 0, false, err
+	}
+	v, ok := t.GetOK(key)
+	return v, ok, nil
+}
+
+// Len returns the number of entries in the table.
+func (t *RawTable) Len() int {
+	if t.c.dense != nil {
+		return t.c.dense.n
+	}
+	return t.keys.count
+}
+
+// Info returns information about the file of the table.
+func (t *RawTable) Info() Info {
+	return t.c.info
+}
+
+// IndexOnly reports whether the table has no values, see CHD.IndexOnly.
+func (t *RawTable) IndexOnly() bool {
+	return !t.hasValues
+}
+
+// Get an entry from the table. Returns math.MaxUint64 if the key is not
+// present, use GetOK to distinguish that from a stored math.MaxUint64.
+func (t *RawTable) Get(key uint64) uint64 {
+	v, ok := t.GetOK(key)
+	if !ok {
+		return math.MaxUint64
+	}
+	return v
+}
+
+// GetOK gets an entry from the table and reports whether it was present. It
+// panics with ErrNoValues for index-only tables, and with ErrPairValues for
+// tables with pair values.
+func (t *RawTable) GetOK(key uint64) (uint64, bool) {
+	if !t.hasValues {
+		panic(ErrNoValues)
+	}
+	if t.values.tag == sectionPairValues {
+		panic(ErrPairValues)
+	}
+	key = t.c.maskKey(key)
+	ti, ok := t.slot(key)
+	if !ok {
+		return 0, false
+	}
+	return t.value(ti, key)
+}
+
+// Contains reports whether key is in the table. Unlike Get, it works for
+// index-only tables.
+func (t *RawTable) Contains(key uint64) bool {
+	_, ok := t.slot(t.c.maskKey(key))
+	return ok
+}
+
+// Slot returns the slot of key, like CHD.Slot.
+func (t *RawTable) Slot(key uint64) (int, bool) {
+	return t.slot(t.c.maskKey(key))
+}
+
+// slot returns the slot of key as stored in the table, unless it was deleted.
+func (t *RawTable) slot(key uint64) (int, bool) {
+	ti, ok := t.findSlot(key)
+	if !ok || (t.deleted.count != 0 && t.uint64At(t.deleted, ti/64)&(1<<(ti%64)) != 0) {
+		return 0, false
+	}
+	return ti, true
+}
+
+// findSlot returns the slot of key as stored in the table.
+func (t *RawTable) findSlot(key uint64) (int, bool) {
+	var ti uint64
+	switch {
+	case t.c.dense != nil:
+		i := key - t.c.dense.base
+		if i >= uint64(t.c.dense.span) || t.uint64At(t.presence, int(i/64))&(1<<(i%64)) == 0 {
+			return 0, false
+		}
+		return int(i), true
+	case t.c.small:
+		for i := 0; i < t.keys.count; i++ {
+			if t.uint64At(t.keys, i) == key {
+				return i, true
+			}
+		}
+		return 0, false
+	case t.c.pthash != nil:
+		p := t.c.pthash
+		h := t.c.hash(key) ^ p.seed
+		ti = (h ^ pilotHash(t.pilot(p.bucket(h)))) % p.size
+		if ti >= p.n {
+			ti = uint64(binary.LittleEndian.Uint32(t.b[t.free.offset+4*int64(ti-p.n):]))
+		}
+	default:
+		if t.keys.count == 0 {
+			return 0, false
+		}
+		h := t.c.hash(key) ^ t.hashFunction(0)
+		i := bucketFor(h, uint64(t.indices.count), t.c.mixBuckets)
+		ri := int(binary.LittleEndian.Uint16(t.b[t.indices.offset+2*int64(i):]))
+		if ri >= t.r.count {
+			return 0, false
+		}
+		ti = (h ^ t.hashFunction(ri)) % uint64(t.keys.count)
+	}
+	if ti >= uint64(t.keys.count) || t.uint64At(t.keys, int(ti)) != key {
+		return 0, false
+	}
+	return int(ti), true
+}
+
+// hashFunction returns r[i].
+func (t *RawTable) hashFunction(i int) uint64 {
+	if t.r.width == 4 {
+		return uint64(binary.LittleEndian.Uint32(t.b[t.r.offset+4*int64(i):]))
+	}
+	return t.uint64At(t.r, i)
+}
+
+// pilot returns the pilot of bucket i of a PTHash table.
+func (t *RawTable) pilot(i uint64) uint64 {
+	p := t.c.pthash
+	off := i * uint64(p.pilotBits)
+	w, shift := off/64, off%64
+	pilot := t.uint64At(t.pilots, int(w)) >> shift
+	if shift+uint64(p.pilotBits) > 64 {
+		pilot |= t.uint64At(t.pilots, int(w+1)) << (64 - shift)
+	}
+	return pilot & (1<<p.pilotBits - 1)
+}
+
+// value returns the value in slot ti, whose key is key as stored in the
+// table. It returns false for dictionary codes beyond the dictionary.
+func (t *RawTable) value(ti int, key uint64) (uint64, bool) {
+	off := t.values.offset + int64(ti)*int64(t.values.width)
+	var v uint64
+	switch t.values.width {
+	case 1:
+		v = uint64(t.b[off])
+	case 2:
+		v = uint64(binary.LittleEndian.Uint16(t.b[off:]))
+	case 4:
+		v = uint64(binary.LittleEndian.Uint32(t.b[off:]))
+		if t.deltas {
+			return key + uint64(int64(int32(v))), true
+		}
+	default:
+		v = binary.LittleEndian.Uint64(t.b[off:])
+	}
+	if t.dict.count > 0 {
+		if v >= uint64(t.dict.count) {
+			return 0, false
+		}
+		return t.uint64At(t.dict, int(v)), true
+	}
+	return v, true
+}
+
+func (t *RawTable) uint64At(s rawSection, i int) uint64 {
+	return binary.LittleEndian.Uint64(t.b[s.offset+8*int64(i):])
+}
@@ -0,0 +1,149 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertSameLookups asserts that raw answers lookups of every key in m, and of
+// missing keys, like c.
+func assertSameLookups(t *testing.T, c *CHD, raw *RawTable, m map[uint64]uint64) {
+	t.Helper()
+	assert.Equal(t, c.Len(), raw.Len())
+	for k := range m {
+		want, ok := c.GetOK(k)
+		require.True(t, ok)
+		got, ok := raw.GetOK(k)
+		assert.True(t, ok, "key %d", k)
+		assert.Equal(t, want, got, "key %d", k)
+		wantSlot, _ := c.Slot(k)
+		gotSlot, _ := raw.Slot(k)
+		assert.Equal(t, wantSlot, gotSlot, "key %d", k)
+	}
+	for k := uint64(0); k < 1000; k++ {
+		_, want := c.GetOK(k)
+		_, got := raw.GetOK(k)
+		assert.Equal(t, want, got, "key %d", k)
+		assert.Equal(t, want, raw.Contains(k), "key %d", k)
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	m := randomData(3000, 22)
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[500+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data  map[uint64]uint64
+		opts  []BuildOption
+		write []WriteOption
+	}{
+		"chd":        {m, nil, nil},
+		"32 bit":     {m, []BuildOption{WithHashFunctions32()}, nil},
+		"filter":     {m, []BuildOption{WithFilter()}, nil},
+		"packed":     {byteValues(), []BuildOption{WithPackedValues()}, nil},
+		"dictionary": {m, []BuildOption{WithPackedValues(), WithDictionaryThreshold(1 << 20)}, nil},
+		"deltas":     {dense, []BuildOption{hashed}, []WriteOption{WithValueDeltas()}},
+		"pthash":     {m, []BuildOption{WithPTHash(7, 0.99)}, nil},
+		"dense":      {dense, []BuildOption{WithDenseThreshold(0.5)}, []WriteOption{WithValueDeltas()}},
+		"small":      {sampleData, nil, nil},
+		"uniform":    {m, []BuildOption{AssumeUniformKeys()}, nil},
+		"hasher":     {m, []BuildOption{WithHasher(splitmixHasher{"splitmix64"})}, nil},
+		"masked":     {m, []BuildOption{MaskKeys(5), WithPTHash(7, 0.99)}, []WriteOption{WithValueDeltas()}},
+		"empty":      {map[uint64]uint64{}, nil, nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, tc.opts...)
+			require.NoError(t, err)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w, tc.write...))
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(5))
+			}
+			mapped, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+			raw, err := OpenRaw(w.Bytes(), lo...)
+			require.NoError(t, err)
+			assert.Equal(t, mapped.Info(), raw.Info())
+			assertSameLookups(t, mapped, raw, tc.data)
+
+			for k, v := range tc.data {
+				got, ok, err := GetFromBytes(w.Bytes(), k, lo...)
+				require.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, v, got)
+				// Lookups don't allocate.
+				assert.Zero(t, testing.AllocsPerRun(10, func() { raw.Get(k) }))
+				break
+			}
+
+			structure, _ := writeSplit(t, c)
+			raw, err = OpenRaw(structure, lo...)
+			require.NoError(t, err)
+			assert.True(t, raw.IndexOnly())
+			for k := range tc.data {
+				assert.True(t, raw.Contains(k))
+				assert.PanicsWithValue(t, ErrNoValues, func() { raw.Get(k) })
+				break
+			}
+		})
+	}
+}
+
+func TestOpenRaw_legacy(t *testing.T) {
+	for _, gc := range golden.Cases() {
+		t.Run(gc.Name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata/golden/v1", gc.Name))
+			require.NoError(t, err)
+			c, err := Mmap(data)
+			require.NoError(t, err)
+			raw, err := OpenRaw(data)
+			require.NoError(t, err)
+			m := map[uint64]uint64{}
+			for i, k := range gc.Keys {
+				m[k] = gc.Values[i]
+			}
+			assertSameLookups(t, c, raw, m)
+		})
+	}
+}
+
+func TestOpenRaw_errors(t *testing.T) {
+	c := MustFromMap(randomData(100, 23))
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	_, err := OpenRaw(w.Bytes()[:w.Len()-8])
+	assert.ErrorIs(t, err, ErrNotCHD)
+	_, err = OpenRaw([]byte("garbage"))
+	assert.ErrorIs(t, err, ErrNotCHD)
+	_, _, err = GetFromBytes(nil, 1)
+	assert.ErrorIs(t, err, ErrNotCHD)
+
+	_, values := writeSplit(t, c)
+	_, err = OpenRaw(values)
+	assert.ErrorIs(t, err, ErrNotCHD)
+
+	w.Reset()
+	require.NoError(t, MustFromMap(sampleData, MaskKeys(1)).Write(w))
+	_, err = OpenRaw(w.Bytes())
+	assert.ErrorIs(t, err, ErrKeyMask)
+
+	b := NewPairBuilder()
+	b.Add2(1, 2, 3)
+	p, err := b.Build()
+	require.NoError(t, err)
+	w.Reset()
+	require.NoError(t, p.Write(w))
+	raw, err := OpenRaw(w.Bytes())
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, ErrPairValues, func() { raw.Get(1) })
+	assert.True(t, raw.Contains(1))
+}
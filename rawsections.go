@@ -0,0 +1,215 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/alecthomas/unsafeslice"
+)
+
+// Sections are the header fields and sections of a serialized table, for
+// storing a table in a container format of its own instead of the file written
+// by Write. See RawSections and FromSections, and FORMAT.md for what the fields
+// and sections hold.
+type Sections struct {
+	// Format version and flags, as in the file header.
+	Version int
+	Flags   uint32
+	// The sections, in the order Write writes them.
+	Sections []SectionData
+}
+
+// SectionData is a section of a serialized table.
+type SectionData struct {
+	// What the section holds, see FORMAT.md. Tags with the highest bit set
+	// are optional sections.
+	Tag uint32
+	// Size in bytes of every element, and the number of elements.
+	Width int
+	Count int
+	// The Count elements of Width bytes, little endian, without padding.
+	Data []byte
+}
+
+// Section returns the section with the given tag, and whether there is one.
+func (s Sections) Section(tag uint32) (SectionData, bool) {
+	for _, d := range s.Sections {
+		if d.Tag == tag {
+			return d, true
+		}
+	}
+	return SectionData{}, false
+}
+
+// RawSections returns the sections of the table as Write without options
+// would write them, so that they can be stored apart. Writing the header
+// fields and then every section with its tag, width and count, zero padded to
+// a multiple of 8 bytes, results in the exact bytes written by Write.
+//
+// The large arrays, like the hash functions, indices, keys and values, are
+// returned without copying on platforms where Mmap aliases its input, as
+// their encoding is their layout in memory. Those sections alias the table:
+// they must not be modified, and are only valid until the table is closed.
+// Later calls to SetValue show through. The other sections are encoded.
+//
+// RawSections panics with ErrNoValues for index-only tables.
+func (c *CHD) RawSections() Sections {
+	if c == nil {
+		panic(ErrNilTable)
+	}
+	c.checkClosed()
+	if c.IndexOnly() {
+		panic(ErrNoValues)
+	}
+	sink := &sectionSink{views: c.sectionViews()}
+	if err := c.write(sink, writeOptions{}); err != nil {
+		// The sink doesn't fail.
+		panic(err)
+	}
+	return sink.s
+}
+
+// sectionViews returns the sections whose encoding is the memory of an array
+// of the table, by tag.
+func (c *CHD) sectionViews() map[uint32][]byte {
+	views := map[uint32][]byte{}
+	if c.valueWidth != 0 {
+		views[sectionValues] = c.packed
+	}
+	if !zeroCopy {
+		return views
+	}
+	if !c.r32 {
+		views[sectionHashFunctions] = unsafeslice.ByteSliceFromUint64Slice(c.r)
+	}
+	views[sectionIndices] = unsafeslice.ByteSliceFromUint16Slice(c.indices)
+	views[sectionKeys] = unsafeslice.ByteSliceFromUint64Slice(c.keys)
+	if c.valueWidth == 0 {
+		views[sectionValues] = unsafeslice.ByteSliceFromUint64Slice(c.values)
+	}
+	views[sectionPairValues] = unsafeslice.ByteSliceFromUint64Slice(c.pairValues)
+	views[sectionDictionary] = unsafeslice.ByteSliceFromUint64Slice(c.dict)
+	if c.dense != nil {
+		views[sectionPresence] = unsafeslice.ByteSliceFromUint64Slice(c.dense.present)
+	}
+	if c.pthash != nil {
+		views[sectionPilots] = unsafeslice.ByteSliceFromUint64Slice(c.pthash.pilots)
+		views[sectionFreeSlots] = unsafeslice.ByteSliceFromUint32Slice(c.pthash.free)
+	}
+	views[sectionSortedIndex] = unsafeslice.ByteSliceFromUint32Slice(c.sorted)
+	return views
+}
+
+// sectionSink splits the serialized table written to it into its sections.
+// The data of sections in views, which must match what is written for them,
+// isn't kept: the view is used instead.
+type sectionSink struct {
+	s     Sections
+	views map[uint32][]byte
+	// The file or section header being written.
+	hdr []byte
+	// Whether the file header has been written.
+	started bool
+	// The number of data and padding bytes of the current section that are
+	// still to be written, and whether its data is being kept.
+	remaining, pad int
+	keep           bool
+}
+
+func (s *sectionSink) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		switch {
+		case s.remaining > 0:
+			k := min(s.remaining, len(p))
+			if s.keep {
+				d := &s.s.Sections[len(s.s.Sections)-1]
+				d.Data = append(d.Data, p[:k]...)
+			}
+			s.remaining -= k
+			p = p[k:]
+		case s.pad > 0:
+			k := min(s.pad, len(p))
+			s.pad -= k
+			p = p[k:]
+		default:
+			size := sectionHeaderSize
+			if !s.started {
+				size = headerSize
+			}
+			k := min(size-len(s.hdr), len(p))
+			s.hdr = append(s.hdr, p[:k]...)
+			p = p[k:]
+			if len(s.hdr) == size {
+				s.header()
+				s.hdr = s.hdr[:0]
+			}
+		}
+	}
+	return n, nil
+}
+
+// header decodes the complete file or section header in s.hdr.
+func (s *sectionSink) header() {
+	if !s.started {
+		s.started = true
+		s.s.Version = int(binary.LittleEndian.Uint16(s.hdr[6:]))
+		s.s.Flags = binary.LittleEndian.Uint32(s.hdr[8:])
+		return
+	}
+	d := SectionData{
+		Tag:   binary.LittleEndian.Uint32(s.hdr),
+		Width: int(binary.LittleEndian.Uint32(s.hdr[4:])),
+		Count: int(binary.LittleEndian.Uint64(s.hdr[8:])),
+	}
+	size := d.Width * d.Count
+	s.remaining, s.pad = size, (8-size%8)%8
+	view, ok := s.views[d.Tag]
+	s.keep = !ok || len(view) != size
+	if s.keep {
+		d.Data = make([]byte, 0, size)
+	} else {
+		d.Data = view[:size:size]
+	}
+	s.s.Sections = append(s.s.Sections, d)
+}
+
+// FromSections creates a table from the sections returned by RawSections,
+// after checking them like Mmap checks a file. Like Mmap, the table aliases the
+// data of the sections where possible: it must not be modified for as long as
+// the table is used.
+func FromSections(s Sections, opts ...LoadOption) (*CHD, error) {
+	if s.Version < minHeaderVersion || s.Version > formatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrNotCHD, s.Version)
+	}
+	h := header{version: s.Version, flags: s.Flags}
+	seen := map[uint32]bool{}
+	data := map[uint32][]byte{}
+	for _, d := range s.Sections {
+		rs, err := h.addSection(d.Tag, uint32(d.Width), uint64(d.Count), 0, seen)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(d.Data)) != rs.size() {
+			return nil, fmt.Errorf("%w: section %d has %d bytes of data for %d elements of %d bytes", ErrNotCHD, d.Tag, len(d.Data), d.Count, d.Width)
+		}
+		if zeroCopy {
+			data[d.Tag] = d.Data
+		} else {
+			data[d.Tag] = append([]byte(nil), d.Data...)
+		}
+	}
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	c, err := load(h, func(tag uint32) []byte { return data[tag] }, opts)
+	if err != nil {
+		return nil, err
+	}
+	if zeroCopy {
+		for _, d := range s.Sections {
+			c.backing = append(c.backing, d.Data)
+		}
+	}
+	return c, nil
+}
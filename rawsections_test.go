@@ -0,0 +1,128 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeSections writes the sections like Write does.
+func encodeSections(s Sections) []byte {
+	b := append([]byte(formatMagic), 0, 0)
+	binary.LittleEndian.PutUint16(b[len(formatMagic):], uint16(s.Version))
+	b = binary.LittleEndian.AppendUint32(b, s.Flags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s.Sections)))
+	for _, d := range s.Sections {
+		b = binary.LittleEndian.AppendUint32(b, d.Tag)
+		b = binary.LittleEndian.AppendUint32(b, uint32(d.Width))
+		b = binary.LittleEndian.AppendUint64(b, uint64(d.Count))
+		b = append(b, d.Data...)
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func TestRawSections(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":        {randomData(2000, 80), nil},
+		"small":      {sampleData, nil},
+		"dense":      {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"pthash":     {randomData(2000, 81), []BuildOption{WithPTHash(7, 0.99)}},
+		"masked":     {randomData(2000, 82), []BuildOption{MaskKeys(3)}},
+		"packed":     {byteValues(), []BuildOption{WithPackedValues()}},
+		"dictionary": {randomData(2000, 83), []BuildOption{WithValueDictionary()}},
+		"r32":        {randomData(2000, 84), []BuildOption{WithHashFunctions32(), WithFilter(), WithSortedIndex()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithSeed(80))...)
+			require.NoError(t, err)
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			var lo []LoadOption
+			if c.MaskedKeys() {
+				lo = append(lo, WithKeyMask(3))
+			}
+			mapped, err := MmapWithOptions(w.Bytes(), lo...)
+			require.NoError(t, err)
+
+			for _, src := range []*CHD{c, mapped} {
+				s := src.RawSections()
+				assert.Equal(t, w.Bytes(), encodeSections(s))
+				g, err := FromSections(s, lo...)
+				require.NoError(t, err)
+				for k, v := range tc.data {
+					assert.Equal(t, v, g.Get(k))
+				}
+				assert.NoError(t, g.Verify())
+				if len(src.keys) > 0 {
+					keys, ok := s.Section(sectionKeys)
+					require.True(t, ok)
+					assert.Equal(t, zeroCopy, unsafe.Pointer(&keys.Data[0]) == unsafe.Pointer(&src.keys[0]))
+					assert.Equal(t, zeroCopy, unsafe.Pointer(&g.keys[0]) == unsafe.Pointer(&keys.Data[0]))
+				}
+			}
+		})
+	}
+}
+
+func TestRawSections_pairValues(t *testing.T) {
+	b := NewPairBuilder()
+	b.Seed(85)
+	for k, v := range randomData(500, 85) {
+		b.Add2(k, v, ^v)
+	}
+	c, err := b.Build()
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	s := c.RawSections()
+	assert.Equal(t, w.Bytes(), encodeSections(s))
+	g, err := FromSections(s)
+	require.NoError(t, err)
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		v1, v2, ok := g.Get2(it.Key())
+		assert.True(t, ok)
+		assert.Equal(t, v1, ^v2)
+	}
+}
+
+func TestFromSections_invalid(t *testing.T) {
+	c := MustFromMap(randomData(100, 86), WithSeed(86))
+	for name, tc := range map[string]struct {
+		change func(s *Sections)
+		err    string
+	}{
+		"version": {func(s *Sections) { s.Version = 9 }, "unsupported format version"},
+		"length":  {func(s *Sections) { s.Sections[0].Data = s.Sections[0].Data[1:] }, "bytes of data"},
+		"width":   {func(s *Sections) { s.Sections[2].Width = 4 }, "byte elements"},
+		"missing": {func(s *Sections) { s.Sections = s.Sections[1:] }, ""},
+		"unknown": {func(s *Sections) { s.Sections[0].Tag = 99 }, "unsupported section"},
+		"twice":   {func(s *Sections) { s.Sections[1] = s.Sections[0] }, "duplicate section"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := c.RawSections()
+			s.Sections = append([]SectionData(nil), s.Sections...)
+			tc.change(&s)
+			_, err := FromSections(s)
+			assert.ErrorIs(t, err, ErrNotCHD)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	idx, err := MmapWithOptions(encodeSections(c.RawSections()), SkipValues())
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, ErrNoValues, func() { idx.RawSections() })
+}
@@ -0,0 +1,390 @@
+package uint64mph
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// The most new hash functions RebuildWith tries for a bucket that doesn't fit
+// in the free slots, before building the table from scratch instead.
+const rebuildAttempts = 1000000
+
+// RebuildWith picks the hash function for a bucket that evicts the fewest keys
+// out of this many candidates.
+const evictionWindow = 64
+
+// RebuildWith returns a table with the entries of old, without the keys in
+// removed (whose values are ignored) and with the entries in added. Keys in
+// both end up with their value in added. old is left unchanged.
+//
+// If the number of keys stays the same, RebuildWith keeps the outer hash and
+// the buckets of old, and only solves the buckets whose keys changed, taking
+// their slots from buckets with fewer keys where needed. For small changes this
+// is much faster than a build from scratch, but it adds about one hash function
+// for every changed key, which repeated rebuilds accumulate.
+//
+// If the number of keys changes, old isn't hashed or has masked keys, or the
+// changed buckets can't be placed, the table is built from scratch instead,
+// with the options old was built with as far as it records them. Either way the
+// metadata of old is kept. Keys deleted from old with Delete are left out,
+// unless they're in added.
+func RebuildWith(old *CHD, added, removed map[uint64]uint64) (*CHD, error) {
+	if old != nil && old.closed {
+		return nil, ErrClosed
+	}
+	if old.IndexOnly() {
+		return nil, ErrNoValues
+	}
+	if old.PairValues() {
+		return nil, ErrPairValues
+	}
+	n := old.Len() - old.DeletedCount()
+	for k := range removed {
+		if _, ok := added[k]; !ok && old.Contains(k) {
+			n--
+		}
+	}
+	for k := range added {
+		if !old.Contains(k) {
+			n++
+		}
+	}
+	var c *CHD
+	// Masked tables are rebuilt from scratch, as the buckets hold masked keys
+	// while added and removed don't.
+	if old != nil && len(old.r) > 0 && old.mixBuckets && n == len(old.keys) && old.keyMask == nil && old.deleted == nil {
+		c = rebuildHashed(old, added, removed)
+	}
+	if c == nil {
+		var err error
+		if c, err = rebuildFromScratch(old, added, removed); err != nil {
+			return nil, err
+		}
+	}
+	if old != nil && old.metadata != nil {
+		c.metadata = append([]byte(nil), old.metadata...)
+	}
+	return c, nil
+}
+
+// rebuildFromScratch implements RebuildWith by building a new table.
+func rebuildFromScratch(old *CHD, added, removed map[uint64]uint64) (*CHD, error) {
+	b := Builder()
+	for it := old.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		if _, ok := removed[k]; ok {
+			continue
+		}
+		if _, ok := added[k]; ok {
+			continue
+		}
+		b.Add(k, v)
+	}
+	for k, v := range added {
+		b.Add(k, v)
+	}
+	var opts []BuildOption
+	if old != nil {
+		if old.r32 {
+			opts = append(opts, WithHashFunctions32())
+		}
+		if old.hasher != nil {
+			opts = append(opts, WithHasher(old.hasher))
+		}
+		if old.filter != nil {
+			opts = append(opts, WithFilter())
+		}
+		if old.valueWidth > 0 && old.dict == nil {
+			opts = append(opts, WithPackedValues())
+		}
+		if old.pthash != nil {
+			opts = append(opts, WithPTHash(old.pthash.params()))
+		}
+		if old.keyMask != nil {
+			opts = append(opts, MaskKeys(old.keyMask.secret))
+		}
+		if old.aggregates != nil {
+			opts = append(opts, WithValueStats())
+		}
+		if old.sorted != nil {
+			opts = append(opts, WithSortedIndex())
+		}
+	}
+	return b.Build(opts...)
+}
+
+// rebuildHashed implements RebuildWith for a hashed table whose number of keys
+// doesn't change. It returns nil if the changed buckets can't be placed.
+func rebuildHashed(old *CHD, added, removed map[uint64]uint64) *CHD {
+	n, m := uint64(len(old.keys)), uint64(len(old.indices))
+	rb := &rebuilder{
+		hasher: &chdHasher{
+			size:    n,
+			buckets: m,
+			r:       append([]uint64(nil), old.r...),
+			rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+			mask:    math.MaxUint64,
+		},
+		keys:    append([]uint64(nil), old.keys...),
+		values:  make([]uint64, n),
+		indices: append([]uint16(nil), old.indices...),
+		seen:    newSlotBitset(n),
+		start:   make([]int, m+1),
+		grouped: make([]uint64, n),
+		changed: map[uint64][]uint64{},
+	}
+	h := rb.hasher
+	h.keyHasher, h.uniformKeys = old.hasher, old.uniformKeys
+	if old.r32 {
+		h.mask = math.MaxUint32
+	}
+	for ti := range rb.keys {
+		rb.values[ti] = old.value(ti)
+		rb.seen.add(uint64(ti))
+	}
+
+	// Group the old keys by bucket.
+	for _, k := range rb.keys {
+		rb.start[h.HashIndexFromKey(k)+1]++
+	}
+	for i := range rb.indices {
+		rb.start[i+1] += rb.start[i]
+	}
+	next := append([]int(nil), rb.start[:m]...)
+	for _, k := range rb.keys {
+		bi := h.HashIndexFromKey(k)
+		rb.grouped[next[bi]] = k
+		next[bi]++
+	}
+
+	// Take the buckets whose keys change out of the table.
+	newKeys := map[uint64][]uint64{}
+	for k := range removed {
+		if _, ok := added[k]; !ok && old.Contains(k) {
+			newKeys[h.HashIndexFromKey(k)] = nil
+		}
+	}
+	for k, v := range added {
+		if ti, ok := old.Slot(k); ok {
+			rb.values[ti] = v
+		} else {
+			bi := h.HashIndexFromKey(k)
+			newKeys[bi] = append(newKeys[bi], k)
+		}
+	}
+	for bi, keys := range newKeys {
+		b := rb.evict(bi)
+		keep := 0
+		for i, k := range b.keys {
+			if _, ok := removed[k]; ok {
+				if _, ok := added[k]; !ok {
+					continue
+				}
+			}
+			b.keys[keep], b.values[keep] = k, b.values[i]
+			keep++
+		}
+		b.keys, b.values = b.keys[:keep], b.values[:keep]
+		for _, k := range keys {
+			b.keys = append(b.keys, k)
+			b.values = append(b.values, added[k])
+		}
+		rb.changed[bi] = b.keys
+		if len(b.keys) > 0 {
+			heap.Push(&rb.pending, b)
+		}
+	}
+
+	for rb.pending.Len() > 0 {
+		if !rb.place(heap.Pop(&rb.pending).(bucket)) {
+			return nil
+		}
+	}
+
+	h.r = compactHashFunctions(h.r, rb.indices)
+	c := &CHD{
+		r:          h.r,
+		indices:    rb.indices,
+		keys:       rb.keys,
+		values:     rb.values,
+		mixBuckets: true,
+		r32:        old.r32,
+	}
+	c.setHasher(old.hasher)
+	o := buildOptions{
+		packValues:          old.valueWidth > 0 && old.dict == nil,
+		dictionaryThreshold: defaultDictionaryThreshold,
+		dictionary:          old.dict != nil,
+		valueStats:          old.aggregates != nil,
+		sortedIndex:         old.sorted != nil,
+	}
+	if err := c.shrinkValues(o); err != nil {
+		return nil
+	}
+	if old.filter != nil {
+		f, err := newXorFilter(c.keys, h.rand)
+		if err != nil {
+			return nil
+		}
+		c.filter = f
+	}
+	return c
+}
+
+// rebuilder holds the state of rebuildHashed.
+type rebuilder struct {
+	hasher  *chdHasher
+	keys    []uint64
+	values  []uint64
+	indices []uint16
+	seen    slotBitset
+	// The keys of the old table by bucket: those of bucket i are
+	// grouped[start[i]:start[i+1]], unless the bucket is in changed.
+	start   []int
+	grouped []uint64
+	// The keys of the buckets whose keys changed.
+	changed map[uint64][]uint64
+	// The buckets waiting to be placed, and slots that were freed. Some of
+	// the slots may have been taken again since.
+	pending bucketHeap
+	free    []uint64
+	hashes  []uint64
+}
+
+// bucketKeys returns the keys of bucket bi.
+func (rb *rebuilder) bucketKeys(bi uint64) []uint64 {
+	if keys, ok := rb.changed[bi]; ok {
+		return keys
+	}
+	return rb.grouped[rb.start[bi]:rb.start[bi+1]]
+}
+
+// evict takes the keys of bucket bi out of the table, and returns them with
+// their values.
+func (rb *rebuilder) evict(bi uint64) bucket {
+	b := bucket{index: bi}
+	ri := rb.indices[bi]
+	if int(ri) >= len(rb.hasher.r) {
+		return b
+	}
+	for _, k := range rb.bucketKeys(bi) {
+		ti := rb.hasher.Table(rb.hasher.r[ri], k)
+		b.keys = append(b.keys, k)
+		b.values = append(b.values, rb.values[ti])
+		rb.seen[ti/64] &^= 1 << (ti % 64)
+		rb.free = append(rb.free, ti)
+	}
+	rb.indices[bi] = ^uint16(0)
+	return b
+}
+
+// place puts b in the table, evicting buckets with fewer keys if needed. It
+// returns false if it can't.
+func (rb *rebuilder) place(b bucket) bool {
+	h := rb.hasher
+	// Convert seen only once, rather than for every call of tryHash.
+	var seen slotSet = rb.seen
+	if len(rb.hashes) < len(b.keys) {
+		rb.hashes = make([]uint64, len(b.keys))
+	}
+	if len(b.keys) > 1 {
+		for ri, r := range h.r {
+			if tryHash(h, seen, rb.keys, rb.values, rb.indices, &b, uint16(ri), r, rb.hashes) {
+				return true
+			}
+		}
+	}
+	if h.Len() == math.MaxUint16 || unplaceable(h, b.keys, rb.hashes) {
+		return false
+	}
+	if len(b.keys) == 1 {
+		// Pick the hash function that puts the key in a free slot.
+		for len(rb.free) > 0 {
+			ti := rb.free[len(rb.free)-1]
+			if rb.seen.has(ti) {
+				rb.free = rb.free[:len(rb.free)-1]
+				continue
+			}
+			hk := h.hash(b.keys[0]) ^ h.r[0]
+			base := hk &^ h.mask
+			x := base + (ti+h.size-base%h.size)%h.size
+			if x < base || x&^h.mask != base {
+				break
+			}
+			r := hk ^ x
+			h.Add(r)
+			return tryHash(h, seen, rb.keys, rb.values, rb.indices, &b, h.Len()-1, r, rb.hashes)
+		}
+	}
+
+	// Try new hash functions, evicting buckets with fewer keys from the slots
+	// they pick. Of every evictionWindow candidates, take the one that evicts
+	// the fewest keys.
+	occupants := map[uint64]bool{}
+	var best uint64
+	bestEvicted := -1
+	for i := 0; i < rebuildAttempts; i++ {
+		_, r := h.Generate()
+		if evicted, ok := rb.occupants(b, r, occupants); ok && (bestEvicted < 0 || evicted < bestEvicted) {
+			best, bestEvicted = r, evicted
+		}
+		if bestEvicted == 0 || (bestEvicted > 0 && i%evictionWindow == evictionWindow-1) {
+			rb.occupants(b, best, occupants)
+			for bi := range occupants {
+				heap.Push(&rb.pending, rb.evict(bi))
+			}
+			h.Add(best)
+			return tryHash(h, seen, rb.keys, rb.values, rb.indices, &b, h.Len()-1, best, rb.hashes)
+		}
+	}
+	return false
+}
+
+// occupants fills occupants with the buckets in the slots hash function r
+// picks for the keys of b, and returns how many keys they have. It returns
+// false if r puts two keys of b in one slot, or if any of the buckets has at
+// least as many keys as b.
+func (rb *rebuilder) occupants(b bucket, r uint64, occupants map[uint64]bool) (int, bool) {
+	clear(occupants)
+	evicted := 0
+	for j, k := range b.keys {
+		ti := rb.hasher.Table(r, k)
+		rb.hashes[j] = ti
+		for _, o := range rb.hashes[:j] {
+			if o == ti {
+				return 0, false
+			}
+		}
+		if !rb.seen.has(ti) {
+			continue
+		}
+		bi := rb.hasher.HashIndexFromKey(rb.keys[ti])
+		if occupants[bi] {
+			continue
+		}
+		size := len(rb.bucketKeys(bi))
+		if size >= len(b.keys) {
+			return 0, false
+		}
+		occupants[bi] = true
+		evicted += size
+	}
+	return evicted, true
+}
+
+// bucketHeap is a heap of buckets with the most keys first.
+type bucketHeap []bucket
+
+func (b bucketHeap) Len() int           { return len(b) }
+func (b bucketHeap) Less(i, j int) bool { return len(b[i].keys) > len(b[j].keys) }
+func (b bucketHeap) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b *bucketHeap) Push(x any)        { *b = append(*b, x.(bucket)) }
+
+func (b *bucketHeap) Pop() any {
+	old := *b
+	x := old[len(old)-1]
+	*b = old[:len(old)-1]
+	return x
+}
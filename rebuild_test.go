@@ -0,0 +1,158 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomDelta returns data with count of its keys replaced by new ones and
+// count of the others updated, and the added and removed entries.
+func randomDelta(rng *rand.Rand, data map[uint64]uint64, count int) (want, added, removed map[uint64]uint64) {
+	want = make(map[uint64]uint64, len(data))
+	for k, v := range data {
+		want[k] = v
+	}
+	added, removed = map[uint64]uint64{}, map[uint64]uint64{}
+	for k, v := range data {
+		if len(removed) == count {
+			break
+		}
+		removed[k] = v
+		delete(want, k)
+	}
+	for len(added) < count {
+		k := rng.Uint64()
+		if _, ok := data[k]; !ok {
+			added[k] = rng.Uint64()
+			want[k] = added[k]
+		}
+	}
+	for k := range want {
+		if _, ok := added[k]; len(added) == 2*count || ok {
+			continue
+		}
+		added[k] = rng.Uint64()
+		want[k] = added[k]
+		if len(added) == 2*count {
+			break
+		}
+	}
+	return want, added, removed
+}
+
+func assertTable(t *testing.T, want map[uint64]uint64, c *CHD) {
+	t.Helper()
+	require.NoError(t, c.Verify())
+	assert.Equal(t, len(want), c.Len())
+	for k, v := range want {
+		got, ok := c.GetOK(k)
+		if !ok || got != v {
+			t.Fatalf("GetOK(%d) = %d, %v; want %d", k, got, ok, v)
+		}
+	}
+}
+
+func TestRebuildWith(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := map[uint64]uint64{}
+	for len(data) < 100000 {
+		data[rng.Uint64()] = rng.Uint64()
+	}
+	for _, tc := range []struct {
+		name string
+		opts []BuildOption
+	}{
+		{"default", nil},
+		{"r32", []BuildOption{WithHashFunctions32()}},
+		{"filter", []BuildOption{WithFilter()}},
+		{"packed", []BuildOption{WithPackedValues()}},
+		{"uniform", []BuildOption{AssumeUniformKeys()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			old, err := FromMap(data, tc.opts...)
+			require.NoError(t, err)
+			require.NoError(t, old.SetMetadata([]byte("meta")))
+			want, added, removed := randomDelta(rng, data, 100)
+			c, err := RebuildWith(old, added, removed)
+			require.NoError(t, err)
+			assertTable(t, want, c)
+			for k := range removed {
+				assert.False(t, c.Contains(k))
+			}
+			assert.Equal(t, old.r[0], c.r[0])
+			assert.Equal(t, old.r32, c.r32)
+			assert.Equal(t, old.filter != nil, c.filter != nil)
+			assert.Equal(t, []byte("meta"), c.Metadata())
+			// The buckets that didn't change keep their hash function.
+			used, kept := 0, 0
+			for i, ri := range old.indices {
+				if int(ri) < len(old.r) {
+					used++
+					if int(c.indices[i]) < len(c.r) && old.r[ri] == c.r[c.indices[i]] {
+						kept++
+					}
+				}
+			}
+			assert.Greater(t, kept, used*95/100)
+			assertTable(t, data, old)
+
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			l, err := Mmap(w.Bytes())
+			require.NoError(t, err)
+			assertTable(t, want, l)
+		})
+	}
+}
+
+func TestRebuildWith_fromScratch(t *testing.T) {
+	old := MustFromMap(sampleData)
+	want := map[uint64]uint64{}
+	for k, v := range sampleData {
+		want[k] = v
+	}
+	added := map[uint64]uint64{1: 2, 3: 4}
+	removed := map[uint64]uint64{3: 0, 5: 0}
+	want[1], want[3] = 2, 4
+	c, err := RebuildWith(old, added, removed)
+	require.NoError(t, err)
+	assertTable(t, want, c)
+
+	c, err = RebuildWith(nil, added, nil)
+	require.NoError(t, err)
+	assertTable(t, added, c)
+
+	c, err = RebuildWith(c, nil, added)
+	require.NoError(t, err)
+	assert.Equal(t, 0, c.Len())
+
+	require.NoError(t, old.Close())
+	_, err = RebuildWith(old, added, removed)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func BenchmarkRebuildWith(b *testing.B) {
+	for _, n := range benchSizes() {
+		d := getBenchDataset(b, n)
+		_, added, removed := randomDelta(rand.New(rand.NewSource(1)), d.builtin, n/1000)
+		b.Run(fmt.Sprintf("n=%d/rebuild", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := RebuildWith(d.table, added, removed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("n=%d/build", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := rebuildFromScratch(d.table, added, removed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Framing determines how records are delimited in a record file.
+type Framing struct {
+	delimited bool
+	delim     byte
+}
+
+// LengthPrefixed frames each record with its length as a uvarint.
+func LengthPrefixed() Framing {
+	return Framing{}
+}
+
+// Delimited terminates each record with delim. Records can't contain delim.
+func Delimited(delim byte) Framing {
+	return Framing{delimited: true, delim: delim}
+}
+
+// RecordWriter appends records to a record file and adds their offsets to a
+// builder. Build the builder once all records are written to get the index.
+type RecordWriter struct {
+	w       io.Writer
+	b       *CHDBuilder
+	framing Framing
+	off     uint64
+}
+
+// NewRecordWriter creates a RecordWriter that writes records to w, starting
+// at offset 0, and adds their offsets to b.
+func NewRecordWriter(w io.Writer, b *CHDBuilder, f Framing) *RecordWriter {
+	return &RecordWriter{w: w, b: b, framing: f}
+}
+
+// Append writes a record to the record file and adds its offset to the builder.
+func (w *RecordWriter) Append(key uint64, record []byte) error {
+	var buf []byte
+	if w.framing.delimited {
+		if bytes.IndexByte(record, w.framing.delim) != -1 {
+			return fmt.Errorf("record for key %d contains the delimiter %q", key, w.framing.delim)
+		}
+		buf = make([]byte, 0, len(record)+1)
+		buf = append(buf, record...)
+		buf = append(buf, w.framing.delim)
+	} else {
+		buf = make([]byte, 0, len(record)+binary.MaxVarintLen64)
+		buf = binary.AppendUvarint(buf, uint64(len(record)))
+		buf = append(buf, record...)
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return err
+	}
+	w.b.Add(key, w.off)
+	w.off += uint64(len(buf))
+	return nil
+}
+
+// Offset returns the number of bytes written so far.
+func (w *RecordWriter) Offset() uint64 {
+	return w.off
+}
+
+// RecordIndex uses a CHD as an index into a record file. The values in the
+// table are the offsets of the records in the file, as written by RecordWriter.
+type RecordIndex struct {
+	c       *CHD
+	r       io.ReaderAt
+	b       []byte
+	size    uint64
+	framing Framing
+}
+
+// NewRecordIndex creates a RecordIndex over a record file of size bytes.
+func NewRecordIndex(c *CHD, r io.ReaderAt, size int64, f Framing) *RecordIndex {
+	return &RecordIndex{c: c, r: r, size: uint64(size), framing: f}
+}
+
+// NewRecordIndexBytes creates a RecordIndex over a record file in memory
+// (typically mmapped). Records returned by Lookup alias b.
+func NewRecordIndexBytes(c *CHD, b []byte, f Framing) *RecordIndex {
+	return &RecordIndex{c: c, b: b, size: uint64(len(b)), framing: f}
+}
+
+// Lookup returns the record for key. It returns false if the key is not
+// present, and an error if the record file doesn't contain the record the
+// index points at.
+func (r *RecordIndex) Lookup(key uint64) ([]byte, bool, error) {
+	off, ok := r.c.GetOK(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if off >= r.size {
+		return nil, true, fmt.Errorf("record offset %d for key %d is past the end of the record file (%d bytes)", off, key, r.size)
+	}
+	if r.framing.delimited {
+		rec, err := r.readDelimited(off)
+		if err != nil {
+			return nil, true, fmt.Errorf("record for key %d at offset %d: %w", key, off, err)
+		}
+		return rec, true, nil
+	}
+	rec, err := r.readLengthPrefixed(off)
+	if err != nil {
+		return nil, true, fmt.Errorf("record for key %d at offset %d: %w", key, off, err)
+	}
+	return rec, true, nil
+}
+
+func (r *RecordIndex) readAt(off, n uint64) ([]byte, error) {
+	if n > r.size-off {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if r.b != nil {
+		return r.b[off : off+n : off+n], nil
+	}
+	buf := make([]byte, n)
+	// ReadAt may return io.EOF along with a full buffer at the end of r.
+	if m, err := r.r.ReadAt(buf, int64(off)); m < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *RecordIndex) readLengthPrefixed(off uint64) ([]byte, error) {
+	n := uint64(binary.MaxVarintLen64)
+	if n > r.size-off {
+		n = r.size - off
+	}
+	hdr, err := r.readAt(off, n)
+	if err != nil {
+		return nil, err
+	}
+	l, ln := binary.Uvarint(hdr)
+	if ln <= 0 {
+		return nil, fmt.Errorf("invalid length prefix")
+	}
+	return r.readAt(off+uint64(ln), l)
+}
+
+func (r *RecordIndex) readDelimited(off uint64) ([]byte, error) {
+	if r.b != nil {
+		i := bytes.IndexByte(r.b[off:], r.framing.delim)
+		if i == -1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return r.b[off : off+uint64(i) : off+uint64(i)], nil
+	}
+	var rec []byte
+	chunk := uint64(4096)
+	for {
+		n := chunk
+		if n > r.size-off {
+			n = r.size - off
+		}
+		if n == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf, err := r.readAt(off, n)
+		if err != nil {
+			return nil, err
+		}
+		if i := bytes.IndexByte(buf, r.framing.delim); i != -1 {
+			return append(rec, buf[:i]...), nil
+		}
+		rec = append(rec, buf...)
+		off += n
+	}
+}
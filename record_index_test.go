@@ -0,0 +1,104 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRecordFile(t *testing.T, f Framing, records map[uint64][]byte) (string, *CHD) {
+	path := filepath.Join(t.TempDir(), "records")
+	fh, err := os.Create(path)
+	require.NoError(t, err)
+	b := Builder()
+	w := NewRecordWriter(fh, b, f)
+	for k, rec := range records {
+		require.NoError(t, w.Append(k, rec))
+	}
+	require.NoError(t, fh.Close())
+	c, err := b.Build()
+	require.NoError(t, err)
+	return path, c
+}
+
+func TestRecordIndex(t *testing.T) {
+	records := map[uint64][]byte{}
+	for i := uint64(0); i < 1000; i++ {
+		records[i*7919] = []byte(fmt.Sprintf("record number %d", i))
+	}
+	records[5] = []byte{}
+	records[6] = make([]byte, 10000)
+
+	for name, f := range map[string]Framing{"length-prefixed": LengthPrefixed(), "delimited": Delimited('\n')} {
+		t.Run(name, func(t *testing.T) {
+			path, c := writeRecordFile(t, f, records)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			fh, err := os.Open(path)
+			require.NoError(t, err)
+			defer fh.Close()
+
+			for _, ri := range []*RecordIndex{
+				NewRecordIndex(c, fh, int64(len(data)), f),
+				NewRecordIndexBytes(c, data, f),
+				// Reads of the last record return io.EOF.
+				NewRecordIndex(c, eofReaderAt{bytes.NewReader(data)}, int64(len(data)), f),
+			} {
+				for k, want := range records {
+					got, ok, err := ri.Lookup(k)
+					assert.NoError(t, err)
+					assert.True(t, ok)
+					assert.Equal(t, string(want), string(got))
+				}
+				_, ok, err := ri.Lookup(1)
+				assert.NoError(t, err)
+				assert.False(t, ok)
+			}
+		})
+	}
+}
+
+func TestRecordIndex_corrupt(t *testing.T) {
+	records := map[uint64][]byte{1: []byte("hello"), 2: []byte("world")}
+	for name, f := range map[string]Framing{"length-prefixed": LengthPrefixed(), "delimited": Delimited(0)} {
+		t.Run(name, func(t *testing.T) {
+			path, c := writeRecordFile(t, f, records)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			// Offsets pointing past the end of the file.
+			bad := c.MapValues(func(key, old uint64) uint64 { return old + 100 })
+			_, ok, err := NewRecordIndexBytes(bad, data, f).Lookup(1)
+			assert.True(t, ok)
+			assert.ErrorContains(t, err, "past the end")
+
+			// Records cut off by truncation.
+			truncated := data[:len(data)-2]
+			last := uint64(1)
+			if c.Get(2) > c.Get(1) {
+				last = 2
+			}
+			fh, err := os.Open(path)
+			require.NoError(t, err)
+			defer fh.Close()
+			for _, ri := range []*RecordIndex{NewRecordIndexBytes(c, truncated, f), NewRecordIndex(c, fh, int64(len(truncated)), f)} {
+				_, ok, err = ri.Lookup(last)
+				assert.True(t, ok)
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestRecordWriter_delimiterInRecord(t *testing.T) {
+	b := Builder()
+	w := NewRecordWriter(io.Discard, b, Delimited('\n'))
+	assert.Error(t, w.Append(1, []byte("two\nlines")))
+	assert.Equal(t, uint64(0), w.Offset())
+}
@@ -0,0 +1,299 @@
+package uint64mph
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReloadableCHD serves the table in a file, and switches to a new table when
+// the file changes. Replace the file with WriteFile, or by renaming a new file
+// over it: mapped files must not be rewritten in place, see Revalidate.
+//
+// Lookups always see either the old or the new table. A replaced table is
+// closed once the last lookup using it is done, which costs every lookup an
+// atomic increment and decrement of a shared counter. A ReloadableCHD is safe
+// for concurrent use.
+type ReloadableCHD struct {
+	path string
+	o    reloadOptions
+	cur  atomic.Pointer[reloadedTable]
+
+	// Held while reloading.
+	mtx sync.Mutex
+	// The file the current table was loaded from.
+	loaded os.FileInfo
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// reloadedTable is a table loaded by ReloadableCHD, closed once it's replaced
+// and the last lookup using it is done.
+type reloadedTable struct {
+	c *CHD
+	// The number of lookups using c, plus one while it's current. Once it
+	// drops to zero, c is closed and it can't be acquired anymore.
+	refs atomic.Int64
+}
+
+func newReloadedTable(c *CHD) *reloadedTable {
+	t := &reloadedTable{c: c}
+	t.refs.Store(1)
+	return t
+}
+
+// acquire takes a reference to t, unless t was closed.
+func (t *reloadedTable) acquire() bool {
+	for {
+		n := t.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if t.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to t, closing it if it was the last one.
+func (t *reloadedTable) release() error {
+	if t.refs.Add(-1) == 0 {
+		return t.c.Close()
+	}
+	return nil
+}
+
+// A ReloadOption configures OpenReloadable.
+type ReloadOption func(*reloadOptions)
+
+type reloadOptions struct {
+	interval   time.Duration
+	maxBackoff time.Duration
+	load       []LoadOption
+	onReload   func(*CHD)
+	onError    func(error)
+}
+
+// WithPollInterval makes ReloadableCHD check the file for changes every
+// interval. Without it, the file is only checked when Reload is called.
+func WithPollInterval(interval time.Duration) ReloadOption {
+	return func(o *reloadOptions) {
+		o.interval = interval
+	}
+}
+
+// WithMaxBackoff limits how long polling backs off after failing to load the
+// file. Every consecutive failure doubles the wait, starting at the poll
+// interval. The default is a minute.
+func WithMaxBackoff(d time.Duration) ReloadOption {
+	return func(o *reloadOptions) {
+		o.maxBackoff = d
+	}
+}
+
+// WithReloadLoadOptions passes opts to OpenMmapFile for every load.
+func WithReloadLoadOptions(opts ...LoadOption) ReloadOption {
+	return func(o *reloadOptions) {
+		o.load = append(o.load, opts...)
+	}
+}
+
+// OnReload calls fn with the new table after every successful reload. fn must
+// not block for long, as reloads wait for it, and must not use the table after
+// returning: use Acquire for that.
+func OnReload(fn func(*CHD)) ReloadOption {
+	return func(o *reloadOptions) {
+		o.onReload = fn
+	}
+}
+
+// OnReloadError calls fn with the error of every failed reload. The previous
+// table keeps being served.
+func OnReloadError(fn func(error)) ReloadOption {
+	return func(o *reloadOptions) {
+		o.onError = fn
+	}
+}
+
+// OpenReloadable opens the table in the file at path with OpenMmapFile, and
+// starts polling it for changes if WithPollInterval is given. It fails if the
+// file can't be loaded now. Call Close to stop polling and close the table.
+func OpenReloadable(path string, opts ...ReloadOption) (*ReloadableCHD, error) {
+	o := reloadOptions{maxBackoff: time.Minute}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &ReloadableCHD{path: path, o: o}
+	c, fi, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.cur.Store(newReloadedTable(c))
+	r.loaded = fi
+	if o.interval > 0 {
+		r.stop, r.done = make(chan struct{}), make(chan struct{})
+		go r.poll()
+	}
+	return r, nil
+}
+
+// open loads the file, and returns the table and the file it was loaded from.
+func (r *ReloadableCHD) open() (*CHD, os.FileInfo, error) {
+	// Stat first, so that a file replaced while opening it is loaded again
+	// by the next check.
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := OpenMmapFile(r.path, r.o.load...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f, ok := c.closer.(interface{ fileInfo() os.FileInfo }); ok {
+		fi = f.fileInfo()
+	}
+	return c, fi, nil
+}
+
+func (r *ReloadableCHD) poll() {
+	defer close(r.done)
+	wait := r.o.interval
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(wait):
+		}
+		if err := r.Reload(); err != nil && !errors.Is(err, ErrClosed) {
+			wait = min(2*wait, max(r.o.maxBackoff, r.o.interval))
+		} else {
+			wait = r.o.interval
+		}
+	}
+}
+
+// Reload loads the file if it changed since it was last loaded, and switches to
+// its table. Call it when notified of a change to the file by other means than
+// polling. If loading fails, the error is returned and passed to the
+// OnReloadError callback, and the previous table stays.
+func (r *ReloadableCHD) Reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	fi, err := os.Stat(r.path)
+	if err == nil && !fileChanged(r.loaded, fi) {
+		return nil
+	}
+	c, fi, err := r.open()
+	if err != nil {
+		if r.o.onError != nil {
+			r.o.onError(err)
+		}
+		return err
+	}
+	old := r.cur.Swap(newReloadedTable(c))
+	r.loaded = fi
+	if r.o.onReload != nil {
+		r.o.onReload(c)
+	}
+	// Errors closing the old table don't affect the new one.
+	old.release()
+	return nil
+}
+
+// fileChanged reports whether the file now described by fi differs from the one
+// loaded, either because it was replaced or modified.
+func fileChanged(loaded, fi os.FileInfo) bool {
+	return !os.SameFile(loaded, fi) || !loaded.ModTime().Equal(fi.ModTime()) || loaded.Size() != fi.Size()
+}
+
+// acquire returns the current table, which must be released when done with
+// it, or nil after Close.
+func (r *ReloadableCHD) acquire() *reloadedTable {
+	for {
+		t := r.cur.Load()
+		if t == nil || t.acquire() {
+			return t
+		}
+		// t was replaced and closed since loading it.
+	}
+}
+
+// Acquire returns the current table, and a function to call when done with it.
+// The table isn't closed before that, even if it's replaced. After Close,
+// Acquire returns a nil table, which behaves as an empty one.
+func (r *ReloadableCHD) Acquire() (*CHD, func()) {
+	t := r.acquire()
+	if t == nil {
+		return nil, func() {}
+	}
+	return t.c, func() { t.release() }
+}
+
+// Get an entry from the current table. See CHD.Get.
+func (r *ReloadableCHD) Get(key uint64) uint64 {
+	v, ok := r.GetOK(key)
+	if !ok {
+		return math.MaxUint64
+	}
+	return v
+}
+
+// GetOK gets an entry from the current table. See CHD.GetOK.
+func (r *ReloadableCHD) GetOK(key uint64) (uint64, bool) {
+	t := r.acquire()
+	if t == nil {
+		return 0, false
+	}
+	v, ok := t.c.GetOK(key)
+	t.release()
+	return v, ok
+}
+
+// Len returns the number of entries in the current table.
+func (r *ReloadableCHD) Len() int {
+	c, release := r.Acquire()
+	defer release()
+	return c.Len()
+}
+
+// Info returns information about the file of the current table.
+func (r *ReloadableCHD) Info() Info {
+	c, release := r.Acquire()
+	defer release()
+	return c.Info()
+}
+
+// Metadata returns a copy of the metadata of the current table, see
+// SetMetadata.
+func (r *ReloadableCHD) Metadata() []byte {
+	c, release := r.Acquire()
+	defer release()
+	return append([]byte(nil), c.Metadata()...)
+}
+
+// Close stops polling and closes the current table once the lookups using it
+// are done. Lookups don't find any key afterwards. Closing an already closed
+// ReloadableCHD is a no-op.
+func (r *ReloadableCHD) Close() error {
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return nil
+	}
+	r.closed = true
+	err := r.cur.Swap(nil).release()
+	r.mtx.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		<-r.done
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package uint64mph
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeGeneration writes a table mapping the first 1000 words to gen to path.
+func writeGeneration(t *testing.T, path string, gen uint64) {
+	t.Helper()
+	b := Builder()
+	for _, w := range words[:1000] {
+		b.Add(w, gen)
+	}
+	c, err := b.Build()
+	require.NoError(t, err)
+	require.NoError(t, c.SetMetadata([]byte{byte(gen)}))
+	require.NoError(t, c.WriteFile(path))
+}
+
+func TestReloadableCHD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table")
+	writeGeneration(t, path, 1)
+	reloaded := make(chan *CHD, 10)
+	r, err := OpenReloadable(path, WithPollInterval(5*time.Millisecond), OnReload(func(c *CHD) { reloaded <- c }))
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, uint64(1), r.Get(words[0]))
+	assert.Equal(t, []byte{1}, r.Metadata())
+	assert.Equal(t, 1000, r.Len())
+
+	// Readers see one generation or the next, never anything else.
+	var stop atomic.Bool
+	var latest atomic.Uint64
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; !stop.Load(); i = (i + 1) % 1000 {
+				// Lookups starting after a reload see its generation.
+				oldest := latest.Load()
+				v, ok := r.GetOK(words[i])
+				if !assert.True(t, ok) || !assert.GreaterOrEqual(t, v, oldest) || !assert.LessOrEqual(t, v, uint64(4)) {
+					return
+				}
+			}
+		}(g)
+	}
+	for gen := uint64(2); gen <= 4; gen++ {
+		writeGeneration(t, path, gen)
+		select {
+		case c := <-reloaded:
+			assert.Equal(t, []byte{byte(gen)}, c.Metadata())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("generation %d wasn't loaded", gen)
+		}
+		latest.Store(gen)
+	}
+	stop.Store(true)
+	wg.Wait()
+	assert.Equal(t, uint64(4), r.Get(words[0]))
+	assert.Equal(t, []byte{4}, r.Metadata())
+}
+
+func TestReloadableCHD_errors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "table")
+	_, err := OpenReloadable(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	writeGeneration(t, path, 1)
+	var errs []error
+	reloads := 0
+	r, err := OpenReloadable(path, OnReloadError(func(err error) { errs = append(errs, err) }), OnReload(func(*CHD) { reloads++ }))
+	require.NoError(t, err)
+	first, release := r.Acquire()
+
+	// Nothing changed.
+	require.NoError(t, r.Reload())
+	assert.Equal(t, 0, reloads)
+
+	// A broken file is reported, and the previous table stays.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken"), []byte("garbage"), 0o644))
+	require.NoError(t, os.Rename(filepath.Join(dir, "broken"), path))
+	assert.ErrorIs(t, r.Reload(), ErrNotCHD)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrNotCHD)
+	assert.Equal(t, uint64(1), r.Get(words[0]))
+
+	writeGeneration(t, path, 2)
+	require.NoError(t, r.Reload())
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, uint64(2), r.Get(words[0]))
+	// The replaced table stays open until released.
+	assert.Equal(t, uint64(1), first.Get(words[0]))
+	release()
+	assert.True(t, first.closed)
+
+	second, release := r.Acquire()
+	require.NoError(t, r.Close())
+	assert.False(t, second.closed)
+	_, ok := r.GetOK(words[0])
+	assert.False(t, ok)
+	release()
+	assert.True(t, second.closed)
+	assert.ErrorIs(t, r.Reload(), ErrClosed)
+	assert.NoError(t, r.Close())
+}
+
+func TestReloadableCHD_backoff(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "table")
+	writeGeneration(t, path, 1)
+	var failures atomic.Int32
+	r, err := OpenReloadable(path, WithPollInterval(time.Millisecond), WithMaxBackoff(20*time.Millisecond), OnReloadError(func(error) { failures.Add(1) }))
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, os.Remove(path))
+	time.Sleep(100 * time.Millisecond)
+	// Polling every millisecond would have failed about 100 times.
+	assert.Greater(t, failures.Load(), int32(0))
+	assert.Less(t, failures.Load(), int32(20))
+	assert.Equal(t, uint64(1), r.Get(words[0]))
+}
@@ -0,0 +1,387 @@
+package uint64mph
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+)
+
+// RemoteCHD looks up keys in a table file that is read with ranged reads, like
+// an object in S3 or a file served over HTTP, without downloading it. Opening
+// it reads the header and the hash functions and indices (or what replaces
+// them), which are small compared to the keys and values. Every lookup then
+// reads one key and one value from the file.
+//
+// The reads can go through a small cache of blocks of the file, see
+// WithBlockCache. Small tables are read whole when opened. A RemoteCHD is safe
+// for concurrent use if its io.ReaderAt is.
+type RemoteCHD struct {
+	r    io.ReaderAt
+	size int64
+	o    remoteOptions
+	// The table without its keys and values, or the whole table if it's
+	// small.
+	c     *CHD
+	slots int
+	// Offset of the keys, if the table has them.
+	keysOffset int64
+	// The values section, with hasValues false for index-only files.
+	values    rawSection
+	hasValues bool
+	deltas    bool
+	cache     *blockCache
+}
+
+// A RemoteOption configures OpenRemote.
+type RemoteOption func(*remoteOptions)
+
+type remoteOptions struct {
+	load []LoadOption
+	// Ranges in a batch closer than this many bytes are read at once.
+	coalesceGap int64
+	blockSize   int64
+	blocks      int
+}
+
+// WithCoalesceGap makes GetBatch read the entries of a batch that are at most
+// gap bytes apart with a single read, including the bytes in between. Reads are
+// usually expensive enough for a few kilobytes of waste to pay off. The default
+// is 4096.
+func WithCoalesceGap(gap int64) RemoteOption {
+	return func(o *remoteOptions) {
+		o.coalesceGap = gap
+	}
+}
+
+// WithBlockCache makes RemoteCHD read whole blocks of blockSize bytes at a
+// time and keep the most recently used blocks in memory, so that lookups
+// of nearby or recently looked up entries don't need a read. By default
+// nothing is cached and every read fetches only the bytes it needs.
+func WithBlockCache(blockSize int64, blocks int) RemoteOption {
+	return func(o *remoteOptions) {
+		o.blockSize, o.blocks = blockSize, blocks
+	}
+}
+
+// WithRemoteLoadOptions passes opts to the loading of the structure, like
+// CopyStructure. SkipValues makes the table index-only.
+func WithRemoteLoadOptions(opts ...LoadOption) RemoteOption {
+	return func(o *remoteOptions) {
+		o.load = append(o.load, opts...)
+	}
+}
+
+// OpenRemote opens the table in the size bytes read from r. See RemoteCHD.
+func OpenRemote(r io.ReaderAt, size int64, opts ...RemoteOption) (*RemoteCHD, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+	o := remoteOptions{coalesceGap: 4096}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.blocks > 0 && o.blockSize <= 0 {
+		return nil, fmt.Errorf("uint64mph: invalid block size %d", o.blockSize)
+	}
+	rc := &RemoteCHD{r: r, size: size, o: o}
+	if o.blocks > 0 {
+		rc.cache = &blockCache{blocks: map[int64]*list.Element{}}
+	}
+	var magic [8]byte
+	if n, _ := r.ReadAt(magic[:], 0); isCompressed(magic[:n]) {
+		return nil, ErrCompressed
+	}
+	h, err := sniffHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h.size > size {
+		return nil, fmt.Errorf("%w: file is %d bytes, its sections need %d", ErrNotCHD, size, h.size)
+	}
+	if h.flags&FlagSmall != 0 {
+		if rc.c, err = ReadAt(io.NewSectionReader(r, 0, size), o.load...); err != nil {
+			return nil, err
+		}
+		return rc, nil
+	}
+
+	lo := loadOptions{}
+	for _, opt := range o.load {
+		opt(&lo)
+	}
+	var readErr error
+	data := func(tag uint32) []byte {
+		s, ok := h.section(tag)
+		if !ok || readErr != nil {
+			return nil
+		}
+		b := make([]byte, s.size())
+		readErr = readFullAt(r, b, s.offset, "section")
+		return b
+	}
+	rc.c, err = load(h, data, append(o.load[:len(o.load):len(o.load)], SkipValues(), func(o *loadOptions) { o.skipKeys = true }))
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	keys, _ := h.section(sectionKeys)
+	rc.keysOffset, rc.slots = keys.offset, keys.count
+	if rc.c.dense != nil {
+		rc.slots = rc.c.dense.span
+	}
+	if h.flags&FlagSplitStructure == 0 && !lo.skipValues {
+		rc.values, rc.hasValues = h.values()
+		if rc.values.count != rc.slots {
+			return nil, fmt.Errorf("%w: %d slots but %d values", ErrNotCHD, rc.slots, rc.values.count)
+		}
+		rc.deltas = rc.values.tag == sectionValueDeltas
+		if h.flags&FlagDictionary != 0 {
+			rc.c.dict = readUint64s(h, data, sectionDictionary)
+			if readErr != nil {
+				return nil, readErr
+			}
+		}
+	}
+	return rc, nil
+}
+
+// Table returns the loaded part of the table: its structure without keys or
+// values, or the whole table if it's small.
+func (rc *RemoteCHD) Table() *CHD {
+	return rc.c
+}
+
+// Lookup gets an entry from the table and reports whether it was present. It
+// only fails if reading fails. It returns ErrNoValues for index-only tables, and
+// ErrPairValues for tables with pair values.
+func (rc *RemoteCHD) Lookup(key uint64) (uint64, bool, error) {
+	var v [1]uint64
+	found, err := rc.GetBatch([]uint64{key}, v[:])
+	return v[0], found == 1, err
+}
+
+// Contains reports whether key is in the table, reading only its key.
+func (rc *RemoteCHD) Contains(key uint64) (bool, error) {
+	if rc.c.small {
+		return rc.c.Contains(key), nil
+	}
+	slots, err := rc.findSlots([]uint64{rc.c.maskKey(key)})
+	return slots[0] >= 0, err
+}
+
+// GetBatch looks up every key in keys like CHD.GetBatch, storing the values in
+// dst, which must be at least as long as keys. Missing keys get
+// math.MaxUint64. It returns the number of keys that were found.
+//
+// The keys of the batch are read together and then the values, merging reads
+// of nearby entries as configured by WithCoalesceGap, so a batch needs at most
+// two rounds of reads.
+func (rc *RemoteCHD) GetBatch(keys, dst []uint64) (int, error) {
+	_ = dst[:len(keys)]
+	if rc.c.PairValues() || rc.values.tag == sectionPairValues {
+		return 0, ErrPairValues
+	}
+	if !rc.hasValues && !rc.c.small {
+		return 0, ErrNoValues
+	}
+	if rc.c.small {
+		if rc.c.IndexOnly() {
+			return 0, ErrNoValues
+		}
+		return rc.c.GetBatch(keys, dst), nil
+	}
+	keys = rc.c.maskKeys(keys)
+	slots, err := rc.findSlots(keys)
+	if err != nil {
+		return 0, err
+	}
+	width := int64(rc.values.width)
+	found := 0
+	var ranges []byteRange
+	for i, ti := range slots {
+		dst[i] = math.MaxUint64
+		if ti >= 0 {
+			off := rc.values.offset + int64(ti)*width
+			ranges = append(ranges, byteRange{off, off + width, i})
+			found++
+		}
+	}
+	err = rc.readRanges(ranges, func(i int, b []byte) {
+		dst[i] = rc.decodeValue(keys[i], b)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return found, nil
+}
+
+// decodeValue decodes the value of key from its bytes in the values section.
+func (rc *RemoteCHD) decodeValue(key uint64, b []byte) uint64 {
+	var v uint64
+	switch len(b) {
+	case 1:
+		v = uint64(b[0])
+	case 2:
+		v = uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		v = uint64(binary.LittleEndian.Uint32(b))
+		if rc.deltas {
+			return key + uint64(int64(int32(v)))
+		}
+	default:
+		v = binary.LittleEndian.Uint64(b)
+	}
+	if rc.c.dict != nil {
+		return rc.c.dict[v]
+	}
+	return v
+}
+
+// findSlots returns the slot of every key in keys, or -1 for missing keys. The
+// keys must have been masked.
+func (rc *RemoteCHD) findSlots(keys []uint64) ([]int, error) {
+	slots := make([]int, len(keys))
+	var ranges []byteRange
+	for i, k := range keys {
+		ti, ok := rc.c.candidateSlot(k, rc.slots)
+		if !ok {
+			ti = -1
+		} else if rc.c.dense == nil {
+			off := rc.keysOffset + 8*int64(ti)
+			ranges = append(ranges, byteRange{off, off + 8, i})
+		}
+		slots[i] = ti
+	}
+	err := rc.readRanges(ranges, func(i int, b []byte) {
+		if binary.LittleEndian.Uint64(b) != keys[i] {
+			slots[i] = -1
+		}
+	})
+	return slots, err
+}
+
+// byteRange is the bytes [start, end) of the file needed by entry i of a
+// batch.
+type byteRange struct {
+	start, end int64
+	i          int
+}
+
+// readRanges reads the given ranges of the file, merging those less than the
+// coalesce gap apart, and calls fn with the bytes of every range.
+func (rc *RemoteCHD) readRanges(ranges []byteRange, fn func(i int, b []byte)) error {
+	slices.SortFunc(ranges, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	for i := 0; i < len(ranges); {
+		merged := ranges[i]
+		j := i + 1
+		for ; j < len(ranges) && ranges[j].start-merged.end <= rc.o.coalesceGap; j++ {
+			merged.end = max(merged.end, ranges[j].end)
+		}
+		b, err := rc.readAt(merged.start, merged.end)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges[i:j] {
+			fn(r.i, b[r.start-merged.start:r.end-merged.start])
+		}
+		i = j
+	}
+	return nil
+}
+
+// readAt returns the bytes [start, end) of the file, reading them through the
+// block cache if there is one.
+func (rc *RemoteCHD) readAt(start, end int64) ([]byte, error) {
+	if end > rc.size {
+		return nil, fmt.Errorf("%w: truncated while reading entry at offset %d", ErrNotCHD, start)
+	}
+	if rc.cache == nil {
+		b := make([]byte, end-start)
+		return b, readFullAt(rc.r, b, start, "entry")
+	}
+	bs := rc.o.blockSize
+	b := make([]byte, 0, end-start)
+	// The blocks read by this call, which may not all fit in the cache.
+	read := map[int64][]byte{}
+	for blk := start / bs; blk*bs < end; blk++ {
+		data, ok := read[blk]
+		if !ok {
+			data, ok = rc.cache.get(blk)
+		}
+		if !ok {
+			// Read the run of missing blocks at once.
+			n := int64(1)
+			for (blk+n)*bs < end && !rc.cache.has(blk+n) {
+				n++
+			}
+			from := blk * bs
+			run := make([]byte, min(n*bs, rc.size-from))
+			if err := readFullAt(rc.r, run, from, "entry"); err != nil {
+				return nil, err
+			}
+			for i := int64(0); i < n; i++ {
+				d := run[i*bs : min((i+1)*bs, int64(len(run)))]
+				read[blk+i] = d
+				rc.cache.put(blk+i, d, rc.o.blocks)
+			}
+			data = read[blk]
+		}
+		b = append(b, data[max(start-blk*bs, 0):min(end-blk*bs, int64(len(data)))]...)
+	}
+	return b, nil
+}
+
+// blockCache holds the most recently used blocks of a file.
+type blockCache struct {
+	mtx    sync.Mutex
+	blocks map[int64]*list.Element
+	// The cached blocks, most recently used first.
+	lru list.List
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func (c *blockCache) get(i int64) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.blocks[i]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) has(i int64) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, ok := c.blocks[i]
+	return ok
+}
+
+// put caches block i, evicting the least recently used blocks beyond max.
+func (c *blockCache) put(i int64, data []byte, max int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.blocks[i]; ok {
+		e.Value.(*cachedBlock).data = data
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.blocks[i] = c.lru.PushFront(&cachedBlock{i, data})
+	for c.lru.Len() > max {
+		delete(c.blocks, c.lru.Remove(c.lru.Back()).(*cachedBlock).index)
+	}
+}
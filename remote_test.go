@@ -0,0 +1,227 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// take returns the ranges read since the last call.
+func (r *recordingReaderAt) take() [][2]int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	reads := r.reads
+	r.reads = nil
+	return reads
+}
+
+func openRemote(t *testing.T, c *CHD, opts ...RemoteOption) (*RemoteCHD, *recordingReaderAt) {
+	t.Helper()
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	r := &recordingReaderAt{r: bytes.NewReader(w.Bytes())}
+	rc, err := OpenRemote(r, int64(w.Len()), opts...)
+	require.NoError(t, err)
+	r.take()
+	return rc, r
+}
+
+func TestRemoteCHD(t *testing.T) {
+	m := randomData(5000, 6)
+	for name, opts := range map[string][]BuildOption{
+		"chd":        nil,
+		"pthash":     {WithPTHash(7, 0.99)},
+		"filter":     {WithFilter()},
+		"packed":     {WithPackedValues()},
+		"dictionary": {WithPackedValues(), WithDictionaryThreshold(10)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if name == "dictionary" {
+				i := uint64(0)
+				for k := range m {
+					m[k] = i % 5
+					i++
+				}
+			}
+			c, err := FromMap(m, opts...)
+			require.NoError(t, err)
+			rc, r := openRemote(t, c)
+			l := c.Spec()
+			for k, v := range m {
+				got, ok, err := rc.Lookup(k)
+				require.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, v, got)
+				// One read of the key and one of the value.
+				reads := r.take()
+				require.Len(t, reads, 2)
+				assert.Equal(t, int64(8), reads[0][1]-reads[0][0])
+				assert.True(t, reads[0][0] >= l.Keys.Offset && reads[0][1] <= l.Keys.Offset+l.Keys.Size())
+				assert.Equal(t, int64(c.ValueWidth()), reads[1][1]-reads[1][0])
+				assert.True(t, reads[1][0] >= l.Values.Offset && reads[1][1] <= l.Values.Offset+l.Values.Size())
+			}
+			for k := range randomData(100, 7) {
+				_, ok, err := rc.Lookup(k)
+				require.NoError(t, err)
+				assert.False(t, ok)
+				// A missing key doesn't need its value read.
+				assert.LessOrEqual(t, len(r.take()), 1)
+			}
+		})
+	}
+}
+
+func TestRemoteCHD_dense(t *testing.T) {
+	b := Builder()
+	for i := uint64(0); i < 1000; i++ {
+		b.Add(1000+i, i)
+	}
+	c, err := b.Build(WithDenseThreshold(0.5))
+	require.NoError(t, err)
+	require.NotNil(t, c.dense)
+	rc, r := openRemote(t, c)
+	v, ok, err := rc.Lookup(1500)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(500), v)
+	// Dense tables have no keys to read.
+	assert.Len(t, r.take(), 1)
+	_, ok, err = rc.Lookup(5)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, r.take())
+}
+
+func TestRemoteCHD_small(t *testing.T) {
+	c, err := FromMap(sampleData)
+	require.NoError(t, err)
+	require.True(t, c.small)
+	rc, r := openRemote(t, c)
+	for k, v := range sampleData {
+		got, ok, err := rc.Lookup(k)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, v, got)
+	}
+	assert.Empty(t, r.take())
+}
+
+func TestRemoteCHD_batch(t *testing.T) {
+	m := randomData(2000, 8)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	var keys []uint64
+	for k := range m {
+		keys = append(keys, k)
+	}
+	keys = append(keys, 1, 2, keys[0])
+
+	want := make([]uint64, len(keys))
+	wantFound := c.GetBatch(keys, want)
+	for name, tc := range map[string]struct {
+		opts     []RemoteOption
+		maxReads int
+	}{
+		// All keys and all values are within the default gap of each other.
+		"coalesced": {nil, 2},
+		"separate":  {[]RemoteOption{WithCoalesceGap(-1)}, 2 * len(keys)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rc, r := openRemote(t, c, tc.opts...)
+			got := make([]uint64, len(keys))
+			found, err := rc.GetBatch(keys, got)
+			require.NoError(t, err)
+			assert.Equal(t, wantFound, found)
+			assert.Equal(t, want, got)
+			assert.Equal(t, uint64(math.MaxUint64), got[len(keys)-2])
+			reads := r.take()
+			assert.LessOrEqual(t, len(reads), tc.maxReads)
+			if name == "separate" {
+				assert.Greater(t, len(reads), len(keys))
+			}
+		})
+	}
+}
+
+func TestRemoteCHD_blockCache(t *testing.T) {
+	m := randomData(3000, 9)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	rc, r := openRemote(t, c, WithBlockCache(512, 4))
+	var k uint64
+	for k = range m {
+		break
+	}
+	v, ok, err := rc.Lookup(k)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, m[k], v)
+	reads := r.take()
+	require.Len(t, reads, 2)
+	for _, rd := range reads {
+		assert.Zero(t, rd[0]%512)
+		// The last block ends at the end of the file.
+		assert.Equal(t, min(512, c.Spec().Size-rd[0]), rd[1]-rd[0])
+	}
+	// The blocks are cached now.
+	_, _, err = rc.Lookup(k)
+	require.NoError(t, err)
+	assert.Empty(t, r.take())
+
+	// Lookups beyond the cache's capacity still work.
+	for k, v := range m {
+		got, ok, err := rc.Lookup(k)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, v, got)
+	}
+	assert.LessOrEqual(t, rc.cache.lru.Len(), 4)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, v := range m {
+				got, _, err := rc.Lookup(k)
+				if !assert.NoError(t, err) || !assert.Equal(t, v, got) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRemoteCHD_errors(t *testing.T) {
+	m := randomData(1000, 10)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	_, err = OpenRemote(nil, 0)
+	assert.ErrorIs(t, err, ErrNilReader)
+	_, err = OpenRemote(bytes.NewReader(w.Bytes()), int64(w.Len())-1)
+	assert.ErrorIs(t, err, ErrNotCHD)
+	_, err = OpenRemote(bytes.NewReader(w.Bytes()), int64(w.Len()), WithBlockCache(0, 4))
+	assert.Error(t, err)
+
+	rc, err := OpenRemote(bytes.NewReader(w.Bytes()), int64(w.Len()), WithRemoteLoadOptions(SkipValues()))
+	require.NoError(t, err)
+	for k := range m {
+		ok, err := rc.Contains(k)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		_, _, err = rc.Lookup(k)
+		assert.ErrorIs(t, err, ErrNoValues)
+		break
+	}
+	ok, err := rc.Contains(1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,340 @@
+package uint64mph
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ShardLocation is where the table of a shard is stored.
+type ShardLocation struct {
+	Path string
+	// Offset and Size select the table within a file holding several, like
+	// a container of concatenated tables. A Size of 0 selects the rest of the
+	// file. Tables stored at offsets that are a multiple of 8 can be aliased
+	// by the mapping.
+	Offset, Size int64
+}
+
+// ManifestName is the name of the manifest WriteDirectory writes.
+const ManifestName = "MANIFEST"
+
+// ReadShardManifest reads a manifest listing the location of every shard, as
+// written by WriteDirectory. Every line holds a shard id followed by its path,
+// and optionally the offset and size of the table within the file:
+//
+//	# id path [offset size]
+//	0 shard-00000.chd
+//	1 container.bin 0 4096
+//	2 container.bin 4096 8192
+//
+// Blank lines and lines starting with # are ignored. Ids must be 0 up to the
+// number of shards, in any order. Relative paths are relative to the directory
+// of the manifest.
+func ReadShardManifest(path string) ([]ShardLocation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(path)
+	byID := map[int]ShardLocation{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		loc, id, err := parseManifestLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if _, dup := byID[id]; dup {
+			return nil, fmt.Errorf("%s:%d: shard %d is listed twice", path, line, id)
+		}
+		if !filepath.IsAbs(loc.Path) {
+			loc.Path = filepath.Join(dir, loc.Path)
+		}
+		byID[id] = loc
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	shards := make([]ShardLocation, len(byID))
+	for id, loc := range byID {
+		if id >= len(shards) {
+			return nil, fmt.Errorf("%s: shard %d is listed, but only %d shards are", path, id, len(shards))
+		}
+		shards[id] = loc
+	}
+	return shards, nil
+}
+
+// parseManifestLine parses a line of a manifest, see ReadShardManifest.
+func parseManifestLine(text string) (ShardLocation, int, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 && len(fields) != 4 {
+		return ShardLocation{}, 0, fmt.Errorf("want \"id path [offset size]\", got %q", text)
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil || id < 0 {
+		return ShardLocation{}, 0, fmt.Errorf("invalid shard id %q", fields[0])
+	}
+	loc := ShardLocation{Path: fields[1]}
+	if len(fields) == 4 {
+		if loc.Offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil || loc.Offset < 0 {
+			return ShardLocation{}, 0, fmt.Errorf("invalid offset %q", fields[2])
+		}
+		if loc.Size, err = strconv.ParseInt(fields[3], 10, 64); err != nil || loc.Size < 0 {
+			return ShardLocation{}, 0, fmt.Errorf("invalid size %q", fields[3])
+		}
+	}
+	return loc, id, nil
+}
+
+// WriteDirectory writes every shard to a file in dir, which must exist, and a
+// manifest listing them named ManifestName, to be opened by
+// OpenShardDirectory.
+func (s *ShardedCHD) WriteDirectory(dir string, opts ...WriteOption) error {
+	var manifest strings.Builder
+	manifest.WriteString("# id path [offset size]\n")
+	for i, c := range s.shards {
+		name := fmt.Sprintf("shard-%05d.chd", i)
+		if err := c.WriteFile(filepath.Join(dir, name), opts...); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		fmt.Fprintf(&manifest, "%d %s\n", i, name)
+	}
+	f, err := os.CreateTemp(dir, ManifestName+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(manifest.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, ManifestName)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// ShardDirectory looks up keys in a table split into shards like ShardedCHD,
+// but opens the shards lazily with OpenMmapFile when a lookup first needs them,
+// and closes the least recently used ones when more than a given number are
+// open. This keeps the number of mappings in check for tables of thousands of
+// shards, of which only some are busy.
+//
+// The shards must be partitioned like ShardedBuilder does, for example
+// written by WriteDirectory. A ShardDirectory is safe for concurrent use. A
+// shard is only closed once the lookups using it are done, so the number of
+// open shards can briefly exceed the limit.
+type ShardDirectory struct {
+	shards  []directoryShard
+	maxOpen int
+	opts    []LoadOption
+
+	mtx sync.Mutex
+	// The open shards, most recently used first.
+	lru    list.List
+	stats  ShardDirectoryStats
+	closed bool
+}
+
+type directoryShard struct {
+	loc ShardLocation
+	// Held while opening the shard, so that concurrent lookups open it once.
+	openMtx sync.Mutex
+	// The open table, guarded by ShardDirectory.mtx.
+	open *openShard
+}
+
+// openShard is a shard's table, closed once it's evicted and the last lookup
+// using it is done.
+type openShard struct {
+	c *CHD
+	// The number of lookups using c, plus one while it's in the LRU list.
+	refs int
+	elem *list.Element
+}
+
+// ShardDirectoryStats counts what a ShardDirectory did, to help pick the limit
+// of open shards.
+type ShardDirectoryStats struct {
+	// Lookups that found their shard open.
+	Hits uint64
+	// Times a shard was opened.
+	Opens uint64
+	// Times a shard was closed to stay within the limit.
+	Evictions uint64
+	// Shards open right now, not counting evicted shards still in use.
+	Open int
+}
+
+// OpenShardDirectory reads the manifest at path, see ReadShardManifest, and
+// returns a ShardDirectory keeping at most maxOpen of its shards open. opts are
+// used to open every shard.
+func OpenShardDirectory(path string, maxOpen int, opts ...LoadOption) (*ShardDirectory, error) {
+	shards, err := ReadShardManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewShardDirectory(shards, maxOpen, opts...)
+}
+
+// NewShardDirectory returns a ShardDirectory over the given shards, indexed by
+// shard id, keeping at most maxOpen of them open. No shard is opened yet.
+func NewShardDirectory(shards []ShardLocation, maxOpen int, opts ...LoadOption) (*ShardDirectory, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("uint64mph: a shard directory needs at least one shard")
+	}
+	if maxOpen < 1 {
+		return nil, fmt.Errorf("uint64mph: invalid limit of %d open shards", maxOpen)
+	}
+	d := &ShardDirectory{shards: make([]directoryShard, len(shards)), maxOpen: maxOpen, opts: opts}
+	for i, loc := range shards {
+		d.shards[i].loc = loc
+	}
+	return d, nil
+}
+
+// Lookup gets an entry from the table and reports whether it was present,
+// opening its shard if needed. It only fails if the shard can't be opened, or
+// the directory was closed.
+func (d *ShardDirectory) Lookup(key uint64) (uint64, bool, error) {
+	s, err := d.acquire(shardFor(key, len(d.shards)))
+	if err != nil {
+		return 0, false, err
+	}
+	v, ok := s.c.GetOK(key)
+	d.release(s)
+	return v, ok, nil
+}
+
+// acquire returns shard id, opened if needed, for a lookup that must call
+// release when done with it.
+func (d *ShardDirectory) acquire(id int) (*openShard, error) {
+	if s, err := d.acquireOpen(id); s != nil || err != nil {
+		return s, err
+	}
+	sh := &d.shards[id]
+	sh.openMtx.Lock()
+	defer sh.openMtx.Unlock()
+	// Another lookup may have opened the shard while we waited.
+	if s, err := d.acquireOpen(id); s != nil || err != nil {
+		return s, err
+	}
+	c, err := openMmapFileRange(sh.loc.Path, sh.loc.Offset, sh.loc.Size, d.opts)
+	if err != nil {
+		return nil, fmt.Errorf("shard %d: %w", id, err)
+	}
+
+	s := &openShard{c: c, refs: 2}
+	var evicted []*openShard
+	d.mtx.Lock()
+	if d.closed {
+		d.mtx.Unlock()
+		c.Close()
+		return nil, ErrClosed
+	}
+	s.elem = d.lru.PushFront(id)
+	sh.open = s
+	d.stats.Opens++
+	for d.lru.Len() > d.maxOpen {
+		old := d.lru.Remove(d.lru.Back()).(int)
+		o := d.shards[old].open
+		d.shards[old].open = nil
+		d.stats.Evictions++
+		if o.refs--; o.refs == 0 {
+			evicted = append(evicted, o)
+		}
+	}
+	d.mtx.Unlock()
+	for _, o := range evicted {
+		o.c.Close()
+	}
+	return s, nil
+}
+
+// acquireOpen returns shard id if it's open, and nil otherwise.
+func (d *ShardDirectory) acquireOpen(id int) (*openShard, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	s := d.shards[id].open
+	if s == nil {
+		return nil, nil
+	}
+	s.refs++
+	d.lru.MoveToFront(s.elem)
+	d.stats.Hits++
+	return s, nil
+}
+
+// release releases a shard returned by acquire, closing it if it was evicted
+// in the meantime and this was the last lookup using it.
+func (d *ShardDirectory) release(s *openShard) {
+	d.mtx.Lock()
+	s.refs--
+	last := s.refs == 0
+	d.mtx.Unlock()
+	if last {
+		s.c.Close()
+	}
+}
+
+// Stats returns what the directory did so far.
+func (d *ShardDirectory) Stats() ShardDirectoryStats {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	st := d.stats
+	st.Open = d.lru.Len()
+	return st
+}
+
+// NumShards returns the number of shards.
+func (d *ShardDirectory) NumShards() int {
+	return len(d.shards)
+}
+
+// Close closes the open shards, or leaves that to the lookups still using
+// them. Lookups fail with ErrClosed afterwards. Closing an already closed
+// directory is a no-op.
+func (d *ShardDirectory) Close() error {
+	var unused []*openShard
+	d.mtx.Lock()
+	if d.closed {
+		d.mtx.Unlock()
+		return nil
+	}
+	d.closed = true
+	for e := d.lru.Front(); e != nil; e = e.Next() {
+		id := e.Value.(int)
+		s := d.shards[id].open
+		d.shards[id].open = nil
+		if s.refs--; s.refs == 0 {
+			unused = append(unused, s)
+		}
+	}
+	d.lru.Init()
+	d.mtx.Unlock()
+	var err error
+	for _, s := range unused {
+		err = errors.Join(err, s.c.Close())
+	}
+	return err
+}
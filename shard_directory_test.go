@@ -0,0 +1,162 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shardedWords builds the first n words into shards.
+func shardedWords(t *testing.T, n, shards int) *ShardedCHD {
+	t.Helper()
+	b := NewShardedBuilder(shards)
+	for i, w := range words[:n] {
+		b.Add(w, uint64(i))
+	}
+	s, err := b.Build()
+	require.NoError(t, err)
+	return s
+}
+
+func TestShardDirectory(t *testing.T) {
+	s := shardedWords(t, 5000, 8)
+	dir := t.TempDir()
+	require.NoError(t, s.WriteDirectory(dir))
+	d, err := OpenShardDirectory(filepath.Join(dir, ManifestName), 3)
+	require.NoError(t, err)
+	defer d.Close()
+	assert.Equal(t, 8, d.NumShards())
+	assert.Equal(t, ShardDirectoryStats{}, d.Stats())
+
+	for i, w := range words[:5000] {
+		v, ok, err := d.Lookup(w)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i), v)
+	}
+	_, ok, err := d.Lookup(5)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	st := d.Stats()
+	assert.Equal(t, 3, st.Open)
+	assert.Equal(t, uint64(5001), st.Hits+st.Opens)
+	assert.Equal(t, st.Opens-3, st.Evictions)
+	assert.GreaterOrEqual(t, st.Opens, uint64(8))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 5000; i += 8 {
+				v, ok, err := d.Lookup(words[i])
+				if !assert.NoError(t, err) || !assert.True(t, ok) || !assert.Equal(t, uint64(i), v) {
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, d.Stats().Open, 3)
+
+	require.NoError(t, d.Close())
+	_, _, err = d.Lookup(words[0])
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.NoError(t, d.Close())
+}
+
+func TestShardDirectory_inFlight(t *testing.T) {
+	s := shardedWords(t, 1000, 2)
+	dir := t.TempDir()
+	require.NoError(t, s.WriteDirectory(dir))
+	d, err := OpenShardDirectory(filepath.Join(dir, ManifestName), 1)
+	require.NoError(t, err)
+
+	first, err := d.acquire(0)
+	require.NoError(t, err)
+	// Opening the other shard evicts the first one, which stays usable until
+	// released.
+	second, err := d.acquire(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), d.Stats().Evictions)
+	assert.Equal(t, s.Shards()[0].Len(), first.c.Len())
+	d.release(first)
+	assert.True(t, first.c.closed)
+
+	// Closing the directory leaves the shard to the lookup using it.
+	require.NoError(t, d.Close())
+	assert.False(t, second.c.closed)
+	assert.Equal(t, s.Shards()[1].Len(), second.c.Len())
+	d.release(second)
+	assert.True(t, second.c.closed)
+}
+
+func TestShardDirectory_container(t *testing.T) {
+	s := shardedWords(t, 2000, 3)
+	dir := t.TempDir()
+	var container bytes.Buffer
+	var manifest bytes.Buffer
+	for i, c := range s.Shards() {
+		// Leave a gap that isn't a whole page.
+		container.Write(make([]byte, 24))
+		off := container.Len()
+		require.NoError(t, c.Write(&container))
+		fmt.Fprintf(&manifest, "%d container.bin %d %d\n", i, off, container.Len()-off)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "container.bin"), container.Bytes(), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "manifest"), manifest.Bytes(), 0o644))
+
+	d, err := OpenShardDirectory(filepath.Join(dir, "manifest"), 2)
+	require.NoError(t, err)
+	defer d.Close()
+	for i, w := range words[:2000] {
+		v, ok, err := d.Lookup(w)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i), v)
+	}
+
+	d, err = NewShardDirectory([]ShardLocation{{Path: filepath.Join(dir, "container.bin"), Offset: 24, Size: int64(container.Len())}}, 1)
+	require.NoError(t, err)
+	_, _, err = d.Lookup(1)
+	assert.ErrorIs(t, err, ErrNotCHD)
+	assert.ErrorContains(t, err, "shard 0")
+}
+
+func TestReadShardManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(s string) string {
+		p := filepath.Join(dir, "manifest")
+		require.NoError(t, os.WriteFile(p, []byte(s), 0o644))
+		return p
+	}
+	shards, err := ReadShardManifest(write("# comment\n\n1 b 8 16\n0 /abs/a\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []ShardLocation{{Path: "/abs/a"}, {Path: filepath.Join(dir, "b"), Offset: 8, Size: 16}}, shards)
+
+	for manifest, want := range map[string]string{
+		"0 a\n0 b\n":   "shard 0 is listed twice",
+		"0 a\n2 b\n":   "shard 2 is listed, but only 2 shards are",
+		"0 a 1\n":      "want \"id path [offset size]\"",
+		"x a\n":        "invalid shard id",
+		"-1 a\n":       "invalid shard id",
+		"0 a -1 2\n":   "invalid offset",
+		"0 a 0 big\n":  "invalid size",
+		"0 a\n1 b c\n": ":2: want",
+	} {
+		_, err := ReadShardManifest(write(manifest))
+		assert.ErrorContains(t, err, want, manifest)
+	}
+
+	_, err = NewShardDirectory(nil, 1)
+	assert.Error(t, err)
+	_, err = NewShardDirectory([]ShardLocation{{Path: "a"}}, 0)
+	assert.Error(t, err)
+}
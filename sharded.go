@@ -0,0 +1,139 @@
+package uint64mph
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// ShardedBuilder partitions entries over several builders by key, so that Add
+// can be called from many goroutines concurrently without contending on a
+// single lock, and Build can build the shards in parallel.
+//
+// Every key always routes to the same shard, so duplicate keys are still
+// detected by Build.
+type ShardedBuilder struct {
+	shards []builderShard
+}
+
+type builderShard struct {
+	mtx sync.Mutex
+	b   *CHDBuilder
+	// Pad to a cache line to avoid false sharing between shards.
+	_ [64]byte
+}
+
+// NewShardedBuilder creates a builder with the given number of shards.
+func NewShardedBuilder(shards int) *ShardedBuilder {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &ShardedBuilder{shards: make([]builderShard, shards)}
+	for i := range s.shards {
+		s.shards[i].b = Builder()
+	}
+	return s
+}
+
+// shardFor returns the shard for key. It uses the high bits of the hash, so it
+// is independent of the bucket assignment within a shard.
+func shardFor(key uint64, shards int) int {
+	hi, _ := bits.Mul64(Hash(key), uint64(shards))
+	return int(hi)
+}
+
+// Add a key and value to the hash table. Add is safe for concurrent use.
+func (s *ShardedBuilder) Add(key, value uint64) {
+	sh := &s.shards[shardFor(key, len(s.shards))]
+	sh.mtx.Lock()
+	sh.b.Add(key, value)
+	sh.mtx.Unlock()
+}
+
+// Build builds all shards in parallel, on up to GOMAXPROCS goroutines unless
+// limited by WithCPUFraction. Options are passed to the build of every shard,
+// so WithStats, which would be written by all of them at once, is rejected.
+//
+// Keys are partitioned by their hash and every shard is built on its own, so
+// the shards don't depend on the number of goroutines, nor on the order of
+// concurrent Adds: with WithSeed, building the same entries writes identical
+// shards. If OnDuplicate is used, resolve must not depend on the order of the
+// values for that to hold.
+func (s *ShardedBuilder) Build(opts ...BuildOption) (*ShardedCHD, error) {
+	return s.BuildContext(context.Background(), opts...)
+}
+
+// BuildContext is like Build, but gives up with ctx's error once ctx is done.
+func (s *ShardedBuilder) BuildContext(ctx context.Context, opts ...BuildOption) (*ShardedCHD, error) {
+	for i := range s.shards {
+		s.shards[i].mtx.Lock()
+		defer s.shards[i].mtx.Unlock()
+	}
+	o := buildOptions{cpuFraction: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.stats != nil {
+		return nil, errors.New("WithStats can't be used with a ShardedBuilder, whose shards are built concurrently")
+	}
+	workers, err := o.cpuWorkers()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := buildAll(ctx, len(s.shards), workers, func(ctx context.Context, i int) (*CHD, error) {
+		return s.shards[i].b.BuildContext(ctx, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ShardedCHD{shards: tables}, nil
+}
+
+// BuildMerged builds a single table containing the entries of all shards.
+func (s *ShardedBuilder) BuildMerged(opts ...BuildOption) (*CHD, error) {
+	b := Builder()
+	for i := range s.shards {
+		s.shards[i].mtx.Lock()
+		defer s.shards[i].mtx.Unlock()
+		e := &s.shards[i].b.entries
+		for c := range e.keys {
+			b.entries.addSlices(e.keys[c], e.values[c])
+		}
+	}
+	return b.Build(opts...)
+}
+
+// ShardedCHD is a hash table split into shards by ShardedBuilder.
+type ShardedCHD struct {
+	shards []*CHD
+}
+
+// Get an entry from the hash table. See CHD.Get.
+func (s *ShardedCHD) Get(key uint64) uint64 {
+	v, ok := s.GetOK(key)
+	if !ok {
+		return math.MaxUint64
+	}
+	return v
+}
+
+// GetOK gets an entry from the hash table. See CHD.GetOK.
+func (s *ShardedCHD) GetOK(key uint64) (uint64, bool) {
+	return s.shards[shardFor(key, len(s.shards))].GetOK(key)
+}
+
+// Len returns the number of entries in all shards.
+func (s *ShardedCHD) Len() int {
+	n := 0
+	for _, c := range s.shards {
+		n += c.Len()
+	}
+	return n
+}
+
+// Shards returns the tables of the individual shards.
+func (s *ShardedCHD) Shards() []*CHD {
+	return append([]*CHD(nil), s.shards...)
+}
@@ -0,0 +1,141 @@
+package uint64mph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedBuilder(t *testing.T) {
+	entries := words[:20000]
+	s := NewShardedBuilder(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < len(entries); i += 4 {
+				s.Add(entries[i], uint64(i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	plain := Builder()
+	for i, w := range entries {
+		plain.Add(w, uint64(i))
+	}
+	want, err := plain.Build()
+	require.NoError(t, err)
+
+	sharded, err := s.Build(WithSeed(1))
+	require.NoError(t, err)
+	merged, err := s.BuildMerged(WithSeed(1))
+	require.NoError(t, err)
+
+	assert.Equal(t, want.Len(), sharded.Len())
+	assert.Equal(t, want.Len(), merged.Len())
+	assert.Len(t, sharded.Shards(), 8)
+	for _, sh := range sharded.Shards() {
+		// Keys are spread over all shards.
+		assert.Greater(t, sh.Len(), len(entries)/16)
+	}
+	for i, w := range entries {
+		assert.Equal(t, want.Get(w), sharded.Get(w))
+		assert.Equal(t, uint64(i), merged.Get(w))
+	}
+	_, ok := sharded.GetOK(5)
+	assert.False(t, ok)
+}
+
+func TestShardedBuilder_duplicates(t *testing.T) {
+	s := NewShardedBuilder(16)
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Add(42, 1)
+		}()
+	}
+	wg.Wait()
+	_, err := s.Build()
+	assert.ErrorContains(t, err, "duplicate key 42")
+	_, err = s.BuildMerged()
+	assert.ErrorContains(t, err, "duplicate key 42")
+}
+
+func TestShardedBuilder_withStats(t *testing.T) {
+	s := NewShardedBuilder(4)
+	for _, w := range words[:1000] {
+		s.Add(w, w)
+	}
+	var st BuildStats
+	_, err := s.Build(WithStats(&st))
+	assert.ErrorContains(t, err, "WithStats can't be used")
+	assert.Zero(t, st)
+	// Building the merged table writes them once.
+	_, err = s.BuildMerged(WithStats(&st))
+	require.NoError(t, err)
+	assert.NotZero(t, st)
+}
+
+func TestShardedBuilder_deterministic(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(16))
+	entries := words[:20000]
+	var want []byte
+	for _, workers := range []int{1, 4, 16} {
+		// Add the entries in another order from as many goroutines.
+		s := NewShardedBuilder(16)
+		order := rand.New(rand.NewSource(int64(workers))).Perm(len(entries))
+		var wg sync.WaitGroup
+		for g := 0; g < workers; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for _, i := range order[g*len(order)/workers : (g+1)*len(order)/workers] {
+					s.Add(entries[i], uint64(i))
+				}
+			}(g)
+		}
+		wg.Wait()
+		sharded, err := s.Build(WithSeed(1), WithCPUFraction(float64(workers)/16))
+		require.NoError(t, err)
+		dir := t.TempDir()
+		require.NoError(t, sharded.WriteDirectory(dir))
+		var got []byte
+		for i := range sharded.Shards() {
+			b, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("shard-%05d.chd", i)))
+			require.NoError(t, err)
+			got = append(got, b...)
+		}
+		if want == nil {
+			want = got
+		}
+		assert.True(t, bytes.Equal(want, got), "%d workers", workers)
+
+		builders := make([]*CHDBuilder, len(s.shards))
+		for i := range s.shards {
+			builders[i] = s.shards[i].b
+			builders[i].Seed(1)
+		}
+		tables, err := BuildAll(context.Background(), builders, workers)
+		require.NoError(t, err)
+		got = nil
+		for _, c := range tables {
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			got = append(got, w.Bytes()...)
+		}
+		assert.True(t, bytes.Equal(want, got), "BuildAll with %d workers", workers)
+	}
+}
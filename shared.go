@@ -0,0 +1,23 @@
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSharedUnsupported is returned by CreateShared, OpenShared and
+// RemoveShared on platforms without POSIX shared memory that can be reached
+// without cgo. Only Linux supports it.
+var ErrSharedUnsupported = errors.New("uint64mph: shared memory isn't supported on this platform")
+
+// sharedName checks a shared memory segment name, which like for shm_open is
+// a single path component, optionally preceded by a slash, and returns it
+// without the slash.
+func sharedName(name string) (string, error) {
+	n := strings.TrimPrefix(name, "/")
+	if n == "" || n == "." || n == ".." || strings.ContainsAny(n, "/\x00") {
+		return "", fmt.Errorf("invalid shared memory name %q", name)
+	}
+	return n, nil
+}
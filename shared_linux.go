@@ -0,0 +1,63 @@
+//go:build linux
+
+package uint64mph
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// sharedDir is where glibc's shm_open creates segments, replaced by tests.
+var sharedDir = "/dev/shm"
+
+// sharedPath returns the path of the segment called name.
+func sharedPath(name string) (string, error) {
+	n, err := sharedName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sharedDir, n), nil
+}
+
+// CreateShared writes c to the POSIX shared memory segment called name, like
+// shm_open does, so that processes on this host can map it with OpenShared
+// without it ever touching disk. name is a single path component, optionally
+// starting with a slash.
+//
+// An existing segment is replaced like WriteFile replaces a file: processes
+// that opened the old one keep using it, and others never see a partial table.
+// The segment lives until RemoveShared removes it or the host reboots, and
+// counts against the size of /dev/shm.
+func CreateShared(name string, c *CHD, opts ...WriteOption) error {
+	path, err := sharedPath(name)
+	if err != nil {
+		return err
+	}
+	return c.WriteFile(path, opts...)
+}
+
+// OpenShared maps the shared memory segment called name, as written by
+// CreateShared, read-only and without copying, like OpenMmapFile. Call the
+// returned function to unmap it; the table must not be used afterwards.
+func OpenShared(name string, opts ...LoadOption) (*CHD, func() error, error) {
+	path, err := sharedPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := OpenMmapFile(path, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, c.Close, nil
+}
+
+// RemoveShared removes the shared memory segment called name, like
+// shm_unlink. Processes that have it open keep their mapping until they close
+// it.
+func RemoveShared(name string) error {
+	path, err := sharedPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
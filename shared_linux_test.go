@@ -0,0 +1,54 @@
+//go:build linux
+
+package uint64mph
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShared(t *testing.T) {
+	if fi, err := os.Stat(sharedDir); err != nil || !fi.IsDir() {
+		t.Skipf("%s isn't available", sharedDir)
+	}
+	name := fmt.Sprintf("/uint64mph-test-%d", os.Getpid())
+	t.Cleanup(func() { RemoveShared(name) })
+
+	m := randomData(500, 60)
+	require.NoError(t, CreateShared(name, MustFromMap(m, WithSeed(60))))
+	c, closeShared, err := OpenShared(name)
+	require.NoError(t, err)
+	for k, v := range m {
+		assert.Equal(t, v, c.Get(k))
+	}
+	if zeroCopy {
+		assert.NotZero(t, c.MemoryFootprint().Aliased)
+	}
+
+	// Replacing the segment leaves the open table alone.
+	require.NoError(t, CreateShared(name, MustFromMap(sampleData, WithSeed(61))))
+	assert.Equal(t, len(m), c.Len())
+	require.NoError(t, closeShared())
+	c, closeShared, err = OpenShared(name[1:])
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleData), c.Len())
+	require.NoError(t, closeShared())
+
+	require.NoError(t, RemoveShared(name))
+	_, _, err = OpenShared(name)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorIs(t, RemoveShared(name), os.ErrNotExist)
+}
+
+func TestShared_badName(t *testing.T) {
+	for _, name := range []string{"", "/", "a/b", "/..", ".", "a\x00"} {
+		assert.ErrorContains(t, CreateShared(name, MustFromMap(sampleData)), "invalid shared memory name", name)
+		_, _, err := OpenShared(name)
+		assert.ErrorContains(t, err, "invalid shared memory name", name)
+		assert.ErrorContains(t, RemoveShared(name), "invalid shared memory name", name)
+	}
+}
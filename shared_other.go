@@ -0,0 +1,18 @@
+//go:build !linux
+
+package uint64mph
+
+// CreateShared isn't supported on this platform, see ErrSharedUnsupported.
+func CreateShared(name string, c *CHD, opts ...WriteOption) error {
+	return ErrSharedUnsupported
+}
+
+// OpenShared isn't supported on this platform, see ErrSharedUnsupported.
+func OpenShared(name string, opts ...LoadOption) (*CHD, func() error, error) {
+	return nil, nil, ErrSharedUnsupported
+}
+
+// RemoveShared isn't supported on this platform, see ErrSharedUnsupported.
+func RemoveShared(name string) error {
+	return ErrSharedUnsupported
+}
@@ -0,0 +1,30 @@
+package uint64mph
+
+import "encoding/binary"
+
+// decodeUint64s decodes the little endian uint64s in b into a new slice.
+func decodeUint64s(b []byte) []uint64 {
+	out := make([]uint64, len(b)/8)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return out
+}
+
+// decodeUint32s decodes the little endian uint32s in b into a new slice.
+func decodeUint32s(b []byte) []uint32 {
+	out := make([]uint32, len(b)/4)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return out
+}
+
+// decodeUint16s decodes the little endian uint16s in b into a new slice.
+func decodeUint16s(b []byte) []uint16 {
+	out := make([]uint16, len(b)/2)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return out
+}
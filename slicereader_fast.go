@@ -1,19 +1,26 @@
-//go:build 386 || amd64 || arm || arm64
-// +build 386 amd64 arm arm64
+//go:build (386 || amd64 || arm || arm64 || loong64 || mips64le || mipsle || ppc64le || riscv64 || wasm) && !uint64mph_safereader
+// +build 386 amd64 arm arm64 loong64 mips64le mipsle ppc64le riscv64 wasm
+// +build !uint64mph_safereader
 
 package uint64mph
 
 import (
 	"encoding/binary"
+	"unsafe"
 
 	"github.com/alecthomas/unsafeslice"
 )
 
+// Whether Mmap returns tables aliasing the input rather than copies.
+const zeroCopy = true
+
 // Read values and typed vectors from a byte slice without copying where
 // possible. This implementation directly references the underlying byte slice
 // for array operations, making them essentially zero copy. As the data is
 // written in little endian form, this of course means that this will only
-// work on little-endian architectures.
+// work on little-endian architectures. Arrays that aren't aligned to their
+// element size in memory, like those of version 1 files, are copied instead:
+// Go requires typed slices to be aligned, and some ARM cores fault otherwise.
 type sliceReader struct {
 	b   []byte
 	pos uint64
@@ -29,15 +36,35 @@ func (b *sliceReader) ReadUint64Array(n uint64) []uint64 {
 	if n == 0 {
 		return []uint64{}
 	}
-	start := b.pos
-	b.pos += n * 8
-	return unsafeslice.Uint64SliceFromByteSlice(b.b[start:b.pos])
+	buf := b.read(n * 8)
+	if !aligned(buf, 8) {
+		return decodeUint64s(buf)
+	}
+	return unsafeslice.Uint64SliceFromByteSlice(buf)
 }
 
 func (b *sliceReader) ReadUint16Array(n uint64) []uint16 {
-	start := b.pos
-	b.pos += n * 2
-	return unsafeslice.Uint16SliceFromByteSlice(b.b[start:b.pos])
+	buf := b.read(n * 2)
+	if n != 0 && !aligned(buf, 2) {
+		return decodeUint16s(buf)
+	}
+	return unsafeslice.Uint16SliceFromByteSlice(buf)
+}
+
+func (b *sliceReader) ReadUint32Array(n uint64) []uint32 {
+	if n == 0 {
+		return []uint32{}
+	}
+	buf := b.read(n * 4)
+	if !aligned(buf, 4) {
+		return decodeUint32s(buf)
+	}
+	return unsafeslice.Uint32SliceFromByteSlice(buf)
+}
+
+// aligned reports whether b starts at a multiple of size in memory.
+func aligned(b []byte, size uintptr) bool {
+	return uintptr(unsafe.Pointer(unsafe.SliceData(b)))%size == 0
 }
 
 // Despite returning a uint64, this actually reads a uint32. All table indices
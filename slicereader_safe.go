@@ -1,5 +1,5 @@
-//go:build !386 && !amd64 && !arm && !arm64
-// +build !386,!amd64,!arm,!arm64
+//go:build (!386 && !amd64 && !arm && !arm64 && !loong64 && !mips64le && !mipsle && !ppc64le && !riscv64 && !wasm) || uint64mph_safereader
+// +build !386,!amd64,!arm,!arm64,!loong64,!mips64le,!mipsle,!ppc64le,!riscv64,!wasm uint64mph_safereader
 
 package uint64mph
 
@@ -7,7 +7,12 @@ import (
 	"encoding/binary"
 )
 
-// Read values and typed vectors from a byte slice without copying where possible.
+// Whether Mmap returns tables aliasing the input rather than copies.
+const zeroCopy = false
+
+// Read values and typed vectors from a byte slice by copying them. This
+// implementation is used on platforms that aren't known to be little-endian,
+// and everywhere when building with the uint64mph_safereader tag.
 type sliceReader struct {
 	b   []byte
 	pos uint64
@@ -20,21 +25,15 @@ func (b *sliceReader) read(size uint64) []byte {
 }
 
 func (b *sliceReader) ReadUint64Array(n uint64) []uint64 {
-	buf := b.read(n * 8)
-	out := make([]uint64, n)
-	for i := 0; i < len(buf); i += 8 {
-		out[i>>3] = binary.LittleEndian.Uint64(buf[i : i+8])
-	}
-	return out
+	return decodeUint64s(b.read(n * 8))
 }
 
 func (b *sliceReader) ReadUint16Array(n uint64) []uint16 {
-	buf := b.read(n * 2)
-	out := make([]uint16, n)
-	for i := 0; i < len(buf); i += 2 {
-		out[i>>1] = binary.LittleEndian.Uint16(buf[i : i+2])
-	}
-	return out
+	return decodeUint16s(b.read(n * 2))
+}
+
+func (b *sliceReader) ReadUint32Array(n uint64) []uint32 {
+	return decodeUint32s(b.read(n * 4))
 }
 
 func (b *sliceReader) ReadInt() uint64 {
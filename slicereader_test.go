@@ -0,0 +1,152 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// alignedBuffer returns n bytes starting at offset off of an 8-byte aligned
+// allocation.
+func alignedBuffer(n, off int) []byte {
+	words := make([]uint64, (n+off+7)/8)
+	return unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), 8*len(words))[off : off+n]
+}
+
+func TestSliceReader(t *testing.T) {
+	want := []uint64{1, 1 << 40, 0xfedcba9876543210, 0}
+	for off := 0; off < 8; off++ {
+		b := alignedBuffer(8*len(want)+2, off)
+		for i, v := range want {
+			for j := 0; j < 8; j++ {
+				b[8*i+j] = byte(v >> (8 * j))
+			}
+		}
+		r := &sliceReader{b: b}
+		got64 := r.ReadUint64Array(uint64(len(want)))
+		assert.Equal(t, want, got64, "offset %d", off)
+		assert.Zero(t, uintptr(unsafe.Pointer(&got64[0]))%8, "offset %d", off)
+		assert.Equal(t, zeroCopy && off == 0, unsafe.Pointer(&got64[0]) == unsafe.Pointer(&b[0]), "offset %d", off)
+
+		r = &sliceReader{b: b}
+		got32 := r.ReadUint32Array(2)
+		assert.Equal(t, []uint32{1, 0}, got32, "offset %d", off)
+		assert.Zero(t, uintptr(unsafe.Pointer(&got32[0]))%4, "offset %d", off)
+		got16 := r.ReadUint16Array(3)
+		assert.Equal(t, []uint16{0, 0, 0x100}, got16, "offset %d", off)
+		assert.Zero(t, uintptr(unsafe.Pointer(&got16[0]))%2, "offset %d", off)
+		assert.Equal(t, uint64(0x32100000), r.ReadInt())
+
+		assert.Empty(t, (&sliceReader{b: b}).ReadUint64Array(0))
+		assert.Empty(t, (&sliceReader{b: b}).ReadUint32Array(0))
+		assert.Empty(t, (&sliceReader{b: b}).ReadUint16Array(0))
+	}
+}
+
+// TestSliceReader_conformance checks that the compiled sliceReader loads every
+// kind of table identically to how it was built, whether or not the file is
+// aligned in memory. Run it with -tags uint64mph_safereader to check the
+// copying reader on platforms that use the aliasing one.
+func TestSliceReader_conformance(t *testing.T) {
+	m := randomData(3000, 11)
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i++ {
+		dense[5000+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":        {m, nil},
+		"32 bit":     {m, []BuildOption{WithHashFunctions32()}},
+		"filter":     {m, []BuildOption{WithFilter()}},
+		"packed":     {byteValues(), []BuildOption{WithPackedValues()}},
+		"dictionary": {m, []BuildOption{WithPackedValues(), WithDictionaryThreshold(1 << 20)}},
+		"pthash":     {m, []BuildOption{WithPTHash(7, 0.99)}},
+		"dense":      {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"small":      {sampleData, nil},
+		"uniform":    {m, []BuildOption{AssumeUniformKeys()}},
+		"outer seed": {m, []BuildOption{WithOuterSeed(3)}},
+		"seeded":     {m, []BuildOption{WithSeed(4)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, tc.opts...)
+			require.NoError(t, err)
+			require.NoError(t, c.SetMetadata([]byte("metadata")))
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			for off := 0; off < 8; off += 4 {
+				b := alignedBuffer(w.Len(), off)
+				copy(b, w.Bytes())
+				l, err := Mmap(b)
+				require.NoError(t, err)
+				assertSameTable(t, c, l)
+				if len(l.keys) > 0 {
+					// Aligned files are aliased where the reader can.
+					assert.Equal(t, zeroCopy && off == 0, l.aliases(unsafe.Pointer(&l.keys[0])))
+				}
+				for k, v := range tc.data {
+					assert.Equal(t, v, l.Get(k))
+				}
+			}
+		})
+	}
+
+	// Version 1 files only align their arrays to 4 bytes.
+	for _, gc := range golden.Cases() {
+		t.Run("v1/"+gc.Name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata/golden/v1", gc.Name))
+			require.NoError(t, err)
+			var tables []*CHD
+			for off := 0; off < 8; off += 4 {
+				b := alignedBuffer(len(data), off)
+				copy(b, data)
+				l, err := Mmap(b)
+				require.NoError(t, err)
+				for i, k := range gc.Keys {
+					assert.Equal(t, gc.Values[i], l.Get(k))
+				}
+				tables = append(tables, l)
+			}
+			assertSameTable(t, tables[0], tables[1])
+		})
+	}
+}
+
+// assertSameTable asserts that got has the same contents as want.
+func assertSameTable(t *testing.T, want, got *CHD) {
+	t.Helper()
+	assertSameSlice(t, want.r, got.r)
+	assertSameSlice(t, want.indices, got.indices)
+	assertSameSlice(t, want.keys, got.keys)
+	assert.Equal(t, want.numValues(), got.numValues())
+	for i := 0; i < want.numValues(); i++ {
+		if _, ok := want.slotKey(i); ok {
+			assert.Equal(t, want.value(i), got.value(i), "slot %d", i)
+		}
+	}
+	assertSameSlice(t, want.dict, got.dict)
+	assert.Equal(t, want.metadata, got.metadata)
+	assert.Equal(t, want.filter, got.filter)
+	assert.Equal(t, want.dense, got.dense)
+	assert.Equal(t, want.pthash, got.pthash)
+	for _, s := range [][]uint64{got.r, got.keys, got.values, got.dict} {
+		if len(s) > 0 {
+			assert.Zero(t, uintptr(unsafe.Pointer(&s[0]))%8)
+		}
+	}
+}
+
+// assertSameSlice is like assert.Equal, but doesn't distinguish nil from empty.
+func assertSameSlice[T any](t *testing.T, want, got []T) {
+	t.Helper()
+	if len(want) != 0 || len(got) != 0 {
+		assert.Equal(t, want, got)
+	}
+}
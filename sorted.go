@@ -0,0 +1,187 @@
+package uint64mph
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ErrNoSortedIndex is returned by Range, Floor and Ceiling for tables built
+// without WithSortedIndex.
+var ErrNoSortedIndex = errors.New("uint64mph: table has no sorted index")
+
+// WithSortedIndex makes Build store the slots of the keys sorted by key, so
+// that Range, Floor and Ceiling can binary search them. It costs 4 bytes per
+// key. The index is written along with the table, in the structure file for
+// WriteSplit. Tables derived from the table by MapValues and RebuildWith keep
+// it.
+func WithSortedIndex() BuildOption {
+	return func(o *buildOptions) {
+		o.sortedIndex = true
+	}
+}
+
+// sortKeys returns the slots of the keys of the table, sorted by key. Slots
+// fit in 32 bits, as sections hold at most math.MaxInt32 elements.
+func (c *CHD) sortKeys() []uint32 {
+	type entry struct {
+		key  uint64
+		slot int
+	}
+	entries := make([]entry, 0, c.Len())
+	for i, n := 0, c.numSlots(); i < n; i++ {
+		if k, ok := c.slotKey(i); ok {
+			entries = append(entries, entry{c.unmaskKey(k), i})
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		switch {
+		case a.key < b.key:
+			return -1
+		case a.key > b.key:
+			return 1
+		}
+		return 0
+	})
+	sorted := make([]uint32, len(entries))
+	for i, e := range entries {
+		sorted[i] = uint32(e.slot)
+	}
+	return sorted
+}
+
+// sortedKey returns the i-th smallest key.
+func (c *CHD) sortedKey(i int) uint64 {
+	k, _ := c.slotKey(int(c.sorted[i]))
+	return c.unmaskKey(k)
+}
+
+// search returns the position of the smallest key that is at least key in the
+// sorted index, or its length if there is none.
+func (c *CHD) search(key uint64) int {
+	return sort.Search(len(c.sorted), func(i int) bool { return c.sortedKey(i) >= key })
+}
+
+// checkSorted returns ErrNoSortedIndex if the table has no sorted index.
+func (c *CHD) checkSorted() error {
+	if c == nil {
+		return ErrNilTable
+	}
+	c.checkClosed()
+	if c.sorted == nil {
+		return ErrNoSortedIndex
+	}
+	return nil
+}
+
+// Range returns an iterator over the entries with keys from lo up to but not
+// including hi, in ascending order of key. It has the signature of an
+// iter.Seq2[uint64, uint64], so it can be ranged over. Finding the first entry
+// takes O(log n) time, every next entry O(1).
+//
+// Range returns ErrNoSortedIndex for tables built without WithSortedIndex,
+// ErrNoValues for index-only tables and ErrPairValues for tables with pair
+// values.
+func (c *CHD) Range(lo, hi uint64) (func(yield func(key, value uint64) bool), error) {
+	if err := c.checkSorted(); err != nil {
+		return nil, err
+	}
+	if c.pairValues != nil {
+		return nil, ErrPairValues
+	}
+	if c.IndexOnly() {
+		return nil, ErrNoValues
+	}
+	return func(yield func(key, value uint64) bool) {
+		for i, n := c.search(lo), len(c.sorted); i < n; i++ {
+			k := c.sortedKey(i)
+			if k >= hi {
+				return
+			}
+			if ti := int(c.sorted[i]); !c.isDeleted(ti) && !yield(k, c.value(ti)) {
+				return
+			}
+		}
+	}, nil
+}
+
+// Floor returns the largest key in the table that is at most key, or
+// ErrKeyNotFound if there is none. It returns ErrNoSortedIndex for tables
+// built without WithSortedIndex.
+func (c *CHD) Floor(key uint64) (uint64, error) {
+	if err := c.checkSorted(); err != nil {
+		return 0, err
+	}
+	i := c.search(key)
+	if i < len(c.sorted) && c.sortedKey(i) == key && !c.isDeleted(int(c.sorted[i])) {
+		return key, nil
+	}
+	for i--; i >= 0; i-- {
+		if !c.isDeleted(int(c.sorted[i])) {
+			return c.sortedKey(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no key at most %d", ErrKeyNotFound, key)
+}
+
+// Ceiling returns the smallest key in the table that is at least key, or
+// ErrKeyNotFound if there is none. It returns ErrNoSortedIndex for tables
+// built without WithSortedIndex.
+func (c *CHD) Ceiling(key uint64) (uint64, error) {
+	if err := c.checkSorted(); err != nil {
+		return 0, err
+	}
+	for i, n := c.search(key), len(c.sorted); i < n; i++ {
+		if !c.isDeleted(int(c.sorted[i])) {
+			return c.sortedKey(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no key at least %d", ErrKeyNotFound, key)
+}
+
+// verifySorted checks that the sorted index holds every key once, in order.
+func (c *CHD) verifySorted() error {
+	if len(c.sorted) != c.Len() {
+		return fmt.Errorf("sorted index has %d keys, the table %d", len(c.sorted), c.Len())
+	}
+	for i, n := 0, len(c.sorted); i < n; i++ {
+		ti := int(c.sorted[i])
+		if ti < 0 || ti >= c.numSlots() {
+			return fmt.Errorf("sorted index position %d holds slot %d of %d", i, ti, c.numSlots())
+		}
+		if _, ok := c.slotKey(ti); !ok {
+			return fmt.Errorf("sorted index position %d holds empty slot %d", i, ti)
+		}
+		if i > 0 && c.sortedKey(i-1) >= c.sortedKey(i) {
+			return fmt.Errorf("sorted index isn't sorted at position %d", i)
+		}
+	}
+	return nil
+}
+
+// sortedIndex writes the sorted index section.
+func (e *encoder) sortedIndex(sorted []uint32) {
+	e.section(sectionSortedIndex, 4, len(sorted))
+	for _, ti := range sorted {
+		e.uint32(ti)
+	}
+	e.pad()
+}
+
+// loadSorted loads the sorted index section, if the file has one. The
+// structure must have been loaded.
+func (c *CHD) loadSorted(h header, data func(tag uint32) []byte) error {
+	if h.flags&FlagSortedIndex == 0 {
+		return nil
+	}
+	s, _ := h.section(sectionSortedIndex)
+	if s.count != c.Len() {
+		return fmt.Errorf("%w: sorted index of %d keys for %d keys", ErrNotCHD, s.count, c.Len())
+	}
+	c.sorted = (&sliceReader{b: data(sectionSortedIndex)}).ReadUint32Array(uint64(s.count))
+	if c.sorted == nil {
+		c.sorted = []uint32{}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertRanges checks Range, Floor and Ceiling of c against the entries in m.
+func assertRanges(t *testing.T, m map[uint64]uint64, c *CHD) {
+	t.Helper()
+	keys := make([]uint64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	all, err := c.Range(0, math.MaxUint64)
+	require.NoError(t, err)
+	var got []uint64
+	all(func(k, v uint64) bool {
+		assert.Equal(t, m[k], v, "key %d", k)
+		got = append(got, k)
+		return true
+	})
+	assert.Equal(t, keys, got)
+
+	for i := 0; i+3 < len(keys); i += len(keys)/7 + 1 {
+		seq, err := c.Range(keys[i], keys[i+3])
+		require.NoError(t, err)
+		got = got[:0]
+		seq(func(k, v uint64) bool {
+			got = append(got, k)
+			return true
+		})
+		assert.Equal(t, keys[i:i+3], got)
+
+		k, err := c.Floor(keys[i+1] - 1)
+		require.NoError(t, err)
+		assert.Equal(t, keys[i], k)
+		k, err = c.Floor(keys[i+1])
+		require.NoError(t, err)
+		assert.Equal(t, keys[i+1], k)
+		k, err = c.Ceiling(keys[i] + 1)
+		require.NoError(t, err)
+		assert.Equal(t, keys[i+1], k)
+		k, err = c.Ceiling(keys[i])
+		require.NoError(t, err)
+		assert.Equal(t, keys[i], k)
+	}
+
+	if keys[0] > 0 {
+		_, err = c.Floor(keys[0] - 1)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+	if keys[len(keys)-1] < math.MaxUint64 {
+		_, err = c.Ceiling(keys[len(keys)-1] + 1)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	}
+}
+
+func TestWithSortedIndex(t *testing.T) {
+	dense := map[uint64]uint64{}
+	for i := uint64(0); i < 1000; i += 1 + i%3/2 {
+		dense[500+i] = i
+	}
+	for name, tc := range map[string]struct {
+		data map[uint64]uint64
+		opts []BuildOption
+	}{
+		"chd":    {randomData(1000, 33), nil},
+		"small":  {sampleData, nil},
+		"dense":  {dense, []BuildOption{WithDenseThreshold(0.5)}},
+		"packed": {byteValues(), []BuildOption{WithPackedValues()}},
+		"pthash": {randomData(1000, 34), []BuildOption{WithPTHash(7, 0.99)}},
+		"masked": {randomData(1000, 35), []BuildOption{MaskKeys(42)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := FromMap(tc.data, append(tc.opts, WithSeed(33), WithSortedIndex())...)
+			require.NoError(t, err)
+			require.NoError(t, c.Verify())
+			assertRanges(t, tc.data, c)
+
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+			assert.Equal(t, c.Spec().Size, int64(w.Len()))
+			fi, err := Stat(bytes.NewReader(w.Bytes()))
+			require.NoError(t, err)
+			assert.NotZero(t, fi.Flags&FlagSortedIndex)
+
+			var load []LoadOption
+			if name == "masked" {
+				load = append(load, WithKeyMask(42))
+			}
+			g, err := MmapWithOptions(w.Bytes(), load...)
+			require.NoError(t, err)
+			// The loaded permutation is the one a fresh sort computes.
+			assert.Equal(t, g.sortKeys(), g.sorted)
+			assert.Equal(t, c.sorted, g.sorted)
+			require.NoError(t, g.Verify())
+			assertRanges(t, tc.data, g)
+
+			r, err := ReadWithOptions(bytes.NewReader(w.Bytes()), load...)
+			require.NoError(t, err)
+			assert.Equal(t, c.sorted, r.sorted)
+			assertRanges(t, tc.data, g.Materialize())
+		})
+	}
+}
+
+func TestWithSortedIndex_none(t *testing.T) {
+	c := MustFromMap(sampleData)
+	_, err := c.Range(0, math.MaxUint64)
+	assert.ErrorIs(t, err, ErrNoSortedIndex)
+	_, err = c.Floor(1)
+	assert.ErrorIs(t, err, ErrNoSortedIndex)
+	_, err = c.Ceiling(1)
+	assert.ErrorIs(t, err, ErrNoSortedIndex)
+	_, err = (*CHD)(nil).Floor(1)
+	assert.ErrorIs(t, err, ErrNilTable)
+
+	empty, err := FromMap(map[uint64]uint64{}, WithSortedIndex())
+	require.NoError(t, err)
+	seq, err := empty.Range(0, math.MaxUint64)
+	require.NoError(t, err)
+	seq(func(k, v uint64) bool {
+		t.Errorf("unexpected entry %d", k)
+		return true
+	})
+	_, err = empty.Ceiling(0)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestWithSortedIndex_split(t *testing.T) {
+	m := randomData(500, 36)
+	structure, values := writeSplit(t, MustFromMap(m, hashed, WithSeed(36), WithSortedIndex()))
+	fi, err := Stat(bytes.NewReader(structure))
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Flags&FlagSortedIndex)
+
+	g, err := MmapSplit(structure, values)
+	require.NoError(t, err)
+	assertRanges(t, m, g)
+
+	// Index-only tables find keys, but have no values to range over.
+	idx, err := MmapSplit(structure, nil)
+	require.NoError(t, err)
+	_, err = idx.Range(0, math.MaxUint64)
+	assert.ErrorIs(t, err, ErrNoValues)
+	k := firstKey(m)
+	got, err := idx.Floor(k)
+	require.NoError(t, err)
+	assert.Equal(t, k, got)
+}
+
+func TestWithSortedIndex_derived(t *testing.T) {
+	m := randomData(1000, 37)
+	c := MustFromMap(m, WithSeed(37), WithSortedIndex())
+
+	n := c.MapValues(func(key, old uint64) uint64 { return key })
+	for k := range m {
+		m[k] = k
+	}
+	assertRanges(t, m, n)
+
+	for _, added := range []map[uint64]uint64{{firstKey(m): 1}, {1: 2, 3: 4}} {
+		r, err := RebuildWith(n, added, nil)
+		require.NoError(t, err)
+		for k, v := range added {
+			m[k] = v
+		}
+		assertRanges(t, m, r)
+		n = r
+	}
+}
+
+func TestRange_break(t *testing.T) {
+	c := MustFromMap(randomData(100, 38), WithSeed(38), WithSortedIndex())
+	seq, err := c.Range(0, math.MaxUint64)
+	require.NoError(t, err)
+	n := 0
+	seq(func(k, v uint64) bool {
+		n++
+		return n < 3
+	})
+	assert.Equal(t, 3, n)
+}
+
+func TestWithSortedIndex_corrupt(t *testing.T) {
+	c := MustFromMap(randomData(100, 39), WithSeed(39), WithSortedIndex())
+	c.sorted[0], c.sorted[1] = c.sorted[1], c.sorted[0]
+	assert.ErrorContains(t, c.Verify(), "isn't sorted")
+	c.sorted[0] = uint32(c.numSlots())
+	assert.ErrorContains(t, c.Verify(), "holds slot")
+
+	w := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData, WithSortedIndex()).Write(w))
+	h, err := mmapHeader(w.Bytes())
+	require.NoError(t, err)
+	h.flags &^= FlagSortedIndex
+	assert.ErrorContains(t, h.check(), "sorted index flag doesn't match")
+}
@@ -0,0 +1,132 @@
+package uint64mph
+
+// Section describes one array in the serialized form of a table.
+type Section struct {
+	// Offset in bytes of the first element from the start of the file.
+	Offset int64
+	// Number of elements.
+	Count int
+	// Width in bytes of every element. Elements are little endian.
+	Width int
+}
+
+// Size returns the size of the section in bytes.
+func (s Section) Size() int64 {
+	return int64(s.Count) * int64(s.Width)
+}
+
+// Layout describes where the arrays of a table are in its serialized form. See
+// FORMAT.md for how to look up keys with them.
+type Layout struct {
+	HashFunctions Section
+	Indices       Section
+	Keys          Section
+	Values        Section
+	// The base key, number of slots and number of keys of a dense table, and
+	// the bitmap of its slots that hold a key. Dense tables have no hash
+	// functions, indices and keys, see WithDenseThreshold.
+	Dense    Section
+	Presence Section
+	// The parameters, pilots and free slots of a table built with
+	// WithPTHash, which has them instead of hash functions and indices.
+	PTHash    Section
+	Pilots    Section
+	FreeSlots Section
+	// The distinct values of a table with a dictionary, which the values
+	// are codes into, see WithDictionaryThreshold.
+	Dictionary Section
+	// Total size of the serialized table in bytes.
+	Size int64
+}
+
+// Spec returns the layout of the table as serialized by Write without options.
+// The metadata, filter, columns, value aggregates, sorted index, generations
+// and deletion marks, if any, follow the values.
+func (c *CHD) Spec() Layout {
+	var l Layout
+	if c == nil {
+		return l
+	}
+	off := int64(headerSize)
+	next := func(count, width int) Section {
+		s := Section{Offset: off + sectionHeaderSize, Count: count, Width: width}
+		off = s.Offset + (s.Size()+7)&^7
+		return s
+	}
+	if c.keyMask != nil {
+		next(1, 8)
+	}
+	if c.dense != nil {
+		l.Dense = next(3, 8)
+		l.Presence = next(len(c.dense.present), 8)
+	} else {
+		if !c.small {
+			if c.hasherSection() {
+				next(len(c.hasher.Name()), 1)
+			}
+			if c.pthash != nil {
+				l.PTHash = next(6, 8)
+				l.Pilots = next(len(c.pthash.pilots), 8)
+				l.FreeSlots = next(len(c.pthash.free), 4)
+			} else {
+				l.HashFunctions = next(len(c.r), c.hashFunctionWidth())
+				l.Indices = next(len(c.indices), 2)
+			}
+		}
+		l.Keys = next(len(c.keys), 8)
+	}
+	l.Values = next(c.numValues(), c.ValueWidth())
+	if c.dict != nil {
+		l.Dictionary = next(len(c.dict), 8)
+	}
+	if c.metadata != nil {
+		next(len(c.metadata), 1)
+	}
+	if c.filter != nil {
+		next(filterHeaderSize+len(c.filter.fingerprints), 1)
+	}
+	if c.columns != nil {
+		next(c.columnsWords(), 8)
+	}
+	if c.aggregates != nil {
+		next(aggregatesWords, 8)
+	}
+	if c.sorted != nil {
+		next(len(c.sorted), 4)
+	}
+	if c.generations != nil {
+		next(c.generationsWords(), 8)
+	}
+	if c.deleted != nil {
+		next(len(c.deleted), 8)
+	}
+	l.Size = off
+	return l
+}
+
+// hashFunctionWidth returns the size of the serialized elements of r.
+func (c *CHD) hashFunctionWidth() int {
+	if c.r32 {
+		return 4
+	}
+	return 8
+}
+
+// HashFunctions returns a copy of the random values used by the hash
+// functions. The first is mixed into every key's hash, the others select a slot
+// within a bucket.
+func (c *CHD) HashFunctions() []uint64 {
+	if c == nil {
+		return nil
+	}
+	return append([]uint64(nil), c.r...)
+}
+
+// Indices returns a copy of the hash function index for every bucket. Buckets
+// without keys have an index beyond the end of HashFunctions.
+func (c *CHD) Indices() []uint16 {
+	if c == nil {
+		return nil
+	}
+	return append([]uint16(nil), c.indices...)
+}
@@ -0,0 +1,67 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Jille/uint64mph/internal/golden"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpec(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+	l := c.Spec()
+	assert.Equal(t, int64(len(b)), l.Size)
+
+	// Decode the sections purely from the layout.
+	for i, r := range c.HashFunctions() {
+		assert.Equal(t, r, binary.LittleEndian.Uint64(b[l.HashFunctions.Offset+int64(8*i):]))
+	}
+	for i, ri := range c.Indices() {
+		assert.Equal(t, ri, binary.LittleEndian.Uint16(b[l.Indices.Offset+int64(2*i):]))
+	}
+	for k, v := range sampleData {
+		slot, ok := c.Slot(k)
+		require.True(t, ok)
+		assert.Equal(t, k, binary.LittleEndian.Uint64(b[l.Keys.Offset+int64(8*slot):]))
+		assert.Equal(t, v, binary.LittleEndian.Uint64(b[l.Values.Offset+int64(8*slot):]))
+	}
+	_, ok := c.Slot(5)
+	assert.False(t, ok)
+
+	// Accessors return copies.
+	c.HashFunctions()[0]++
+	c.Indices()[0]++
+	assert.NoError(t, c.Verify())
+}
+
+func TestConformance(t *testing.T) {
+	js, err := os.ReadFile("testdata/conformance/conformance.json")
+	require.NoError(t, err)
+	var vec golden.ConformanceVector
+	require.NoError(t, json.Unmarshal(js, &vec))
+	require.NotEmpty(t, vec.Entries)
+	require.NotEmpty(t, vec.Misses)
+
+	data, err := os.ReadFile("testdata/conformance/" + golden.Conformance().Name)
+	require.NoError(t, err)
+	c, err := Mmap(data)
+	require.NoError(t, err)
+	for _, e := range vec.Entries {
+		slot, ok := c.Slot(e.Key)
+		assert.True(t, ok)
+		assert.Equal(t, e.Slot, slot)
+		assert.Equal(t, e.Value, c.Get(e.Key))
+	}
+	for _, m := range vec.Misses {
+		_, ok := c.GetOK(m.Key)
+		assert.False(t, ok)
+	}
+}
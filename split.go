@@ -0,0 +1,158 @@
+package uint64mph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// ErrNoValues is returned (or panicked with by lookups) when using the values
+// of an index-only table, see IndexOnly.
+var ErrNoValues = errors.New("uint64mph: table was loaded without values")
+
+// WriteSplit serializes the table into two files: structure gets everything
+// needed to find a key and the metadata, and values gets the values. This keeps the keys out of
+// the page cache for lookups on tables loaded with MmapSplit. Both files record
+// an identifier of the structure, so that MmapSplit rejects a values file
+// belonging to a different table. values may be nil to only write the
+// structure.
+func (c *CHD) WriteSplit(structure, values io.Writer, opts ...WriteOption) error {
+	if err := c.checkWritable(structure != nil); err != nil {
+		return err
+	}
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if values != nil && c.IndexOnly() {
+		return ErrNoValues
+	}
+	digest := c.writeDigest(o)
+	id := c.structureID()
+
+	oflags, osections := c.optionalSections(digest)
+	e := newEncoder(structure)
+	e.header(c.writeVersion(), FlagSplitStructure|oflags|c.structureFlags(), c.structureSections()+1+osections)
+	e.splitID(id)
+	c.writeStructure(e)
+	c.writeOptional(e, digest)
+	if err := e.flush(); err != nil || values == nil {
+		return err
+	}
+
+	return c.writeSplitValues(values, id, o)
+}
+
+// writeSplitValues writes the values file of WriteSplit.
+func (c *CHD) writeSplitValues(w io.Writer, id [16]byte, o writeOptions) error {
+	flags, deltas := c.encodeValues(o)
+	e := newEncoder(w)
+	e.header(c.writeVersion(), FlagSplitValues|flags, 1+c.valuesSections())
+	e.splitID(id)
+	c.writeValues(e, deltas)
+	return e.flush()
+}
+
+// structureID returns a hash of the serialized structure.
+func (c *CHD) structureID() [16]byte {
+	h := fnv.New128a()
+	e := newEncoder(h)
+	c.writeStructure(e)
+	e.flush()
+	var id [16]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+func (e *encoder) splitID(id [16]byte) {
+	e.section(sectionSplitID, 1, len(id))
+	e.bytes(id[:])
+}
+
+// MmapSplit creates a table over the files written by WriteSplit, like Mmap. If
+// values is nil, the table is index-only: Slot and Verify work, but looking up
+// values panics with ErrNoValues. Of the LoadOptions, only WithKeyMask,
+// WithGenerations and WithDeletedKeys apply.
+func MmapSplit(structure, values []byte, opts ...LoadOption) (*CHD, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	sh, err := mmapHeader(structure)
+	if err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if sh.flags&FlagSplitStructure == 0 {
+		return nil, fmt.Errorf("structure: %w: not a split structure file", ErrNotCHD)
+	}
+	c := &CHD{info: Info{Version: sh.version, Flags: sh.flags}, mixBuckets: sh.version >= 3, small: sh.flags&FlagSmall != 0}
+	if err := c.loadStructure(sh, mmapSection(sh, structure), false); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if err := c.loadHasher(sh, mmapSection(sh, structure)); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if err := c.loadKeyMask(mmapSection(sh, structure), o); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	c.loadMetadata(mmapSection(sh, structure))
+	if err := c.loadFilter(mmapSection(sh, structure)); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if err := c.loadColumns(mmapSection(sh, structure)); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if err := c.loadSorted(sh, mmapSection(sh, structure)); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	if err := c.loadGenerations(mmapSection(sh, structure), o); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	c.loadDigest(mmapSection(sh, structure))
+	if zeroCopy {
+		c.backing = [][]byte{structure}
+	}
+	if values == nil {
+		if err := c.loadDeletions(mmapSection(sh, structure), o.deletedKeys); err != nil {
+			return nil, fmt.Errorf("structure: %w", err)
+		}
+		return c, nil
+	}
+
+	vh, err := mmapHeader(values)
+	if err != nil {
+		return nil, fmt.Errorf("values: %w", err)
+	}
+	if vh.flags&FlagSplitValues == 0 {
+		return nil, fmt.Errorf("values: %w: not a split values file", ErrNotCHD)
+	}
+	if !bytes.Equal(splitID(sh, structure), splitID(vh, values)) {
+		return nil, fmt.Errorf("%w: values file belongs to a different table", ErrNotCHD)
+	}
+	if s, _ := vh.values(); s.count != c.numSlots() {
+		return nil, fmt.Errorf("%w: %d slots but %d values", ErrNotCHD, c.numSlots(), s.count)
+	}
+	c.loadValues(vh, mmapSection(vh, values))
+	c.loadAggregates(sh, mmapSection(sh, structure))
+	if zeroCopy {
+		c.backing = append(c.backing, values)
+	}
+	if err := c.loadDeletions(mmapSection(sh, structure), o.deletedKeys); err != nil {
+		return nil, fmt.Errorf("structure: %w", err)
+	}
+	return c, nil
+}
+
+func splitID(h header, b []byte) []byte {
+	s, _ := h.section(sectionSplitID)
+	return b[s.offset : s.offset+s.size()]
+}
+
+// IndexOnly reports whether the table was loaded without its values. This is
+// the case for tables loaded by MmapSplit without a values file, or with the
+// SkipValues option.
+func (c *CHD) IndexOnly() bool {
+	return c != nil && c.numValues() < c.numSlots()
+}
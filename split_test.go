@@ -0,0 +1,118 @@
+package uint64mph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSplit(t *testing.T, c *CHD, opts ...WriteOption) ([]byte, []byte) {
+	s, v := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.WriteSplit(s, v, opts...))
+	return s.Bytes(), v.Bytes()
+}
+
+func TestWriteSplit(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	structure, values := writeSplit(t, c)
+
+	g, err := MmapSplit(structure, values)
+	require.NoError(t, err)
+	assert.False(t, g.IndexOnly())
+	for k, v := range sampleData {
+		assert.Equal(t, v, g.Get(k))
+	}
+	assert.NoError(t, g.Verify())
+
+	fi, err := Stat(bytes.NewReader(structure))
+	require.NoError(t, err)
+	assert.Equal(t, FlagSplitStructure, fi.Flags)
+	assert.Equal(t, len(sampleData), fi.Entries)
+	assert.Zero(t, fi.ValuesBytes)
+	fi, err = Stat(bytes.NewReader(values))
+	require.NoError(t, err)
+	assert.Equal(t, FlagSplitValues, fi.Flags)
+	assert.Equal(t, len(sampleData), fi.Entries)
+	assert.Equal(t, int64(8*len(sampleData)), fi.ValuesBytes)
+
+	// Rewriting the loaded table as a single file gives the same result.
+	w1, w2 := &bytes.Buffer{}, &bytes.Buffer{}
+	require.NoError(t, c.Write(w1))
+	require.NoError(t, g.Write(w2))
+	assert.Equal(t, w1.Bytes(), w2.Bytes())
+}
+
+func TestWriteSplit_deltas(t *testing.T) {
+	m := map[uint64]uint64{10: 11, 20: 19, 30: 31, 40: 39, 50: 51}
+	structure, values := writeSplit(t, MustFromMap(m), WithValueDeltas())
+	fi, err := Stat(bytes.NewReader(values))
+	require.NoError(t, err)
+	assert.Equal(t, FlagSplitValues|FlagValueDeltas, fi.Flags)
+
+	g, err := MmapSplit(structure, values)
+	require.NoError(t, err)
+	for k, v := range m {
+		assert.Equal(t, v, g.Get(k))
+	}
+}
+
+func TestMmapSplit_indexOnly(t *testing.T) {
+	structure, _ := writeSplit(t, MustFromMap(sampleData))
+	for _, load := range []func() (*CHD, error){
+		func() (*CHD, error) { return MmapSplit(structure, nil) },
+		func() (*CHD, error) { return Mmap(structure) },
+	} {
+		g, err := load()
+		require.NoError(t, err)
+		assert.True(t, g.IndexOnly())
+		assert.Equal(t, len(sampleData), g.Len())
+		assert.NoError(t, g.Verify())
+		for k := range sampleData {
+			_, ok := g.Slot(k)
+			assert.True(t, ok)
+			assert.PanicsWithValue(t, ErrNoValues, func() { g.Get(k) })
+		}
+		_, ok := g.GetOK(5)
+		assert.False(t, ok)
+		assert.ErrorIs(t, g.SetValue(5, 1), ErrNoValues)
+		assert.ErrorIs(t, g.Write(&bytes.Buffer{}), ErrNoValues)
+		_, err = g.WritePairs(&bytes.Buffer{})
+		assert.ErrorIs(t, err, ErrNoValues)
+		assert.PanicsWithValue(t, ErrNoValues, func() { g.Iterate().Get() })
+		assert.NotZero(t, g.Iterate().Key())
+
+		// The structure can still be written on its own.
+		s := &bytes.Buffer{}
+		require.NoError(t, g.WriteSplit(s, nil))
+		assert.Equal(t, structure, s.Bytes())
+	}
+}
+
+func TestMmapSplit_mismatch(t *testing.T) {
+	structure, values := writeSplit(t, MustFromMap(sampleData))
+	other := map[uint64]uint64{}
+	for k, v := range sampleData {
+		other[k+1] = v
+	}
+	otherStructure, otherValues := writeSplit(t, MustFromMap(other))
+	full := &bytes.Buffer{}
+	require.NoError(t, MustFromMap(sampleData).Write(full))
+
+	for name, files := range map[string][2][]byte{
+		"other values":    {structure, otherValues},
+		"other structure": {otherStructure, values},
+		"swapped":         {values, structure},
+		"full structure":  {full.Bytes(), values},
+		"full values":     {structure, full.Bytes()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := MmapSplit(files[0], files[1])
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+
+	_, err := Mmap(values)
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
@@ -0,0 +1,152 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The format version of files without a header, as written by Write before
+// the header was introduced.
+const legacyFormatVersion = 1
+
+// Largest number of hash functions a table can have: indices are uint16s.
+const maxHashFunctions = 1 << 16
+
+// FileInfo describes a serialized hash table.
+type FileInfo struct {
+	// Version of the serialization format.
+	Version int
+	// Flags set in the header, like FlagValueDeltas. Always zero for version 1.
+	Flags uint32
+	// Number of entries in the table. For the values file of a dense table
+	// this is the number of slots, holes included.
+	Entries int
+	// Number of buckets (the length of the indices array).
+	Buckets int
+	// Number of hash functions (the length of the r array).
+	HashFunctions int
+	// Sizes in bytes of the sections in the file. The keys of dense tables
+	// are their presence bitmap, and the values include the dictionary, if
+	// any. The hash functions of PTHash tables are their free slots, and the
+	// indices their pilots.
+	HashFunctionBytes int64
+	IndicesBytes      int64
+	KeysBytes         int64
+	ValuesBytes       int64
+	// Total size of the serialized table in bytes.
+	Size int64
+	// Digest of the table, if it was written with WithDigest, see CHD.Digest.
+	// Zero otherwise.
+	Digest [32]byte
+}
+
+// ErrNotCHD is returned when a file isn't a serialized CHD.
+var ErrNotCHD = errors.New("not a serialized CHD")
+
+// Stat reads the metadata of a serialized hash table. Only the header and
+// section lengths are read, not the sections themselves, except for the few
+// bytes holding the number of keys of a dense table or the number of buckets
+// of a PTHash table, and the digest.
+func Stat(r io.ReaderAt) (FileInfo, error) {
+	var magic [8]byte
+	if n, _ := r.ReadAt(magic[:], 0); isCompressed(magic[:n]) {
+		return FileInfo{}, ErrCompressed
+	}
+	h, err := sniffHeader(r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	hf, _ := h.section(sectionHashFunctions)
+	indices, _ := h.section(sectionIndices)
+	keys, _ := h.section(sectionKeys)
+	values, _ := h.values()
+	dict, _ := h.section(sectionDictionary)
+	fi := FileInfo{
+		Version:           h.version,
+		Flags:             h.flags,
+		Entries:           keys.count,
+		Buckets:           indices.count,
+		HashFunctions:     hf.count,
+		HashFunctionBytes: hf.size(),
+		IndicesBytes:      indices.size(),
+		KeysBytes:         keys.size(),
+		ValuesBytes:       values.size() + dict.size(),
+		Size:              h.size,
+	}
+	if h.flags&FlagSplitValues != 0 {
+		fi.Entries = values.count
+	}
+	if h.flags&FlagDense != 0 {
+		dense, _ := h.section(sectionDense)
+		presence, _ := h.section(sectionPresence)
+		var b [8]byte
+		if err := readFullAt(r, b[:], dense.offset+16, "dense section"); err != nil {
+			return FileInfo{}, err
+		}
+		fi.Entries = int(min(binary.LittleEndian.Uint64(b[:]), uint64(64*presence.count)))
+		fi.KeysBytes = presence.size()
+	}
+	if h.flags&FlagPTHash != 0 {
+		pthash, _ := h.section(sectionPTHash)
+		pilots, _ := h.section(sectionPilots)
+		free, _ := h.section(sectionFreeSlots)
+		var b [8]byte
+		if err := readFullAt(r, b[:], pthash.offset+8, "PTHash section"); err != nil {
+			return FileInfo{}, err
+		}
+		fi.Buckets = int(min(binary.LittleEndian.Uint64(b[:]), math.MaxInt32))
+		fi.HashFunctionBytes = free.size()
+		fi.IndicesBytes = pilots.size()
+	}
+	if h.flags&FlagDigest != 0 {
+		digest, _ := h.section(sectionDigest)
+		if err := readFullAt(r, fi.Digest[:], digest.offset, "digest section"); err != nil {
+			return FileInfo{}, err
+		}
+	}
+	if err := checkSize(r, fi.Size, h.version == legacyFormatVersion); err != nil {
+		return FileInfo{}, err
+	}
+	return fi, nil
+}
+
+// checkSize checks that the file is exactly as large as the sections claim, or
+// at least as large for legacy files, which have always been accepted with
+// trailing garbage.
+func checkSize(r io.ReaderAt, size int64, legacy bool) error {
+	var b [1]byte
+	if n, err := r.ReadAt(b[:], size-1); n < 1 {
+		if err == nil || err == io.EOF {
+			return fmt.Errorf("%w: file is shorter than the %d bytes its sections need", ErrNotCHD, size)
+		}
+		return err
+	}
+	if legacy {
+		return nil
+	}
+	if n, err := r.ReadAt(b[:], size); n != 0 || err != io.EOF {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return fmt.Errorf("%w: file has trailing data after %d bytes", ErrNotCHD, size)
+	}
+	return nil
+}
+
+// StatFile is like Stat, but reads the file at path.
+func StatFile(path string) (FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+	fi, err := Stat(f)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return fi, nil
+}
@@ -0,0 +1,79 @@
+package uint64mph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	c := MustFromMap(sampleData, hashed)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+
+	fi, err := Stat(bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	s := c.Stats()
+	assert.Equal(t, FileInfo{
+		Version:           3,
+		Entries:           7,
+		Buckets:           3,
+		HashFunctions:     s.HashFunctions,
+		HashFunctionBytes: int64(s.HashFunctionBytes),
+		IndicesBytes:      6,
+		KeysBytes:         56,
+		ValuesBytes:       56,
+		Size:              int64(w.Len()),
+	}, fi)
+
+	path := filepath.Join(t.TempDir(), "data.idx")
+	require.NoError(t, os.WriteFile(path, w.Bytes(), 0644))
+	fi2, err := StatFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, fi, fi2)
+}
+
+func TestStat_notCHD(t *testing.T) {
+	c := MustFromMap(sampleData)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	b := w.Bytes()
+
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"short":     {1, 0},
+		"text":      []byte("this is definitely not a hash table"),
+		"truncated": b[:len(b)-1],
+		"trailing":  append(append([]byte{}, b...), 0),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Stat(bytes.NewReader(data))
+			assert.ErrorIs(t, err, ErrNotCHD)
+		})
+	}
+
+	_, err := StatFile(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestStat_legacyTrailing(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata/golden/v1", "1k.idx"))
+	require.NoError(t, err)
+	fi, err := Stat(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, 1, fi.Version)
+
+	// Legacy files with trailing garbage load, so they stat too.
+	trailing, err := Stat(bytes.NewReader(append(b, 0, 1, 2)))
+	require.NoError(t, err)
+	assert.Equal(t, fi, trailing)
+	_, err = Mmap(append(b, 0, 1, 2))
+	assert.NoError(t, err)
+
+	_, err = Stat(bytes.NewReader(b[:len(b)-1]))
+	assert.ErrorIs(t, err, ErrNotCHD)
+}
@@ -0,0 +1,160 @@
+package uint64mph
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TableStats describes the size and shape of a hash table.
+type TableStats struct {
+	// Number of entries in the table.
+	Entries int
+	// Number of buckets (the length of the indices array).
+	Buckets int
+	// Number of hash functions (the length of the r array).
+	HashFunctions int
+	// Number of buckets that didn't get any keys assigned.
+	EmptyBuckets int
+	// HashFunctionUsage[i] is the number of buckets that use hash function i.
+	HashFunctionUsage []int
+
+	// Bytes used by each section. The keys of dense tables are their presence
+	// bitmap, and the values include the dictionary, if any. The hash
+	// functions of PTHash tables are their free slots, and the indices their
+	// pilots.
+	HashFunctionBytes int
+	IndicesBytes      int
+	KeysBytes         int
+	ValuesBytes       int
+	FilterBytes       int
+}
+
+// TotalBytes returns the sum of the sizes of all sections.
+func (s TableStats) TotalBytes() int {
+	return s.HashFunctionBytes + s.IndicesBytes + s.KeysBytes + s.ValuesBytes + s.FilterBytes
+}
+
+func (s TableStats) String() string {
+	var usage strings.Builder
+	for i, n := range s.HashFunctionUsage {
+		if i > 0 {
+			usage.WriteByte(' ')
+		}
+		fmt.Fprintf(&usage, "%d:%d", i, n)
+	}
+	return fmt.Sprintf("%d entries, %d buckets (%d empty), %d hash functions, %d bytes (r=%d indices=%d keys=%d values=%d), usage [%s]",
+		s.Entries, s.Buckets, s.EmptyBuckets, s.HashFunctions, s.TotalBytes(),
+		s.HashFunctionBytes, s.IndicesBytes, s.KeysBytes, s.ValuesBytes, usage.String())
+}
+
+// Stats computes statistics about the table.
+func (c *CHD) Stats() TableStats {
+	if c == nil {
+		return TableStats{}
+	}
+	s := c.sizes()
+	s.HashFunctionUsage = make([]int, len(c.r))
+	for _, ri := range c.indices {
+		if int(ri) >= len(c.r) {
+			s.EmptyBuckets++
+			continue
+		}
+		s.HashFunctionUsage[ri]++
+	}
+	return s
+}
+
+// sizes returns the stats that don't require looking at every bucket.
+func (c *CHD) sizes() TableStats {
+	s := TableStats{
+		Entries:           c.Len(),
+		Buckets:           len(c.indices),
+		HashFunctions:     len(c.r),
+		HashFunctionBytes: c.hashFunctionWidth() * len(c.r),
+		IndicesBytes:      2 * len(c.indices),
+		KeysBytes:         8 * len(c.keys),
+		ValuesBytes:       8*len(c.values) + len(c.packed) + 8*len(c.dict) + 8*len(c.pairValues),
+	}
+	if c.filter != nil {
+		s.FilterBytes = len(c.filter.fingerprints)
+	}
+	if c.dense != nil {
+		s.KeysBytes = 8 * len(c.dense.present)
+	}
+	if c.pthash != nil {
+		s.Buckets = int(c.pthash.buckets)
+		s.HashFunctionBytes = 4 * len(c.pthash.free)
+		s.IndicesBytes = 8 * len(c.pthash.pilots)
+	}
+	return s
+}
+
+// BuildStats describes a completed build.
+type BuildStats struct {
+	TableStats
+	// How long the build took.
+	Duration time.Duration
+	// The highest number of new hash functions tried for a single bucket.
+	MaxAttempts int
+	// The outer seed r[0], either drawn from the RNG or set by WithOuterSeed.
+	OuterSeed uint64
+	// The strategy chosen for the memory budget, see MemoryBudget.
+	Strategy BuildStrategy
+	// The peak growth of the Go heap observed during the build. Memory
+	// mapped by StrategyExternal isn't included.
+	PeakBytes int64
+	// The seed picked by WithBestOfSeeds, 0 for other builds.
+	Seed int64
+}
+
+// WithStats stores statistics about the build in s once Build succeeds.
+func WithStats(s *BuildStats) BuildOption {
+	return func(o *buildOptions) {
+		o.stats = s
+	}
+}
+
+// The most entries CHD.GoString prints.
+const maxGoStringEntries = 16
+
+// String returns a short summary of the table, like "CHD{7 keys, 2 hash
+// funcs, 120 B}".
+func (c *CHD) String() string {
+	if c == nil {
+		return "CHD(nil)"
+	}
+	s := c.sizes()
+	return fmt.Sprintf("CHD{%d keys, %d hash funcs, %d B}", s.Entries, s.HashFunctions, s.TotalBytes())
+}
+
+// GoString returns the first few entries of the table and its stats, for %#v.
+func (c *CHD) GoString() string {
+	if c == nil {
+		return "(*uint64mph.CHD)(nil)"
+	}
+	var b strings.Builder
+	b.WriteString("uint64mph.CHD{")
+	n := 0
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		if n == maxGoStringEntries {
+			fmt.Fprintf(&b, ", ... %d more", c.Len()-n)
+			break
+		}
+		if n > 0 {
+			b.WriteString(", ")
+		}
+		if c.IndexOnly() {
+			fmt.Fprintf(&b, "%d", it.Key())
+		} else if c.pairValues != nil {
+			k, v1, v2 := it.Get2()
+			fmt.Fprintf(&b, "%d: (%d, %d)", k, v1, v2)
+		} else {
+			k, v := it.Get()
+			fmt.Fprintf(&b, "%d: %d", k, v)
+		}
+		n++
+	}
+	fmt.Fprintf(&b, "; %s}", c.Stats())
+	return b.String()
+}
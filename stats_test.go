@@ -0,0 +1,69 @@
+package uint64mph
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCHDStats(t *testing.T) {
+	var bs BuildStats
+	c, err := FromMap(sampleData, WithSeed(3), WithStats(&bs), hashed)
+	assert.NoError(t, err)
+	s := c.Stats()
+	assert.Equal(t, s, bs.TableStats)
+	assert.Equal(t, 7, s.Entries)
+	assert.Equal(t, 3, s.Buckets)
+	assert.Equal(t, len(c.r), s.HashFunctions)
+	assert.Equal(t, 56, s.KeysBytes)
+	assert.Equal(t, 56, s.ValuesBytes)
+	assert.Equal(t, 6, s.IndicesBytes)
+
+	used := 0
+	for _, n := range s.HashFunctionUsage {
+		used += n
+	}
+	assert.Equal(t, s.Buckets, used+s.EmptyBuckets)
+
+	w := &bytes.Buffer{}
+	assert.NoError(t, c.Write(w))
+	// The serialized form has a header and four section headers on top of the
+	// sections, and pads the 6 bytes of indices to 8.
+	assert.Equal(t, w.Len(), s.TotalBytes()+headerSize+4*sectionHeaderSize+2)
+	assert.Contains(t, s.String(), "7 entries, 3 buckets")
+}
+
+func TestCHDStats_empty(t *testing.T) {
+	c, err := Builder().Build()
+	assert.NoError(t, err)
+	s := c.Stats()
+	assert.Equal(t, 0, s.Entries)
+	assert.Equal(t, 1, s.EmptyBuckets)
+}
+
+func TestCHDString(t *testing.T) {
+	c, err := FromMap(sampleData, WithSeed(3), hashed)
+	assert.NoError(t, err)
+	s := c.Stats()
+	assert.Equal(t, fmt.Sprintf("CHD{7 keys, %d hash funcs, %d B}", s.HashFunctions, s.TotalBytes()), c.String())
+	assert.Equal(t, c.String(), fmt.Sprint(c))
+	gs := fmt.Sprintf("%#v", c)
+	for k, v := range sampleData {
+		assert.Contains(t, gs, fmt.Sprintf("%d: %d", k, v))
+	}
+	assert.Contains(t, gs, s.String())
+
+	m := map[uint64]uint64{}
+	for i, w := range words[:1000] {
+		m[w] = uint64(i)
+	}
+	gs = MustFromMap(m).GoString()
+	assert.Contains(t, gs, ", ... 984 more; 1000 entries")
+	assert.Less(t, len(gs), 1000)
+
+	b := bucket{keys: words[:1000]}
+	assert.Contains(t, b.String(), "... 984 more, }")
+	assert.Less(t, len(b.String()), 500)
+}
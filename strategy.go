@@ -0,0 +1,262 @@
+package uint64mph
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+)
+
+// BuildStrategy is the way Build groups the keys into buckets and keeps track of
+// them while placing the buckets. See MemoryBudget.
+type BuildStrategy int
+
+const (
+	// StrategyMaps uses Go maps to find duplicate keys and occupied slots. It
+	// is the fastest strategy and the default without a memory budget, but it
+	// needs over a hundred bytes per key.
+	StrategyMaps BuildStrategy = iota
+	// StrategySorted stores the keys sorted by bucket in a single array,
+	// finds duplicate keys by comparing the keys within every bucket, and uses
+	// a bitset for occupied slots.
+	StrategySorted
+	// StrategyExternal is like StrategySorted, but keeps the array of keys
+	// sorted by bucket in a temporary file in os.TempDir mapped into memory,
+	// so the operating system can page it out. It is only available on Unix.
+	StrategyExternal
+)
+
+func (s BuildStrategy) String() string {
+	switch s {
+	case StrategyMaps:
+		return "maps"
+	case StrategySorted:
+		return "sorted"
+	case StrategyExternal:
+		return "external"
+	}
+	return fmt.Sprintf("BuildStrategy(%d)", int(s))
+}
+
+// MemoryBudget makes Build choose the fastest strategy whose estimated peak
+// memory usage stays below bytes, and fail right away if even the table itself
+// doesn't fit. The budget covers the memory Build allocates: the table and the
+// structures needed to build it, but not the entries held by the builder. The
+// strategy that was used and the measured peak are reported by WithStats. A
+// budget of 0 removes the limit.
+func (b *CHDBuilder) MemoryBudget(bytes int64) {
+	b.memoryBudget = bytes
+}
+
+// The estimated number of bytes used by a Go map[uint64]bool per key, including
+// the slack of growing it.
+const mapBytesPerKey = 48
+
+// tableMemory estimates the size of a table with n keys in m buckets.
+func tableMemory(n, m uint64, filter bool) uint64 {
+	size := 16*n + 2*m
+	if filter {
+		size += filterMemory(n)
+	}
+	return size
+}
+
+func filterMemory(n uint64) uint64 {
+	return 32 + n*123/100
+}
+
+// estimateMemory estimates the peak memory usage of Build with strategy s.
+func estimateMemory(s BuildStrategy, n, m uint64, filter bool) uint64 {
+	var scratch uint64
+	switch s {
+	case StrategyMaps:
+		// The duplicates and seen maps, and the buckets, whose slices have
+		// up to twice the capacity needed.
+		scratch = 2*mapBytesPerKey*n + uint64(56)*m + 32*n
+	case StrategySorted:
+		// The keys and values sorted by bucket, the bucket offsets and
+		// order, and the seen bitset.
+		scratch = 16*n + 8*m + n/8
+	case StrategyExternal:
+		scratch = 8*m + n/8
+	}
+	if filter {
+		// The filter is built after the buckets have been placed, and needs
+		// about 16 bytes per slot and 12 bytes per key.
+		scratch = max(scratch, 16*filterMemory(n)+12*n)
+	}
+	return tableMemory(n, m, filter) + scratch
+}
+
+// chooseStrategy returns the fastest strategy that fits within budget.
+func chooseStrategy(budget int64, n, m uint64, filter bool) (BuildStrategy, error) {
+	if size := tableMemory(n, m, filter); size > uint64(budget) {
+		return 0, fmt.Errorf("the table needs about %d bytes, exceeding the memory budget of %d bytes", size, budget)
+	}
+	strategies := []BuildStrategy{StrategyMaps}
+	if n <= math.MaxUint32 {
+		strategies = append(strategies, StrategySorted)
+		if externalBuildSupported {
+			strategies = append(strategies, StrategyExternal)
+		}
+	}
+	var least uint64
+	for _, s := range strategies {
+		least = estimateMemory(s, n, m, filter)
+		if least <= uint64(budget) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("building the table needs about %d bytes, exceeding the memory budget of %d bytes", least, budget)
+}
+
+// bucketSource provides the buckets to place, largest first.
+type bucketSource interface {
+	Len() int
+	Bucket(i int) bucket
+}
+
+func (b bucketVector) Bucket(i int) bucket { return b[i] }
+
+// csrBuckets stores all buckets in a single pair of arrays, sorted by bucket.
+type csrBuckets struct {
+	// The bucket indices, largest bucket first.
+	order []uint32
+	// The entries of bucket i are at offsets[i]:offsets[i+1].
+	offsets []uint32
+	keys    []uint64
+	values  []uint64
+}
+
+func (c *csrBuckets) Len() int { return len(c.order) }
+
+func (c *csrBuckets) Bucket(i int) bucket {
+	oh := c.order[i]
+	start, end := c.offsets[oh], c.offsets[oh+1]
+	return bucket{
+		index:  uint64(oh),
+		keys:   c.keys[start:end:end],
+		values: c.values[start:end:end],
+	}
+}
+
+// groupSorted groups the entries into m buckets, storing them in keys and
+// values, which must have room for all entries. It orders the buckets like
+// sorting a bucketVector does, so the built table doesn't depend on the
+// strategy.
+func groupSorted(entries *entryChunks, hasher *chdHasher, m uint64, keys, values []uint64) (*csrBuckets, error) {
+	c := &csrBuckets{
+		order:   make([]uint32, m),
+		offsets: make([]uint32, m+1),
+		keys:    keys,
+		values:  values,
+	}
+	for _, chunk := range entries.keys {
+		for _, key := range chunk {
+			c.offsets[hasher.HashIndexFromKey(key)+1]++
+		}
+	}
+	for i := uint64(1); i <= m; i++ {
+		c.offsets[i] += c.offsets[i-1]
+	}
+	// Use the offsets as the position to write the next key of every bucket,
+	// which leaves each pointing at the start of the next bucket.
+	for ci, chunk := range entries.keys {
+		for i, key := range chunk {
+			oh := hasher.HashIndexFromKey(key)
+			c.keys[c.offsets[oh]] = key
+			c.values[c.offsets[oh]] = entries.values[ci][i]
+			c.offsets[oh]++
+		}
+	}
+	copy(c.offsets[1:], c.offsets[:m])
+	c.offsets[0] = 0
+
+	for i := range c.order {
+		c.order[i] = uint32(i)
+		if key, ok := findDuplicate(c.Bucket(i).keys); ok {
+			return nil, fmt.Errorf("%w %d", ErrDuplicateKey, key)
+		}
+	}
+	sort.Slice(c.order, func(i, j int) bool {
+		si := c.offsets[c.order[i]+1] - c.offsets[c.order[i]]
+		sj := c.offsets[c.order[j]+1] - c.offsets[c.order[j]]
+		if si != sj {
+			return si > sj
+		}
+		return c.order[i] < c.order[j]
+	})
+	return c, nil
+}
+
+// findDuplicate returns a key that occurs more than once in keys.
+func findDuplicate(keys []uint64) (uint64, bool) {
+	if len(keys) > 16 {
+		sorted := append([]uint64(nil), keys...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i] == sorted[i-1] {
+				return sorted[i], true
+			}
+		}
+		return 0, false
+	}
+	for i, k := range keys {
+		for _, o := range keys[:i] {
+			if k == o {
+				return k, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// slotSet records the slots of the table that are taken.
+type slotSet interface {
+	has(slot uint64) bool
+	add(slot uint64)
+}
+
+type slotMap map[uint64]bool
+
+func (s slotMap) has(slot uint64) bool { return s[slot] }
+func (s slotMap) add(slot uint64)      { s[slot] = true }
+
+type slotBitset []uint64
+
+func newSlotBitset(n uint64) slotBitset {
+	return make(slotBitset, (n+63)/64)
+}
+
+func (s slotBitset) has(slot uint64) bool { return s[slot/64]&(1<<(slot%64)) != 0 }
+func (s slotBitset) add(slot uint64)      { s[slot/64] |= 1 << (slot % 64) }
+
+// peakTracker measures the peak growth of the Go heap.
+type peakTracker struct {
+	base, peak uint64
+}
+
+func newPeakTracker() *peakTracker {
+	// Collect garbage first so it isn't freed during the build, which would
+	// hide the build's own allocations.
+	runtime.GC()
+	p := &peakTracker{}
+	p.base = p.heap()
+	return p
+}
+
+func (p *peakTracker) heap() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// sample records the current heap size.
+func (p *peakTracker) sample() {
+	if p == nil {
+		return
+	}
+	if h := p.heap(); h > p.base && h-p.base > p.peak {
+		p.peak = h - p.base
+	}
+}
@@ -0,0 +1,91 @@
+package uint64mph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildStrategies(t *testing.T) {
+	b := Builder()
+	for i, w := range words[:100000] {
+		b.Add(w, uint64(i))
+	}
+	var want *CHD
+	for _, s := range []BuildStrategy{StrategyMaps, StrategySorted, StrategyExternal} {
+		t.Run(s.String(), func(t *testing.T) {
+			if s == StrategyExternal && !externalBuildSupported {
+				t.Skip("not supported on this platform")
+			}
+			var stats BuildStats
+			c, err := b.Build(WithSeed(1), WithStats(&stats), func(o *buildOptions) { o.strategy = s })
+			require.NoError(t, err)
+			assert.Equal(t, s, stats.Strategy)
+			assert.Greater(t, stats.PeakBytes, int64(0))
+			// The estimate is close, but garbage can make the heap grow a little more.
+			assert.Less(t, stats.PeakBytes, int64(estimateMemory(s, 100000, 50000, false))*3/2)
+			if want == nil {
+				want = c
+				return
+			}
+			// The table doesn't depend on the strategy.
+			assert.Equal(t, want.r, c.r)
+			assert.Equal(t, want.indices, c.indices)
+			assert.Equal(t, want.keys, c.keys)
+			assert.Equal(t, want.values, c.values)
+		})
+	}
+}
+
+func TestBuildStrategies_duplicates(t *testing.T) {
+	for _, s := range []BuildStrategy{StrategySorted, StrategyExternal} {
+		if s == StrategyExternal && !externalBuildSupported {
+			continue
+		}
+		b := Builder()
+		for i, w := range words[:1000] {
+			b.Add(w, uint64(i))
+		}
+		b.Add(words[500], 1)
+		_, err := b.Build(func(o *buildOptions) { o.strategy = s })
+		assert.ErrorContains(t, err, "duplicate key", s)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const n, m = 100000, 50000
+	b := Builder()
+	for _, w := range words[:n] {
+		b.Add(w, w)
+	}
+	for _, tc := range []struct {
+		budget uint64
+		want   BuildStrategy
+	}{
+		{1 << 40, StrategyMaps},
+		{estimateMemory(StrategyMaps, n, m, false), StrategyMaps},
+		{estimateMemory(StrategyMaps, n, m, false) - 1, StrategySorted},
+		{estimateMemory(StrategySorted, n, m, false) - 1, StrategyExternal},
+	} {
+		if tc.want == StrategyExternal && !externalBuildSupported {
+			continue
+		}
+		b.MemoryBudget(int64(tc.budget))
+		var stats BuildStats
+		c, err := b.Build(WithStats(&stats))
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, stats.Strategy, "budget %d", tc.budget)
+		assert.Equal(t, n, c.Len())
+	}
+
+	b.MemoryBudget(16 * n)
+	_, err := b.Build()
+	assert.ErrorContains(t, err, "the table needs about 1700000 bytes, exceeding the memory budget of 1600000 bytes")
+	b.MemoryBudget(int64(tableMemory(n, m, false)))
+	_, err = b.Build()
+	assert.ErrorContains(t, err, "exceeding the memory budget")
+	b.MemoryBudget(int64(tableMemory(n, m, false)))
+	_, err = b.Build(WithFilter())
+	assert.ErrorContains(t, err, "the table needs about")
+}
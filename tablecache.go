@@ -0,0 +1,371 @@
+package uint64mph
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A TableLoader loads the table called name for a TableCache. See PathLoader
+// and ReaderAtLoader.
+type TableLoader func(ctx context.Context, name string) (*CHD, error)
+
+// PathLoader returns a TableLoader that maps the file path returns for a name
+// with OpenMmapFile.
+func PathLoader(path func(name string) (string, error), opts ...LoadOption) TableLoader {
+	return func(_ context.Context, name string) (*CHD, error) {
+		p, err := path(name)
+		if err != nil {
+			return nil, err
+		}
+		return OpenMmapFile(p, opts...)
+	}
+}
+
+// ReaderAtLoader returns a TableLoader that reads the table from the reader
+// open returns for a name with ReadAt. Readers that are an io.Closer are closed
+// once the table is read.
+func ReaderAtLoader(open func(ctx context.Context, name string) (io.ReaderAt, error), opts ...LoadOption) TableLoader {
+	return func(ctx context.Context, name string) (*CHD, error) {
+		r, err := open(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		c, err := ReadAt(r, opts...)
+		if cl, ok := r.(io.Closer); ok {
+			if cerr := cl.Close(); err == nil && cerr != nil {
+				c.Close()
+				return nil, cerr
+			}
+		}
+		return c, err
+	}
+}
+
+// A TableCacheOption configures NewTableCache.
+type TableCacheOption func(*tableCacheOptions)
+
+type tableCacheOptions struct {
+	maxTables int
+	maxBytes  int64
+	ttl       time.Duration
+}
+
+// WithMaxTables makes TableCache keep at most n tables loaded.
+func WithMaxTables(n int) TableCacheOption {
+	return func(o *tableCacheOptions) {
+		o.maxTables = n
+	}
+}
+
+// WithMaxBytes makes TableCache keep at most n bytes of tables loaded, as
+// counted by MemoryFootprint, including the bytes of mapped files. A single
+// table larger than that is still kept, as long as it's the only one.
+func WithMaxBytes(n int64) TableCacheOption {
+	return func(o *tableCacheOptions) {
+		o.maxBytes = n
+	}
+}
+
+// WithTTL makes TableCache load a table again when it's asked for d or more
+// after loading it, to pick up new versions of the table.
+func WithTTL(d time.Duration) TableCacheOption {
+	return func(o *tableCacheOptions) {
+		o.ttl = d
+	}
+}
+
+// TableCache holds tables loaded by name, like the index files of a number of
+// datasets of which only some are busy. Tables are loaded when first asked for,
+// and concurrent requests for a table that is being loaded wait for that load
+// instead of starting their own. The least recently used tables are evicted
+// when there are more than WithMaxTables of them or they take more than
+// WithMaxBytes, and they are closed once the last user releases them. Without
+// either limit, tables are only evicted when their WithTTL expires.
+//
+// A TableCache is safe for concurrent use. Failed loads aren't cached: the next
+// Get tries again.
+type TableCache struct {
+	load TableLoader
+	o    tableCacheOptions
+	// Returns the current time, replaced by tests.
+	now func() time.Time
+
+	mtx    sync.Mutex
+	tables map[string]*cachedTable
+	// The loads in progress, by name.
+	loading map[string]*tableLoad
+	// The cached tables, most recently used first.
+	lru    list.List
+	bytes  int64
+	stats  TableCacheStats
+	closed bool
+}
+
+// cachedTable is a table loaded by TableCache, closed once it's evicted and
+// the last user is done with it.
+type cachedTable struct {
+	name   string
+	c      *CHD
+	size   int64
+	loaded time.Time
+	// The number of users of c, plus one while it's cached.
+	refs int
+	elem *list.Element
+}
+
+// tableLoad is a load in progress, shared by the Gets waiting for it.
+type tableLoad struct {
+	done chan struct{}
+	// The loaded table and the error, set before done is closed.
+	t   *cachedTable
+	err error
+	// The number of Gets still waiting. Each of them is handed a reference to
+	// the table once it's loaded.
+	waiters  int
+	finished bool
+}
+
+// TableCacheStats counts what a TableCache did, to help pick its limits.
+type TableCacheStats struct {
+	// Gets that found their table loaded.
+	Hits uint64
+	// Gets that had to wait for their table to be loaded.
+	Misses uint64
+	// Times a table was loaded, and times loading one failed.
+	Loads      uint64
+	LoadErrors uint64
+	// Times a table was evicted to stay within the limits, or because its
+	// time to live expired.
+	Evictions   uint64
+	Expirations uint64
+	// Tables cached right now and the bytes they take, not counting evicted
+	// tables still in use.
+	Tables int
+	Bytes  int64
+}
+
+// NewTableCache returns a TableCache loading tables with load. Nothing is
+// loaded yet.
+func NewTableCache(load TableLoader, opts ...TableCacheOption) (*TableCache, error) {
+	if load == nil {
+		return nil, errors.New("uint64mph: a table cache needs a loader")
+	}
+	tc := &TableCache{load: load, now: time.Now, tables: map[string]*cachedTable{}, loading: map[string]*tableLoad{}}
+	for _, opt := range opts {
+		opt(&tc.o)
+	}
+	if tc.o.maxTables < 0 {
+		return nil, fmt.Errorf("uint64mph: invalid limit of %d tables", tc.o.maxTables)
+	}
+	if tc.o.maxBytes < 0 {
+		return nil, fmt.Errorf("uint64mph: invalid limit of %d bytes", tc.o.maxBytes)
+	}
+	if tc.o.ttl < 0 {
+		return nil, fmt.Errorf("uint64mph: invalid time to live %v", tc.o.ttl)
+	}
+	return tc, nil
+}
+
+// Get returns the table called name, loading it if needed, and a function to
+// call when done with it. The table isn't closed before that, even if it's
+// evicted. The release function may be called more than once.
+//
+// If ctx is done before the table is loaded, Get returns ctx.Err(). The load
+// itself carries on for the other Gets waiting for it, and the table is cached
+// for later ones. Get fails with ErrClosed after Close.
+func (tc *TableCache) Get(ctx context.Context, name string) (*CHD, func(), error) {
+	var expired []*cachedTable
+	tc.mtx.Lock()
+	if tc.closed {
+		tc.mtx.Unlock()
+		return nil, nil, ErrClosed
+	}
+	if t := tc.tables[name]; t != nil {
+		if !tc.expired(t) {
+			t.refs++
+			tc.lru.MoveToFront(t.elem)
+			tc.stats.Hits++
+			tc.mtx.Unlock()
+			return t.c, tc.releaser(t), nil
+		}
+		tc.stats.Expirations++
+		expired = tc.remove(t, expired)
+	}
+	tc.stats.Misses++
+	l := tc.loading[name]
+	if l == nil {
+		l = &tableLoad{done: make(chan struct{})}
+		tc.loading[name] = l
+		go tc.runLoad(context.WithoutCancel(ctx), name, l)
+	}
+	l.waiters++
+	tc.mtx.Unlock()
+	closeTables(expired)
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		tc.mtx.Lock()
+		if !l.finished {
+			l.waiters--
+			tc.mtx.Unlock()
+			return nil, nil, ctx.Err()
+		}
+		tc.mtx.Unlock()
+		// The load finished regardless, and handed us a reference.
+		if l.t != nil {
+			tc.release(l.t)
+		}
+		return nil, nil, ctx.Err()
+	}
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+	return l.t.c, tc.releaser(l.t), nil
+}
+
+// runLoad loads the table called name and hands it to the Gets waiting for it.
+func (tc *TableCache) runLoad(ctx context.Context, name string, l *tableLoad) {
+	c, err := tc.load(ctx, name)
+	if err == nil && c == nil {
+		err = ErrNilTable
+	}
+	var evicted []*cachedTable
+	tc.mtx.Lock()
+	delete(tc.loading, name)
+	l.finished = true
+	switch {
+	case err != nil:
+		tc.stats.LoadErrors++
+		l.err = fmt.Errorf("table %q: %w", name, err)
+	case tc.closed:
+		c.Close()
+		l.err = ErrClosed
+	default:
+		tc.stats.Loads++
+		t := &cachedTable{name: name, c: c, size: c.MemoryFootprint().Total, loaded: tc.now(), refs: 1 + l.waiters}
+		t.elem = tc.lru.PushFront(t)
+		tc.tables[name] = t
+		tc.bytes += t.size
+		l.t = t
+		evicted = tc.evict()
+	}
+	tc.mtx.Unlock()
+	closeTables(evicted)
+	close(l.done)
+}
+
+// evict removes expired tables, and then the least recently used ones until
+// the cache is within its limits. It returns the tables to close. tc.mtx must
+// be held.
+func (tc *TableCache) evict() []*cachedTable {
+	var evicted []*cachedTable
+	if tc.o.ttl > 0 {
+		for e := tc.lru.Front(); e != nil; {
+			t := e.Value.(*cachedTable)
+			e = e.Next()
+			if tc.expired(t) {
+				tc.stats.Expirations++
+				evicted = tc.remove(t, evicted)
+			}
+		}
+	}
+	for tc.lru.Len() > 1 && (tc.o.maxTables > 0 && tc.lru.Len() > tc.o.maxTables || tc.o.maxBytes > 0 && tc.bytes > tc.o.maxBytes) {
+		tc.stats.Evictions++
+		evicted = tc.remove(tc.lru.Back().Value.(*cachedTable), evicted)
+	}
+	return evicted
+}
+
+// expired reports whether t's time to live expired.
+func (tc *TableCache) expired(t *cachedTable) bool {
+	return tc.o.ttl > 0 && tc.now().Sub(t.loaded) >= tc.o.ttl
+}
+
+// remove drops t from the cache, and appends it to unused if nobody is using
+// it. tc.mtx must be held.
+func (tc *TableCache) remove(t *cachedTable, unused []*cachedTable) []*cachedTable {
+	tc.lru.Remove(t.elem)
+	delete(tc.tables, t.name)
+	tc.bytes -= t.size
+	if t.refs--; t.refs == 0 {
+		unused = append(unused, t)
+	}
+	return unused
+}
+
+// releaser returns the function releasing a reference to t.
+func (tc *TableCache) releaser(t *cachedTable) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { tc.release(t) })
+	}
+}
+
+// release drops a reference to t, closing it if it was evicted in the meantime
+// and this was the last one.
+func (tc *TableCache) release(t *cachedTable) {
+	tc.mtx.Lock()
+	t.refs--
+	last := t.refs == 0
+	tc.mtx.Unlock()
+	if last {
+		t.c.Close()
+	}
+}
+
+func closeTables(ts []*cachedTable) error {
+	var err error
+	for _, t := range ts {
+		err = errors.Join(err, t.c.Close())
+	}
+	return err
+}
+
+// Evict drops the table called name from the cache, if it's cached, so that
+// the next Get loads it again. It's closed once nobody uses it anymore.
+func (tc *TableCache) Evict(name string) {
+	var unused []*cachedTable
+	tc.mtx.Lock()
+	if t := tc.tables[name]; t != nil {
+		tc.stats.Evictions++
+		unused = tc.remove(t, nil)
+	}
+	tc.mtx.Unlock()
+	closeTables(unused)
+}
+
+// Stats returns what the cache did so far.
+func (tc *TableCache) Stats() TableCacheStats {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	st := tc.stats
+	st.Tables = tc.lru.Len()
+	st.Bytes = tc.bytes
+	return st
+}
+
+// Close closes the cached tables, or leaves that to the users still holding
+// them. Tables still being loaded are closed once they are. Get fails with
+// ErrClosed afterwards. Closing an already closed cache is a no-op.
+func (tc *TableCache) Close() error {
+	var unused []*cachedTable
+	tc.mtx.Lock()
+	if tc.closed {
+		tc.mtx.Unlock()
+		return nil
+	}
+	tc.closed = true
+	for e := tc.lru.Front(); e != nil; {
+		t := e.Value.(*cachedTable)
+		e = e.Next()
+		unused = tc.remove(t, unused)
+	}
+	tc.mtx.Unlock()
+	return closeTables(unused)
+}
@@ -0,0 +1,325 @@
+package uint64mph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTables returns a loader of tables called "0" up to "n-1", where table i
+// maps keys to i, and counts the loads of every table.
+func testTables(t *testing.T, n int) (TableLoader, []atomic.Int32) {
+	t.Helper()
+	tables := map[string][]byte{}
+	for i := 0; i < n; i++ {
+		m := map[uint64]uint64{}
+		for k := uint64(0); k < 100; k++ {
+			m[k] = uint64(i)
+		}
+		w := &bytes.Buffer{}
+		require.NoError(t, MustFromMap(m, WithSeed(int64(90+i))).Write(w))
+		tables[fmt.Sprint(i)] = w.Bytes()
+	}
+	loads := make([]atomic.Int32, n)
+	return func(_ context.Context, name string) (*CHD, error) {
+		b, ok := tables[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		var i int
+		fmt.Sscan(name, &i)
+		loads[i].Add(1)
+		return ReadBytes(b)
+	}, loads
+}
+
+func TestTableCache(t *testing.T) {
+	load, loads := testTables(t, 5)
+	tc, err := NewTableCache(load, WithMaxTables(3))
+	require.NoError(t, err)
+	defer tc.Close()
+	ctx := context.Background()
+
+	var held []*CHD
+	for i := 0; i < 5; i++ {
+		c, release, err := tc.Get(ctx, fmt.Sprint(i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), c.Get(7))
+		if i == 0 {
+			// Evicted tables stay usable until they are released.
+			held = append(held, c)
+			defer release()
+		} else {
+			release()
+			release()
+			held = append(held, c)
+		}
+	}
+	st := tc.Stats()
+	assert.Equal(t, uint64(5), st.Misses)
+	assert.Equal(t, uint64(5), st.Loads)
+	assert.Equal(t, uint64(2), st.Evictions)
+	assert.Equal(t, 3, st.Tables)
+	assert.Equal(t, 3*held[4].MemoryFootprint().Total, st.Bytes)
+	assert.Equal(t, uint64(0), held[0].Get(7))
+	assert.PanicsWithValue(t, ErrClosed, func() { held[1].Get(7) })
+
+	c, release, err := tc.Get(ctx, "4")
+	require.NoError(t, err)
+	assert.Same(t, held[4], c)
+	release()
+	assert.Equal(t, uint64(1), tc.Stats().Hits)
+	assert.Equal(t, int32(1), loads[4].Load())
+
+	_, _, err = tc.Get(ctx, "nope")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, uint64(1), tc.Stats().LoadErrors)
+
+	tc.Evict("4")
+	assert.PanicsWithValue(t, ErrClosed, func() { held[4].Get(7) })
+	_, release, err = tc.Get(ctx, "4")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, int32(2), loads[4].Load())
+
+	require.NoError(t, tc.Close())
+	require.NoError(t, tc.Close())
+	assert.PanicsWithValue(t, ErrClosed, func() { held[2].Get(7) })
+	_, _, err = tc.Get(ctx, "1")
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestTableCache_maxBytes(t *testing.T) {
+	load, _ := testTables(t, 4)
+	c, err := load(context.Background(), "0")
+	require.NoError(t, err)
+	size := c.MemoryFootprint().Total
+	tc, err := NewTableCache(load, WithMaxBytes(2*size+1))
+	require.NoError(t, err)
+	defer tc.Close()
+	for i := 0; i < 4; i++ {
+		_, release, err := tc.Get(context.Background(), fmt.Sprint(i))
+		require.NoError(t, err)
+		release()
+	}
+	st := tc.Stats()
+	assert.Equal(t, 2, st.Tables)
+	assert.Equal(t, 2*size, st.Bytes)
+	assert.Equal(t, uint64(2), st.Evictions)
+
+	// A table larger than the limit is kept on its own.
+	small, err := NewTableCache(load, WithMaxBytes(1))
+	require.NoError(t, err)
+	defer small.Close()
+	for i := 0; i < 2; i++ {
+		_, release, err := small.Get(context.Background(), fmt.Sprint(i))
+		require.NoError(t, err)
+		release()
+		assert.Equal(t, 1, small.Stats().Tables)
+	}
+}
+
+func TestTableCache_ttl(t *testing.T) {
+	load, loads := testTables(t, 2)
+	tc, err := NewTableCache(load, WithTTL(time.Minute))
+	require.NoError(t, err)
+	defer tc.Close()
+	now := time.Unix(1000, 0)
+	tc.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c, release, err := tc.Get(ctx, "0")
+	require.NoError(t, err)
+	release()
+	now = now.Add(59 * time.Second)
+	_, release, err = tc.Get(ctx, "0")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, int32(1), loads[0].Load())
+
+	now = now.Add(time.Second)
+	_, release, err = tc.Get(ctx, "0")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, int32(2), loads[0].Load())
+	assert.PanicsWithValue(t, ErrClosed, func() { c.Get(7) })
+
+	// Expired tables are dropped when others are loaded.
+	now = now.Add(time.Minute)
+	_, release, err = tc.Get(ctx, "1")
+	require.NoError(t, err)
+	release()
+	st := tc.Stats()
+	assert.Equal(t, uint64(2), st.Expirations)
+	assert.Equal(t, 1, st.Tables)
+}
+
+func TestTableCache_singleflight(t *testing.T) {
+	load, loads := testTables(t, 1)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	tc, err := NewTableCache(func(ctx context.Context, name string) (*CHD, error) {
+		close(started)
+		<-unblock
+		return load(ctx, name)
+	})
+	require.NoError(t, err)
+	defer tc.Close()
+
+	var wg sync.WaitGroup
+	got := make([]*CHD, 8)
+	for g := range got {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			c, release, err := tc.Get(context.Background(), "0")
+			if assert.NoError(t, err) {
+				got[g] = c
+				release()
+			}
+		}(g)
+	}
+	<-started
+
+	// A Get that gives up doesn't stop the load.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = tc.Get(ctx, "0")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, int32(1), loads[0].Load())
+	for _, c := range got {
+		assert.Same(t, got[0], c)
+	}
+	assert.Equal(t, uint64(9), tc.Stats().Misses)
+	_, release, err := tc.Get(context.Background(), "0")
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, uint64(1), tc.Stats().Hits)
+}
+
+func TestTableCache_closeWhileLoading(t *testing.T) {
+	load, _ := testTables(t, 1)
+	unblock := make(chan struct{})
+	var loaded *CHD
+	tc, err := NewTableCache(func(ctx context.Context, name string) (*CHD, error) {
+		<-unblock
+		c, err := load(ctx, name)
+		loaded = c
+		return c, err
+	})
+	require.NoError(t, err)
+	errc := make(chan error)
+	go func() {
+		_, _, err := tc.Get(context.Background(), "0")
+		errc <- err
+	}()
+	require.Eventually(t, func() bool { return tc.Stats().Misses == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, tc.Close())
+	close(unblock)
+	assert.ErrorIs(t, <-errc, ErrClosed)
+	assert.PanicsWithValue(t, ErrClosed, func() { loaded.Get(7) })
+}
+
+func TestTableCache_concurrent(t *testing.T) {
+	load, _ := testTables(t, 10)
+	tc, err := NewTableCache(load, WithMaxTables(3))
+	require.NoError(t, err)
+	defer tc.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				n := (g*7 + i*i) % 10
+				c, release, err := tc.Get(context.Background(), fmt.Sprint(n))
+				if !assert.NoError(t, err) {
+					return
+				}
+				for k := uint64(0); k < 100; k += 13 {
+					if !assert.Equal(t, uint64(n), c.Get(k)) {
+						break
+					}
+				}
+				release()
+				if i%50 == 0 {
+					tc.Evict(fmt.Sprint(n))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	st := tc.Stats()
+	assert.LessOrEqual(t, st.Tables, 3)
+	assert.Equal(t, uint64(8*500), st.Hits+st.Misses)
+	assert.Equal(t, uint64(st.Tables), st.Loads-st.Evictions)
+}
+
+func TestTableLoaders(t *testing.T) {
+	m := randomData(200, 95)
+	c := MustFromMap(m, WithSeed(95))
+	path := filepath.Join(t.TempDir(), "a.chd")
+	require.NoError(t, c.WriteFile(path))
+	ctx := context.Background()
+
+	byPath := PathLoader(func(name string) (string, error) {
+		if name != "a" {
+			return "", os.ErrNotExist
+		}
+		return path, nil
+	})
+	g, err := byPath(ctx, "a")
+	require.NoError(t, err)
+	k := firstKey(m)
+	assert.Equal(t, m[k], g.Get(k))
+	require.NoError(t, g.Close())
+	_, err = byPath(ctx, "b")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	var closed bool
+	byReader := ReaderAtLoader(func(_ context.Context, name string) (io.ReaderAt, error) {
+		f, err := os.Open(filepath.Join(filepath.Dir(path), name+".chd"))
+		closed = false
+		return closeHook{f, &closed}, err
+	})
+	g, err = byReader(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, m[k], g.Get(k))
+	assert.True(t, closed)
+	_, err = byReader(ctx, "b")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = NewTableCache(nil)
+	assert.Error(t, err)
+	_, err = NewTableCache(byPath, WithMaxTables(-1))
+	assert.Error(t, err)
+	_, err = NewTableCache(byPath, WithTTL(-time.Second))
+	assert.Error(t, err)
+	_, err = NewTableCache(func(context.Context, string) (*CHD, error) { return nil, errors.New("x") })
+	assert.NoError(t, err)
+}
+
+// closeHook is a file that records being closed.
+type closeHook struct {
+	*os.File
+	closed *bool
+}
+
+func (h closeHook) Close() error {
+	*h.closed = true
+	return h.File.Close()
+}
@@ -0,0 +1,75 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// textPrefix starts the text form of a table, followed by the format version
+// and a colon.
+const textPrefix = "uint64mph.v"
+
+// MaxTextSize is the largest table UnmarshalText accepts, in bytes of the
+// serialized table (before base64 encoding). Larger tables fail with
+// ErrTooLarge. It may be changed, but not concurrently with UnmarshalText.
+var MaxTextSize int64 = 1 << 20
+
+// MarshalText implements encoding.TextMarshaler, so tables can be embedded in
+// JSON, YAML and other text formats. The text is the table as written by Write,
+// encoded as standard base64 and prefixed by "uint64mph.v" followed by the
+// format version and a colon, like "uint64mph.v3:Q0hEMw...". It's meant for
+// small tables: the text is a third larger than the file.
+func (c *CHD) MarshalText() ([]byte, error) {
+	if err := c.checkWritable(true); err != nil {
+		return nil, err
+	}
+	var w bytes.Buffer
+	if err := c.Write(&w); err != nil {
+		return nil, err
+	}
+	prefix := textPrefix + strconv.Itoa(c.writeVersion()) + ":"
+	text := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(w.Len()))
+	copy(text, prefix)
+	base64.StdEncoding.Encode(text[len(prefix):], w.Bytes())
+	return text, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, loading the table written
+// by MarshalText into c like Read does. Tables larger than MaxTextSize are
+// rejected before they're decoded.
+func (c *CHD) UnmarshalText(text []byte) error {
+	if c == nil {
+		return ErrNilTable
+	}
+	rest, ok := bytes.CutPrefix(text, []byte(textPrefix))
+	if !ok {
+		return fmt.Errorf("%w: text doesn't start with %q", ErrNotCHD, textPrefix)
+	}
+	v, encoded, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return fmt.Errorf("%w: no colon after the version", ErrNotCHD)
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return fmt.Errorf("%w: invalid version %q", ErrNotCHD, v)
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > MaxTextSize+2 {
+		return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, MaxTextSize)
+	}
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(b, encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotCHD, err)
+	}
+	loaded, err := ReadWithLimit(bytes.NewReader(b[:n]), MaxTextSize)
+	if err != nil {
+		return err
+	}
+	if loaded.info.Version != version {
+		return fmt.Errorf("%w: text says version %d, but the table has version %d", ErrNotCHD, version, loaded.info.Version)
+	}
+	*c = *loaded
+	return nil
+}
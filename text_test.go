@@ -0,0 +1,74 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalText(t *testing.T) {
+	type config struct {
+		Name  string
+		Table *CHD
+	}
+	c := MustFromMap(randomData(500, 26), WithFilter())
+	b, err := json.Marshal(config{Name: "x", Table: c})
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"Table":"uint64mph.v3:`)
+
+	var got config
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, "x", got.Name)
+	assertSameTable(t, c, got.Table)
+
+	// Missing tables stay nil.
+	got = config{}
+	require.NoError(t, json.Unmarshal([]byte(`{"Table":null}`), &got))
+	assert.Nil(t, got.Table)
+
+	// The text holds the file written by Write.
+	text, err := c.MarshalText()
+	require.NoError(t, err)
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	encoded := strings.TrimPrefix(string(text), "uint64mph.v3:")
+	assert.Equal(t, base64.StdEncoding.EncodeToString(w.Bytes()), encoded)
+}
+
+func TestUnmarshalText_errors(t *testing.T) {
+	c := MustFromMap(randomData(500, 27))
+	text, err := c.MarshalText()
+	require.NoError(t, err)
+	var loaded CHD
+
+	for name, tc := range map[string]struct {
+		text, err string
+	}{
+		"no prefix":  {"Q0hE", "doesn't start with"},
+		"no colon":   {"uint64mph.v3", "no colon"},
+		"bad number": {"uint64mph.vx:", `invalid version "x"`},
+		"not base64": {"uint64mph.v3:!!!!", "illegal base64"},
+		"truncated":  {string(text[:len(text)-40]), "not a serialized CHD"},
+		"version":    {strings.Replace(string(text), ".v3:", ".v2:", 1), "text says version 2, but the table has version 3"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorContains(t, loaded.UnmarshalText([]byte(tc.text)), tc.err)
+		})
+	}
+
+	defer func(max int64) { MaxTextSize = max }(MaxTextSize)
+	MaxTextSize = c.Spec().Size - 1
+	assert.ErrorIs(t, loaded.UnmarshalText(text), ErrTooLarge)
+	MaxTextSize = c.Spec().Size
+	require.NoError(t, loaded.UnmarshalText(text))
+	assertSameTable(t, c, &loaded)
+
+	assert.ErrorIs(t, (*CHD)(nil).UnmarshalText(text), ErrNilTable)
+	_, err = (*CHD)(nil).MarshalText()
+	assert.ErrorIs(t, err, ErrNilTable)
+}
@@ -0,0 +1,77 @@
+package uint64mph
+
+// A TraceEvent is a step of building a table, passed to the tracer set with
+// WithTrace. It is one of OuterHashChosen, BucketAssigned, HashFunctionAdded,
+// BucketPlaced and BuildFailed.
+type TraceEvent interface {
+	traceEvent()
+}
+
+// OuterHashChosen starts the placement of the buckets with the outer hash Seed,
+// which assigns the keys to buckets and doubles as hash function 0. Build
+// starts over with another outer hash when the keys of a bucket can't be told
+// apart, after which the events of the new attempt follow.
+type OuterHashChosen struct {
+	Seed uint64
+}
+
+// BucketAssigned reports the number of keys the outer hash assigned to a
+// bucket. These events are emitted for all buckets, including empty ones, in
+// the order Build places them: largest first.
+type BucketAssigned struct {
+	// The position of the bucket in the placement order.
+	Bucket int
+	// The index of the bucket in the table.
+	Index uint64
+	Keys  int
+}
+
+// HashFunctionAdded reports a new hash function, found while placing the bucket
+// of the BucketPlaced event that follows it.
+type HashFunctionAdded struct {
+	// The index of the hash function. Unused and equal hash functions are
+	// dropped once all buckets are placed, so the built table may number
+	// them differently.
+	HashFunction int
+	Seed         uint64
+}
+
+// BucketPlaced reports that the keys of a bucket were moved to free slots.
+// Empty buckets aren't placed.
+type BucketPlaced struct {
+	Bucket int
+	Index  uint64
+	Keys   int
+	// The hash function that placed the keys, see HashFunctionAdded.
+	HashFunction int
+	// The number of new hash functions tried, zero if an existing one fit.
+	Attempts int
+}
+
+// BuildFailed reports that a bucket couldn't be placed. Build returns Err.
+type BuildFailed struct {
+	Bucket   int
+	Index    uint64
+	Keys     int
+	Attempts int
+	Err      error
+}
+
+func (OuterHashChosen) traceEvent()   {}
+func (BucketAssigned) traceEvent()    {}
+func (HashFunctionAdded) traceEvent() {}
+func (BucketPlaced) traceEvent()      {}
+func (BuildFailed) traceEvent()       {}
+
+// WithTrace makes Build call trace with every step of placing the keys, to
+// observe the algorithm or debug inputs that build slowly. trace is called
+// synchronously, so a slow tracer slows down the build. Without a tracer,
+// tracing costs a nil check per step.
+//
+// Only the CHD structure is traced: small, dense and PTHash builds emit no
+// events.
+func WithTrace(trace func(TraceEvent)) BuildOption {
+	return func(o *buildOptions) {
+		o.trace = trace
+	}
+}
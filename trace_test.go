@@ -0,0 +1,64 @@
+package uint64mph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTrace(t *testing.T) {
+	want := []TraceEvent{
+		OuterHashChosen{Seed: 0x4d65822107fcfd52},
+		BucketAssigned{Bucket: 0, Index: 3, Keys: 4},
+		BucketAssigned{Bucket: 1, Index: 1, Keys: 3},
+		BucketAssigned{Bucket: 2, Index: 4, Keys: 2},
+		BucketAssigned{Bucket: 3, Index: 0, Keys: 1},
+		BucketAssigned{Bucket: 4, Index: 2, Keys: 0},
+		HashFunctionAdded{HashFunction: 1, Seed: 0x57e9d1860d1d68d8},
+		BucketPlaced{Bucket: 0, Index: 3, Keys: 4, HashFunction: 1, Attempts: 5},
+		HashFunctionAdded{HashFunction: 2, Seed: 0xa68447a4189deb99},
+		BucketPlaced{Bucket: 1, Index: 1, Keys: 3, HashFunction: 2, Attempts: 4},
+		HashFunctionAdded{HashFunction: 3, Seed: 0x39f6f78a15d523b},
+		BucketPlaced{Bucket: 2, Index: 4, Keys: 2, HashFunction: 3, Attempts: 22},
+		BucketPlaced{Bucket: 3, Index: 0, Keys: 1, HashFunction: 0, Attempts: 0},
+	}
+	b := Builder()
+	for i := uint64(1); i <= 10; i++ {
+		b.Add(i*1000003, i)
+	}
+	for _, s := range []BuildStrategy{StrategyMaps, StrategySorted} {
+		var got []TraceEvent
+		c, err := b.Build(WithSeed(1), WithTrace(func(e TraceEvent) { got = append(got, e) }), func(o *buildOptions) { o.strategy = s })
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "strategy %v", s)
+		assert.Equal(t, uint64(0x4d65822107fcfd52), c.r[0])
+	}
+
+	// Small tables aren't traced.
+	var got []TraceEvent
+	_, err := FromMap(sampleData, WithTrace(func(e TraceEvent) { got = append(got, e) }))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestWithTrace_failed(t *testing.T) {
+	var got []TraceEvent
+	var err error
+	for i := 0; i < 20; i++ {
+		got = nil
+		_, err = FromMap(sampleData, hashed, WithSeed(int64(i)), WithOuterSeed(uint64(i)), WithRatio(0.01), WithMaxAttempts(1), WithTrace(func(e TraceEvent) { got = append(got, e) }))
+		if err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, ErrNoHashFunction)
+	require.NotEmpty(t, got)
+	failed, ok := got[len(got)-1].(BuildFailed)
+	require.True(t, ok, "last event is %#v", got[len(got)-1])
+	assert.Equal(t, err, failed.Err)
+	assert.Equal(t, 1, failed.Attempts)
+	assigned, ok := got[1+failed.Bucket].(BucketAssigned)
+	require.True(t, ok)
+	assert.Equal(t, BucketAssigned{Bucket: failed.Bucket, Index: failed.Index, Keys: failed.Keys}, assigned)
+}
@@ -0,0 +1,139 @@
+package uint64mph
+
+import "io"
+
+// Integer is the type of the keys and values of a CHDT: any type whose
+// underlying type is uint64 or int64, like a defined ID type.
+type Integer interface {
+	~uint64 | ~int64
+}
+
+// BuilderT builds a hash table with keys of type K and values of type V, so
+// that keys of one ID type can't be mixed up with those of another. It is a
+// thin wrapper around CHDBuilder: keys and values are converted to uint64 like
+// by Int64Builder, and the conversions compile to nothing.
+//
+// The serialized form is that of a CHD, which doesn't record K and V. Loading
+// a file as a CHDT of other types than it was built with isn't detected, and
+// is up to the caller to avoid.
+type BuilderT[K, V Integer] struct {
+	b *CHDBuilder
+}
+
+// NewBuilderT creates a new builder for a hash table with keys of type K and
+// values of type V.
+func NewBuilderT[K, V Integer]() *BuilderT[K, V] {
+	return &BuilderT[K, V]{b: Builder()}
+}
+
+// Seed the RNG. See CHDBuilder.Seed.
+func (b *BuilderT[K, V]) Seed(seed int64) {
+	b.b.Seed(seed)
+}
+
+// Add a key and value to the hash table.
+func (b *BuilderT[K, V]) Add(key K, value V) {
+	b.b.Add(uint64(key), uint64(value))
+}
+
+// Build the hash table. See CHDBuilder.Build.
+func (b *BuilderT[K, V]) Build(opts ...BuildOption) (*CHDT[K, V], error) {
+	c, err := b.b.Build(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDT[K, V]{c: c}, nil
+}
+
+// CHDT is a hash table lookup with keys of type K and values of type V, see
+// BuilderT.
+type CHDT[K, V Integer] struct {
+	c *CHD
+}
+
+// NewCHDT interprets the keys of c as Ks and its values as Vs.
+func NewCHDT[K, V Integer](c *CHD) *CHDT[K, V] {
+	return &CHDT[K, V]{c: c}
+}
+
+// ReadT reads a serialized CHD and interprets its keys as Ks and its values
+// as Vs.
+func ReadT[K, V Integer](r io.Reader) (*CHDT[K, V], error) {
+	c, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDT[K, V]{c: c}, nil
+}
+
+// MmapT is like Mmap but interprets the keys as Ks and the values as Vs.
+func MmapT[K, V Integer](b []byte) (*CHDT[K, V], error) {
+	c, err := Mmap(b)
+	if err != nil {
+		return nil, err
+	}
+	return &CHDT[K, V]{c: c}, nil
+}
+
+// CHD returns the underlying table.
+func (c *CHDT[K, V]) CHD() *CHD {
+	return c.c
+}
+
+// Get an entry from the hash table and report whether it was present.
+func (c *CHDT[K, V]) Get(key K) (V, bool) {
+	v, ok := c.c.GetOK(uint64(key))
+	return V(v), ok
+}
+
+// Contains reports whether key is in the table.
+func (c *CHDT[K, V]) Contains(key K) bool {
+	return c.c.Contains(uint64(key))
+}
+
+func (c *CHDT[K, V]) Len() int {
+	return c.c.Len()
+}
+
+// Iterate over entries in the hash table.
+func (c *CHDT[K, V]) Iterate() *IteratorT[K, V] {
+	it := c.c.Iterate()
+	if it == nil {
+		return nil
+	}
+	return &IteratorT[K, V]{it: it}
+}
+
+// Entries returns an iterator over the entries in the hash table. It has the
+// signature of an iter.Seq2[K, V], so it can be ranged over.
+func (c *CHDT[K, V]) Entries() func(yield func(key K, value V) bool) {
+	return func(yield func(key K, value V) bool) {
+		for it := c.c.Iterate(); it != nil; it = it.Next() {
+			k, v := it.Get()
+			if !yield(K(k), V(v)) {
+				return
+			}
+		}
+	}
+}
+
+// Serialize the hash table. See CHD.Write.
+func (c *CHDT[K, V]) Write(w io.Writer) error {
+	return c.c.Write(w)
+}
+
+type IteratorT[K, V Integer] struct {
+	it *Iterator
+}
+
+func (c *IteratorT[K, V]) Get() (key K, value V) {
+	k, v := c.it.Get()
+	return K(k), V(v)
+}
+
+func (c *IteratorT[K, V]) Next() *IteratorT[K, V] {
+	if c.it.Next() == nil {
+		return nil
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package uint64mph
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	userID  uint64
+	balance int64
+)
+
+func TestCHDT(t *testing.T) {
+	data := map[userID]balance{
+		1:              -1,
+		2:              math.MaxInt64,
+		math.MaxUint64: math.MinInt64,
+		1337:           42,
+		7:              0,
+		8:              -8,
+		9:              9,
+		10:             -10,
+		11:             11,
+	}
+	b := NewBuilderT[userID, balance]()
+	b.Seed(6)
+	for k, v := range data {
+		b.Add(k, v)
+	}
+	c, err := b.Build()
+	require.NoError(t, err)
+	assert.Equal(t, len(data), c.Len())
+	for k, v := range data {
+		got, ok := c.Get(k)
+		assert.True(t, ok)
+		assert.Equal(t, v, got)
+		assert.True(t, c.Contains(k))
+	}
+	_, ok := c.Get(3)
+	assert.False(t, ok)
+
+	w := &bytes.Buffer{}
+	require.NoError(t, c.Write(w))
+	for _, load := range []func() (*CHDT[userID, balance], error){
+		func() (*CHDT[userID, balance], error) { return MmapT[userID, balance](w.Bytes()) },
+		func() (*CHDT[userID, balance], error) { return ReadT[userID, balance](bytes.NewReader(w.Bytes())) },
+	} {
+		n, err := load()
+		require.NoError(t, err)
+		seen := map[userID]balance{}
+		for it := n.Iterate(); it != nil; it = it.Next() {
+			k, v := it.Get()
+			seen[k] = v
+		}
+		assert.Equal(t, data, seen)
+		seen = map[userID]balance{}
+		n.Entries()(func(k userID, v balance) bool {
+			seen[k] = v
+			return true
+		})
+		assert.Equal(t, data, seen)
+	}
+
+	// The file is that of a CHD with the uint64 bit patterns.
+	u, err := Mmap(w.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), u.Get(1))
+	assert.Equal(t, uint64(1<<63), NewCHDT[userID, uint64](u).CHD().Get(math.MaxUint64))
+
+	calls := 0
+	c.Entries()(func(userID, balance) bool {
+		calls++
+		return false
+	})
+	assert.Equal(t, 1, calls)
+}
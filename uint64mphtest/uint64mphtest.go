@@ -0,0 +1,93 @@
+// Package uint64mphtest provides helpers for testing code that uses uint64mph.
+//
+// It only uses the exported API of uint64mph.
+package uint64mphtest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/Jille/uint64mph"
+)
+
+// RandomTable builds a table with n random entries. The same seed always results
+// in the same table. The entries are returned as well, for use with
+// AssertEquivalent.
+func RandomTable(t testing.TB, n int, seed int64) (*uint64mph.CHD, map[uint64]uint64) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	m := make(map[uint64]uint64, n)
+	b := uint64mph.Builder()
+	for len(m) < n {
+		k := rng.Uint64()
+		if _, ok := m[k]; ok {
+			continue
+		}
+		v := rng.Uint64()
+		m[k] = v
+		b.Add(k, v)
+	}
+	c, err := b.Build(uint64mph.WithSeed(seed))
+	if err != nil {
+		t.Fatalf("uint64mphtest: building random table: %v", err)
+	}
+	return c, m
+}
+
+// AssertEquivalent checks that c contains exactly the entries in m.
+func AssertEquivalent(t testing.TB, c *uint64mph.CHD, m map[uint64]uint64) {
+	t.Helper()
+	if c.Len() != len(m) {
+		t.Errorf("table has %d entries, want %d", c.Len(), len(m))
+	}
+	for k, want := range m {
+		got, ok := c.GetOK(k)
+		if !ok {
+			t.Errorf("key %d is missing from the table", k)
+		} else if got != want {
+			t.Errorf("key %d has value %d, want %d", k, got, want)
+		}
+	}
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		want, ok := m[k]
+		if !ok {
+			t.Errorf("table contains unexpected key %d", k)
+		} else if v != want {
+			t.Errorf("iterating key %d yields value %d, want %d", k, v, want)
+		}
+	}
+}
+
+// Corrupt returns a copy of b with the byte at off inverted.
+func Corrupt(b []byte, off int) []byte {
+	c := append([]byte(nil), b...)
+	c[off] ^= 0xff
+	return c
+}
+
+// CheckRoundTrip serializes c and checks that both Read and Mmap return a table
+// with the same content.
+func CheckRoundTrip(t testing.TB, c *uint64mph.CHD) {
+	t.Helper()
+	m := map[uint64]uint64{}
+	for it := c.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		m[k] = v
+	}
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatalf("uint64mphtest: Write: %v", err)
+	}
+	r, err := uint64mph.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("uint64mphtest: Read: %v", err)
+	}
+	AssertEquivalent(t, r, m)
+	mm, err := uint64mph.Mmap(buf.Bytes())
+	if err != nil {
+		t.Fatalf("uint64mphtest: Mmap: %v", err)
+	}
+	AssertEquivalent(t, mm, m)
+}
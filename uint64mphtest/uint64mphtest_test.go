@@ -0,0 +1,100 @@
+package uint64mphtest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/Jille/uint64mph"
+)
+
+// recorder is a testing.TB that records failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRandomTable(t *testing.T) {
+	c, m := RandomTable(t, 1000, 1)
+	if c.Len() != 1000 || len(m) != 1000 {
+		t.Fatalf("got %d entries and %d entries in the map, want 1000", c.Len(), len(m))
+	}
+	AssertEquivalent(t, c, m)
+	CheckRoundTrip(t, c)
+
+	d, _ := RandomTable(t, 1000, 1)
+	var a, b bytes.Buffer
+	if err := c.Write(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("RandomTable with the same seed returned different tables")
+	}
+}
+
+func TestAssertEquivalent_mismatch(t *testing.T) {
+	c, m := RandomTable(t, 10, 4)
+	var changed uint64
+	for k := range m {
+		changed = k
+		m[k]++
+		break
+	}
+	m[1] = 1
+
+	r := &recorder{TB: t}
+	AssertEquivalent(r, c, m)
+	want := []string{
+		"table has 10 entries, want 11",
+		fmt.Sprintf("key %d has value %d, want %d", changed, m[changed]-1, m[changed]),
+		"key 1 is missing from the table",
+		fmt.Sprintf("iterating key %d yields value %d, want %d", changed, m[changed]-1, m[changed]),
+	}
+	if len(r.errors) != len(want) {
+		t.Fatalf("got errors %q, want %q", r.errors, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, e := range r.errors {
+			found = found || e == w
+		}
+		if !found {
+			t.Errorf("missing error %q in %q", w, r.errors)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	c, m := RandomTable(t, 100, 3)
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	orig := buf.Bytes()
+	bad := Corrupt(orig, len(orig)-1)
+	if bytes.Equal(orig, bad) || orig[len(orig)-1] == bad[len(bad)-1] {
+		t.Fatal("Corrupt didn't change the last byte")
+	}
+	if !bytes.Equal(orig[:len(orig)-1], bad[:len(bad)-1]) {
+		t.Fatal("Corrupt changed other bytes")
+	}
+	d, err := uint64mph.Mmap(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last byte belongs to the last value, so exactly one entry is off.
+	r := &recorder{TB: t}
+	AssertEquivalent(r, d, m)
+	if len(r.errors) != 2 {
+		t.Errorf("got errors %q, want one for Get and one for Iterate", r.errors)
+	}
+}
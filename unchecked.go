@@ -0,0 +1,37 @@
+package uint64mph
+
+import "unsafe"
+
+// getOKUnchecked is GetOK without bounds checks on the arrays, used instead of
+// it when building with the uint64mph_unsafe tag. It relies on the invariants
+// established by Build and checked by Mmap and Read: a table with hash
+// functions has at least one bucket, and as many values as keys. With those,
+// the bucket is below len(indices) and the slot below len(keys), and the index
+// of the hash function is compared against len(r) anyway. Tables that don't
+// have hash functions, keys or values take the checked path. GetOK has masked
+// the key already.
+func (c *CHD) getOKUnchecked(key uint64) (uint64, bool) {
+	nr := uint64(len(c.r))
+	if nr == 0 || len(c.keys) == 0 || len(c.values) != len(c.keys) || len(c.indices) == 0 {
+		ti, ok := c.slot(key)
+		if !ok {
+			return 0, false
+		}
+		return c.valueOK(ti)
+	}
+	if c.filter != nil && !c.filter.contains(key) {
+		return 0, false
+	}
+	r := unsafe.Pointer(unsafe.SliceData(c.r))
+	h := c.hash(key) ^ *(*uint64)(r)
+	i := bucketFor(h, uint64(len(c.indices)), c.mixBuckets)
+	ri := uint64(*(*uint16)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(c.indices)), i*2)))
+	if ri >= nr {
+		return 0, false
+	}
+	ti := (h ^ *(*uint64)(unsafe.Add(r, ri*8))) % uint64(len(c.keys))
+	if *(*uint64)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(c.keys)), ti*8)) != key {
+		return 0, false
+	}
+	return *(*uint64)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(c.values)), ti*8)), true
+}
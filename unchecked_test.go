@@ -0,0 +1,58 @@
+package uint64mph
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOKUnchecked(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	m := map[uint64]uint64{}
+	keys := make([]uint64, 0, 50000)
+	for len(m) < cap(keys) {
+		k := rng.Uint64()
+		if _, ok := m[k]; !ok {
+			m[k] = rng.Uint64()
+			keys = append(keys, k)
+		}
+	}
+	v2, err := os.ReadFile("testdata/golden/v2/1k.idx")
+	require.NoError(t, err)
+	old, err := Mmap(v2)
+	require.NoError(t, err)
+	tables := map[string]*CHD{
+		"plain":  MustFromMap(m),
+		"filter": MustFromMap(m, WithFilter()),
+		"r32":    MustFromMap(m, WithHashFunctions32()),
+		"small":  MustFromMap(sampleData),
+		"v2":     old,
+		"empty":  MustFromMap(nil),
+	}
+	for name, c := range tables {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 1000000; i++ {
+				key := rng.Uint64()
+				if i%2 == 0 {
+					key = keys[rng.Intn(len(keys))]
+				}
+				v, ok := c.getOKUnchecked(key)
+				wv, wok := c.GetOK(key)
+				if v != wv || ok != wok {
+					t.Fatalf("getOKUnchecked(%d) = %d, %v; GetOK returned %d, %v", key, v, ok, wv, wok)
+				}
+			}
+		})
+	}
+
+	structure, _ := writeSplit(t, MustFromMap(m))
+	indexOnly, err := MmapSplit(structure, nil)
+	require.NoError(t, err)
+	assert.PanicsWithValue(t, ErrNoValues, func() { indexOnly.getOKUnchecked(keys[0]) })
+	c := MustFromMap(m)
+	require.NoError(t, c.Close())
+	assert.PanicsWithValue(t, ErrClosed, func() { c.getOKUnchecked(keys[0]) })
+}
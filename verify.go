@@ -0,0 +1,87 @@
+package uint64mph
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// maxVerifyFailures is the number of failures kept in a VerifyReport.
+const maxVerifyFailures = 10
+
+// VerifyReport is the result of StreamVerify.
+type VerifyReport struct {
+	// Pairs is the number of pairs read.
+	Pairs int
+	// Entries is the number of entries in the table.
+	Entries int
+	// Missing is the number of keys that aren't in the table.
+	Missing int
+	// Mismatched is the number of keys that have a different value in the
+	// table.
+	Mismatched int
+	// Failures are the first missing or mismatched keys, in the order they
+	// were read.
+	Failures []VerifyFailure
+}
+
+// VerifyFailure is a pair that the table didn't answer correctly.
+type VerifyFailure struct {
+	Key  uint64
+	Want uint64
+	// Got is the value in the table, if Found.
+	Got   uint64
+	Found bool
+}
+
+// OK reports whether the table answered every pair correctly and has no other
+// entries.
+func (r VerifyReport) OK() bool {
+	return r.Missing == 0 && r.Mismatched == 0 && r.Entries == r.Pairs
+}
+
+// StreamVerify checks that the table read from table contains exactly the
+// entries read in the pairs format from pairs. The pairs are streamed, so they
+// can be many more than fit in memory. The table is loaded with ReadAt and
+// opts, like WithKeyMask for tables with masked keys.
+//
+// Differences are counted in the report; an error is only returned if the table
+// or the pairs can't be read. The pairs must not contain duplicate keys, or the
+// entry counts won't match.
+func StreamVerify(table io.ReaderAt, pairs io.Reader, opts ...LoadOption) (VerifyReport, error) {
+	c, err := ReadAt(table, opts...)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	if c.IndexOnly() {
+		return VerifyReport{}, ErrNoValues
+	}
+	rep := VerifyReport{Entries: c.Len()}
+	br := bufio.NewReader(pairs)
+	var buf [16]byte
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			if err == io.EOF {
+				return rep, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return rep, ErrPartialPair
+			}
+			return rep, err
+		}
+		rep.Pairs++
+		k, want := binary.LittleEndian.Uint64(buf[:8]), binary.LittleEndian.Uint64(buf[8:])
+		got, ok := c.GetOK(k)
+		switch {
+		case !ok:
+			rep.Missing++
+		case got != want:
+			rep.Mismatched++
+		default:
+			continue
+		}
+		if len(rep.Failures) < maxVerifyFailures {
+			rep.Failures = append(rep.Failures, VerifyFailure{Key: k, Want: want, Got: got, Found: ok})
+		}
+	}
+}
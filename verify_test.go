@@ -0,0 +1,75 @@
+package uint64mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamVerify(t *testing.T) {
+	m := randomData(1000, 12)
+	c, err := FromMap(m)
+	require.NoError(t, err)
+	table := &bytes.Buffer{}
+	require.NoError(t, c.Write(table))
+	pairs := &bytes.Buffer{}
+	_, err = c.WritePairs(pairs)
+	require.NoError(t, err)
+
+	rep, err := StreamVerify(bytes.NewReader(table.Bytes()), bytes.NewReader(pairs.Bytes()))
+	require.NoError(t, err)
+	assert.True(t, rep.OK())
+	assert.Equal(t, VerifyReport{Pairs: 1000, Entries: 1000}, rep)
+
+	// Change the value of the first pair, drop the second and add missing keys.
+	b := bytes.Clone(pairs.Bytes())
+	k := binary.LittleEndian.Uint64(b)
+	v := binary.LittleEndian.Uint64(b[8:])
+	binary.LittleEndian.PutUint64(b[8:], v+1)
+	b = append(b[:16], b[32:]...)
+	for i := uint64(0); i < 20; i++ {
+		b = binary.LittleEndian.AppendUint64(b, 1<<63+i)
+		b = binary.LittleEndian.AppendUint64(b, i)
+	}
+	rep, err = StreamVerify(bytes.NewReader(table.Bytes()), bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.False(t, rep.OK())
+	assert.Equal(t, 1019, rep.Pairs)
+	assert.Equal(t, 1000, rep.Entries)
+	assert.Equal(t, 1, rep.Mismatched)
+	assert.Equal(t, 20, rep.Missing)
+	require.Len(t, rep.Failures, maxVerifyFailures)
+	assert.Equal(t, VerifyFailure{Key: k, Want: v + 1, Got: v, Found: true}, rep.Failures[0])
+	assert.Equal(t, VerifyFailure{Key: 1 << 63, Want: 0}, rep.Failures[1])
+
+	// A table with fewer entries than pairs isn't OK, even if they all match.
+	rep, err = StreamVerify(bytes.NewReader(table.Bytes()), bytes.NewReader(pairs.Bytes()[:32]))
+	require.NoError(t, err)
+	assert.Empty(t, rep.Failures)
+	assert.False(t, rep.OK())
+}
+
+func TestStreamVerify_errors(t *testing.T) {
+	c, err := FromMap(sampleData)
+	require.NoError(t, err)
+	table := &bytes.Buffer{}
+	require.NoError(t, c.Write(table))
+
+	_, err = StreamVerify(bytes.NewReader(table.Bytes()), bytes.NewReader(make([]byte, 17)))
+	assert.ErrorIs(t, err, ErrPartialPair)
+	_, err = StreamVerify(bytes.NewReader(table.Bytes()[:10]), bytes.NewReader(nil))
+	assert.ErrorIs(t, err, ErrNotCHD)
+	readErr := errors.New("read error")
+	_, err = StreamVerify(bytes.NewReader(table.Bytes()), iotest.ErrReader(readErr))
+	assert.ErrorIs(t, err, readErr)
+
+	// The structure of a split table has no values to check.
+	structure, _ := writeSplit(t, MustFromMap(randomData(1000, 13)))
+	_, err = StreamVerify(bytes.NewReader(structure), bytes.NewReader(nil))
+	assert.ErrorIs(t, err, ErrNoValues)
+}
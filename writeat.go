@@ -0,0 +1,111 @@
+package uint64mph
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of keys or values written by one WriteAt call of WriteToAt.
+const writeAtChunk = 1 << 17
+
+// WriteToAt serializes the table like Write without options, but writes the
+// keys and values sections from GOMAXPROCS goroutines, each at its own offset.
+// For large tables on fast storage this is much faster than Write, which
+// encodes everything on a single goroutine. w must allow concurrent WriteAt
+// calls, as *os.File does. It returns the size of the table in bytes; the
+// bytes are exactly those written by Write.
+func (c *CHD) WriteToAt(w io.WriterAt) (int64, error) {
+	if err := c.checkWritable(w != nil); err != nil {
+		return 0, err
+	}
+	if c.IndexOnly() {
+		return 0, ErrNoValues
+	}
+	l := c.Spec()
+
+	// Everything but the elements of the keys and values sections is small, and
+	// written the same way as by Write. So are packed and pair values.
+	flags, _ := c.encodeValues(writeOptions{})
+	oflags, osections := c.optionalSections(nil)
+	e := newEncoder(io.NewOffsetWriter(w, 0))
+	e.header(c.writeVersion(), flags|oflags|c.structureFlags(), c.structureSections()+c.valuesSections()+osections)
+	if c.dense != nil {
+		c.writeDense(e)
+	} else {
+		c.writeHashFunctions(e)
+		e.section(sectionKeys, 8, len(c.keys))
+	}
+	if err := e.flush(); err != nil {
+		return 0, err
+	}
+	e = newEncoder(io.NewOffsetWriter(w, l.Values.Offset-sectionHeaderSize))
+	if c.valueWidth != 0 || c.pairValues != nil {
+		c.writeValues(e, nil)
+	} else {
+		e.section(sectionValues, 8, len(c.values))
+		if err := e.flush(); err != nil {
+			return 0, err
+		}
+		e = newEncoder(io.NewOffsetWriter(w, l.Values.Offset+l.Values.Size()))
+	}
+	c.writeOptional(e, nil)
+	if err := e.flush(); err != nil {
+		return 0, err
+	}
+
+	if err := writeUint64sAt(w, []Section{l.Keys, l.Values}, [][]uint64{c.keys, c.values}); err != nil {
+		return 0, err
+	}
+	return l.Size, nil
+}
+
+// writeUint64sAt writes every array at the offset of its section, in chunks of
+// writeAtChunk elements spread over GOMAXPROCS goroutines.
+func writeUint64sAt(w io.WriterAt, sections []Section, arrays [][]uint64) error {
+	type chunk struct {
+		off  int64
+		data []uint64
+	}
+	var chunks []chunk
+	for i, a := range arrays {
+		for start := 0; start < len(a); start += writeAtChunk {
+			end := min(start+writeAtChunk, len(a))
+			chunks = append(chunks, chunk{sections[i].Offset + 8*int64(start), a[start:end]})
+		}
+	}
+	workers := min(runtime.GOMAXPROCS(0), len(chunks))
+	var (
+		wg       sync.WaitGroup
+		next     atomic.Int64
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0, 8*writeAtChunk)
+			for {
+				n := int(next.Add(1) - 1)
+				if n >= len(chunks) {
+					return
+				}
+				buf = buf[:0]
+				for _, v := range chunks[n].data {
+					buf = binary.LittleEndian.AppendUint64(buf, v)
+				}
+				if _, err := w.WriteAt(buf, chunks[n].off); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					// Skip the remaining chunks.
+					next.Store(int64(len(chunks)))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,119 @@
+package uint64mph
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteToAt(t *testing.T) {
+	var many []uint64
+	for i := 0; i < 3*writeAtChunk+5; i++ {
+		many = append(many, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	cb := Builder()
+	cb.AddSlices(many, many)
+	manyTable, err := cb.Build()
+	require.NoError(t, err)
+	withOptional := MustFromMap(sampleData, hashed, WithFilter())
+	require.NoError(t, withOptional.SetMetadata([]byte("metadata")))
+	v2, err := os.ReadFile("testdata/golden/v2/1k.idx")
+	require.NoError(t, err)
+	old, err := Mmap(v2)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for name, c := range map[string]*CHD{
+		"many":     manyTable,
+		"small":    MustFromMap(sampleData),
+		"empty":    MustFromMap(nil),
+		"optional": withOptional,
+		"r32":      MustFromMap(sampleData, hashed, WithHashFunctions32()),
+		"v2":       old,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			require.NoError(t, c.Write(w))
+
+			f, err := os.Create(filepath.Join(dir, name))
+			require.NoError(t, err)
+			defer f.Close()
+			n, err := c.WriteToAt(f)
+			require.NoError(t, err)
+			assert.Equal(t, int64(w.Len()), n)
+			got, err := os.ReadFile(f.Name())
+			require.NoError(t, err)
+			assert.Equal(t, sha256.Sum256(w.Bytes()), sha256.Sum256(got))
+		})
+	}
+
+	structure, _ := writeSplit(t, MustFromMap(sampleData))
+	indexOnly, err := MmapSplit(structure, nil)
+	require.NoError(t, err)
+	_, err = indexOnly.WriteToAt(&failingWriterAt{})
+	assert.ErrorIs(t, err, ErrNoValues)
+
+	_, err = manyTable.WriteToAt(&failingWriterAt{failAt: 2})
+	assert.ErrorIs(t, err, errWriteAt)
+}
+
+var errWriteAt = errors.New("write failed")
+
+// failingWriterAt fails every WriteAt once failAt calls have been made.
+type failingWriterAt struct {
+	failAt int32
+	calls  atomic.Int32
+}
+
+func (w *failingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if w.calls.Add(1) > w.failAt {
+		return 0, errWriteAt
+	}
+	return len(p), nil
+}
+
+func BenchmarkWriteToAt(b *testing.B) {
+	for _, n := range benchSizes() {
+		d := getBenchDataset(b, n)
+		size := d.table.Spec().Size
+		path := filepath.Join(b.TempDir(), "table.idx")
+		b.Run(fmt.Sprintf("n=%d/Write", n), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				f, err := os.Create(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := d.table.Write(f); err != nil {
+					b.Fatal(err)
+				}
+				f.Close()
+			}
+		})
+		for _, procs := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("n=%d/WriteToAt/procs=%d", n, procs), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				b.SetBytes(size)
+				for i := 0; i < b.N; i++ {
+					f, err := os.Create(path)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := d.table.WriteToAt(f); err != nil {
+						b.Fatal(err)
+					}
+					f.Close()
+				}
+			})
+		}
+	}
+}